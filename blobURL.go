@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// blobURL is the URL of a page blob given with --bloburl, naming the
+// storage account, the container and the blob at once.
+type blobURL struct {
+	serviceURL     string // The URL of the blob service of the account
+	account        string // The name of the storage account
+	endpointSuffix string // The storage endpoint suffix of the Azure cloud, empty for an IP endpoint
+	container      string // The container of the blob
+	blob           string // The name of the blob, with its virtual directories
+}
+
+// parseBlobURL parses the blob URL given with --bloburl, it returns
+// nil if the flag is not set. Like the blob service endpoint, the
+// URL must use HTTPS, unless --allow-http is passed. The account is
+// the first label of the host, or the first path segment for the IP
+// endpoints of the storage emulators, it must match --stgaccountname
+// if given. The URL authenticates with the credential flags, a SAS
+// URL must be given with --sasuri instead.
+func parseBlobURL(c *cli.Context) (*blobURL, error) {
+	rawURL := c.String("bloburl")
+	if rawURL == "" {
+		return nil, nil
+	}
+	for _, flag := range []string{"sasuri", "blobendpoint", "endpoint-suffix"} {
+		if c.String(flag) != "" {
+			return nil, fmt.Errorf("The --bloburl and --%s flags cannot be used together", flag)
+		}
+	}
+
+	parts, err := blob.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid blob URL: %w", err)
+	}
+	switch strings.ToLower(parts.Scheme) {
+	case "https":
+	case "http":
+		if !c.Bool("allow-http") {
+			return nil, errors.New("Refusing to use plain HTTP blob URL, use HTTPS or pass --allow-http (meant for storage emulators only)")
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported scheme %q in blob URL, expected https", parts.Scheme)
+	}
+	if parts.Host == "" {
+		return nil, errors.New("Missing host in blob URL")
+	}
+	if parts.ContainerName == "" || parts.BlobName == "" {
+		return nil, errors.New("The blob URL does not point at a blob, expected https://<account>.blob.<endpoint-suffix>/<container>/<blob>")
+	}
+	if parts.SAS.Signature() != "" {
+		return nil, errors.New("The blob URL has a SAS token, pass it with --sasuri instead")
+	}
+	if parts.Snapshot != "" || parts.VersionID != "" {
+		return nil, errors.New("The blob URL points at a snapshot or a version of the blob, expected the blob itself")
+	}
+
+	u := &blobURL{
+		account:   parts.IPEndpointStyleInfo.AccountName,
+		container: parts.ContainerName,
+		blob:      parts.BlobName,
+	}
+	if u.account == "" {
+		labels := strings.SplitN(parts.Host, ".", 3)
+		if len(labels) != 3 || labels[1] != "blob" {
+			return nil, fmt.Errorf("The host %q of the blob URL is not a blob service endpoint, expected <account>.blob.<endpoint-suffix>", parts.Host)
+		}
+		u.account = labels[0]
+		u.endpointSuffix = labels[2]
+	}
+	if account := c.String("stgaccountname"); account != "" && !strings.EqualFold(account, u.account) {
+		return nil, fmt.Errorf("The storage account %q differs from the account %q of the blob URL", account, u.account)
+	}
+	parts.ContainerName = ""
+	parts.BlobName = ""
+	parts.UnparsedParams = ""
+	u.serviceURL = parts.String()
+	return u, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+// defaultConfigName is the name of the configuration file looked up
+// in the home directory when --config is not given.
+const defaultConfigName = ".azure-vhd-utils.toml"
+
+// configKeys are the flags whose default value can be set in the
+// configuration file.
+var configKeys = map[string]bool{
+	"stgaccountname":  true,
+	"containername":   true,
+	"endpoint-suffix": true,
+	"parallelism":     true,
+	"tenantid":        true,
+}
+
+// secretConfigKeys are the flags which must not be kept in the
+// configuration file, mapped to the environment variable to use
+// instead.
+var secretConfigKeys = map[string]string{
+	"stgaccountkey": accountKeyEnv,
+	"sasuri":        "",
+}
+
+// applyConfigFile sets the flags of the command which are not given
+// on the command line nor in the environment to their value in the
+// configuration file, the one given with the --config flag or, if it
+// exists, the default one in the home directory.
+func applyConfigFile(c *cli.Context) error {
+	path := c.GlobalString("config")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		path = filepath.Join(home, defaultConfigName)
+		if _, err := os.Stat(path); err != nil {
+			return nil
+		}
+	}
+	values, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	for _, f := range c.Command.Flags {
+		name := f.GetName()
+		value, ok := values[name]
+		if !ok || c.IsSet(name) {
+			continue
+		}
+		if err := c.Set(name, value); err != nil {
+			return fmt.Errorf("Invalid value for %s in the configuration file %s: %w", name, path, err)
+		}
+	}
+	return nil
+}
+
+// readConfigFile reads the configuration file at path, made of
+// "name = value" lines, where name is a flag without its leading
+// dashes and the value can be quoted like a TOML string. Empty lines
+// and the lines starting with # are ignored.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the configuration file: %w", err)
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("Invalid line %d of the configuration file %s, expected name = value", lineNumber, path)
+		}
+		name = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+		if env, ok := secretConfigKeys[name]; ok {
+			if env == "" {
+				return nil, fmt.Errorf("The configuration file %s must not hold the secret %s, pass it on the command line", path, name)
+			}
+			return nil, fmt.Errorf("The configuration file %s must not hold the secret %s, set the %s environment variable instead", path, name, env)
+		}
+		if !configKeys[name] {
+			return nil, fmt.Errorf("Unknown setting %q on line %d of the configuration file %s", name, lineNumber, path)
+		}
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, fmt.Errorf("Invalid value on line %d of the configuration file %s: %w", lineNumber, path, err)
+			}
+		}
+		values[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read the configuration file: %w", err)
+	}
+	return values, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+
+	"github.com/flatcar/azure-vhd-utils/op"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/diskstream"
+)
+
+// The exit codes of the commands, telling the scripts running them
+// why a command failed.
+const (
+	exitCodeFailure    = 1 // Any other failure
+	exitCodeAuth       = 2 // The credentials were rejected or could not be obtained
+	exitCodeNetwork    = 3 // The storage service could not be reached, timed out or throttled
+	exitCodeSource     = 4 // The local VHD is missing, invalid or changed while read
+	exitCodeIncomplete = 5 // The upload stopped before all the data was written and verified
+)
+
+// exitCodeError is the error of a command with the exit code it
+// exits with.
+type exitCodeError struct {
+	err  error
+	code int
+}
+
+func (e *exitCodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitCodeError) Unwrap() error {
+	return e.err
+}
+
+// withExitCode returns err with the exit code of the command failing
+// with it, or nil if err is nil.
+func withExitCode(err error, code int) error {
+	if err == nil {
+		return nil
+	}
+	return &exitCodeError{err: err, code: code}
+}
+
+// exitCode returns the exit code of a command failing with err,
+// exitCodeFailure unless it was given with withExitCode.
+func exitCode(err error) int {
+	var e *exitCodeError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	return exitCodeFailure
+}
+
+// uploadExitCode classifies the error of an upload. When several
+// classes apply, like for an upload left incomplete because the
+// network failed, the first one of authentication, network, source
+// and incomplete upload wins.
+func uploadExitCode(err error) int {
+	var respErr *azcore.ResponseError
+	isResponseError := errors.As(err, &respErr)
+	var authErr *azidentity.AuthenticationFailedError
+	if errors.As(err, &authErr) ||
+		isResponseError && (respErr.StatusCode == http.StatusUnauthorized || respErr.StatusCode == http.StatusForbidden) {
+		return exitCodeAuth
+	}
+
+	// The requests of an interrupted command fail like on a network
+	// error. The errors of the system calls reading the local VHD
+	// are net.Error too, only the failed requests are looked for.
+	var urlErr *url.Error
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	interrupted := errors.Is(err, context.Canceled)
+	if !interrupted && (errors.As(err, &urlErr) || errors.As(err, &opErr) || errors.As(err, &dnsErr) || errors.Is(err, context.DeadlineExceeded)) {
+		return exitCodeNetwork
+	}
+	if isResponseError {
+		switch respErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+			http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return exitCodeNetwork
+		}
+	}
+
+	if op.ErrorIsAnyOf(err, op.InvalidLocalVHD, op.VHDSizeMismatch, op.VHDMD5Mismatch) || errors.Is(err, diskstream.ErrSourceChanged) {
+		return exitCodeSource
+	}
+	if op.ErrorIsAnyOf(err, op.UploadIncomplete, op.BlobBlockMismatch, op.BlobDataMismatch) {
+		return exitCodeIncomplete
+	}
+	return exitCodeFailure
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/urfave/cli.v1"
+
+	"github.com/flatcar/azure-vhd-utils/upload"
+)
+
+// jsonLogEntry is a single line of the log in JSON format.
+type jsonLogEntry struct {
+	Time   string            `json:"time"`
+	Level  string            `json:"level"`
+	Msg    string            `json:"msg"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// jsonLogMutex serializes the writes of the JSON log lines.
+var jsonLogMutex sync.Mutex
+
+// writeJSONLog writes a JSON log line to the standard error.
+func writeJSONLog(level, msg string, fields map[string]string) {
+	b, err := json.Marshal(jsonLogEntry{
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Level:  level,
+		Msg:    strings.TrimSpace(msg),
+		Fields: fields,
+	})
+	if err != nil {
+		b = []byte(fmt.Sprintf("{\"level\":\"error\",\"msg\":%q}", err.Error()))
+	}
+	jsonLogMutex.Lock()
+	defer jsonLogMutex.Unlock()
+	os.Stderr.Write(append(b, '\n'))
+}
+
+// jsonLogWriter is the output of the standard logger in the JSON log
+// format, it turns every logged line into a JSON log line.
+type jsonLogWriter struct{}
+
+func (jsonLogWriter) Write(p []byte) (int, error) {
+	writeJSONLog("info", string(p), nil)
+	return len(p), nil
+}
+
+// useJSONLog is true if the logs are written as JSON lines.
+var useJSONLog bool
+
+// setupLogFormat configures the standard logger for the log format
+// selected with the --log-format flag.
+func setupLogFormat(c *cli.Context) error {
+	switch c.GlobalString("log-format") {
+	case "", "text":
+	case "json":
+		useJSONLog = true
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{})
+	default:
+		return fmt.Errorf("Invalid value for --log-format %q, expected text or json", c.GlobalString("log-format"))
+	}
+	return nil
+}
+
+// uploadLogger returns the logger to pass to the upload operations,
+// it writes the messages with the standard logger for text logs and
+// as JSON lines, with their level and their fields, for JSON logs.
+func uploadLogger() upload.Logger {
+	if !useJSONLog {
+		return upload.NewFuncLogger(func(s string) {
+			log.Println(s)
+		})
+	}
+	return jsonLogger{}
+}
+
+// jsonLogger is the upload.FieldLogger writing JSON log lines.
+type jsonLogger struct{}
+
+func (jsonLogger) Infof(format string, args ...interface{}) {
+	writeJSONLog(upload.LevelInfo.String(), fmt.Sprintf(format, args...), nil)
+}
+
+func (jsonLogger) Warnf(format string, args ...interface{}) {
+	writeJSONLog(upload.LevelWarn.String(), fmt.Sprintf(format, args...), nil)
+}
+
+func (jsonLogger) Errorf(format string, args ...interface{}) {
+	writeJSONLog(upload.LevelError.String(), fmt.Sprintf(format, args...), nil)
+}
+
+func (jsonLogger) LogFields(level upload.Level, msg string, fields map[string]string) {
+	writeJSONLog(level.String(), msg, fields)
+}
+
+// logFatal logs the error the command failed with and exits with
+// the exit code of the error.
+func logFatal(err error) {
+	if useJSONLog {
+		writeJSONLog("error", err.Error(), nil)
+	} else {
+		log.Println(err)
+	}
+	os.Exit(exitCode(err))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// namePlaceholderRegexp matches the placeholders of a blob name
+// template.
+var namePlaceholderRegexp = regexp.MustCompile(`\{[^{}]*\}`)
+
+// expandNameTemplate returns the blob name for the local VHD at
+// vhdPath from the template, replacing the placeholders:
+//
+//	{basename}  the file name of the VHD without the .vhd extension
+//	{date}      the current UTC date as YYYYMMDD
+//	{time}      the current UTC time as HHMMSS
+//	{sha8}      the first 8 hex digits of the SHA-256 hash of the VHD file
+//
+// The VHD is read to compute its hash only if the template uses
+// {sha8}.
+func expandNameTemplate(template, vhdPath string, now time.Time) (string, error) {
+	var err error
+	var sha string
+	name := namePlaceholderRegexp.ReplaceAllStringFunc(template, func(placeholder string) string {
+		if err != nil {
+			return ""
+		}
+		switch placeholder {
+		case "{basename}":
+			base := filepath.Base(vhdPath)
+			return strings.TrimSuffix(base, filepath.Ext(base))
+		case "{date}":
+			return now.UTC().Format("20060102")
+		case "{time}":
+			return now.UTC().Format("150405")
+		case "{sha8}":
+			if sha == "" {
+				sha, err = fileSHA256(vhdPath)
+			}
+			if len(sha) < 8 {
+				return ""
+			}
+			return sha[:8]
+		default:
+			err = fmt.Errorf("Unknown placeholder %s in --name-template, expected {basename}, {date}, {time} or {sha8}", placeholder)
+			return ""
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// fileSHA256 returns the hex encoded SHA-256 hash of the file at
+// path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// validateBlobName returns an error if the name does not follow the
+// naming rules of Azure blobs: 1 to 1024 characters, with no control
+// characters and no backslashes, not ending with a dot or a slash,
+// with at most 254 path segments. The slashes separate the virtual
+// directories of the name, so the segments must not be empty, be a
+// dot or two, which URLs collapse, or start or end with spaces. The
+// other characters are escaped in the URL of the blob.
+func validateBlobName(name string) error {
+	if len(name) == 0 || len(name) > 1024 {
+		return fmt.Errorf("Invalid blob name %q, it must have between 1 and 1024 characters", name)
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, "/") {
+		return fmt.Errorf("Invalid blob name %q, it must not end with a dot or a slash", name)
+	}
+	if strings.ContainsRune(name, '\\') || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("Invalid blob name %q, it must not contain backslashes or control characters", name)
+	}
+	if strings.Count(name, "/") >= 254 {
+		return fmt.Errorf("Invalid blob name %q, it must not have more than 254 path segments", name)
+	}
+	for _, segment := range strings.Split(name, "/") {
+		switch {
+		case segment == "":
+			return fmt.Errorf("Invalid blob name %q, its virtual directories must not be empty, it must not start with a slash or have two slashes in a row", name)
+		case segment == "." || segment == "..":
+			return fmt.Errorf("Invalid blob name %q, its virtual directories must not be %q", name, segment)
+		case strings.TrimSpace(segment) != segment:
+			return fmt.Errorf("Invalid blob name %q, its path segments must not start or end with spaces", name)
+		}
+	}
+	return nil
+}
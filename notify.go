@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/flatcar/azure-vhd-utils/op"
+)
+
+// notifyAttempts is the number of times the completion notification
+// is sent before giving up.
+const notifyAttempts = 3
+
+// notifyTimeout is the time limit of a single attempt to send the
+// completion notification.
+const notifyTimeout = 30 * time.Second
+
+// uploadNotification is the JSON summary of an upload POSTed to the
+// URL given with --notify-url once the upload is over.
+type uploadNotification struct {
+	Status       string           `json:"status"` // "succeeded" or "failed"
+	Error        string           `json:"error,omitempty"`
+	LocalVHDPath string           `json:"localVHDPath"`
+	Container    string           `json:"container"`
+	Blob         string           `json:"blob"`
+	Started      time.Time        `json:"started"`
+	Duration     string           `json:"duration"`
+	Result       *op.UploadResult `json:"result,omitempty"`
+}
+
+// newUploadNotification returns the summary of an upload which
+// started at the given time and ended with the given result and
+// error.
+func newUploadNotification(localVHDPath, container, blob string, started time.Time, result *op.UploadResult, err error) *uploadNotification {
+	n := &uploadNotification{
+		Status:       "succeeded",
+		LocalVHDPath: localVHDPath,
+		Container:    container,
+		Blob:         blob,
+		Started:      started.UTC(),
+		Duration:     time.Since(started).Round(time.Millisecond).String(),
+		Result:       result,
+	}
+	if err != nil {
+		n.Status = "failed"
+		n.Error = err.Error()
+	}
+	return n
+}
+
+// notify POSTs the notification as JSON to the given URL. Failed
+// attempts are retried with a growing delay, except when the server
+// rejected the notification with a 4xx response.
+func notify(url string, notification interface{}) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: notifyTimeout}
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		var resp *http.Response
+		resp, err = client.Post(url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				return nil
+			}
+			err = fmt.Errorf("the server responded with %s", resp.Status)
+			if resp.StatusCode/100 == 4 {
+				return err
+			}
+		}
+		if attempt == notifyAttempts {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
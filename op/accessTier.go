@@ -0,0 +1,60 @@
+package op
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/pageblob"
+
+	"github.com/flatcar/azure-vhd-utils/upload"
+)
+
+// validateAccessTier checks that the access tier can be set on a page
+// blob, only the premium page blob tiers P4 to P80 can. The hot, cool
+// and archive tiers are for the block blobs of standard accounts.
+func validateAccessTier(tier *blob.AccessTier) error {
+	if tier == nil {
+		return nil
+	}
+	for _, t := range pageblob.PossiblePremiumPageBlobAccessTierValues() {
+		if string(t) == string(*tier) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the access tier %q cannot be set on a page blob, expected one of the premium page blob tiers P4 to P80", *tier)
+}
+
+// checkAccessTierAccount checks that the storage account of the page
+// blob supports the premium page blob tiers, which only premium
+// general purpose accounts do. The check is skipped with a warning if
+// the account information cannot be read, e.g. with a SAS token not
+// allowing it, the service then rejects an unsupported tier itself.
+func checkAccessTierAccount(ctx context.Context, client upload.PageBlobClient, tier *blob.AccessTier, logger func(string)) error {
+	info, err := client.GetAccountInfo(ctx, nil)
+	if err != nil {
+		logger(fmt.Sprintf("Cannot read the storage account information to check the access tier %s: %v", *tier, err))
+		return nil
+	}
+	if info.AccountKind != nil {
+		switch *info.AccountKind {
+		case "BlockBlobStorage", "FileStorage", "BlobStorage":
+			return fmt.Errorf("the storage account of kind %s does not support page blobs with an access tier, a premium general purpose account is needed for the tier %s", *info.AccountKind, *tier)
+		}
+	}
+	if info.SKUName != nil && !strings.HasPrefix(string(*info.SKUName), "Premium") {
+		return fmt.Errorf("the access tier %s is only supported by premium storage accounts, the account has the SKU %s", *tier, *info.SKUName)
+	}
+	return nil
+}
+
+// pageBlobAccessTier returns the access tier as the premium page blob
+// tier of the creation options of the blob.
+func pageBlobAccessTier(tier *blob.AccessTier) *pageblob.PremiumPageBlobAccessTier {
+	if tier == nil {
+		return nil
+	}
+	t := pageblob.PremiumPageBlobAccessTier(*tier)
+	return &t
+}
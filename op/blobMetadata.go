@@ -0,0 +1,127 @@
+package op
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/flatcar/azure-vhd-utils/upload"
+	"github.com/flatcar/azure-vhd-utils/upload/metadata"
+)
+
+// maxBlobMetadataSize is the most bytes the names and the values of
+// the metadata of a blob can take, the upload marker included.
+const maxBlobMetadataSize = 8 * 1024
+
+// maxBlobTags is the most tags a blob can have.
+const maxBlobTags = 10
+
+// validateBlobMetadata checks that the custom metadata can be set on
+// a blob: the names are C# identifiers, other than the name of the
+// upload marker, and the values are printable ASCII.
+func validateBlobMetadata(m map[string]string) error {
+	size := 0
+	for k, v := range m {
+		if !isCSharpIdentifier(k) {
+			return fmt.Errorf("invalid metadata name %q, expected letters, digits and underscores, not starting with a digit", k)
+		}
+		if metadata.IsMetaDataKey(k) {
+			return fmt.Errorf("the metadata name %q is reserved for the upload marker", k)
+		}
+		for _, c := range v {
+			if c < ' ' || c > '~' {
+				return fmt.Errorf("invalid value %q of the metadata %q, expected printable ASCII characters", v, k)
+			}
+		}
+		if strings.TrimSpace(v) != v {
+			return fmt.Errorf("invalid value %q of the metadata %q, leading and trailing spaces are dropped by the service", v, k)
+		}
+		size += len(k) + len(v)
+	}
+	if size > maxBlobMetadataSize {
+		return fmt.Errorf("the metadata take %d bytes, above the limit of %d bytes", size, maxBlobMetadataSize)
+	}
+	return nil
+}
+
+// validateBlobTags checks that the tags can be set on a blob: at most
+// 10 tags, with names of 1 to 128 characters and values of up to 256
+// characters, made of letters, digits, spaces and +-./:=_.
+func validateBlobTags(tags map[string]string) error {
+	if len(tags) > maxBlobTags {
+		return fmt.Errorf("%d tags given, a blob can have at most %d tags", len(tags), maxBlobTags)
+	}
+	for k, v := range tags {
+		if len(k) == 0 || len(k) > 128 {
+			return fmt.Errorf("invalid tag name %q, expected 1 to 128 characters", k)
+		}
+		if len(v) > 256 {
+			return fmt.Errorf("invalid value of the tag %q, expected at most 256 characters, got %d", k, len(v))
+		}
+		if c, ok := invalidTagChar(k); ok {
+			return fmt.Errorf("invalid character %q in the tag name %q, expected letters, digits, spaces and +-./:=_", c, k)
+		}
+		if c, ok := invalidTagChar(v); ok {
+			return fmt.Errorf("invalid character %q in the value of the tag %q, expected letters, digits, spaces and +-./:=_", c, k)
+		}
+	}
+	return nil
+}
+
+// isCSharpIdentifier returns true if s is a C# identifier, as the
+// names of the metadata must be, restricted to ASCII.
+func isCSharpIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// invalidTagChar returns the first character of s not allowed in the
+// names and the values of the tags, if any.
+func invalidTagChar(s string) (rune, bool) {
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune(" +-./:=_", c):
+		default:
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// customBlobMetadata returns the custom metadata to keep on the blob
+// along the upload marker: the existing metadata of the blob, without
+// the marker, updated with the given ones. Metadata names are
+// case-insensitive.
+func customBlobMetadata(existing map[string]*string, m map[string]string) map[string]*string {
+	custom := metadata.WithoutMetaData(existing)
+	for k, v := range m {
+		for e := range custom {
+			if strings.EqualFold(e, k) {
+				delete(custom, e)
+			}
+		}
+		v := v
+		custom[k] = &v
+	}
+	return custom
+}
+
+// setBlobTags replaces the tags of the blob, if any are given.
+func setBlobTags(ctx context.Context, client upload.PageBlobClient, tags map[string]string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	_, err := client.SetTags(ctx, tags, nil)
+	return err
+}
@@ -0,0 +1,159 @@
+package op
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+
+	"github.com/flatcar/azure-vhd-utils/upload"
+	"github.com/flatcar/azure-vhd-utils/upload/concurrent"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+)
+
+// BlockChecksum is the SHA256 digest of a range of the VHD written
+// to the page blob, computed with UploadOptions.PerBlockChecksum.
+type BlockChecksum struct {
+	// Offset and Length are the range of the VHD, in bytes.
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	// SHA256 is the hex encoded SHA256 digest of the range.
+	SHA256 string `json:"sha256"`
+}
+
+// newBlockChecksums returns the checksums of the given digests.
+func newBlockChecksums(digests []upload.BlockDigest) []BlockChecksum {
+	checksums := make([]BlockChecksum, 0, len(digests))
+	for _, d := range digests {
+		checksums = append(checksums, BlockChecksum{
+			Offset: d.Range.Start,
+			Length: d.Range.Length(),
+			SHA256: hex.EncodeToString(d.SHA256),
+		})
+	}
+	return checksums
+}
+
+// errBlockDigestMismatch is returned by the work reading a range back
+// whose digest does not match, it is not retried.
+var errBlockDigestMismatch = errors.New("SHA256 digest mismatch")
+
+// verifyBlockDigests reads the ranges of the given digests back from
+// the page blob, with parallelism concurrent reads, and compares the
+// SHA256 digests of their data. It returns the ranges whose digest
+// does not match, the error is about the ranges failing to be read.
+func verifyBlockDigests(ctx context.Context, client upload.PageBlobClient, digests []upload.BlockDigest, parallelism int) ([]*common.IndexRange, error) {
+	requestChan := make(chan *concurrent.Request, 0)
+	loadBalancer := concurrent.NewBalancerWithContext(ctx, parallelism)
+	loadBalancer.Init()
+	workerErrorChan, allWorkersFinishedChan := loadBalancer.Run(requestChan)
+	workCtx := loadBalancer.Context()
+
+	var mutex sync.Mutex
+	var mismatched []*common.IndexRange
+	var readErrors []error
+	readErrorsDone := make(chan struct{})
+	go func() {
+		defer close(readErrorsDone)
+		for err := range workerErrorChan {
+			if errors.Is(err, errBlockDigestMismatch) {
+				continue
+			}
+			readErrors = append(readErrors, err)
+		}
+	}()
+
+	cancelled := false
+L:
+	for _, d := range digests {
+		d := d
+		req := &concurrent.Request{
+			ID: d.Range.String(),
+			Work: func() error {
+				resp, err := client.DownloadStream(workCtx, &blob.DownloadStreamOptions{
+					Range: blob.HTTPRange{Offset: d.Range.Start, Count: d.Range.Length()},
+				})
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				h := sha256.New()
+				if n, err := io.Copy(h, resp.Body); err != nil {
+					return err
+				} else if n != d.Range.Length() {
+					return fmt.Errorf("read %d bytes of the range %s of %d bytes", n, d.Range, d.Range.Length())
+				}
+				if !bytes.Equal(h.Sum(nil), d.SHA256) {
+					mutex.Lock()
+					mismatched = append(mismatched, d.Range)
+					mutex.Unlock()
+					return errBlockDigestMismatch
+				}
+				return nil
+			},
+			ShouldRetry: func(err error) bool {
+				return workCtx.Err() == nil && !errors.Is(err, errBlockDigestMismatch)
+			},
+			RetryBackoff: 2 * time.Second,
+		}
+		select {
+		case requestChan <- req:
+		case <-ctx.Done():
+			cancelled = true
+			break L
+		}
+	}
+	close(requestChan)
+	if cancelled {
+		loadBalancer.TearDownWorkers()
+	}
+
+	<-allWorkersFinishedChan
+	<-readErrorsDone
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if len(readErrors) > 0 {
+		return nil, fmt.Errorf("%d ranges of the blob failed to be read back: %w", len(readErrors), errors.Join(readErrors...))
+	}
+	return coalesceRanges(mismatched), nil
+}
+
+// checkBlockDigests reads the ranges written by an upload back from
+// the page blob and fails with BlobBlockMismatch if the data of any
+// of them does not match its digest. If clearMismatched is true the
+// mismatching ranges are cleared, so resuming the upload writes them
+// again. There is nothing to verify if no range was written.
+func checkBlockDigests(ctx context.Context, client upload.PageBlobClient, digests []upload.BlockDigest, parallelism int, clearMismatched bool, logger func(string)) error {
+	if len(digests) == 0 {
+		return nil
+	}
+	logger(fmt.Sprintf("Verifying the SHA256 digests of the %d uploaded ranges", len(digests)))
+	mismatched, err := verifyBlockDigests(ctx, client, digests, parallelism)
+	if err != nil {
+		return err
+	}
+	if len(mismatched) == 0 {
+		return nil
+	}
+	for _, r := range mismatched {
+		logger(fmt.Sprintf("The range %s read back from the blob does not match the uploaded data", r))
+	}
+	if !clearMismatched {
+		return fmt.Errorf("%d ranges of the blob, %d bytes, do not match the uploaded data: %w", len(mismatched), common.TotalRangeLength(mismatched), BlobBlockMismatch)
+	}
+	for _, r := range mismatched {
+		if _, err := client.ClearPages(ctx, blob.HTTPRange{Offset: r.Start, Count: r.Length()}, nil); err != nil {
+			return fmt.Errorf("failed to clear the mismatching range %s of the blob, rerun with --overwrite: %w", r, err)
+		}
+	}
+	return fmt.Errorf("%d ranges of the blob, %d bytes, do not match the uploaded data and were cleared, rerun the command to upload them again: %w", len(mismatched), common.TotalRangeLength(mismatched), BlobBlockMismatch)
+}
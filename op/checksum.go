@@ -0,0 +1,99 @@
+package op
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/flatcar/azure-vhd-utils/upload/progress"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/diskstream"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/validator"
+)
+
+// ChecksumOptions are the options of Checksum.
+type ChecksumOptions struct {
+	// ParentPath is the path of the parent VHD of a differencing
+	// disk, if the path recorded in the disk is wrong.
+	ParentPath string
+	// SHA256 computes the SHA256 hash too.
+	SHA256 bool
+	// Quiet does not print the progress of the computation.
+	Quiet bool
+}
+
+// VHDChecksum are the hashes of a VHD computed by Checksum.
+type VHDChecksum struct {
+	// Size is the number of bytes hashed, the size of the VHD as
+	// a fixed disk.
+	Size int64
+	// MD5 is the MD5 hash of the VHD, as stored in the
+	// Content-MD5 property of the uploaded page blob.
+	MD5 []byte
+	// SHA256 is the SHA256 hash of the VHD, if requested.
+	SHA256 []byte
+}
+
+// Checksum computes the hashes of the local VHD at the path vhd as
+// it is uploaded: the VHD is read as a fixed disk, with the holes of
+// a dynamic or differencing one read as zeros, followed by its
+// footer. The MD5 hash is then the one the upload stores on the page
+// blob.
+func Checksum(vhd string, opts *ChecksumOptions) (*VHDChecksum, error) {
+	if opts == nil {
+		opts = &ChecksumOptions{}
+	}
+
+	if err := validator.ValidateVhdWithParent(vhd, opts.ParentPath); err != nil {
+		return nil, err
+	}
+	diskStream, err := diskstream.CreateNewDiskStreamWithOptions(vhd, &diskstream.Options{ParentPath: opts.ParentPath})
+	if err != nil {
+		return nil, err
+	}
+	defer diskStream.Close()
+
+	md5Hash := md5.New()
+	hashes := []io.Writer{md5Hash}
+	var sha256Hash hash.Hash
+	if opts.SHA256 {
+		sha256Hash = sha256.New()
+		hashes = append(hashes, sha256Hash)
+	}
+
+	progressStream := progress.NewReaderWithProgressInPhase(diskStream, diskStream.GetSize(), time.Second, progress.PhaseHashing)
+	defer progressStream.Close()
+	go func() {
+		s := time.Time{}
+		if !opts.Quiet {
+			fmt.Println("Computing the checksum of the VHD..")
+		}
+		for progressRecord := range progressStream.ProgressChan {
+			if !opts.Quiet {
+				t := s.Add(progressRecord.RemainingDuration)
+				fmt.Printf("\r %s: %3d%% RemainingTime: %02dh:%02dm:%02ds Throughput: %d MB/sec",
+					progressRecord.Phase,
+					int(progressRecord.PercentComplete),
+					t.Hour(), t.Minute(), t.Second(),
+					int(progressRecord.AverageThroughputMbPerSecond),
+				)
+			}
+		}
+	}()
+
+	buf := make([]byte, 2097152) // 2 MB staging buffer
+	n, err := io.CopyBuffer(io.MultiWriter(hashes...), progressStream, buf)
+	if err != nil {
+		return nil, err
+	}
+	checksum := &VHDChecksum{
+		Size: n,
+		MD5:  md5Hash.Sum(nil),
+	}
+	if sha256Hash != nil {
+		checksum.SHA256 = sha256Hash.Sum(nil)
+	}
+	return checksum, nil
+}
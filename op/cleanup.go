@@ -0,0 +1,95 @@
+package op
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
+
+	"github.com/flatcar/azure-vhd-utils/upload/metadata"
+)
+
+// CleanupOptions are the options of Cleanup.
+type CleanupOptions struct {
+	// OlderThan is the age of the last change of a page blob
+	// with an unfinished upload after which its marker is
+	// considered stale. Defaults to 24 hours.
+	OlderThan time.Duration
+	// Clear removes the markers of the blobs with a
+	// finished upload and the stale markers of the blobs with
+	// an unfinished one, otherwise the markers are only listed.
+	Clear bool
+	// Logger logs the removed markers.
+	Logger func(string)
+}
+
+// UploadMarker describes the upload metadata marker found on a page
+// blob by Cleanup.
+type UploadMarker struct {
+	BlobName     string    // The name of the page blob
+	LastModified time.Time // The last change of the page blob
+	Complete     bool      // True if the upload of the blob was finished, its MD5 hash is set
+	Stale        bool      // True if the upload was not finished and the blob was not changed for OlderThan
+	Cleared      bool      // True if the marker was removed
+}
+
+// Cleanup lists the page blobs in the container which have the upload
+// metadata marker, left by an upload to allow resuming it. The marker
+// of a finished upload is no longer needed, and the marker of an
+// unfinished upload is stale if the blob was not changed for a while,
+// its upload was likely abandoned. With the Clear option these
+// markers are removed, keeping the other metadata of the blobs. An
+// upload whose marker was removed cannot be resumed anymore.
+func Cleanup(ctx context.Context, blobServiceClient *service.Client, containerName string, opts *CleanupOptions) ([]*UploadMarker, error) {
+	if opts == nil {
+		opts = &CleanupOptions{}
+	}
+	olderThan := 24 * time.Hour
+	if opts.OlderThan > 0 {
+		olderThan = opts.OlderThan
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = noopLogger
+	}
+
+	containerClient := blobServiceClient.NewContainerClient(containerName)
+	pager := containerClient.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Include: container.ListBlobsInclude{Metadata: true},
+	})
+	now := time.Now()
+	var markers []*UploadMarker
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return markers, err
+		}
+		for _, item := range page.Segment.BlobItems {
+			if item.Name == nil || item.Properties == nil || !metadata.HasMetaData(item.Metadata) {
+				continue
+			}
+			marker := &UploadMarker{
+				BlobName: *item.Name,
+				Complete: len(item.Properties.ContentMD5) > 0,
+			}
+			if item.Properties.LastModified != nil {
+				marker.LastModified = *item.Properties.LastModified
+			}
+			marker.Stale = !marker.Complete && now.Sub(marker.LastModified) >= olderThan
+			markers = append(markers, marker)
+
+			if !opts.Clear || !(marker.Complete || marker.Stale) {
+				continue
+			}
+			blobClient := containerClient.NewBlobClient(marker.BlobName)
+			if _, err := blobClient.SetMetadata(ctx, metadata.WithoutMetaData(item.Metadata), nil); err != nil {
+				return markers, fmt.Errorf("failed to remove the upload marker of the blob '%s': %v", marker.BlobName, err)
+			}
+			marker.Cleared = true
+			logger(fmt.Sprintf("Removed the upload marker of the blob '%s'", marker.BlobName))
+		}
+	}
+	return markers, nil
+}
@@ -0,0 +1,108 @@
+package op
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/pageblob"
+
+	"github.com/flatcar/azure-vhd-utils/upload"
+)
+
+// conditionalPageBlobClient is a PageBlobClient whose page writes
+// only succeed while the sequence number of the blob is the one it
+// set. The ETag of a page blob changes with every write, so it
+// cannot tell the writes of the upload from those of another writer,
+// the sequence number only changes when a writer sets it.
+type conditionalPageBlobClient struct {
+	upload.PageBlobClient
+	sequenceNumber int64
+	ctx            context.Context
+	stop           context.CancelCauseFunc
+}
+
+// claimBlob sets the sequence number of the blob of the given client
+// to a random value and returns a client whose page writes fail with
+// a 412 response once another writer changed it. The context of the
+// returned client, derived from ctx, is cancelled then, so the
+// upload aborts at once instead of failing every range.
+func claimBlob(ctx context.Context, client upload.PageBlobClient) (*conditionalPageBlobClient, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	if err != nil {
+		return nil, err
+	}
+	sequenceNumber := n.Int64()
+	action := pageblob.SequenceNumberActionTypeUpdate
+	if _, err := client.UpdateSequenceNumber(ctx, &pageblob.UpdateSequenceNumberOptions{
+		ActionType:     &action,
+		SequenceNumber: &sequenceNumber,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to set the sequence number of the blob for the conditional writes: %w", err)
+	}
+
+	conditionalCtx, stop := context.WithCancelCause(ctx)
+	return &conditionalPageBlobClient{
+		PageBlobClient: client,
+		sequenceNumber: sequenceNumber,
+		ctx:            conditionalCtx,
+		stop:           stop,
+	}, nil
+}
+
+// conditions returns a copy of the given sequence number access
+// conditions requiring the sequence number set by claimBlob.
+func (c *conditionalPageBlobClient) conditions(sc *pageblob.SequenceNumberAccessConditions) *pageblob.SequenceNumberAccessConditions {
+	conditions := pageblob.SequenceNumberAccessConditions{}
+	if sc != nil {
+		conditions = *sc
+	}
+	conditions.IfSequenceNumberEqualTo = &c.sequenceNumber
+	return &conditions
+}
+
+// checkCondition aborts the upload if the given error of a write
+// tells that the sequence number of the blob changed.
+func (c *conditionalPageBlobClient) checkCondition(err error) error {
+	if bloberror.HasCode(err, bloberror.SequenceNumberConditionNotMet) {
+		c.stop(fmt.Errorf("the sequence number of the blob changed, another writer modified it during the upload: %w", BlobModifiedConcurrently))
+	}
+	return err
+}
+
+// err returns the reason the context of the client was cancelled if
+// the blob was modified by another writer, otherwise err.
+func (c *conditionalPageBlobClient) err(err error) error {
+	if cause := context.Cause(c.ctx); errors.Is(cause, BlobModifiedConcurrently) {
+		return cause
+	}
+	return err
+}
+
+func (c *conditionalPageBlobClient) UploadPages(ctx context.Context, body io.ReadSeekCloser, contentRange blob.HTTPRange, o *pageblob.UploadPagesOptions) (pageblob.UploadPagesResponse, error) {
+	options := pageblob.UploadPagesOptions{}
+	if o != nil {
+		options = *o
+	}
+	options.SequenceNumberAccessConditions = c.conditions(options.SequenceNumberAccessConditions)
+	response, err := c.PageBlobClient.UploadPages(ctx, body, contentRange, &options)
+	return response, c.checkCondition(err)
+}
+
+func (c *conditionalPageBlobClient) ClearPages(ctx context.Context, rnge blob.HTTPRange, o *pageblob.ClearPagesOptions) (pageblob.ClearPagesResponse, error) {
+	options := pageblob.ClearPagesOptions{}
+	if o != nil {
+		options = *o
+	}
+	options.SequenceNumberAccessConditions = c.conditions(options.SequenceNumberAccessConditions)
+	response, err := c.PageBlobClient.ClearPages(ctx, rnge, &options)
+	return response, c.checkCondition(err)
+}
+
+var _ upload.PageBlobClient = (*conditionalPageBlobClient)(nil)
@@ -0,0 +1,177 @@
+package op
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/flatcar/azure-vhd-utils/vhdcore"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/converter"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/diskstream"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/validator"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/vhdx"
+)
+
+// ConvertOptions are the options of ConvertToDynamic and
+// ConvertToFixed.
+type ConvertOptions struct {
+	// Overwrite replaces the output file if it exists already.
+	Overwrite bool
+	// BlockSize is the size of the blocks of the dynamic disk,
+	// it defaults to 2 MB. It is ignored by ConvertToFixed.
+	BlockSize uint32
+	Logger    func(string)
+}
+
+// ConvertToDynamic writes the local VHD at the path vhd to the file
+// at the path output as a dynamic VHD, only the blocks holding data
+// take space in it. The VHD is read like it is uploaded, so a dynamic
+// or differencing VHD is converted too. The output is checked to be
+// a valid VHD, the file is removed if the conversion failed.
+func ConvertToDynamic(vhd, output string, opts *ConvertOptions) error {
+	if opts == nil {
+		opts = &ConvertOptions{}
+	}
+	blockSize := converter.DefaultBlockSize
+	if opts.BlockSize > 0 {
+		blockSize = opts.BlockSize
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = noopLogger
+	}
+
+	if isVhdx, err := vhdx.IsVhdxFile(vhd); err != nil {
+		return err
+	} else if isVhdx {
+		return errors.New("a VHDX file cannot be converted to a dynamic VHD, convert it to a fixed VHD first")
+	}
+	if err := validator.ValidateVhd(vhd); err != nil {
+		return err
+	}
+	diskStream, err := diskstream.CreateNewDiskStream(vhd)
+	if err != nil {
+		return err
+	}
+	defer diskStream.Close()
+
+	var size int64
+	err = writeConvertedVHD(output, opts.Overwrite, func(f *os.File) error {
+		var err error
+		size, err = converter.ToDynamic(diskStream, f, blockSize)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	logger(fmt.Sprintf("Converted %.2f MB of VHD into a dynamic VHD of %.2f MB", float64(diskStream.GetSize())/oneMB, float64(size)/oneMB))
+	return nil
+}
+
+// ConvertToFixed writes the local VHD or VHDX at the path vhd to the
+// file at the path output as a fixed VHD, the VHD which a page blob
+// holds. A VHD is read like it is uploaded, so a dynamic or
+// differencing VHD is expanded, the zero blocks of the output are
+// left as holes of a sparse file. A VHDX differencing disk or one
+// whose log was not applied is not supported. The output is checked
+// to be a valid VHD, the file is removed if the conversion failed.
+func ConvertToFixed(vhd, output string, opts *ConvertOptions) error {
+	if opts == nil {
+		opts = &ConvertOptions{}
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = noopLogger
+	}
+
+	isVhdx, err := vhdx.IsVhdxFile(vhd)
+	if err != nil {
+		return err
+	}
+	if isVhdx {
+		v, err := vhdx.Open(vhd)
+		if err != nil {
+			return err
+		}
+		defer v.Close()
+		if err := v.CheckReadable(); err != nil {
+			return err
+		}
+		uniqueID, err := common.NewUUID(v.Metadata.VirtualDiskID[:])
+		if err != nil {
+			return err
+		}
+		size := v.VirtualSize()
+		err = writeConvertedVHD(output, opts.Overwrite, func(f *os.File) error {
+			if _, err := converter.ToFixed(io.NewSectionReader(v, 0, size), size, f); err != nil {
+				return err
+			}
+			_, err := f.WriteAt(converter.NewFixedFooter(size, uniqueID), size)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		logger(fmt.Sprintf("Converted VHDX into a fixed VHD of %.2f MB", float64(size+vhdcore.VhdFooterSize)/oneMB))
+		return nil
+	}
+
+	if err := validator.ValidateVhd(vhd); err != nil {
+		return err
+	}
+	diskStream, err := diskstream.CreateNewDiskStream(vhd)
+	if err != nil {
+		return err
+	}
+	defer diskStream.Close()
+
+	err = writeConvertedVHD(output, opts.Overwrite, func(f *os.File) error {
+		_, err := converter.ToFixed(diskStream, diskStream.GetSize(), f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	logger(fmt.Sprintf("Converted VHD into a fixed VHD of %.2f MB", float64(diskStream.GetSize())/oneMB))
+	return nil
+}
+
+// writeConvertedVHD creates the file at the path output, replacing it
+// if overwrite is true, writes the converted VHD to it with write and
+// checks that it is a valid VHD. The file is removed if any of this
+// failed.
+func writeConvertedVHD(output string, overwrite bool, write func(f *os.File) error) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(output, flags, 0644)
+	if err != nil {
+		return err
+	}
+	succeeded := false
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+		if !succeeded {
+			os.Remove(output)
+		}
+	}()
+
+	if err := write(f); err != nil {
+		return err
+	}
+	err = f.Close()
+	f = nil
+	if err != nil {
+		return err
+	}
+	if err := validator.ValidateVhd(output); err != nil {
+		return err
+	}
+	succeeded = true
+	return nil
+}
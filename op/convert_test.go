@@ -0,0 +1,45 @@
+package op
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flatcar/azure-vhd-utils/upload/uploadtest"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/footer"
+)
+
+func TestConvertToDynamicKeepsDiskData(t *testing.T) {
+	// Data in the first and the last of the 512 KB blocks, and across the boundary of two blocks in between
+	data := uploadtest.NewData(4*1024*1024, 12, 0, 2047, 2048, 5000, 8191)
+	fixed := uploadtest.NewFixedVHD(t, data)
+	dynamic := filepath.Join(t.TempDir(), "dynamic.vhd")
+	if err := ConvertToDynamic(fixed, dynamic, &ConvertOptions{BlockSize: 512 * 1024}); err != nil {
+		t.Fatalf("conversion failed: %v", err)
+	}
+
+	stream := uploadtest.OpenVHD(t, dynamic)
+	if stream.GetDiskType() != footer.DiskTypeDynamic {
+		t.Errorf("got a disk of type %v, expected a dynamic one", stream.GetDiskType())
+	}
+	if got, expected := stream.GetSize(), uploadtest.OpenVHD(t, fixed).GetSize(); got != expected {
+		t.Errorf("got a disk stream of %d bytes, expected %d", got, expected)
+	}
+	content, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content[:len(data)], data) {
+		t.Error("the data of the dynamic disk differs from the data of the fixed one")
+	}
+	// The blocks holding only zeros are left unallocated
+	fi, err := os.Stat(dynamic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() >= int64(len(data)) {
+		t.Errorf("got a dynamic VHD of %d bytes, expected it smaller than the %d bytes of its data", fi.Size(), len(data))
+	}
+}
@@ -0,0 +1,132 @@
+package op
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
+)
+
+type CopyOptions struct {
+	Overwrite bool
+	// DeleteSource deletes the source blob once it was copied,
+	// which makes the copy a rename.
+	DeleteSource bool
+	// PollInterval is the time to wait between the checks of the
+	// copy status, defaults to 5 seconds.
+	PollInterval time.Duration
+	// CreateContainer creates the destination container, private,
+	// if it does not exist yet, otherwise the copy fails with
+	// ContainerNotFound.
+	CreateContainer bool
+	Logger          func(string)
+}
+
+// Copy copies a blob within the storage account on the server side,
+// so the data does not need to be downloaded and uploaded again. The
+// blob metadata and properties, including the upload metadata and
+// the MD5 hash of the VHD, are copied too. The destination container
+// must exist, unless CreateContainer is set.
+func Copy(ctx context.Context, blobServiceClient *service.Client, srcContainer, srcBlobName, dstContainer, dstBlobName string, opts *CopyOptions) error {
+	if !strings.HasSuffix(strings.ToLower(dstBlobName), ".vhd") {
+		return MissingVHDSuffix
+	}
+	if srcContainer == dstContainer && srcBlobName == dstBlobName {
+		return SameCopySourceAndDestination
+	}
+
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	pollInterval := 5 * time.Second
+	if opts.PollInterval > 0 {
+		pollInterval = opts.PollInterval
+	}
+	logger := noopLogger
+	if opts.Logger != nil {
+		logger = opts.Logger
+	}
+
+	srcBlobClient := blobServiceClient.NewContainerClient(srcContainer).NewBlobClient(srcBlobName)
+	if _, err := srcBlobClient.GetProperties(ctx, nil); err != nil {
+		return err
+	}
+
+	dstContainerClient := blobServiceClient.NewContainerClient(dstContainer)
+	if opts.CreateContainer {
+		_, err := dstContainerClient.Create(ctx, nil)
+		if err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists, bloberror.ResourceAlreadyExists) {
+			return err
+		}
+	}
+
+	dstBlobClient := dstContainerClient.NewBlobClient(dstBlobName)
+	_, err := dstBlobClient.GetProperties(ctx, nil)
+	if err == nil {
+		if !opts.Overwrite {
+			return BlobAlreadyExists
+		}
+		logger(fmt.Sprintf("Blob with name '%s' already exists, it will be overwritten", dstBlobName))
+	} else if bloberror.HasCode(err, bloberror.ContainerNotFound) {
+		return ContainerNotFound
+	} else if !bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ResourceNotFound) {
+		return err
+	}
+
+	resp, err := dstBlobClient.StartCopyFromURL(ctx, srcBlobClient.URL(), nil)
+	if err != nil {
+		return err
+	}
+	logger(fmt.Sprintf("Copying blob '%s/%s' to '%s/%s'", srcContainer, srcBlobName, dstContainer, dstBlobName))
+
+	if err := waitForCopy(ctx, dstBlobClient, resp.CopyStatus, pollInterval, logger); err != nil {
+		return err
+	}
+	logger("Copy completed")
+
+	if opts.DeleteSource {
+		if _, err := srcBlobClient.Delete(ctx, nil); err != nil {
+			return fmt.Errorf("blob was copied, but deleting the source failed: %w", err)
+		}
+		logger(fmt.Sprintf("Deleted source blob '%s/%s'", srcContainer, srcBlobName))
+	}
+	return nil
+}
+
+// waitForCopy polls the status of the copy to the blob represented
+// by the client until it is not pending anymore. The parameter status
+// is the status reported when the copy was started.
+func waitForCopy(ctx context.Context, client *blob.Client, status *blob.CopyStatusType, pollInterval time.Duration, logger func(string)) error {
+	var description string
+	for status != nil && *status == blob.CopyStatusTypePending {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+
+		props, err := client.GetProperties(ctx, nil)
+		if err != nil {
+			return err
+		}
+		status = props.CopyStatus
+		if props.CopyProgress != nil {
+			logger(fmt.Sprintf("Copy progress: %s bytes", *props.CopyProgress))
+		}
+		if props.CopyStatusDescription != nil {
+			description = *props.CopyStatusDescription
+		}
+	}
+
+	if status == nil {
+		return fmt.Errorf("unknown copy status")
+	}
+	if *status != blob.CopyStatusTypeSuccess {
+		return fmt.Errorf("copy %s: %s", *status, description)
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package op
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
+
+	"github.com/flatcar/azure-vhd-utils/upload"
+	"github.com/flatcar/azure-vhd-utils/upload/concurrent"
+	"github.com/flatcar/azure-vhd-utils/upload/progress"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/validator"
+)
+
+// oneMB is one MegaByte
+const oneMB = 1024 * 1024
+
+// downloadRetryBackoff is the longest delay before the first retry of
+// the read of a range, doubled for each next one.
+var downloadRetryBackoff = 2 * time.Second
+
+// DownloadOptions are the options of Download.
+type DownloadOptions struct {
+	// Overwrite replaces the local file if it exists already.
+	Overwrite bool
+	// Parallelism is the number of concurrent reads of the page
+	// blob, it defaults to 8 * number of CPUs.
+	Parallelism int
+	Logger      func(string)
+	// Progress, if not nil, is called with a copy of every
+	// progress record of the download, after printing it.
+	Progress upload.ProgressCallback
+}
+
+// Download fetches the page blob holding a VHD into the local file
+// at the path vhd. Only the allocated page ranges of the blob are
+// read, the unallocated ones are left as holes of zeros in the file.
+// The ranges written are recorded in a state file next to the VHD,
+// with the .download-state suffix, so a download which failed or
+// was cancelled keeps the file and is resumed by the next call,
+// unless Overwrite is set. A download is only resumed if the blob
+// has not changed and the file still has its size. The downloaded
+// file is checked to be a valid VHD, once complete the state file
+// is removed, the file too if it is not a valid VHD.
+func Download(ctx context.Context, blobServiceClient *service.Client, container, blobName, vhd string, opts *DownloadOptions) error {
+	const PageBlobPageSize int64 = 512
+	const PageBlobPageSetSize int64 = 4 * 1024 * 1024
+
+	if opts == nil {
+		opts = &DownloadOptions{}
+	}
+	parallelism := 8 * runtime.NumCPU()
+	if opts.Parallelism > 0 {
+		parallelism = opts.Parallelism
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = noopLogger
+	}
+
+	pageblobClient := blobServiceClient.NewContainerClient(container).NewPageBlobClient(blobName)
+	props, err := pageblobClient.GetProperties(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if props.BlobType == nil || *props.BlobType != blob.BlobTypePageBlob {
+		return fmt.Errorf("the blob '%s' is not a page blob", blobName)
+	}
+	if props.ContentLength == nil {
+		return fmt.Errorf("the size of the blob '%s' is not reported", blobName)
+	}
+	blobSize := *props.ContentLength
+	etag := ""
+	if props.ETag != nil {
+		etag = string(*props.ETag)
+	}
+
+	blobRanges, err := getAlreadyUploadedBlobRanges(ctx, pageblobClient)
+	if err != nil {
+		return err
+	}
+	ranges := common.ChunkRangesBySizeWithQuant(coalesceRanges(blobRanges), PageBlobPageSetSize, PageBlobPageSize)
+
+	statePath := downloadStatePath(vhd)
+	var state *downloadState
+	if !opts.Overwrite {
+		state, err = openDownloadState(statePath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	var f *os.File
+	if state != nil {
+		defer state.close()
+		if state.blobSize != blobSize || state.etag != etag {
+			return fmt.Errorf("the blob '%s' changed since the download to %s started, rerun with --overwrite to download it again", blobName, vhd)
+		}
+		if fi, err := os.Stat(vhd); err != nil || fi.Size() != blobSize {
+			return fmt.Errorf("the file %s does not have the size of %d bytes of the blob recorded in %s, rerun with --overwrite to download it again", vhd, blobSize, statePath)
+		}
+		if f, err = os.OpenFile(vhd, os.O_WRONLY, 0); err != nil {
+			return err
+		}
+		ranges = common.ChunkRangesBySizeWithQuant(common.SubtractRanges(ranges, state.completed), PageBlobPageSetSize, PageBlobPageSize)
+		logger(fmt.Sprintf("Resuming the download to %s, %.2f MB were downloaded already", vhd, float64(common.TotalRangeLength(state.completed))/oneMB))
+	} else {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if opts.Overwrite {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		}
+		if f, err = os.OpenFile(vhd, flags, 0644); err != nil {
+			return err
+		}
+	}
+	// The file and its state are kept for a resume if the
+	// download of the ranges fails, removed on any other failure.
+	succeeded, resumable := false, false
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+		if !succeeded && !resumable {
+			os.Remove(vhd)
+			os.Remove(statePath)
+		}
+	}()
+	if state == nil {
+		// The ranges not written below read as zeros.
+		if err := f.Truncate(blobSize); err != nil {
+			return err
+		}
+		if state, err = createDownloadState(statePath, blobSize, etag); err != nil {
+			return err
+		}
+		defer state.close()
+	}
+
+	downloadSize := common.TotalRangeLength(ranges)
+	logger(fmt.Sprintf("Downloading %.2f MB of allocated pages out of %.2f MB", float64(downloadSize)/oneMB, float64(blobSize)/oneMB))
+	if err := downloadRanges(ctx, pageblobClient, f, ranges, state, parallelism, logger, opts.Progress); err != nil {
+		resumable = true
+		return fmt.Errorf("the download to %s was interrupted, rerun the command to resume it: %w", vhd, err)
+	}
+
+	err = f.Close()
+	f = nil
+	if err != nil {
+		return err
+	}
+	if err := validator.ValidateVhd(vhd); err != nil {
+		return err
+	}
+	succeeded = true
+	if err := os.Remove(statePath); err != nil {
+		logger(fmt.Sprintf("Failed to remove the download state file %s: %v", statePath, err))
+	}
+	logger("Download completed")
+	return nil
+}
+
+// downloadRanges writes the given ranges of the page blob to the
+// same offsets of the file, with parallelism concurrent reads, and
+// records them in the download state once written.
+func downloadRanges(ctx context.Context, client upload.PageBlobClient, f *os.File, ranges []*common.IndexRange, state *downloadState, parallelism int, logger func(string), callback upload.ProgressCallback) error {
+	requestChan := make(chan *concurrent.Request, 0)
+	loadBalancer := concurrent.NewBalancerWithContext(ctx, parallelism)
+	loadBalancer.Init()
+	workerErrorChan, allWorkersFinishedChan := loadBalancer.Run(requestChan)
+	workCtx := loadBalancer.Context()
+
+	status := progress.NewStatus(parallelism, 0, common.TotalRangeLength(ranges), progress.NewComputestateDefaultSize(), progress.DefaultThroughputWindow, progress.DefaultThroughputSmoothing)
+	status.SetPhase(progress.PhaseDownloading)
+	status.SetBlocksTotal(int64(len(ranges)))
+	progressChan := status.Run()
+	printDone := make(chan struct{})
+	go func() {
+		defer close(printDone)
+		s := time.Time{}
+		fmt.Println("\nDownloading the VHD..")
+		for record := range progressChan {
+			t := s.Add(record.RemainingDuration)
+			fmt.Printf("\r %s: %3d%% [%10.2f MB] Block: %d/%d RemainingTime: %02dh:%02dm:%02ds Throughput: %d Mb/sec   ",
+				record.Phase,
+				int(record.PercentComplete),
+				float64(record.BytesProcessed)/oneMB,
+				record.BlocksCompleted, record.BlocksTotal,
+				t.Hour(), t.Minute(), t.Second(),
+				int(record.AverageThroughputMbPerSecond),
+			)
+			if callback != nil {
+				callback(*record)
+			}
+		}
+		fmt.Println()
+	}()
+
+	// The channel is closed once all workers exited
+	var workErrors []error
+	workErrorsDone := make(chan struct{})
+	go func() {
+		defer close(workErrorsDone)
+		for err := range workerErrorChan {
+			if ctx.Err() == nil {
+				logger(fmt.Sprintf("Failed to download range %v", err))
+			}
+			workErrors = append(workErrors, err)
+		}
+	}()
+
+	cancelled := false
+L:
+	for _, r := range ranges {
+		r := r
+		req := &concurrent.Request{
+			ID: r.String(),
+			Work: func() error {
+				status.ReportRangeStarted(r)
+				defer status.ReportRangeFinished(r)
+				resp, err := client.DownloadStream(workCtx, &blob.DownloadStreamOptions{
+					Range: blob.HTTPRange{Offset: r.Start, Count: r.Length()},
+				})
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				buf := make([]byte, r.Length())
+				if _, err := io.ReadFull(resp.Body, buf); err != nil {
+					return err
+				}
+				if _, err := f.WriteAt(buf, r.Start); err != nil {
+					return err
+				}
+				if err := state.add(r); err != nil {
+					return err
+				}
+				status.ReportBytesProcessedCount(r.Length())
+				status.ReportBlockComplete()
+				return nil
+			},
+			ShouldRetry: func(err error) bool {
+				return ctx.Err() == nil
+			},
+			RetryBackoff: downloadRetryBackoff,
+		}
+		select {
+		case requestChan <- req:
+		case <-ctx.Done():
+			cancelled = true
+			break L
+		}
+	}
+	close(requestChan)
+	if cancelled {
+		loadBalancer.TearDownWorkers()
+	}
+
+	<-allWorkersFinishedChan
+	<-workErrorsDone
+	status.Close()
+	<-printDone
+
+	if cancelled || (len(workErrors) > 0 && ctx.Err() != nil) {
+		return ctx.Err()
+	}
+	if len(workErrors) > 0 {
+		return fmt.Errorf("%d ranges of the blob failed to download: %w", len(workErrors), errors.Join(workErrors...))
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package op
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+)
+
+// downloadStateSuffix is appended to the path of the downloaded VHD
+// to get the path of its download state file.
+const downloadStateSuffix = ".download-state"
+
+// downloadStateHeader starts the first line of a download state
+// file, followed by the version of its format.
+const downloadStateHeader = "azure-vhd-utils-download-state"
+
+// downloadStateVersion is the version of the format of the download
+// state files written. A file of a later version is rejected, the
+// lines a version does not know are ignored, so new lines can be
+// added without changing the version.
+const downloadStateVersion = 1
+
+// downloadState is the state of a download, kept in a file next to
+// the downloaded VHD so an interrupted download can be resumed: the
+// size and the ETag of the blob, and the ranges already written to
+// the VHD, one "range start end" line each, appended as they are
+// written.
+type downloadState struct {
+	blobSize  int64
+	etag      string
+	completed []*common.IndexRange
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// downloadStatePath returns the path of the download state file of
+// the VHD at the path vhd.
+func downloadStatePath(vhd string) string {
+	return vhd + downloadStateSuffix
+}
+
+// createDownloadState creates the download state file at path, or
+// replaces it, for the download of a blob of the given size and
+// ETag.
+func createDownloadState(path string, blobSize int64, etag string) (*downloadState, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(f, "%s %d\nblob-size %d\netag %s\n", downloadStateHeader, downloadStateVersion, blobSize, etag); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write the download state file %s: %v", path, err)
+	}
+	return &downloadState{blobSize: blobSize, etag: etag, f: f}, nil
+}
+
+// openDownloadState reads the download state file at path and opens
+// it to append the next completed ranges. A last line cut short,
+// when the download was killed while writing it, is dropped. The
+// error satisfies os.IsNotExist if there is no such file.
+func openDownloadState(path string) (*downloadState, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// Only the complete lines are kept
+	end := bytes.LastIndexByte(b, '\n') + 1
+	s := &downloadState{blobSize: -1}
+	scanner := bufio.NewScanner(bytes.NewReader(b[:end]))
+	for line := 0; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if line == 0 {
+			if len(fields) != 2 || fields[0] != downloadStateHeader {
+				return nil, fmt.Errorf("the file %s is not a download state file", path)
+			}
+			version, err := strconv.Atoi(fields[1])
+			if err != nil || version < 1 {
+				return nil, fmt.Errorf("the download state file %s has the invalid version %q", path, fields[1])
+			}
+			if version > downloadStateVersion {
+				return nil, fmt.Errorf("the download state file %s has the version %d, only the version %d is known, remove it to download the blob again", path, version, downloadStateVersion)
+			}
+			continue
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "blob-size":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("invalid line %d of the download state file %s", line+1, path)
+			}
+			if s.blobSize, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid blob size on line %d of the download state file %s", line+1, path)
+			}
+		case "etag":
+			s.etag = strings.Join(fields[1:], " ")
+		case "range":
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("invalid line %d of the download state file %s", line+1, path)
+			}
+			start, err1 := strconv.ParseInt(fields[1], 10, 64)
+			end, err2 := strconv.ParseInt(fields[2], 10, 64)
+			if err1 != nil || err2 != nil || start < 0 || end < start {
+				return nil, fmt.Errorf("invalid range on line %d of the download state file %s", line+1, path)
+			}
+			s.completed = append(s.completed, common.NewIndexRange(start, end))
+		}
+	}
+	if s.blobSize < 0 {
+		return nil, fmt.Errorf("the download state file %s lacks the size of the blob", path)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(int64(end)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(int64(end), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.f = f
+	return s, nil
+}
+
+// add records that the given range was written to the VHD.
+func (s *downloadState) add(r *common.IndexRange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := fmt.Fprintf(s.f, "range %d %d\n", r.Start, r.End); err != nil {
+		return fmt.Errorf("failed to write the download state file: %v", err)
+	}
+	return nil
+}
+
+// close closes the download state file.
+func (s *downloadState) close() error {
+	return s.f.Close()
+}
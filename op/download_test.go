@@ -0,0 +1,70 @@
+package op
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+
+	"github.com/flatcar/azure-vhd-utils/upload/uploadtest"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+)
+
+func TestDownloadRangesCountsAllFailures(t *testing.T) {
+	defer func(backoff time.Duration) { downloadRetryBackoff = backoff }(downloadRetryBackoff)
+	downloadRetryBackoff = 0
+
+	const rangeSize = 64 * 1024
+	data := uploadtest.NewData(16*rangeSize, 3, 0, 200, 1000, 2000)
+	client := uploadtest.NewPageBlobClient()
+	client.Preload(data, nil)
+	failing := map[int64]bool{2 * rangeSize: true, 7 * rangeSize: true, 13 * rangeSize: true}
+	client.Fault = func(ctx context.Context, method string, r blob.HTTPRange) error {
+		if method == uploadtest.MethodDownloadStream && failing[r.Offset] {
+			return uploadtest.NewResponseError(http.StatusInternalServerError, "InternalError")
+		}
+		return nil
+	}
+	ranges := common.ChunkRangesBySize([]*common.IndexRange{common.NewIndexRange(0, int64(len(data))-1)}, rangeSize)
+
+	for i := 0; i < 10; i++ {
+		dir := t.TempDir()
+		f, err := os.Create(filepath.Join(dir, "disk.vhd"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		statePath := filepath.Join(dir, "disk.vhd"+downloadStateSuffix)
+		state, err := createDownloadState(statePath, int64(len(data)), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = downloadRanges(context.Background(), client, f, ranges, state, 4, noopLogger, nil)
+		state.close()
+		if err == nil || !strings.HasPrefix(err.Error(), "3 ranges of the blob failed to download") {
+			t.Fatalf("got error %v, expected the 3 failed ranges", err)
+		}
+		if state, err = openDownloadState(statePath); err != nil {
+			t.Fatal(err)
+		}
+		state.close()
+		if len(state.completed) != len(ranges)-len(failing) {
+			t.Errorf("got %d ranges recorded as downloaded, expected %d", len(state.completed), len(ranges)-len(failing))
+		}
+		downloaded := make([]byte, len(data))
+		if _, err := f.ReadAt(downloaded, 0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		for _, r := range state.completed {
+			if !bytes.Equal(downloaded[r.Start:r.End+1], data[r.Start:r.End+1]) {
+				t.Errorf("the range %s of the file differs from the blob", r)
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package op
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/pageblob"
+
+	"github.com/flatcar/azure-vhd-utils/upload"
+)
+
+// customerProvidedKeySize is the size of the AES-256 keys the service
+// encrypts the blobs with, in bytes.
+const customerProvidedKeySize = 32
+
+// encryptedPageBlobClient is a PageBlobClient whose requests name the
+// encryption of the blob: the encryption scope of the writes, or the
+// customer-provided key of the writes and of the reads of the data
+// and the metadata. The service encrypts the blob with the scope or
+// the key given when it is created and rejects the writes naming
+// another one, so all of them name the same one. A blob encrypted
+// with a customer-provided key cannot be read without it either.
+type encryptedPageBlobClient struct {
+	upload.PageBlobClient
+	scope *blob.CPKScopeInfo // nil without an encryption scope
+	key   *blob.CPKInfo      // nil without a customer-provided key
+}
+
+// withEncryption returns a client writing to the blob of the given
+// client with the encryption scope or the customer-provided key of
+// the options, or the client itself if there is none.
+func withEncryption(client upload.PageBlobClient, opts *UploadOptions) (upload.PageBlobClient, error) {
+	if opts.EncryptionScope == "" && opts.CustomerProvidedKey == nil {
+		return client, nil
+	}
+	if opts.EncryptionScope != "" && opts.CustomerProvidedKey != nil {
+		return nil, errors.New("a blob cannot be encrypted with both an encryption scope and a customer-provided key")
+	}
+	c := &encryptedPageBlobClient{PageBlobClient: client}
+	if opts.EncryptionScope != "" {
+		scope := opts.EncryptionScope
+		c.scope = &blob.CPKScopeInfo{EncryptionScope: &scope}
+	}
+	if opts.CustomerProvidedKey != nil {
+		key, err := validateCustomerProvidedKey(opts.CustomerProvidedKey)
+		if err != nil {
+			return nil, err
+		}
+		c.key = key
+	}
+	return c, nil
+}
+
+// validateCustomerProvidedKey checks that the given customer-provided
+// key is a base64 encoded AES-256 key and returns a copy of it with
+// its SHA256 hash and its algorithm, if they were not given.
+func validateCustomerProvidedKey(cpk *blob.CPKInfo) (*blob.CPKInfo, error) {
+	if cpk.EncryptionKey == nil {
+		return nil, errors.New("the customer-provided key has no encryption key")
+	}
+	key, err := base64.StdEncoding.DecodeString(*cpk.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("the customer-provided key is not base64 encoded: %w", err)
+	}
+	if len(key) != customerProvidedKeySize {
+		return nil, fmt.Errorf("the customer-provided key must be an AES-256 key of %d bytes, got %d bytes", customerProvidedKeySize, len(key))
+	}
+	sum := sha256.Sum256(key)
+	hash := base64.StdEncoding.EncodeToString(sum[:])
+	if cpk.EncryptionKeySHA256 != nil && *cpk.EncryptionKeySHA256 != hash {
+		return nil, errors.New("the SHA256 hash of the customer-provided key does not match the key")
+	}
+	algorithm := blob.EncryptionAlgorithmTypeAES256
+	if cpk.EncryptionAlgorithm != nil && *cpk.EncryptionAlgorithm != algorithm {
+		return nil, fmt.Errorf("unsupported algorithm %q of the customer-provided key, expected %s", *cpk.EncryptionAlgorithm, algorithm)
+	}
+	encodedKey := *cpk.EncryptionKey
+	return &blob.CPKInfo{
+		EncryptionKey:       &encodedKey,
+		EncryptionKeySHA256: &hash,
+		EncryptionAlgorithm: &algorithm,
+	}, nil
+}
+
+func (c *encryptedPageBlobClient) Create(ctx context.Context, size int64, o *pageblob.CreateOptions) (pageblob.CreateResponse, error) {
+	options := pageblob.CreateOptions{}
+	if o != nil {
+		options = *o
+	}
+	options.CPKScopeInfo = c.scope
+	options.CPKInfo = c.key
+	return c.PageBlobClient.Create(ctx, size, &options)
+}
+
+func (c *encryptedPageBlobClient) UploadPages(ctx context.Context, body io.ReadSeekCloser, contentRange blob.HTTPRange, o *pageblob.UploadPagesOptions) (pageblob.UploadPagesResponse, error) {
+	options := pageblob.UploadPagesOptions{}
+	if o != nil {
+		options = *o
+	}
+	options.CPKScopeInfo = c.scope
+	options.CPKInfo = c.key
+	return c.PageBlobClient.UploadPages(ctx, body, contentRange, &options)
+}
+
+func (c *encryptedPageBlobClient) ClearPages(ctx context.Context, rnge blob.HTTPRange, o *pageblob.ClearPagesOptions) (pageblob.ClearPagesResponse, error) {
+	options := pageblob.ClearPagesOptions{}
+	if o != nil {
+		options = *o
+	}
+	options.CPKScopeInfo = c.scope
+	options.CPKInfo = c.key
+	return c.PageBlobClient.ClearPages(ctx, rnge, &options)
+}
+
+func (c *encryptedPageBlobClient) SetMetadata(ctx context.Context, metadata map[string]*string, o *blob.SetMetadataOptions) (blob.SetMetadataResponse, error) {
+	options := blob.SetMetadataOptions{}
+	if o != nil {
+		options = *o
+	}
+	options.CPKScopeInfo = c.scope
+	options.CPKInfo = c.key
+	return c.PageBlobClient.SetMetadata(ctx, metadata, &options)
+}
+
+func (c *encryptedPageBlobClient) GetProperties(ctx context.Context, o *blob.GetPropertiesOptions) (blob.GetPropertiesResponse, error) {
+	if c.key == nil {
+		return c.PageBlobClient.GetProperties(ctx, o)
+	}
+	options := blob.GetPropertiesOptions{}
+	if o != nil {
+		options = *o
+	}
+	options.CPKInfo = c.key
+	return c.PageBlobClient.GetProperties(ctx, &options)
+}
+
+func (c *encryptedPageBlobClient) DownloadStream(ctx context.Context, o *blob.DownloadStreamOptions) (blob.DownloadStreamResponse, error) {
+	if c.key == nil {
+		return c.PageBlobClient.DownloadStream(ctx, o)
+	}
+	options := blob.DownloadStreamOptions{}
+	if o != nil {
+		options = *o
+	}
+	options.CPKInfo = c.key
+	return c.PageBlobClient.DownloadStream(ctx, &options)
+}
+
+var _ upload.PageBlobClient = (*encryptedPageBlobClient)(nil)
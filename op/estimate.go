@@ -0,0 +1,66 @@
+package op
+
+import (
+	"runtime"
+
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+)
+
+// UploadEstimate describes what an upload of a local VHD would
+// write, as computed by EstimateUpload.
+type UploadEstimate struct {
+	// VHDSize is the size of the VHD as a fixed disk in bytes,
+	// which is the size of the page blob.
+	VHDSize int64 `json:"vhdSize"`
+	// UploadSize is the number of bytes which would be written to
+	// the page blob.
+	UploadSize int64 `json:"uploadSize"`
+	// Ranges are the ranges of the VHD which would be written.
+	Ranges []*common.IndexRange `json:"-"`
+}
+
+// EstimateUpload checks the local VHD at the path vhd and computes
+// the ranges an upload with the given options would write to a new
+// page blob, without contacting Azure. Only the options affecting
+// the local VHD and its ranges are used: the parent, the footer
+// overrides, the validation level, the start offset and the length,
+// the sparse threshold, the direct I/O, the low memory and the upload
+// block size ones. The ranges already in an existing blob are not
+// known, so a resume would upload less.
+func EstimateUpload(vhd string, opts *UploadOptions) (*UploadEstimate, error) {
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	pageSetSize, err := uploadPageSetSize(opts)
+	if err != nil {
+		return nil, err
+	}
+	scanParallelism := runtime.NumCPU()
+	if opts.LowMemory {
+		scanParallelism = 1
+	}
+	uploadLogger := newLogger(opts)
+	logger := infoFunc(uploadLogger)
+
+	diskStream, err := openLocalVHD(vhd, opts, warnFunc(uploadLogger))
+	if err != nil {
+		return nil, err
+	}
+	defer diskStream.Close()
+
+	vhdSize := diskStream.GetSize()
+	rangesToSkip, err := rangesOutsideSpan(opts.StartOffset, opts.Length, vhdSize)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges, err := locateRangesToUpload(diskStream, rangesToSkip, pageSetSize, scanParallelism, opts.SparseThreshold, false, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &UploadEstimate{
+		VHDSize:    vhdSize,
+		UploadSize: common.TotalRangeLength(ranges),
+		Ranges:     ranges,
+	}, nil
+}
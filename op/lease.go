@@ -0,0 +1,207 @@
+package op
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/lease"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/pageblob"
+
+	"github.com/flatcar/azure-vhd-utils/upload"
+)
+
+// The duration of the lease acquired on the blob with
+// UploadOptions.AcquireLease, the interval it is renewed at and the
+// time given to release it once the upload is over.
+const (
+	leaseDuration       = 60 * time.Second
+	leaseRenewInterval  = 20 * time.Second
+	leaseReleaseTimeout = 30 * time.Second
+)
+
+// blobLease is a lease on the blob being uploaded, renewed in the
+// background until it is released.
+type blobLease struct {
+	client *lease.BlobClient
+	ctx    context.Context
+	stop   context.CancelCauseFunc
+	done   chan struct{}
+}
+
+// acquireBlobLease acquires a lease on the existing blob of the given
+// client and renews it until released. The context of the lease,
+// derived from ctx, is cancelled if the lease could not be renewed
+// before it expired, the cause tells why.
+func acquireBlobLease(ctx context.Context, client upload.PageBlobClient, logger func(string)) (*blobLease, error) {
+	// The lease requests need no encryption scope or key
+	if encrypted, ok := client.(*encryptedPageBlobClient); ok {
+		client = encrypted.PageBlobClient
+	}
+	pageblobClient, ok := client.(*pageblob.Client)
+	if !ok {
+		return nil, errors.New("a lease can only be acquired on the blob of a page blob client of the Azure SDK")
+	}
+	leaseClient, err := lease.NewBlobClient(pageblobClient, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := leaseClient.AcquireLease(ctx, int32(leaseDuration/time.Second), nil); err != nil {
+		return nil, fmt.Errorf("failed to acquire a lease on the blob: %w", err)
+	}
+
+	leaseCtx, stop := context.WithCancelCause(ctx)
+	l := &blobLease{
+		client: leaseClient,
+		ctx:    leaseCtx,
+		stop:   stop,
+		done:   make(chan struct{}),
+	}
+	go l.renew(logger)
+	return l, nil
+}
+
+// renew renews the lease every leaseRenewInterval until it is
+// released. A failed renewal is retried on the next tick, unless the
+// lease would expire by then, the context of the lease is cancelled
+// then.
+func (l *blobLease) renew(logger func(string)) {
+	defer close(l.done)
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			_, err := l.client.RenewLease(l.ctx, nil)
+			if err == nil {
+				renewed = time.Now()
+				continue
+			}
+			if l.ctx.Err() != nil {
+				return
+			}
+			if time.Since(renewed)+leaseRenewInterval >= leaseDuration {
+				l.stop(fmt.Errorf("failed to renew the lease on the blob, the upload was aborted: %w", err))
+				return
+			}
+			logger(fmt.Sprintf("Failed to renew the lease on the blob, retrying in %s: %v", leaseRenewInterval, err))
+		case <-l.ctx.Done():
+			return
+		}
+	}
+}
+
+// err returns the reason the context of the lease was cancelled if
+// the lease was lost, otherwise err.
+func (l *blobLease) err(err error) error {
+	if cause := context.Cause(l.ctx); cause != nil && !errors.Is(cause, context.Canceled) && !errors.Is(cause, context.DeadlineExceeded) {
+		return cause
+	}
+	return err
+}
+
+// release stops renewing the lease and releases it, even if the
+// context of the upload was cancelled. A failure to release it is
+// only logged, the lease expires by itself.
+func (l *blobLease) release(logger func(string)) {
+	l.stop(nil)
+	<-l.done
+	ctx, cancel := context.WithTimeout(context.Background(), leaseReleaseTimeout)
+	defer cancel()
+	if _, err := l.client.ReleaseLease(ctx, nil); err != nil {
+		logger(fmt.Sprintf("Failed to release the lease on the blob, it expires in %s: %v", leaseDuration, err))
+	}
+}
+
+// leasedPageBlobClient is a PageBlobClient whose writes to the blob
+// carry the ID of the lease on the blob.
+type leasedPageBlobClient struct {
+	upload.PageBlobClient
+	leaseID *string
+}
+
+// withLease returns a client writing to the blob of the given client
+// with the given lease.
+func withLease(client upload.PageBlobClient, l *blobLease) upload.PageBlobClient {
+	return &leasedPageBlobClient{PageBlobClient: client, leaseID: l.client.LeaseID()}
+}
+
+// accessConditions returns a copy of the given access conditions
+// with the ID of the lease.
+func (c *leasedPageBlobClient) accessConditions(ac *blob.AccessConditions) *blob.AccessConditions {
+	conditions := blob.AccessConditions{}
+	if ac != nil {
+		conditions = *ac
+	}
+	conditions.LeaseAccessConditions = &blob.LeaseAccessConditions{LeaseID: c.leaseID}
+	return &conditions
+}
+
+func (c *leasedPageBlobClient) Create(ctx context.Context, size int64, o *pageblob.CreateOptions) (pageblob.CreateResponse, error) {
+	options := pageblob.CreateOptions{}
+	if o != nil {
+		options = *o
+	}
+	options.AccessConditions = c.accessConditions(options.AccessConditions)
+	return c.PageBlobClient.Create(ctx, size, &options)
+}
+
+func (c *leasedPageBlobClient) UploadPages(ctx context.Context, body io.ReadSeekCloser, contentRange blob.HTTPRange, o *pageblob.UploadPagesOptions) (pageblob.UploadPagesResponse, error) {
+	options := pageblob.UploadPagesOptions{}
+	if o != nil {
+		options = *o
+	}
+	options.AccessConditions = c.accessConditions(options.AccessConditions)
+	return c.PageBlobClient.UploadPages(ctx, body, contentRange, &options)
+}
+
+func (c *leasedPageBlobClient) ClearPages(ctx context.Context, rnge blob.HTTPRange, o *pageblob.ClearPagesOptions) (pageblob.ClearPagesResponse, error) {
+	options := pageblob.ClearPagesOptions{}
+	if o != nil {
+		options = *o
+	}
+	options.AccessConditions = c.accessConditions(options.AccessConditions)
+	return c.PageBlobClient.ClearPages(ctx, rnge, &options)
+}
+
+func (c *leasedPageBlobClient) SetMetadata(ctx context.Context, metadata map[string]*string, o *blob.SetMetadataOptions) (blob.SetMetadataResponse, error) {
+	options := blob.SetMetadataOptions{}
+	if o != nil {
+		options = *o
+	}
+	options.AccessConditions = c.accessConditions(options.AccessConditions)
+	return c.PageBlobClient.SetMetadata(ctx, metadata, &options)
+}
+
+func (c *leasedPageBlobClient) SetHTTPHeaders(ctx context.Context, HTTPHeaders blob.HTTPHeaders, o *blob.SetHTTPHeadersOptions) (blob.SetHTTPHeadersResponse, error) {
+	options := blob.SetHTTPHeadersOptions{}
+	if o != nil {
+		options = *o
+	}
+	options.AccessConditions = c.accessConditions(options.AccessConditions)
+	return c.PageBlobClient.SetHTTPHeaders(ctx, HTTPHeaders, &options)
+}
+
+func (c *leasedPageBlobClient) SetTags(ctx context.Context, tags map[string]string, o *blob.SetTagsOptions) (blob.SetTagsResponse, error) {
+	options := blob.SetTagsOptions{}
+	if o != nil {
+		options = *o
+	}
+	options.AccessConditions = c.accessConditions(options.AccessConditions)
+	return c.PageBlobClient.SetTags(ctx, tags, &options)
+}
+
+func (c *leasedPageBlobClient) UpdateSequenceNumber(ctx context.Context, o *pageblob.UpdateSequenceNumberOptions) (pageblob.UpdateSequenceNumberResponse, error) {
+	options := pageblob.UpdateSequenceNumberOptions{}
+	if o != nil {
+		options = *o
+	}
+	options.AccessConditions = c.accessConditions(options.AccessConditions)
+	return c.PageBlobClient.UpdateSequenceNumber(ctx, &options)
+}
+
+var _ upload.PageBlobClient = (*leasedPageBlobClient)(nil)
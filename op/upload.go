@@ -1,23 +1,31 @@
 package op
 
 import (
+	"bytes"
 	"context"
-	"encoding/base64"
+	"crypto/md5"
 	"errors"
 	"fmt"
+	"io"
+	"os"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/pageblob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
 	"github.com/coreos/pkg/multierror"
 
 	"github.com/flatcar/azure-vhd-utils/upload"
 	"github.com/flatcar/azure-vhd-utils/upload/metadata"
+	"github.com/flatcar/azure-vhd-utils/upload/progress"
+	"github.com/flatcar/azure-vhd-utils/vhdcore"
 	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
 	"github.com/flatcar/azure-vhd-utils/vhdcore/diskstream"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/footer"
 	"github.com/flatcar/azure-vhd-utils/vhdcore/validator"
 )
 
@@ -27,6 +35,19 @@ const (
 	MissingVHDSuffix Error = iota
 	BlobAlreadyExists
 	MissingUploadMetadata
+	OverwriteNotConfirmed
+	SameCopySourceAndDestination
+	VHDSizeMismatch
+	VHDMD5Mismatch
+	MissingBlobForStartOffset
+	BlobNotEmpty
+	BlobMD5Mismatch
+	ContainerNotFound
+	BlobBlockMismatch
+	BlobModifiedConcurrently
+	BlobDataMismatch
+	InvalidLocalVHD
+	UploadIncomplete
 )
 
 func (e Error) Error() string {
@@ -37,19 +58,41 @@ func (e Error) Error() string {
 		return "blob already exists"
 	case MissingUploadMetadata:
 		return "blob has no upload metadata"
+	case OverwriteNotConfirmed:
+		return "overwriting the blob was not confirmed"
+	case SameCopySourceAndDestination:
+		return "copy source and destination are the same blob"
+	case VHDSizeMismatch:
+		return "VHD size does not match the expected size"
+	case VHDMD5Mismatch:
+		return "VHD MD5 hash does not match the expected hash"
+	case MissingBlobForStartOffset:
+		return "blob to upload from the start offset does not exist"
+	case BlobNotEmpty:
+		return "created blob already has allocated pages"
+	case BlobMD5Mismatch:
+		return "MD5 hash stored in the blob properties does not match the hash of the VHD"
+	case ContainerNotFound:
+		return "container of the blob does not exist"
+	case BlobBlockMismatch:
+		return "data read back from the blob does not match the SHA256 digest of the uploaded data"
+	case BlobModifiedConcurrently:
+		return "blob was modified by another writer during the upload"
+	case BlobDataMismatch:
+		return "data read back from the blob does not match the local VHD"
+	case InvalidLocalVHD:
+		return "local VHD cannot be uploaded"
+	case UploadIncomplete:
+		return "upload of the VHD is incomplete"
 	default:
 		return "unknown upload error"
 	}
 }
 
 func ErrorIsAnyOf(err error, errs ...Error) bool {
-	var opError Error
-	if !errors.As(err, &opError) {
-		return false
-	}
-
+	// A classified error is both its error and its class
 	for _, e := range errs {
-		if opError == e {
+		if errors.Is(err, e) {
 			return true
 		}
 	}
@@ -57,113 +100,826 @@ func ErrorIsAnyOf(err error, errs ...Error) bool {
 	return false
 }
 
+// classifiedError is an error of an operation classified with an
+// Error, without changing its message: errors.Is reports both the
+// error and the class.
+type classifiedError struct {
+	err   error
+	class Error
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() []error {
+	return []error{e.err, e.class}
+}
+
+// classifyError returns err classified with class, or nil if err is
+// nil.
+func classifyError(err error, class Error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{err: err, class: class}
+}
+
 type UploadOptions struct {
 	Overwrite   bool
 	Parallelism int
-	Logger      func(string)
+	// Logger, if not nil, gets every message at its level, e.g.
+	// the retried writes and the pauses on throttling as
+	// warnings and the failed writes as errors. The structured
+	// details of a message, like the range and the attempts of a
+	// failed write, are formatted into it, unless the logger is
+	// an upload.FieldLogger. upload.NewFuncLogger adapts a
+	// func(string) to it.
+	Logger upload.Logger
+	// SkipExistenceCheck skips querying the destination blob
+	// before the upload. The caller guarantees that the blob
+	// does not exist yet, so no overwrite protection or resume
+	// is attempted and the blob is always created from scratch.
+	SkipExistenceCheck bool
+	// SparseThreshold, when greater than zero, enables skipping
+	// the all-zero pages of mostly empty ranges. A range whose
+	// fraction of zero pages is at least SparseThreshold is
+	// uploaded as the runs of its non-zero pages only.
+	SparseThreshold float64
+	// ConfirmOverwrite, if not nil, is called with the size and
+	// the last modification time of an existing blob before it
+	// is overwritten. Returning false aborts the upload with
+	// OverwriteNotConfirmed.
+	ConfirmOverwrite func(size int64, lastModified time.Time) bool
+	// MinThroughputMbps, when greater than zero, aborts the
+	// upload if the throughput, in megabits per second, stays
+	// below it for MinThroughputWindow.
+	MinThroughputMbps   float64
+	MinThroughputWindow time.Duration
+	// VerifyBlobSize checks that the size of the page blob, as
+	// reported by the service after creating it, is the size
+	// of the VHD before uploading anything.
+	VerifyBlobSize bool
+	// VerifyEmptyBlob checks that the page blob has no allocated
+	// pages right after creating it, failing with BlobNotEmpty
+	// otherwise. This catches another process writing to the
+	// same new blob.
+	VerifyEmptyBlob bool
+	// VerifyMD5 reads the blob properties back once the upload
+	// is finalized and fails with BlobMD5Mismatch if the MD5
+	// hash stored there is not the hash of the whole VHD,
+	// including the empty ranges skipped by the upload.
+	VerifyMD5 bool
+	// PerBlockChecksum computes the SHA256 digest of every range
+	// as it is written and, once all of them are uploaded, reads
+	// the ranges back from the blob and compares their digests
+	// before the upload is finalized. The upload fails with
+	// BlobBlockMismatch if any of them does not match, so the
+	// corruption of a single range is caught, unlike with the
+	// MD5 hash of the whole VHD which Azure does not check. The
+	// digests are returned in UploadResult.BlockChecksums for an
+	// audit, the blob metadata are too small to hold them. Only
+	// the ranges written by this run are verified, not the ones
+	// uploaded by a previous run of a resumed upload. Reading the
+	// data back doubles the traffic of the upload.
+	PerBlockChecksum bool
+	// VerifyAfterUpload reads the ranges of the blob holding the
+	// data of the VHD back once all of them are uploaded, with
+	// the parallelism of the upload, and compares them with the
+	// local VHD before the upload is finalized. The data of a
+	// dynamic or differencing VHD are read through its block
+	// allocation table, like for the upload, and the footer is
+	// compared too. Unlike PerBlockChecksum, the ranges uploaded
+	// by a previous run of a resumed upload are verified as well.
+	// The mismatching ranges are logged, cleared from the blob so
+	// resuming the upload writes them again, and the upload fails
+	// with BlobDataMismatch. Reading the data back doubles the
+	// traffic of the upload.
+	VerifyAfterUpload bool
+	// AcquireLease acquires a lease on the blob once it exists,
+	// before the first page is written, so no other writer can
+	// modify the blob during the upload. The lease is renewed
+	// periodically and released once the upload is over, even
+	// if it failed. The upload is aborted if the lease cannot be
+	// renewed before it expires. It requires the client of the
+	// blob to be a *pageblob.Client.
+	AcquireLease bool
+	// ConditionalWrites sets the sequence number of the blob to a
+	// random value once it exists and makes every page write
+	// conditional on it. Another upload of the blob with
+	// ConditionalWrites, or a writer replacing the blob, changes
+	// the sequence number, so the next write fails with a 412
+	// response and the upload aborts with an error wrapping
+	// BlobModifiedConcurrently instead of interleaving its pages
+	// with the other writer. The ETag cannot be used for this,
+	// it changes with every page written. Writers which do not
+	// touch the sequence number are not noticed, AcquireLease
+	// keeps them out.
+	ConditionalWrites bool
+	// BusyThreshold is the number of consecutive 503 Server Busy
+	// responses after which all the writes are paused for
+	// BusyCoolDown. They default to 5 and 30 seconds, a negative
+	// BusyThreshold disables the pausing.
+	BusyThreshold int
+	BusyCoolDown  time.Duration
+	// MaxRetriesPerBlock is the number of times a failed write
+	// is retried before the range is reported as failed, and
+	// RetryBackoff is the delay before the first retry, doubled
+	// for each next one up to 30 seconds. They default to 5 and
+	// 2 seconds, a negative value disables the retries or the
+	// delay.
+	MaxRetriesPerBlock int
+	RetryBackoff       time.Duration
+	// OperationTimeout is the time a single write of a range may
+	// take, it defaults to 2 minutes and a negative value
+	// disables it. A write taking longer is abandoned and retried
+	// like a failed one, the rest of the upload goes on.
+	OperationTimeout time.Duration
+	// MaxBytesPerSecond, when greater than zero, limits the
+	// bandwidth of the upload to that many bytes per second,
+	// across all the concurrent writes.
+	MaxBytesPerSecond int64
+	// ReadParallelism is the number of goroutines reading the
+	// ranges of the VHD ahead of the writes, each with its own
+	// handle to the VHD, it defaults to 1. More readers help when
+	// reading the disk is slower than writing to Azure.
+	ReadParallelism int
+	// QueueDepth is the number of ranges read ahead of the writes
+	// kept in a buffer while all the writes are busy, so the reads
+	// and the writes do not wait for each other. Every buffered
+	// range holds up to UploadBlockSize bytes of memory, zero
+	// buffers none.
+	QueueDepth int
+	// FooterOverrides, if not nil, replaces fields of the VHD
+	// footer written to the page blob.
+	FooterOverrides *diskstream.FooterOverrides
+	// Progress, if not nil, is called with a copy of every
+	// progress record of hashing, verifying and uploading the
+	// VHD, including the ranges being uploaded.
+	Progress upload.ProgressCallback
+	// QuietProgress skips printing the progress to the terminal,
+	// e.g. when Progress forwards it to a structured logger or a
+	// web UI instead.
+	QuietProgress bool
+	// ExpectedSize, when greater than zero, is the virtual size
+	// of the VHD in bytes, as recorded in a manifest of the
+	// built image. ExpectedMD5, if not empty, is the MD5 hash of
+	// the local VHD file. The upload fails with VHDSizeMismatch
+	// or VHDMD5Mismatch before sending anything if the local VHD
+	// does not match them.
+	ExpectedSize int64
+	ExpectedMD5  []byte
+	// NoFinalStatus skips printing the final 100% status line
+	// once the upload succeeded.
+	NoFinalStatus bool
+	// LogBlocks logs a line for every write of a range started,
+	// done or failed, with the attempt number, instead of
+	// printing the progress line, for troubleshooting.
+	LogBlocks bool
+	// ParentPath, if not empty, is the path to the parent VHD of
+	// a differencing disk, used instead of the path recorded in
+	// the disk. The whole chain is merged into a fixed VHD.
+	ParentPath string
+	// AdaptiveParallelism adapts the number of concurrent writes
+	// to the observed throughput and throttling, starting low
+	// and using Parallelism as the maximum.
+	AdaptiveParallelism bool
+	// MinParallelism and MaxParallelism, if greater than zero,
+	// bound the number of concurrent writes of the adaptive
+	// parallelism, they default to 1 and Parallelism.
+	MinParallelism int
+	MaxParallelism int
+	// StartOffset, when greater than zero, starts the upload at
+	// the given offset of the VHD, which must be a multiple of
+	// 512 bytes. The blob must exist already, the ranges before
+	// the offset are kept as they are in the blob and all the
+	// ranges of the VHD holding data from the offset on are
+	// uploaded again. It cannot be combined with Overwrite.
+	StartOffset int64
+	// Length, when greater than zero, limits the upload from
+	// StartOffset to the given number of bytes, a multiple of 512
+	// ending within the VHD. Like with StartOffset, the blob must
+	// exist already and the ranges out of the span are kept as
+	// they are in the blob, so only a part of the VHD is patched.
+	Length int64
+	// DirectIO reads the VHD bypassing the page cache of the
+	// operating system where supported, falling back to the
+	// regular reads elsewhere.
+	DirectIO bool
+	// DetectSourceChanges aborts the upload with an error
+	// wrapping diskstream.ErrSourceChanged if the size or the
+	// modification time of the VHD file changes while it is
+	// read, instead of uploading a mix of its old and new
+	// content, when the VHD is in use.
+	DetectSourceChanges bool
+	// LowMemory trades throughput for a small memory footprint,
+	// for huge disks on small machines: the ranges are uploaded
+	// in chunks of 1 MB instead of 4 MB, scanned for emptiness
+	// by a single goroutine and, unless Parallelism is set, by
+	// 2 concurrent writes.
+	LowMemory bool
+	// UploadBlockSize, if greater than zero, is the size of the
+	// chunks the ranges are written in, one UploadPages request
+	// each, instead of 4 MB, or 1 MB with LowMemory. It must be a
+	// multiple of 512 of at most 4 MB, the largest write to a
+	// page blob.
+	UploadBlockSize int64
+	// ValidationLevel is the strictness of the validation of
+	// the VHD footer before the upload, the problems accepted at
+	// the level are logged as warnings.
+	ValidationLevel validator.Level
+	// SkipValidation skips the validation of the cookies and
+	// checksums of the VHD footer and header before the upload,
+	// only its size is checked. A corrupted VHD is then only
+	// noticed when it cannot be read, if at all.
+	SkipValidation bool
+	// TrustExistingPages resumes the upload into an existing blob
+	// lacking the upload metadata, e.g. written by another tool
+	// or whose marker was cleared, if it has the size of the VHD.
+	// Nothing tells then whether the pages of the blob hold the
+	// data of the local VHD, they are trusted and only the
+	// ranges missing from the blob are uploaded.
+	TrustExistingPages bool
+	// Metadata are custom metadata stored on the page blob along
+	// the upload marker. The metadata of a resumed upload are
+	// kept, updated with these.
+	Metadata map[string]string
+	// Tags are the tags set on the page blob once the upload
+	// completed, replacing its existing tags.
+	Tags map[string]string
+	// AccessTier, if not nil, is the access tier the page blob is
+	// created with, one of the premium page blob tiers P4 to P80
+	// supported by the premium storage accounts. The tier of an
+	// existing blob the upload resumes into is left unchanged.
+	AccessTier *blob.AccessTier
+	// SkipContainerCreate does not create the container of the
+	// blob before the upload, which is done by default if it does
+	// not exist yet, the upload then fails with ContainerNotFound
+	// if it is missing. ContainerAccess, if not nil, is the public
+	// access level of the created container, which is private by
+	// default. The access level of an existing container is left
+	// unchanged.
+	SkipContainerCreate bool
+	ContainerAccess     *container.PublicAccessType
+	// EncryptionScope, if not empty, is the encryption scope the
+	// page blob is created with, encrypting it with the keys of
+	// the scope instead of the default ones of the account. The
+	// scope is named by every write to the blob too, the service
+	// rejects the writes naming another scope than the one of
+	// the blob, so the blob a resumed upload writes to must have
+	// been created with the same scope. It cannot be used with a
+	// managed disk.
+	EncryptionScope string
+	// CustomerProvidedKey, if not nil, is the AES-256 key the
+	// page blob is created and every page is encrypted with,
+	// instead of the keys of the account. The service keeps
+	// only the SHA256 hash of the key, computed if not given, so
+	// the same key is given to every write and read of the data
+	// and the metadata of the blob, including the reads of the
+	// verifications and of a resumed upload; the blob cannot be
+	// read without it afterwards. The key must be base64 encoded
+	// and the service only accepts it over HTTPS. It cannot be
+	// combined with EncryptionScope, nor used with a managed
+	// disk.
+	CustomerProvidedKey *blob.CPKInfo
+}
+
+// The number of concurrent writes and the size of the chunks the
+// ranges are uploaded in with UploadOptions.LowMemory.
+const (
+	lowMemoryParallelism       = 2
+	lowMemoryPageSetSize int64 = 1024 * 1024
+)
+
+// defaultOperationTimeout is the time a single write of a range may
+// take unless UploadOptions.OperationTimeout is set.
+const defaultOperationTimeout = 2 * time.Minute
+
+// maxUploadBlockSize is the largest body of a write to a page blob.
+const maxUploadBlockSize int64 = 4 * 1024 * 1024
+
+// uploadPageSetSize returns the size of the chunks the ranges are
+// written in with the given options.
+func uploadPageSetSize(opts *UploadOptions) (int64, error) {
+	const PageBlobPageSize int64 = 512
+
+	switch {
+	case opts.UploadBlockSize < 0, opts.UploadBlockSize > maxUploadBlockSize, opts.UploadBlockSize%PageBlobPageSize != 0:
+		return 0, fmt.Errorf("invalid upload block size %d, expected a multiple of %d of at most %d bytes", opts.UploadBlockSize, PageBlobPageSize, maxUploadBlockSize)
+	case opts.UploadBlockSize > 0:
+		return opts.UploadBlockSize, nil
+	case opts.LowMemory:
+		return lowMemoryPageSetSize, nil
+	}
+	return maxUploadBlockSize, nil
+}
+
+// UploadResult describes a completed upload.
+type UploadResult struct {
+	// Parallelism is the number of concurrent writes used, the
+	// level converged on with AdaptiveParallelism.
+	Parallelism int `json:"parallelism"`
+	// BytesUploaded is the number of bytes written to the page
+	// blob by this run, without the ranges skipped as empty or
+	// uploaded by a previous run.
+	BytesUploaded int64 `json:"bytesUploaded"`
+	// TotalLogicalBytes is the size of the VHD as a fixed disk,
+	// which is the size of the page blob.
+	TotalLogicalBytes int64 `json:"totalLogicalBytes"`
+	// BlocksUploaded is the number of ranges written, of at most
+	// 4 MB each, and BlocksRetried the number of them whose write
+	// failed at least once before succeeding.
+	BlocksUploaded int `json:"blocksUploaded"`
+	BlocksRetried  int `json:"blocksRetried"`
+	// Duration is the time spent writing the data, in
+	// nanoseconds in JSON, and AverageThroughputMbps the average
+	// throughput over it in megabits per second.
+	Duration              time.Duration `json:"duration"`
+	AverageThroughputMbps float64       `json:"averageThroughputMbps"`
+	// BlockChecksums are the SHA256 digests of the ranges written
+	// and verified with PerBlockChecksum, sorted by offset.
+	BlockChecksums []BlockChecksum `json:"blockChecksums,omitempty"`
+	// WorkerStats are the counters of the writes handled by each
+	// worker, sorted by worker ID, to tell whether one of them was
+	// starved or failing more than the others.
+	WorkerStats []WorkerStats `json:"workerStats,omitempty"`
+}
+
+// WorkerStats are the counters of the writes handled by a worker
+// of an upload.
+type WorkerStats struct {
+	// ID identifies the worker, from 0 to the parallelism.
+	ID int `json:"id"`
+	// Requests is the number of ranges the worker handled, written
+	// or failed, Retries the number of times it wrote a range
+	// again after a failure and Failures the number of ranges it
+	// failed to write after all the retries.
+	Requests int `json:"requests"`
+	Retries  int `json:"retries"`
+	Failures int `json:"failures"`
+	// BytesUploaded is the number of bytes of the ranges the
+	// worker wrote.
+	BytesUploaded int64 `json:"bytesUploaded"`
+	// BusyTime is the time the worker spent writing, in
+	// nanoseconds in JSON, without the delays between retries.
+	BusyTime time.Duration `json:"busyTime"`
+}
+
+// newUploadResult returns the result of an upload of a VHD of
+// totalBytes bytes whose data was written as in the given result.
+func newUploadResult(result *upload.Result, totalBytes int64) *UploadResult {
+	r := &UploadResult{
+		Parallelism:       result.Parallelism,
+		BytesUploaded:     result.BytesUploaded,
+		TotalLogicalBytes: totalBytes,
+		BlocksUploaded:    result.BlocksUploaded,
+		BlocksRetried:     result.BlocksRetried,
+		Duration:          result.Duration,
+	}
+	if seconds := result.Duration.Seconds(); seconds > 0 {
+		r.AverageThroughputMbps = 8 * float64(result.BytesUploaded) / oneMB / seconds
+	}
+	for _, s := range result.WorkerStats {
+		r.WorkerStats = append(r.WorkerStats, WorkerStats{
+			ID:            s.ID,
+			Requests:      s.Requests,
+			Retries:       s.Retries,
+			Failures:      s.Failures,
+			BytesUploaded: s.Bytes,
+			BusyTime:      s.BusyTime,
+		})
+	}
+	return r
 }
 
 func noopLogger(s string) {
 }
 
-func Upload(ctx context.Context, blobServiceClient *service.Client, container, blob, vhd string, opts *UploadOptions) error {
+// newLogger returns the logger of the options, one discarding the
+// messages if it is nil.
+func newLogger(opts *UploadOptions) upload.Logger {
+	if opts.Logger == nil {
+		return upload.NewFuncLogger(noopLogger)
+	}
+	return opts.Logger
+}
+
+// infoFunc returns a function logging the messages to logger at the
+// info level.
+func infoFunc(logger upload.Logger) func(string) {
+	return func(s string) {
+		logger.Infof("%s", s)
+	}
+}
+
+// warnFunc returns a function logging the messages to logger at the
+// warning level.
+func warnFunc(logger upload.Logger) func(string) {
+	return func(s string) {
+		logger.Warnf("%s", s)
+	}
+}
+
+func Upload(ctx context.Context, blobServiceClient *service.Client, containerName, blobName, vhd string, opts *UploadOptions) (*UploadResult, error) {
+	containerClient := blobServiceClient.NewContainerClient(containerName)
+	var createContainer func(ctx context.Context) error
+	if opts == nil || !opts.SkipContainerCreate {
+		createContainer = func(ctx context.Context) error {
+			var access *container.PublicAccessType
+			if opts != nil {
+				access = opts.ContainerAccess
+			}
+			_, err := containerClient.Create(ctx, &container.CreateOptions{Access: access})
+			if err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists, bloberror.ResourceAlreadyExists) {
+				return err
+			}
+			return nil
+		}
+	}
+	return uploadToPageBlob(ctx, containerClient.NewPageBlobClient(blobName), createContainer, blobName, vhd, opts)
+}
+
+// UploadToPageBlob uploads the VHD like Upload does, to the page blob
+// represented by the given client, which can be a fake one. The
+// container of the blob is expected to exist, it is not created. The blob name is only checked for the .vhd suffix and
+// used in the logs.
+func UploadToPageBlob(ctx context.Context, pageblobClient upload.PageBlobClient, blobName, vhd string, opts *UploadOptions) (*UploadResult, error) {
+	return uploadToPageBlob(ctx, pageblobClient, nil, blobName, vhd, opts)
+}
+
+// uploadToPageBlob implements Upload and UploadToPageBlob, the
+// container is created with createContainer, if not nil, only once
+// the local VHD was checked.
+func uploadToPageBlob(ctx context.Context, pageblobClient upload.PageBlobClient, createContainer func(context.Context) error, blobName, vhd string, opts *UploadOptions) (*UploadResult, error) {
 	const PageBlobPageSize int64 = 512
-	const PageBlobPageSetSize int64 = 4 * 1024 * 1024
 
-	if !strings.HasSuffix(strings.ToLower(blob), ".vhd") {
-		return MissingVHDSuffix
+	if !strings.HasSuffix(strings.ToLower(blobName), ".vhd") {
+		return nil, MissingVHDSuffix
 	}
 
 	if opts == nil {
 		opts = &UploadOptions{}
 	}
+	pageblobClient, err := withEncryption(pageblobClient, opts)
+	if err != nil {
+		return nil, err
+	}
 
+	pageSetSize, err := uploadPageSetSize(opts)
+	if err != nil {
+		return nil, err
+	}
 	parallelism := 8 * runtime.NumCPU()
+	scanParallelism := runtime.NumCPU()
+	if opts.LowMemory {
+		parallelism = lowMemoryParallelism
+		scanParallelism = 1
+	}
 	if opts.Parallelism > 0 {
 		parallelism = opts.Parallelism
 	}
+	minParallelism := 1
+	if opts.AdaptiveParallelism {
+		if opts.MaxParallelism > 0 {
+			parallelism = opts.MaxParallelism
+		}
+		if opts.MinParallelism > 0 {
+			minParallelism = opts.MinParallelism
+		}
+		if minParallelism > parallelism {
+			return nil, fmt.Errorf("the minimum parallelism %d is above the maximum parallelism %d", minParallelism, parallelism)
+		}
+	}
 	overwrite := opts.Overwrite
-	logger := noopLogger
-	if opts.Logger != nil {
-		logger = opts.Logger
+	busyThreshold := 5
+	if opts.BusyThreshold != 0 {
+		busyThreshold = opts.BusyThreshold
+	}
+	busyCoolDown := 30 * time.Second
+	if opts.BusyCoolDown > 0 {
+		busyCoolDown = opts.BusyCoolDown
 	}
+	retryBackoff := 2 * time.Second
+	if opts.RetryBackoff != 0 {
+		retryBackoff = opts.RetryBackoff
+	}
+	operationTimeout := defaultOperationTimeout
+	if opts.OperationTimeout != 0 {
+		operationTimeout = opts.OperationTimeout
+	}
+	uploadLogger := newLogger(opts)
+	logger := infoFunc(uploadLogger)
 
-	if err := ensureVHDSanity(vhd); err != nil {
-		return err
+	if err := validateBlobMetadata(opts.Metadata); err != nil {
+		return nil, err
+	}
+	if err := validateBlobTags(opts.Tags); err != nil {
+		return nil, err
+	}
+	if err := validateAccessTier(opts.AccessTier); err != nil {
+		return nil, err
+	}
+	if opts.ContainerAccess != nil && opts.SkipContainerCreate {
+		return nil, errors.New("a container access level requires creating the container")
 	}
 
-	diskStream, err := diskstream.CreateNewDiskStream(vhd)
+	diskStream, err := openLocalVHD(vhd, opts, warnFunc(uploadLogger))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer diskStream.Close()
 
-	containerClient := blobServiceClient.NewContainerClient(container)
-	pageblobClient := containerClient.NewPageBlobClient(blob)
-	blobClient := pageblobClient.BlobClient()
+	startOffset := opts.StartOffset
+	keptRanges, err := rangesOutsideSpan(startOffset, opts.Length, diskStream.GetSize())
+	if err != nil {
+		return nil, err
+	}
+	// Only a part of the VHD is uploaded into the existing blob
+	partial := len(keptRanges) > 0
+	if partial {
+		if overwrite {
+			return nil, errors.New("a start offset or a length cannot be combined with overwriting the blob")
+		}
+		if opts.SkipExistenceCheck {
+			return nil, errors.New("a start offset or a length cannot be combined with skipping the existence check")
+		}
+	}
+
+	// The progress of hashing and verifying the VHD is reported
+	// the same way as the progress of the upload.
+	if err := verifyExpectedVHD(vhd, diskStream, opts.ExpectedSize, opts.ExpectedMD5, opts.Progress, opts.QuietProgress); err != nil {
+		return nil, err
+	}
 
-	_, err = containerClient.Create(ctx, nil)
-	if err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists, bloberror.ResourceAlreadyExists) {
-		return err
+	if createContainer != nil {
+		if err := createContainer(ctx); err != nil {
+			return nil, err
+		}
 	}
 
-	blobExists := true
-	blobProperties, err := blobClient.GetProperties(ctx, nil)
-	if err != nil {
-		if !bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ResourceNotFound) {
-			return err
+	blobExists := false
+	var blobProperties blob.GetPropertiesResponse
+	if !opts.SkipExistenceCheck {
+		blobExists = true
+		blobProperties, err = pageblobClient.GetProperties(ctx, nil)
+		if err != nil {
+			if bloberror.HasCode(err, bloberror.ContainerNotFound) {
+				return nil, ContainerNotFound
+			}
+			if !bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ResourceNotFound) {
+				return nil, err
+			}
+			blobExists = false
 		}
-		blobExists = false
 	}
 
 	resume := false
 	var blobMetaData *metadata.MetaData
 	if blobExists {
-		if !overwrite {
+		if overwrite {
+			if opts.ConfirmOverwrite != nil {
+				var size int64
+				var lastModified time.Time
+				if blobProperties.ContentLength != nil {
+					size = *blobProperties.ContentLength
+				}
+				if blobProperties.LastModified != nil {
+					lastModified = *blobProperties.LastModified
+				}
+				if !opts.ConfirmOverwrite(size, lastModified) {
+					return nil, OverwriteNotConfirmed
+				}
+			}
+			logger(fmt.Sprintf("Blob with name '%s' already exists, it will be overwritten", blobName))
+		} else if partial {
+			// The metadata, if any, is checked, but the blob
+			// may lack it or even be complete already.
+			blobMetaData, err = metadata.NewMetadataFromBlobMetadata(blobProperties.Metadata)
+			if err != nil {
+				return nil, err
+			}
+			if blobProperties.ContentLength == nil || *blobProperties.ContentLength != diskStream.GetSize() {
+				return nil, fmt.Errorf("the blob size does not match the VHD size of %d bytes, the upload cannot start at an offset", diskStream.GetSize())
+			}
+			resume = true
+			if opts.Length > 0 {
+				logger(fmt.Sprintf("Blob with name '%s' already exists, uploading %d bytes from offset %d", blobName, opts.Length, startOffset))
+			} else {
+				logger(fmt.Sprintf("Blob with name '%s' already exists, uploading from offset %d", blobName, startOffset))
+			}
+		} else {
 			if len(blobProperties.ContentMD5) > 0 {
-				return BlobAlreadyExists
+				return nil, BlobAlreadyExists
 			}
 			blobMetaData, err = metadata.NewMetadataFromBlobMetadata(blobProperties.Metadata)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			if blobMetaData == nil {
-				return MissingUploadMetadata
+				if !opts.TrustExistingPages {
+					return nil, MissingUploadMetadata
+				}
+				if blobProperties.ContentLength == nil || *blobProperties.ContentLength != diskStream.GetSize() {
+					return nil, fmt.Errorf("the blob size does not match the VHD size of %d bytes, the upload cannot be resumed", diskStream.GetSize())
+				}
+				logger(fmt.Sprintf("Blob with name '%s' already exists without upload metadata, trusting its pages", blobName))
+			} else {
+				logger(fmt.Sprintf("Blob with name '%s' already exists, checking upload can be resumed", blobName))
 			}
+			resume = true
+		}
+	} else if partial {
+		return nil, MissingBlobForStartOffset
+	}
+	if resume && opts.FooterOverrides != nil && opts.FooterOverrides.UniqueID != nil {
+		// The footer may have been uploaded already, with another unique id
+		return nil, errors.New("a new unique id cannot be written to the footer of a blob uploaded before, overwrite the blob instead")
+	}
+
+	// The lease, if asked for, is held from the time the blob
+	// exists until the upload is over.
+	var blobLease *blobLease
+	defer func() {
+		if blobLease != nil {
+			blobLease.release(logger)
+		}
+	}()
+	// The conditional writes, if asked for, start once the blob
+	// exists, after the lease which setting the sequence number
+	// needs.
+	var conditional *conditionalPageBlobClient
+	startConditionalWrites := func() error {
+		if !opts.ConditionalWrites {
+			return nil
+		}
+		c, err := claimBlob(ctx, pageblobClient)
+		if err != nil {
+			return err
+		}
+		conditional = c
+		ctx = c.ctx
+		pageblobClient = c
+		return nil
+	}
+	startLease := func() error {
+		if !opts.AcquireLease {
+			return nil
+		}
+		l, err := acquireBlobLease(ctx, pageblobClient, warnFunc(uploadLogger))
+		if err != nil {
+			return err
+		}
+		blobLease = l
+		ctx = l.ctx
+		pageblobClient = withLease(pageblobClient, l)
+		logger(fmt.Sprintf("Acquired a lease on the blob '%s'", blobName))
+		return nil
+	}
+	if resume {
+		if err := startLease(); err != nil {
+			return nil, err
+		}
+		if err := startConditionalWrites(); err != nil {
+			return nil, err
 		}
-		resume = true
-		logger(fmt.Sprintf("Blob with name '%s' already exists, checking upload can be resumed", blob))
 	}
 
-	localMetaData, err := getLocalVHDMetaData(vhd)
+	// An upload which got all its data in the blob before it
+	// died only needs to be finalized. The hash recorded with
+	// the marker is trusted, the other metadata tell whether
+	// the local VHD is the one uploaded.
+	dataComplete := resume && !partial && blobMetaData != nil &&
+		blobMetaData.FileMetaData.DataComplete && len(blobMetaData.FileMetaData.MD5Hash) > 0
+
+	// The MD5 hash of the VHD is computed while uploading it. A
+	// resumed upload does not read the ranges uploaded before,
+	// so in that case the hash is computed up front instead.
+	localMetaData, err := getLocalVHDMetaData(vhd, diskStream, resume && !dataComplete, opts.Progress, opts.QuietProgress)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var rangesToSkip []*common.IndexRange
+	// The custom metadata of the blob, kept along the marker
+	var customMetadata map[string]*string
 	if resume {
+		customMetadata = customBlobMetadata(blobProperties.Metadata, opts.Metadata)
+	} else {
+		customMetadata = customBlobMetadata(nil, opts.Metadata)
+	}
+
+	if dataComplete {
+		localMetaData.FileMetaData.MD5Hash = blobMetaData.FileMetaData.MD5Hash
 		if errs := metadata.CompareMetaData(blobMetaData, localMetaData); len(errs) > 0 {
-			return multierror.Error(errs)
+			return nil, multierror.Error(errs)
 		}
-		ranges, err := getAlreadyUploadedBlobRanges(ctx, pageblobClient)
-		if err != nil {
-			return err
+		logger(fmt.Sprintf("All the data of the blob '%s' was already uploaded, finalizing the upload", blobName))
+		if len(opts.Metadata) > 0 {
+			localMetaData.FileMetaData.DataComplete = true
+			if err := setBlobMetaData(ctx, pageblobClient, localMetaData, customMetadata); err != nil {
+				return nil, err
+			}
+		}
+		if err := setBlobMD5Hash(ctx, pageblobClient, localMetaData); err != nil {
+			return nil, err
+		}
+		if opts.VerifyMD5 {
+			if err := verifyBlobMD5Hash(ctx, pageblobClient, localMetaData); err != nil {
+				return nil, err
+			}
+		}
+		if err := setBlobTags(ctx, pageblobClient, opts.Tags); err != nil {
+			return nil, err
+		}
+		if opts.Progress != nil {
+			opts.Progress(progress.Record{
+				Phase:           progress.PhaseUploading,
+				PercentComplete: 100,
+				BytesProcessed:  diskStream.GetSize(),
+			})
+		}
+		logger("Upload completed")
+		return &UploadResult{
+			Parallelism:       parallelism,
+			TotalLogicalBytes: diskStream.GetSize(),
+		}, nil
+	}
+
+	blobSize := diskStream.GetSize()
+	var rangesToSkip []*common.IndexRange
+	if resume {
+		if blobMetaData != nil {
+			if errs := metadata.CompareMetaData(blobMetaData, localMetaData); len(errs) > 0 {
+				return nil, multierror.Error(errs)
+			}
+		} else if !partial {
+			// From now on a rerun resumes like any other upload
+			if err := setBlobMetaData(ctx, pageblobClient, localMetaData, customMetadata); err != nil {
+				return nil, err
+			}
+		}
+		if partial {
+			rangesToSkip = keptRanges
+		} else {
+			ranges, err := getAlreadyUploadedBlobRanges(ctx, pageblobClient)
+			if err != nil {
+				return nil, err
+			}
+			rangesToSkip = ranges
+		}
+		if blobProperties.ContentLength != nil {
+			blobSize = *blobProperties.ContentLength
+		}
+		if opts.AccessTier != nil {
+			logger(fmt.Sprintf("Resuming into the existing blob '%s', its access tier is left unchanged", blobName))
 		}
-		rangesToSkip = ranges
 	} else {
-		if err := createBlob(ctx, pageblobClient, diskStream.GetSize(), localMetaData); err != nil {
-			return err
+		if opts.AccessTier != nil {
+			if err := checkAccessTierAccount(ctx, pageblobClient, opts.AccessTier, warnFunc(uploadLogger)); err != nil {
+				return nil, err
+			}
+		}
+		// The page blob is created (or replaced, when
+		// overwriting) once with its final size, the upload
+		// below only writes pages into it.
+		if err := createBlob(ctx, pageblobClient, blobSize, localMetaData, customMetadata, opts.AccessTier); err != nil {
+			return nil, err
+		}
+		if err := startLease(); err != nil {
+			return nil, err
+		}
+		if err := startConditionalWrites(); err != nil {
+			return nil, err
+		}
+		if opts.VerifyBlobSize {
+			if err := verifyBlobSize(ctx, pageblobClient, blobSize); err != nil {
+				return nil, err
+			}
+		}
+		if opts.VerifyEmptyBlob {
+			if err := verifyEmptyBlob(ctx, pageblobClient); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	uploadableRanges, err := upload.LocateUploadableRanges(diskStream, rangesToSkip, PageBlobPageSize, PageBlobPageSetSize)
+	uploadableRanges, err := locateRangesToUpload(diskStream, rangesToSkip, pageSetSize, scanParallelism, opts.SparseThreshold, opts.QuietProgress, logger)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	uploadableRanges, err = upload.DetectEmptyRanges(diskStream, uploadableRanges)
-	if err != nil {
-		return err
+	if err := upload.EnsureRangesWithinBlob(uploadableRanges, blobSize); err != nil {
+		return nil, err
+	}
+
+	// The ranges skipped as empty are expected to read as zeros
+	// from the blob. A partial upload writes into the existing
+	// blob, which may hold the data of another upload, so the
+	// stale pages there are cleared. An overwritten blob was
+	// created anew above, it has no page yet.
+	if partial {
+		if err := clearStaleBlobRanges(ctx, pageblobClient, uploadableRanges, keptRanges, logger); err != nil {
+			return nil, err
+		}
 	}
 
 	uploadContext := &upload.DiskUploadContext{
@@ -173,36 +929,253 @@ func Upload(ctx context.Context, blobServiceClient *service.Client, container, b
 		PageblobClient:        pageblobClient,
 		Parallelism:           parallelism,
 		Resume:                resume,
+		MinThroughputMbps:     opts.MinThroughputMbps,
+		MinThroughputWindow:   opts.MinThroughputWindow,
+		Logger:                uploadLogger,
+		BusyThreshold:         busyThreshold,
+		BusyCoolDown:          busyCoolDown,
+		Progress:              opts.Progress,
+		QuietProgress:         opts.QuietProgress,
+		NoFinalStatus:         opts.NoFinalStatus,
+		LogBlocks:             opts.LogBlocks,
+		AdaptiveParallelism:   opts.AdaptiveParallelism,
+		MinParallelism:        minParallelism,
+		MaxRetriesPerBlock:    opts.MaxRetriesPerBlock,
+		RetryBackoff:          retryBackoff,
+		OperationTimeout:      operationTimeout,
+		MaxBytesPerSecond:     opts.MaxBytesPerSecond,
+		ReadParallelism:       opts.ReadParallelism,
+		QueueDepth:            opts.QueueDepth,
+	}
+	if !resume {
+		uploadContext.Hash = md5.New()
+	}
+	if opts.PerBlockChecksum {
+		uploadContext.BlockDigests = upload.NewBlockDigests()
 	}
 
-	err = upload.Upload(ctx, uploadContext)
+	result, err := upload.Upload(ctx, uploadContext)
 	if err != nil {
-		return err
+		if blobLease != nil {
+			err = blobLease.err(err)
+		}
+		if conditional != nil {
+			err = conditional.err(err)
+		}
+		return nil, classifyError(err, UploadIncomplete)
+	}
+	var blockDigests []upload.BlockDigest
+	if uploadContext.BlockDigests != nil {
+		// The blob is finalized only once its data is known to be right
+		blockDigests = uploadContext.BlockDigests.Digests()
+		if err := checkBlockDigests(ctx, pageblobClient, blockDigests, parallelism, true, logger); err != nil {
+			return nil, err
+		}
+	}
+	if opts.VerifyAfterUpload {
+		if partial {
+			// The pages out of the span were not written by
+			// this run, the blob is finalized below only if
+			// all of it matches the local VHD. The mismatching
+			// pages out of the span are only reported.
+			wholeBlob := common.ChunkRangesBySize([]*common.IndexRange{common.NewIndexRange(0, blobSize-1)}, pageSetSize)
+			if err := checkUploadedRanges(ctx, pageblobClient, diskStream, wholeBlob, parallelism, false, logger); err != nil {
+				return nil, err
+			}
+		} else {
+			verifiedRanges := rangesToVerify(uploadableRanges, rangesToSkip, pageSetSize)
+			if err := checkUploadedRanges(ctx, pageblobClient, diskStream, verifiedRanges, parallelism, true, logger); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	if err := setBlobMD5Hash(ctx, blobClient, localMetaData); err != nil {
-		return err
+	if uploadContext.Hash != nil {
+		localMetaData.FileMetaData.MD5Hash = uploadContext.Hash.Sum(nil)
+	}
+	uploadResult := newUploadResult(result, diskStream.GetSize())
+	if blockDigests != nil {
+		uploadResult.BlockChecksums = newBlockChecksums(blockDigests)
+	}
+	if partial && !opts.VerifyAfterUpload {
+		// Nothing tells that the pages out of the span hold the
+		// data of the local VHD, so the blob is not marked as
+		// complete and its MD5 hash, if any, no longer holds.
+		// Resuming the whole upload finalizes it.
+		if err := setBlobMetaData(ctx, pageblobClient, localMetaData, customMetadata); err != nil {
+			return nil, err
+		}
+		if len(blobProperties.ContentMD5) > 0 {
+			if err := clearBlobMD5Hash(ctx, pageblobClient); err != nil {
+				return nil, err
+			}
+		}
+		logger(fmt.Sprintf("Uploaded the span of the VHD into the blob '%s', the blob is not finalized since the rest of it was not checked, rerun the whole upload, or the partial one verifying the blob after the upload, to finalize it", blobName))
+		return uploadResult, nil
+	}
+	// The metadata stored on the blob when it was created lacks
+	// the MD5 hash if it was computed while uploading, and the
+	// marker of the complete data, which is set before the
+	// upload is finalized.
+	localMetaData.FileMetaData.DataComplete = true
+	if err := setBlobMetaData(ctx, pageblobClient, localMetaData, customMetadata); err != nil {
+		return nil, err
+	}
+	if err := setBlobMD5Hash(ctx, pageblobClient, localMetaData); err != nil {
+		return nil, err
+	}
+	if opts.VerifyMD5 {
+		if err := verifyBlobMD5Hash(ctx, pageblobClient, localMetaData); err != nil {
+			return nil, err
+		}
+	}
+	if err := setBlobTags(ctx, pageblobClient, opts.Tags); err != nil {
+		return nil, err
 	}
 	logger("Upload completed")
-	return nil
+	return uploadResult, nil
 }
 
-// ensureVHDSanity ensure is VHD is valid for Azure.
-func ensureVHDSanity(vhd string) error {
-	if err := validator.ValidateVhd(vhd); err != nil {
+// openLocalVHD validates the local VHD at the level and with the
+// parent of the options, logging the problems accepted at the level
+// with warn, and opens a stream reading it as the fixed VHD to
+// upload.
+func openLocalVHD(vhd string, opts *UploadOptions, warn func(string)) (*diskstream.DiskStream, error) {
+	validatorOpts := &validator.Options{
+		ParentPath: opts.ParentPath,
+		Level:      opts.ValidationLevel,
+		Warn:       warn,
+	}
+	if err := ensureVHDSanity(vhd, validatorOpts, opts.SkipValidation); err != nil {
+		return nil, classifyError(err, InvalidLocalVHD)
+	}
+
+	diskStream, err := diskstream.CreateNewDiskStreamWithOptions(vhd, &diskstream.Options{
+		FooterOverrides:     opts.FooterOverrides,
+		ParentPath:          opts.ParentPath,
+		DirectIO:            opts.DirectIO,
+		DetectChanges:       opts.DetectSourceChanges,
+		AllowCookieVariants: opts.ValidationLevel == validator.LevelLenient,
+	})
+	return diskStream, classifyError(err, InvalidLocalVHD)
+}
+
+// locateRangesToUpload returns the ranges of the VHD read by the
+// disk stream to upload in chunks of at most pageSetSize bytes: the
+// ranges with data, without rangesToSkip and without the ranges
+// holding only zeros, found by scanParallelism goroutines. The zero
+// pages of the ranges with at least sparseThreshold of them are
+// skipped too, if the threshold is greater than zero. If quiet is
+// true, the progress of the scan is not printed.
+func locateRangesToUpload(diskStream *diskstream.DiskStream, rangesToSkip []*common.IndexRange, pageSetSize int64, scanParallelism int, sparseThreshold float64, quiet bool, logger func(string)) ([]*common.IndexRange, error) {
+	const PageBlobPageSize int64 = 512
+
+	uploadableRanges, err := upload.LocateUploadableRanges(diskStream, rangesToSkip, PageBlobPageSize, pageSetSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if diskStream.GetDiskType() != footer.DiskTypeFixed {
+		logger("Using the block allocation table of the VHD to find its data, skipping the scan for empty ranges")
+	}
+	uploadableRanges, err = upload.DetectEmptyRangesWithParallelism(diskStream, uploadableRanges, scanParallelism, quiet)
+	if err != nil {
+		return nil, err
+	}
+
+	if sparseThreshold > 0 {
+		logger(fmt.Sprintf("Skipping zero pages of ranges with at least %.0f%% zero pages, this relies on the unwritten pages of the page blob reading as zeros", sparseThreshold*100))
+		uploadableRanges, err = upload.MinimizeSparseRanges(diskStream, uploadableRanges, PageBlobPageSize, sparseThreshold, quiet)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return uploadableRanges, nil
+}
+
+// ensureVHDSanity ensure is VHD is valid for Azure, only its size is
+// checked if skipValidation is true. A file which is not a VHD at all
+// is always rejected first.
+func ensureVHDSanity(vhd string, opts *validator.Options, skipValidation bool) error {
+	if err := validator.CheckVhdFile(vhd, skipValidation || opts.Level == validator.LevelLenient); err != nil {
 		return err
 	}
 
-	if err := validator.ValidateVhdSize(vhd); err != nil {
+	if !skipValidation {
+		if err := validator.ValidateVhdWithOptions(vhd, opts); err != nil {
+			return err
+		}
+	}
+
+	if err := validator.ValidateVhdSizeWithOptions(vhd, opts); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// getLocalVHDMetaData returns the metadata of a local VHD
-func getLocalVHDMetaData(vhd string) (*metadata.MetaData, error) {
-	localMetaData, err := metadata.NewMetaDataFromLocalVHD(vhd)
+// verifyExpectedVHD checks that the virtual size of the VHD read by
+// the given disk stream is expectedSize, unless it is zero, and that
+// the MD5 hash of the VHD file is expectedMD5, unless it is empty.
+// The progress of reading the VHD file is printed and passed to the
+// callback.
+func verifyExpectedVHD(vhd string, diskStream *diskstream.DiskStream, expectedSize int64, expectedMD5 []byte, callback upload.ProgressCallback, quiet bool) error {
+	if expectedSize > 0 {
+		size := diskStream.GetSize() - vhdcore.VhdFooterSize
+		if size != expectedSize {
+			return fmt.Errorf("%w: expected %d bytes, got %d bytes", VHDSizeMismatch, expectedSize, size)
+		}
+	}
+
+	if len(expectedMD5) > 0 {
+		f, err := os.Open(vhd)
+		if err != nil {
+			return err
+		}
+		fStat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		progressStream := progress.NewReaderWithProgressInPhase(f, fStat.Size(), time.Second, progress.PhaseVerifying)
+		defer progressStream.Close()
+		go func() {
+			s := time.Time{}
+			if !quiet {
+				fmt.Println("Verifying the MD5 hash of the VHD..")
+			}
+			for progressRecord := range progressStream.ProgressChan {
+				if !quiet {
+					t := s.Add(progressRecord.RemainingDuration)
+					fmt.Printf("\r %s: %3d%% RemainingTime: %02dh:%02dm:%02ds Throughput: %d MB/sec",
+						progressRecord.Phase,
+						int(progressRecord.PercentComplete),
+						t.Hour(), t.Minute(), t.Second(),
+						int(progressRecord.AverageThroughputMbPerSecond),
+					)
+				}
+				if callback != nil {
+					callback(*progressRecord)
+				}
+			}
+		}()
+		h := md5.New()
+		if _, err := io.Copy(h, progressStream); err != nil {
+			return err
+		}
+		if sum := h.Sum(nil); !bytes.Equal(sum, expectedMD5) {
+			return fmt.Errorf("%w: expected %x, got %x", VHDMD5Mismatch, expectedMD5, sum)
+		}
+	}
+	return nil
+}
+
+// getLocalVHDMetaData returns the metadata of a local VHD read by
+// the given disk stream, the MD5 hash of the VHD is computed only if
+// computeHash is true, reporting its progress to the callback and
+// printing it unless quiet is true.
+func getLocalVHDMetaData(vhd string, diskStream *diskstream.DiskStream, computeHash bool, callback upload.ProgressCallback, quiet bool) (*metadata.MetaData, error) {
+	localMetaData, err := metadata.NewMetaDataFromDiskStream(vhd, diskStream, computeHash, callback, quiet)
 	if err != nil {
 		return nil, err
 	}
@@ -213,38 +1186,155 @@ func getLocalVHDMetaData(vhd string) (*metadata.MetaData, error) {
 // metadata. The parameter client is the Azure pageblob client
 // representing a blob in a container, size is the size of the new
 // page blob in bytes and parameter vhdMetaData is the custom metadata
-// to be associacted with the page blob.
-func createBlob(ctx context.Context, client *pageblob.Client, size int64, vhdMetaData *metadata.MetaData) error {
+// to be associacted with the page blob, along the custom ones. The
+// blob is created with the access tier, if not nil.
+func createBlob(ctx context.Context, client upload.PageBlobClient, size int64, vhdMetaData *metadata.MetaData, custom map[string]*string, tier *blob.AccessTier) error {
 	m, err := vhdMetaData.ToPtrMap()
 	if err != nil {
 		return err
 	}
+	for k, v := range custom {
+		m[k] = v
+	}
 	opts := pageblob.CreateOptions{
 		Metadata: m,
+		Tier:     pageBlobAccessTier(tier),
 	}
 	_, err = client.Create(ctx, size, &opts)
 	return err
 }
 
+// verifyBlobSize checks that the size of the blob reported by the
+// service is the expected size in bytes.
+func verifyBlobSize(ctx context.Context, client upload.PageBlobClient, size int64) error {
+	props, err := client.GetProperties(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if props.ContentLength == nil {
+		return fmt.Errorf("the size of the created page blob is not reported, expected %d bytes", size)
+	}
+	if *props.ContentLength != size {
+		return fmt.Errorf("the created page blob has %d bytes, expected %d bytes", *props.ContentLength, size)
+	}
+	return nil
+}
+
+// verifyEmptyBlob checks that the page blob has no allocated pages.
+func verifyEmptyBlob(ctx context.Context, client upload.PageBlobClient) error {
+	ranges, err := getAlreadyUploadedBlobRanges(ctx, client)
+	if err != nil {
+		return err
+	}
+	if len(ranges) > 0 {
+		return fmt.Errorf("%w: %d page ranges (%d bytes)", BlobNotEmpty, len(ranges), common.TotalRangeLength(ranges))
+	}
+	return nil
+}
+
+// setBlobMetaData replaces the metadata of the blob with the given
+// VHD metadata and custom metadata.
+func setBlobMetaData(ctx context.Context, client upload.PageBlobClient, vhdMetaData *metadata.MetaData, custom map[string]*string) error {
+	m, err := vhdMetaData.ToPtrMap()
+	if err != nil {
+		return err
+	}
+	for k, v := range custom {
+		m[k] = v
+	}
+	_, err = client.SetMetadata(ctx, m, nil)
+	return err
+}
+
 // setBlobMD5Hash sets MD5 hash of the blob in its properties
-func setBlobMD5Hash(ctx context.Context, client *blob.Client, vhdMetaData *metadata.MetaData) error {
+func setBlobMD5Hash(ctx context.Context, client upload.PageBlobClient, vhdMetaData *metadata.MetaData) error {
 	if vhdMetaData.FileMetaData.MD5Hash == nil {
 		return nil
 	}
-	buf := make([]byte, base64.StdEncoding.EncodedLen(len(vhdMetaData.FileMetaData.MD5Hash)))
-	base64.StdEncoding.Encode(buf, vhdMetaData.FileMetaData.MD5Hash)
+	// The client takes care of base64 encoding the hash.
 	blobHeaders := blob.HTTPHeaders{
-		BlobContentMD5: buf,
+		BlobContentMD5: vhdMetaData.FileMetaData.MD5Hash,
 	}
 	_, err := client.SetHTTPHeaders(ctx, blobHeaders, nil)
 	return err
 }
 
+// clearBlobMD5Hash removes the MD5 hash from the blob properties.
+func clearBlobMD5Hash(ctx context.Context, client upload.PageBlobClient) error {
+	_, err := client.SetHTTPHeaders(ctx, blob.HTTPHeaders{}, nil)
+	return err
+}
+
+// verifyBlobMD5Hash checks that the MD5 hash in the blob properties
+// is the hash of the VHD.
+func verifyBlobMD5Hash(ctx context.Context, client upload.PageBlobClient, vhdMetaData *metadata.MetaData) error {
+	props, err := client.GetProperties(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(props.ContentMD5, vhdMetaData.FileMetaData.MD5Hash) {
+		return fmt.Errorf("%w: stored %x, computed %x", BlobMD5Mismatch, props.ContentMD5, vhdMetaData.FileMetaData.MD5Hash)
+	}
+	return nil
+}
+
+// clearStaleBlobRanges clears the allocated pages of the page blob
+// out of keptRanges that are not in the ranges about to be uploaded,
+// so the empty ranges of the VHD skipped by the upload do not keep
+// stale data.
+func clearStaleBlobRanges(ctx context.Context, client upload.PageBlobClient, uploadableRanges, keptRanges []*common.IndexRange, logger func(string)) error {
+	blobRanges, err := getAlreadyUploadedBlobRanges(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	staleRanges := common.SubtractRanges(blobRanges, append(append([]*common.IndexRange{}, uploadableRanges...), keptRanges...))
+	if len(staleRanges) == 0 {
+		return nil
+	}
+
+	logger(fmt.Sprintf("Clearing %d stale page ranges (%d bytes) of the blob", len(staleRanges), common.TotalRangeLength(staleRanges)))
+	for _, r := range staleRanges {
+		_, err := client.ClearPages(ctx, blob.HTTPRange{
+			Offset: r.Start,
+			Count:  r.Length(),
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rangesOutsideSpan returns the ranges of a VHD of the given size out
+// of the span of length bytes starting at startOffset, or up to the
+// end of the VHD if length is zero. Nothing is out of the default
+// span covering the whole VHD. The span must be 512 byte aligned and
+// within the VHD.
+func rangesOutsideSpan(startOffset, length, size int64) ([]*common.IndexRange, error) {
+	const PageBlobPageSize int64 = 512
+
+	if startOffset < 0 || startOffset%PageBlobPageSize != 0 || startOffset >= size {
+		return nil, fmt.Errorf("invalid start offset %d, expected a multiple of %d below the VHD size of %d bytes", startOffset, PageBlobPageSize, size)
+	}
+	if length < 0 || length%PageBlobPageSize != 0 || length > size-startOffset {
+		return nil, fmt.Errorf("invalid length %d, expected a multiple of %d of at most %d bytes, up to the end of the VHD", length, PageBlobPageSize, size-startOffset)
+	}
+	var ranges []*common.IndexRange
+	if startOffset > 0 {
+		ranges = append(ranges, common.NewIndexRange(0, startOffset-1))
+	}
+	if length > 0 && startOffset+length < size {
+		ranges = append(ranges, common.NewIndexRange(startOffset+length, size-1))
+	}
+	return ranges, nil
+}
+
 // getAlreadyUploadedBlobRanges returns the range slice containing
 // ranges of a page blob those are already uploaded. The parameter
 // client is the Azure pageblob client representing a blob in a
 // container.
-func getAlreadyUploadedBlobRanges(ctx context.Context, client *pageblob.Client) ([]*common.IndexRange, error) {
+func getAlreadyUploadedBlobRanges(ctx context.Context, client upload.PageBlobClient) ([]*common.IndexRange, error) {
 	var (
 		marker       *string
 		rangesToSkip []*common.IndexRange
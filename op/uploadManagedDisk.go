@@ -0,0 +1,151 @@
+package op
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/flatcar/azure-vhd-utils/upload"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+)
+
+// UploadToManagedDisk uploads the local VHD at the path vhd to a
+// managed disk through its upload SAS, the page blob represented by
+// the given client. The managed disk must have been created for an
+// upload with the size of the VHD file and granted write access, the
+// blob then exists already with that size and holds no data.
+//
+// Unlike Upload, the blob is not created and no metadata, hash or
+// tags are stored on it, the managed disk does not support them, so
+// an interrupted upload cannot be resumed and is rerun from the
+// start instead. The options about the blob, like Metadata, Tags,
+// AccessTier or StartOffset, are rejected, the others apply as for
+// Upload. Once the upload completed, the write access of the disk
+// must be revoked to attach it.
+func UploadToManagedDisk(ctx context.Context, pageblobClient upload.PageBlobClient, vhd string, opts *UploadOptions) (*UploadResult, error) {
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	switch {
+	case len(opts.Metadata) > 0, len(opts.Tags) > 0:
+		return nil, errors.New("the blob of a managed disk cannot have metadata or tags")
+	case opts.AccessTier != nil:
+		return nil, errors.New("the access tier of a managed disk is its SKU, it cannot be set on its blob")
+	case opts.StartOffset > 0, opts.Length > 0, opts.TrustExistingPages:
+		return nil, errors.New("the upload to a managed disk cannot be resumed, it is rerun from the start")
+	case opts.VerifyMD5:
+		return nil, errors.New("the blob of a managed disk has no MD5 hash to verify")
+	case opts.AcquireLease:
+		return nil, errors.New("the blob of a managed disk cannot be leased, its write access is granted to the SAS URL only")
+	case opts.ConditionalWrites:
+		return nil, errors.New("the sequence number of the blob of a managed disk cannot be set, its write access is granted to the SAS URL only")
+	case opts.EncryptionScope != "", opts.CustomerProvidedKey != nil:
+		return nil, errors.New("a managed disk is encrypted with its disk encryption set, not with an encryption scope or a customer-provided key")
+	}
+
+	pageSetSize, err := uploadPageSetSize(opts)
+	if err != nil {
+		return nil, err
+	}
+	parallelism := 8 * runtime.NumCPU()
+	scanParallelism := runtime.NumCPU()
+	if opts.LowMemory {
+		parallelism = lowMemoryParallelism
+		scanParallelism = 1
+	}
+	if opts.Parallelism > 0 {
+		parallelism = opts.Parallelism
+	}
+	busyThreshold := 5
+	if opts.BusyThreshold != 0 {
+		busyThreshold = opts.BusyThreshold
+	}
+	busyCoolDown := 30 * time.Second
+	if opts.BusyCoolDown > 0 {
+		busyCoolDown = opts.BusyCoolDown
+	}
+	retryBackoff := 2 * time.Second
+	if opts.RetryBackoff != 0 {
+		retryBackoff = opts.RetryBackoff
+	}
+	operationTimeout := defaultOperationTimeout
+	if opts.OperationTimeout != 0 {
+		operationTimeout = opts.OperationTimeout
+	}
+	uploadLogger := newLogger(opts)
+	logger := infoFunc(uploadLogger)
+
+	diskStream, err := openLocalVHD(vhd, opts, warnFunc(uploadLogger))
+	if err != nil {
+		return nil, err
+	}
+	defer diskStream.Close()
+
+	props, err := pageblobClient.GetProperties(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the properties of the managed disk, is the SAS URL still valid: %w", err)
+	}
+	if props.ContentLength == nil {
+		return nil, errors.New("the size of the managed disk is not reported")
+	}
+	if *props.ContentLength != diskStream.GetSize() {
+		return nil, fmt.Errorf("the managed disk has %d bytes, expected the size of the VHD of %d bytes, create it with --upload-size-bytes %d", *props.ContentLength, diskStream.GetSize(), diskStream.GetSize())
+	}
+
+	uploadableRanges, err := locateRangesToUpload(diskStream, nil, pageSetSize, scanParallelism, opts.SparseThreshold, opts.QuietProgress, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := upload.EnsureRangesWithinBlob(uploadableRanges, *props.ContentLength); err != nil {
+		return nil, err
+	}
+
+	uploadContext := &upload.DiskUploadContext{
+		VhdStream:             diskStream,
+		AlreadyProcessedBytes: diskStream.GetSize() - common.TotalRangeLength(uploadableRanges),
+		UploadableRanges:      uploadableRanges,
+		PageblobClient:        pageblobClient,
+		Parallelism:           parallelism,
+		MinThroughputMbps:     opts.MinThroughputMbps,
+		MinThroughputWindow:   opts.MinThroughputWindow,
+		Logger:                uploadLogger,
+		BusyThreshold:         busyThreshold,
+		BusyCoolDown:          busyCoolDown,
+		Progress:              opts.Progress,
+		QuietProgress:         opts.QuietProgress,
+		NoFinalStatus:         opts.NoFinalStatus,
+		LogBlocks:             opts.LogBlocks,
+		MaxRetriesPerBlock:    opts.MaxRetriesPerBlock,
+		RetryBackoff:          retryBackoff,
+		OperationTimeout:      operationTimeout,
+		MaxBytesPerSecond:     opts.MaxBytesPerSecond,
+		ReadParallelism:       opts.ReadParallelism,
+		QueueDepth:            opts.QueueDepth,
+	}
+	if opts.PerBlockChecksum {
+		uploadContext.BlockDigests = upload.NewBlockDigests()
+	}
+	result, err := upload.Upload(ctx, uploadContext)
+	if err != nil {
+		return nil, classifyError(err, UploadIncomplete)
+	}
+	uploadResult := newUploadResult(result, diskStream.GetSize())
+	if uploadContext.BlockDigests != nil {
+		// A failed upload is rerun from the start, nothing to clear
+		blockDigests := uploadContext.BlockDigests.Digests()
+		if err := checkBlockDigests(ctx, pageblobClient, blockDigests, parallelism, false, logger); err != nil {
+			return nil, err
+		}
+		uploadResult.BlockChecksums = newBlockChecksums(blockDigests)
+	}
+	if opts.VerifyAfterUpload {
+		verifiedRanges := rangesToVerify(uploadableRanges, nil, pageSetSize)
+		if err := checkUploadedRanges(ctx, pageblobClient, diskStream, verifiedRanges, parallelism, false, logger); err != nil {
+			return nil, err
+		}
+	}
+	logger("Upload completed, revoke the write access of the managed disk to attach it")
+	return uploadResult, nil
+}
@@ -0,0 +1,79 @@
+package op
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
+)
+
+// streamBufferChunkSize is the size of the chunks a VHD stream is
+// copied to its temporary file in, the all-zero chunks are skipped
+// to keep the file sparse.
+const streamBufferChunkSize = 1024 * 1024
+
+// UploadStream uploads the VHD read from r like Upload uploads a
+// local VHD file. The size, if greater than zero, is the size of the
+// VHD in bytes and the stream must have exactly that many bytes.
+//
+// The upload reads the ranges of the VHD out of order and more than
+// once, so the stream is first buffered to a temporary file, which
+// also works for pipes like the standard input. The file is sparse
+// where the VHD is all zeros, so it only takes the disk space of the
+// data. It is removed once the upload is over. Since the temporary
+// file differs on every run, an upload from a stream cannot be
+// resumed, overwrite the blob instead.
+func UploadStream(ctx context.Context, blobServiceClient *service.Client, container, blobName string, r io.Reader, size int64, opts *UploadOptions) (*UploadResult, error) {
+	f, err := os.CreateTemp("", "azure-vhd-utils-*.vhd")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+
+	copied, err := copySparse(ctx, f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to buffer the VHD stream: %v", err)
+	}
+	if size > 0 && copied != size {
+		return nil, fmt.Errorf("the VHD stream has %d bytes, expected %d bytes", copied, size)
+	}
+	return Upload(ctx, blobServiceClient, container, blobName, f.Name(), opts)
+}
+
+// copySparse copies r to the file f, seeking over the all-zero chunks
+// instead of writing them, and returns the number of bytes copied.
+func copySparse(ctx context.Context, f *os.File, r io.Reader) (int64, error) {
+	buf := make([]byte, streamBufferChunkSize)
+	zeros := make([]byte, streamBufferChunkSize)
+	var copied int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return copied, err
+		}
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zeros[:n]) {
+				if _, err := f.Seek(int64(n), io.SeekCurrent); err != nil {
+					return copied, err
+				}
+			} else if _, err := f.Write(buf[:n]); err != nil {
+				return copied, err
+			}
+			copied += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return copied, err
+		}
+	}
+	// A trailing zero chunk was only seeked over.
+	return copied, f.Truncate(copied)
+}
@@ -0,0 +1,385 @@
+package op
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+
+	"github.com/flatcar/azure-vhd-utils/upload"
+	"github.com/flatcar/azure-vhd-utils/upload/metadata"
+	"github.com/flatcar/azure-vhd-utils/upload/uploadtest"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/diskstream"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/footer"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/reader"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/validator"
+)
+
+var _ upload.PageBlobClient = (*uploadtest.PageBlobClient)(nil)
+
+// testUploadOptions returns the options of the test uploads, retrying the failed writes at once and reporting the
+// progress to nobody.
+func testUploadOptions() *UploadOptions {
+	return &UploadOptions{
+		Parallelism:   4,
+		RetryBackoff:  time.Millisecond,
+		QuietProgress: true,
+		NoFinalStatus: true,
+	}
+}
+
+// streamMD5 returns the MD5 hash of the disk stream of the VHD at path, read from start to end.
+func streamMD5(t *testing.T, path string) []byte {
+	t.Helper()
+	h := md5.New()
+	if _, err := io.Copy(h, uploadtest.OpenVHD(t, path)); err != nil {
+		t.Fatal(err)
+	}
+	return h.Sum(nil)
+}
+
+// failWritesFrom returns a fault hook failing the writes of the pages at or after offset with a 403 response.
+func failWritesFrom(offset int64) uploadtest.FaultFunc {
+	return func(ctx context.Context, method string, r blob.HTTPRange) error {
+		if method == uploadtest.MethodUploadPages && r.Offset >= offset {
+			return uploadtest.NewResponseError(http.StatusForbidden, "AuthorizationFailure")
+		}
+		return nil
+	}
+}
+
+func TestUploadToPageBlobSetsMD5OfVHD(t *testing.T) {
+	data := uploadtest.NewData(6*1024*1024, 6, 0, 5000, 5001, 12287)
+	for name, path := range map[string]string{
+		"fixed":   uploadtest.NewFixedVHD(t, data),
+		"dynamic": uploadtest.NewDynamicVHD(t, data, 2*1024*1024),
+	} {
+		t.Run(name, func(t *testing.T) {
+			client := uploadtest.NewPageBlobClient()
+			if _, err := UploadToPageBlob(context.Background(), client, "disk.vhd", path, testUploadOptions()); err != nil {
+				t.Fatalf("upload failed: %v", err)
+			}
+			expected := streamMD5(t, path)
+			if got := client.ContentMD5(); !bytes.Equal(got, expected) {
+				t.Errorf("got the MD5 hash %x in the blob properties, expected %x", got, expected)
+			}
+			blobData := client.Data()
+			if sum := md5.Sum(blobData); !bytes.Equal(sum[:], expected) {
+				t.Errorf("the content of the blob has the MD5 hash %x, expected %x", sum, expected)
+			}
+			if !bytes.Equal(blobData[:len(data)], data) {
+				t.Error("the data of the blob differs from the data of the disk")
+			}
+		})
+	}
+}
+
+func TestUploadToPageBlobResumesSameVHD(t *testing.T) {
+	data := uploadtest.NewData(12*1024*1024, 7, 0, 1000, 20000)
+	path := uploadtest.NewFixedVHD(t, data)
+	client := uploadtest.NewPageBlobClient()
+	client.Fault = failWritesFrom(8 * 1024 * 1024)
+	opts := testUploadOptions()
+	opts.MaxRetriesPerBlock = -1
+	if _, err := UploadToPageBlob(context.Background(), client, "disk.vhd", path, opts); !ErrorIsAnyOf(err, UploadIncomplete) {
+		t.Fatalf("got error %v, expected the upload to be incomplete", err)
+	}
+
+	client.Fault = nil
+	if _, err := UploadToPageBlob(context.Background(), client, "disk.vhd", path, testUploadOptions()); err != nil {
+		t.Fatalf("resume failed: %v", err)
+	}
+	expected := streamMD5(t, path)
+	if got := client.ContentMD5(); !bytes.Equal(got, expected) {
+		t.Errorf("got the MD5 hash %x in the blob properties, expected %x", got, expected)
+	}
+	if sum := md5.Sum(client.Data()); !bytes.Equal(sum[:], expected) {
+		t.Errorf("the content of the blob has the MD5 hash %x, expected %x", sum, expected)
+	}
+}
+
+func TestUploadToPageBlobRefusesResumeOfAnotherVHD(t *testing.T) {
+	data := uploadtest.NewData(12*1024*1024, 7, 0, 1000, 20000)
+	path := uploadtest.NewFixedVHD(t, data)
+	client := uploadtest.NewPageBlobClient()
+	client.Fault = failWritesFrom(8 * 1024 * 1024)
+	opts := testUploadOptions()
+	opts.MaxRetriesPerBlock = -1
+	if _, err := UploadToPageBlob(context.Background(), client, "disk.vhd", path, opts); !ErrorIsAnyOf(err, UploadIncomplete) {
+		t.Fatalf("got error %v, expected the upload to be incomplete", err)
+	}
+
+	// Another VHD of the same size replaces the first one, with its modification time
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := os.ReadFile(uploadtest.NewFixedVHD(t, uploadtest.NewData(12*1024*1024, 8, 0, 1000, 20000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, other, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Fault = nil
+	_, err = UploadToPageBlob(context.Background(), client, "disk.vhd", path, testUploadOptions())
+	if err == nil || !strings.Contains(err.Error(), "Footer of the VHD file") {
+		t.Fatalf("got error %v, expected the footers to differ", err)
+	}
+	if len(client.ContentMD5()) > 0 {
+		t.Error("the upload of another VHD was finalized")
+	}
+}
+
+// blobMetaData returns the upload metadata of the blob, failing the test if it has none.
+func blobMetaData(t *testing.T, client *uploadtest.PageBlobClient) *metadata.MetaData {
+	t.Helper()
+	m := make(map[string]*string)
+	for k, v := range client.Metadata() {
+		m[k] = to.Ptr(v)
+	}
+	md, err := metadata.NewMetadataFromBlobMetadata(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md == nil {
+		t.Fatal("the blob has no upload metadata")
+	}
+	return md
+}
+
+func TestUploadToPageBlobPartialIsNotFinalized(t *testing.T) {
+	data := uploadtest.NewData(12*1024*1024, 9, 0, 9000, 20000)
+	path := uploadtest.NewFixedVHD(t, data)
+	expected := streamMD5(t, path)
+	client := uploadtest.NewPageBlobClient()
+	if _, err := UploadToPageBlob(context.Background(), client, "disk.vhd", path, testUploadOptions()); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	opts := testUploadOptions()
+	opts.StartOffset = 4 * 1024 * 1024
+	opts.Length = 4 * 1024 * 1024
+	if _, err := UploadToPageBlob(context.Background(), client, "disk.vhd", path, opts); err != nil {
+		t.Fatalf("partial upload failed: %v", err)
+	}
+	if got := client.ContentMD5(); len(got) > 0 {
+		t.Errorf("got the MD5 hash %x in the blob properties after a partial upload, expected none", got)
+	}
+	if blobMetaData(t, client).FileMetaData.DataComplete {
+		t.Error("the blob is marked as complete after a partial upload")
+	}
+
+	opts.VerifyAfterUpload = true
+	if _, err := UploadToPageBlob(context.Background(), client, "disk.vhd", path, opts); err != nil {
+		t.Fatalf("verified partial upload failed: %v", err)
+	}
+	if got := client.ContentMD5(); !bytes.Equal(got, expected) {
+		t.Errorf("got the MD5 hash %x in the blob properties after a verified partial upload, expected %x", got, expected)
+	}
+	if !blobMetaData(t, client).FileMetaData.DataComplete {
+		t.Error("the blob is not marked as complete after a verified partial upload")
+	}
+}
+
+func TestUploadToPageBlobResumeFinalizesPartialUpload(t *testing.T) {
+	data := uploadtest.NewData(12*1024*1024, 9, 0, 9000, 20000)
+	path := uploadtest.NewFixedVHD(t, data)
+	client := uploadtest.NewPageBlobClient()
+	if _, err := UploadToPageBlob(context.Background(), client, "disk.vhd", path, testUploadOptions()); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	opts := testUploadOptions()
+	opts.StartOffset = 8 * 1024 * 1024
+	if _, err := UploadToPageBlob(context.Background(), client, "disk.vhd", path, opts); err != nil {
+		t.Fatalf("partial upload failed: %v", err)
+	}
+
+	if _, err := UploadToPageBlob(context.Background(), client, "disk.vhd", path, testUploadOptions()); err != nil {
+		t.Fatalf("resume failed: %v", err)
+	}
+	if got, expected := client.ContentMD5(), streamMD5(t, path); !bytes.Equal(got, expected) {
+		t.Errorf("got the MD5 hash %x in the blob properties, expected %x", got, expected)
+	}
+}
+
+func TestUploadToPageBlobOverwriteCreatesBlobOnce(t *testing.T) {
+	data := uploadtest.NewData(6*1024*1024, 10, 0, 5000, 12287)
+	path := uploadtest.NewFixedVHD(t, data)
+	client := uploadtest.NewPageBlobClient()
+	client.Preload(make([]byte, 2*1024*1024), nil)
+	opts := testUploadOptions()
+	opts.Overwrite = true
+	if _, err := UploadToPageBlob(context.Background(), client, "disk.vhd", path, opts); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	// The blob is created at its final size, the client has no way to resize it afterwards
+	if got := client.Calls(uploadtest.MethodCreate); got != 1 {
+		t.Errorf("got %d creates of the blob, expected exactly one", got)
+	}
+	if got, expected := int64(len(client.Data())), int64(len(data))+512; got != expected {
+		t.Errorf("got a blob of %d bytes, expected %d", got, expected)
+	}
+}
+
+func TestUploadToPageBlobPartialClearsStaleData(t *testing.T) {
+	const mb = 1024 * 1024
+	// The span from 4 MB to 8 MB holds only zeros in the VHD
+	data := uploadtest.NewData(12*mb, 11, 0, 20000)
+	path := uploadtest.NewFixedVHD(t, data)
+	vhd, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The blob holds the VHD, but for stale data in the span
+	stale := append([]byte(nil), vhd...)
+	for i := 4 * mb; i < 8*mb; i++ {
+		stale[i] = 0xa5
+	}
+	client := uploadtest.NewPageBlobClient()
+	client.Preload(stale, nil)
+	opts := testUploadOptions()
+	opts.StartOffset = 4 * mb
+	opts.Length = 4 * mb
+	if _, err := UploadToPageBlob(context.Background(), client, "disk.vhd", path, opts); err != nil {
+		t.Fatalf("partial upload failed: %v", err)
+	}
+	if got := client.Calls(uploadtest.MethodUploadPages); got != 0 {
+		t.Errorf("got %d writes, expected the empty span skipped", got)
+	}
+	if got := client.Calls(uploadtest.MethodClearPages); got == 0 {
+		t.Error("got no clear of the stale pages")
+	}
+	if !bytes.Equal(client.Data(), vhd) {
+		t.Error("the content of the blob differs from the VHD")
+	}
+	// The pages out of the span are kept
+	for _, r := range client.WrittenRanges() {
+		if r.Start < 8*mb && r.End >= 4*mb {
+			t.Errorf("got pages written at %v, expected the span cleared", client.WrittenRanges())
+			break
+		}
+	}
+}
+
+func TestUploadToPageBlobWritesNewUniqueID(t *testing.T) {
+	data := uploadtest.NewData(6*1024*1024, 14, 0, 5000)
+	path := uploadtest.NewFixedVHD(t, data)
+	original, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uniqueID, err := common.NewRandomUUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := uploadtest.NewPageBlobClient()
+	opts := testUploadOptions()
+	opts.FooterOverrides = &diskstream.FooterOverrides{UniqueID: uniqueID}
+	if _, err := UploadToPageBlob(context.Background(), client, "disk.vhd", path, opts); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	blobData := client.Data()
+	blobFooter, err := footer.NewFactory(reader.NewVhdReaderFromByteSlice(blobData)).Create()
+	if err != nil {
+		t.Fatalf("the footer of the blob cannot be read: %v", err)
+	}
+	if blobFooter.UniqueID.String() != uniqueID.String() {
+		t.Errorf("got the unique id %s in the footer of the blob, expected %s", blobFooter.UniqueID, uniqueID)
+	}
+	if expected := footer.ComputeCheckSum(blobFooter.RawData); blobFooter.CheckSum != expected {
+		t.Errorf("got the checksum %#x in the footer of the blob, expected %#x", blobFooter.CheckSum, expected)
+	}
+	if !bytes.Equal(blobData[:len(data)], data) {
+		t.Error("the data of the blob differs from the data of the disk")
+	}
+	// The local VHD is left as it is
+	if local, err := os.ReadFile(path); err != nil || !bytes.Equal(local, original) {
+		t.Errorf("the local VHD changed with the upload, error %v", err)
+	}
+}
+
+func TestUploadToPageBlobAllZeroVHD(t *testing.T) {
+	const size = 8 * 1024 * 1024
+	path := uploadtest.NewDynamicVHD(t, make([]byte, size), 2*1024*1024)
+	client := uploadtest.NewPageBlobClient()
+	if _, err := UploadToPageBlob(context.Background(), client, "disk.vhd", path, testUploadOptions()); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if got := client.Calls(uploadtest.MethodCreate); got != 1 {
+		t.Errorf("got %d creates of the blob, expected exactly one", got)
+	}
+	blobData := client.Data()
+	if len(blobData) != size+512 {
+		t.Fatalf("got a blob of %d bytes, expected %d", len(blobData), size+512)
+	}
+	// The disk data is never written, only the footer is
+	written := client.WrittenRanges()
+	if len(written) != 1 || written[0].Start != size || written[0].End != size+511 {
+		t.Errorf("got pages written at %v, expected only the footer", written)
+	}
+	if !bytes.Equal(blobData[:size], make([]byte, size)) {
+		t.Error("the data of the blob is not all zeros")
+	}
+
+	// The blob is a valid fixed VHD
+	blobVHD := filepath.Join(t.TempDir(), "blob.vhd")
+	if err := os.WriteFile(blobVHD, blobData, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := validator.ValidateVhd(blobVHD); err != nil {
+		t.Errorf("the blob is not a valid VHD: %v", err)
+	}
+	stream := uploadtest.OpenVHD(t, blobVHD)
+	if stream.GetDiskType() != footer.DiskTypeFixed || stream.GetSize() != size+512 {
+		t.Errorf("got a %v disk of %d bytes from the blob, expected a fixed one of %d bytes", stream.GetDiskType(), stream.GetSize(), size+512)
+	}
+	if got, expected := client.ContentMD5(), streamMD5(t, path); !bytes.Equal(got, expected) {
+		t.Errorf("got the MD5 hash %x in the blob properties, expected %x", got, expected)
+	}
+}
+
+func BenchmarkUploadBlockSize(b *testing.B) {
+	const size = 16 * 1024 * 1024
+	pages := make([]int64, 0, size/uploadtest.PageSize)
+	for p := int64(0); p < size/uploadtest.PageSize; p++ {
+		pages = append(pages, p)
+	}
+	path := uploadtest.NewFixedVHD(b, uploadtest.NewData(size, 17, pages...))
+	for _, blockSize := range []int64{256 * 1024, 1024 * 1024, 4 * 1024 * 1024} {
+		b.Run(fmt.Sprintf("block=%dK", blockSize/1024), func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				client := uploadtest.NewPageBlobClient()
+				// Every write pays the round trip of a request over a high-latency link
+				client.Fault = func(ctx context.Context, method string, r blob.HTTPRange) error {
+					if method == uploadtest.MethodUploadPages {
+						time.Sleep(10 * time.Millisecond)
+					}
+					return nil
+				}
+				opts := testUploadOptions()
+				opts.UploadBlockSize = blockSize
+				if _, err := UploadToPageBlob(context.Background(), client, "disk.vhd", path, opts); err != nil {
+					b.Fatalf("upload failed: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package op
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
+
+	"github.com/flatcar/azure-vhd-utils/vhdcore"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/footer"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/reader"
+)
+
+// VHDInfo describes a page blob holding a VHD, as found by
+// IsValidVHDBlob.
+type VHDInfo struct {
+	Size               int64           // The size of the blob in bytes
+	VirtualSize        int64           // The virtual size of the disk in the footer
+	DiskType           footer.DiskType // The disk type in the footer
+	UniqueID           string          // The unique id of the disk in the footer
+	CreatorApplication string          // The application which created the disk
+	Finalized          bool            // True if the MD5 hash of the VHD is set in the blob properties
+	Reason             string          // Why the blob is not a valid VHD, empty for a valid one
+}
+
+// IsValidVHDBlob checks that the blob exists and is a page blob
+// ending with a valid footer of a fixed VHD matching the size of the
+// blob. Only the properties and the footer of the blob are read. The
+// returned info holds what could be learned about the blob, with the
+// reason why the blob is not a valid VHD if the result is false. The
+// error is only returned if the blob could not be checked.
+func IsValidVHDBlob(ctx context.Context, blobServiceClient *service.Client, container, blobName string) (bool, VHDInfo, error) {
+	var info VHDInfo
+	invalid := func(format string, a ...interface{}) (bool, VHDInfo, error) {
+		info.Reason = fmt.Sprintf(format, a...)
+		return false, info, nil
+	}
+
+	blobClient := blobServiceClient.NewContainerClient(container).NewBlobClient(blobName)
+	props, err := blobClient.GetProperties(ctx, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ContainerNotFound, bloberror.ResourceNotFound) {
+			return invalid("the blob does not exist")
+		}
+		return false, info, err
+	}
+	if props.ContentLength != nil {
+		info.Size = *props.ContentLength
+	}
+	info.Finalized = len(props.ContentMD5) > 0
+	if props.BlobType == nil || *props.BlobType != blob.BlobTypePageBlob {
+		return invalid("the blob is not a page blob")
+	}
+	if info.Size < vhdcore.VhdFooterSize {
+		return invalid("the blob has %d bytes, too few to hold a VHD footer", info.Size)
+	}
+
+	resp, err := blobClient.DownloadStream(ctx, &blob.DownloadStreamOptions{
+		Range: blob.HTTPRange{Offset: info.Size - vhdcore.VhdFooterSize, Count: vhdcore.VhdFooterSize},
+	})
+	if err != nil {
+		return false, info, err
+	}
+	defer resp.Body.Close()
+	buf := make([]byte, vhdcore.VhdFooterSize)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		return false, info, fmt.Errorf("failed to read the footer of the blob: %v", err)
+	}
+
+	vhdFooter, err := footer.NewFactory(reader.NewVhdReaderFromByteSlice(buf)).Create()
+	if err != nil {
+		return invalid("the footer of the blob cannot be parsed: %v", err)
+	}
+	info.VirtualSize = vhdFooter.VirtualSize
+	info.DiskType = vhdFooter.DiskType
+	info.UniqueID = vhdFooter.UniqueID.String()
+	info.CreatorApplication = vhdFooter.CreatorApplication
+
+	if err := footer.CheckCookie(vhdFooter); err != nil {
+		return invalid("the footer of the blob has an invalid cookie")
+	}
+	if checkSum := footer.ComputeCheckSum(vhdFooter.RawData); checkSum != vhdFooter.CheckSum {
+		return invalid("the footer of the blob has the checksum %#x, expected %#x", vhdFooter.CheckSum, checkSum)
+	}
+	if vhdFooter.DiskType != footer.DiskTypeFixed {
+		return invalid("the blob holds a %s disk, expected a fixed disk", vhdFooter.DiskType)
+	}
+	if vhdFooter.VirtualSize+vhdcore.VhdFooterSize != info.Size {
+		return invalid("the blob has %d bytes, expected %d bytes for the virtual size of the disk", info.Size, vhdFooter.VirtualSize+vhdcore.VhdFooterSize)
+	}
+	return true, info, nil
+}
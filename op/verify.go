@@ -0,0 +1,99 @@
+package op
+
+import (
+	"context"
+	"runtime"
+	"sort"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
+
+	"github.com/flatcar/azure-vhd-utils/upload"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/diskstream"
+)
+
+// PageRangesReport describes how the ranges of a local VHD holding
+// data compare to the allocated page ranges of the page blob the VHD
+// was uploaded to.
+type PageRangesReport struct {
+	LocalRanges []*common.IndexRange // The ranges of the VHD which would be uploaded
+	BlobRanges  []*common.IndexRange // The allocated page ranges of the page blob
+	Missing     []*common.IndexRange // The ranges of the VHD holding data not allocated in the page blob
+	Extra       []*common.IndexRange // The allocated page ranges of the page blob the VHD has no data for
+}
+
+// Matches returns true if the page blob has allocated pages for all
+// the data of the VHD and for nothing else.
+func (r *PageRangesReport) Matches() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0
+}
+
+// VerifyPageRanges compares the allocated page ranges of the page
+// blob with the ranges of the local VHD that the upload would write,
+// without downloading any data. It catches gross problems like an
+// incomplete upload or a blob holding a different VHD quickly. The
+// ranges of the VHD skipped by the blob are checked for holding only
+// zeros, so a blob uploaded with the sparse threshold matches too.
+func VerifyPageRanges(ctx context.Context, blobServiceClient *service.Client, container, blobName, vhd string) (*PageRangesReport, error) {
+	const PageBlobPageSize int64 = 512
+	const PageBlobPageSetSize int64 = 4 * 1024 * 1024
+
+	diskStream, err := diskstream.CreateNewDiskStream(vhd)
+	if err != nil {
+		return nil, err
+	}
+	defer diskStream.Close()
+
+	pageblobClient := blobServiceClient.NewContainerClient(container).NewPageBlobClient(blobName)
+	blobRanges, err := getAlreadyUploadedBlobRanges(ctx, pageblobClient)
+	if err != nil {
+		return nil, err
+	}
+
+	localRanges, err := upload.LocateUploadableRanges(diskStream, nil, PageBlobPageSize, PageBlobPageSetSize)
+	if err != nil {
+		return nil, err
+	}
+	localRanges, err = upload.DetectEmptyRangesWithParallelism(diskStream, localRanges, runtime.NumCPU(), false)
+	if err != nil {
+		return nil, err
+	}
+	localRanges = coalesceRanges(localRanges)
+	blobRanges = coalesceRanges(blobRanges)
+
+	missing := common.SubtractRanges(localRanges, blobRanges)
+	missing = common.ChunkRangesBySizeWithQuant(missing, PageBlobPageSetSize, PageBlobPageSize)
+	missing, err = upload.NonZeroPageRanges(diskStream, missing, PageBlobPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PageRangesReport{
+		LocalRanges: localRanges,
+		BlobRanges:  blobRanges,
+		Missing:     coalesceRanges(missing),
+		Extra:       coalesceRanges(common.SubtractRanges(blobRanges, localRanges)),
+	}, nil
+}
+
+// coalesceRanges returns the given ranges sorted, with the overlapping
+// and adjacent ranges merged.
+func coalesceRanges(ranges []*common.IndexRange) []*common.IndexRange {
+	sorted := make([]*common.IndexRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+
+	var result []*common.IndexRange
+	for _, r := range sorted {
+		if last := len(result) - 1; last >= 0 && r.Start <= result[last].End+1 {
+			if r.End > result[last].End {
+				result[last] = common.NewIndexRange(result[last].Start, r.End)
+			}
+			continue
+		}
+		result = append(result, common.NewIndexRange(r.Start, r.End))
+	}
+	return result
+}
@@ -0,0 +1,165 @@
+package op
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+
+	"github.com/flatcar/azure-vhd-utils/upload"
+	"github.com/flatcar/azure-vhd-utils/upload/concurrent"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/diskstream"
+)
+
+// errRangeDataMismatch is returned by the work reading a range back
+// whose data differs from the local VHD, it is not retried.
+var errRangeDataMismatch = errors.New("data mismatch")
+
+// verifyUploadedRanges reads the given ranges back from the page
+// blob, with parallelism concurrent reads, and compares their data
+// with the same ranges of the stream of the local VHD. The stream
+// reads the data of a dynamic or differencing VHD through its block
+// allocation table and the footer from its end, like the upload. It
+// returns the ranges whose data does not match, the error is about
+// the ranges failing to be read.
+func verifyUploadedRanges(ctx context.Context, client upload.PageBlobClient, stream *diskstream.DiskStream, ranges []*common.IndexRange, parallelism int) ([]*common.IndexRange, error) {
+	requestChan := make(chan *concurrent.Request, 0)
+	loadBalancer := concurrent.NewBalancerWithContext(ctx, parallelism)
+	loadBalancer.Init()
+	workerErrorChan, allWorkersFinishedChan := loadBalancer.Run(requestChan)
+	workCtx := loadBalancer.Context()
+
+	// The stream is shared by the works, it has a single position
+	var streamMutex sync.Mutex
+	readLocal := func(r *common.IndexRange, p []byte) error {
+		streamMutex.Lock()
+		defer streamMutex.Unlock()
+		if _, err := stream.Seek(r.Start, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(stream, p); err != nil {
+			return fmt.Errorf("failed to read the range %s of the local VHD: %w", r, err)
+		}
+		return nil
+	}
+
+	var mutex sync.Mutex
+	var mismatched []*common.IndexRange
+	var readErrors []error
+	readErrorsDone := make(chan struct{})
+	go func() {
+		defer close(readErrorsDone)
+		for err := range workerErrorChan {
+			if errors.Is(err, errRangeDataMismatch) {
+				continue
+			}
+			readErrors = append(readErrors, err)
+		}
+	}()
+
+	cancelled := false
+L:
+	for _, r := range ranges {
+		r := r
+		req := &concurrent.Request{
+			ID: r.String(),
+			Work: func() error {
+				resp, err := client.DownloadStream(workCtx, &blob.DownloadStreamOptions{
+					Range: blob.HTTPRange{Offset: r.Start, Count: r.Length()},
+				})
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				remote := make([]byte, r.Length())
+				if n, err := io.ReadFull(resp.Body, remote); err != nil {
+					return fmt.Errorf("read %d bytes of the range %s of %d bytes: %w", n, r, r.Length(), err)
+				}
+				local := make([]byte, r.Length())
+				if err := readLocal(r, local); err != nil {
+					return err
+				}
+				if !bytes.Equal(remote, local) {
+					mutex.Lock()
+					mismatched = append(mismatched, r)
+					mutex.Unlock()
+					return errRangeDataMismatch
+				}
+				return nil
+			},
+			ShouldRetry: func(err error) bool {
+				return workCtx.Err() == nil && !errors.Is(err, errRangeDataMismatch)
+			},
+			RetryBackoff: 2 * time.Second,
+		}
+		select {
+		case requestChan <- req:
+		case <-ctx.Done():
+			cancelled = true
+			break L
+		}
+	}
+	close(requestChan)
+	if cancelled {
+		loadBalancer.TearDownWorkers()
+	}
+
+	<-allWorkersFinishedChan
+	<-readErrorsDone
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if len(readErrors) > 0 {
+		return nil, fmt.Errorf("%d ranges of the blob failed to be read back: %w", len(readErrors), errors.Join(readErrors...))
+	}
+	return coalesceRanges(mismatched), nil
+}
+
+// checkUploadedRanges reads the given ranges back from the page blob
+// and fails with BlobDataMismatch if the data of any of them differs
+// from the local VHD. If clearMismatched is true the mismatching
+// ranges are cleared, so resuming the upload writes them again.
+func checkUploadedRanges(ctx context.Context, client upload.PageBlobClient, stream *diskstream.DiskStream, ranges []*common.IndexRange, parallelism int, clearMismatched bool, logger func(string)) error {
+	if len(ranges) == 0 {
+		return nil
+	}
+	logger(fmt.Sprintf("Verifying %d ranges of the blob, %d bytes, against the local VHD", len(ranges), common.TotalRangeLength(ranges)))
+	mismatched, err := verifyUploadedRanges(ctx, client, stream, ranges, parallelism)
+	if err != nil {
+		return err
+	}
+	if len(mismatched) == 0 {
+		return nil
+	}
+	for _, r := range mismatched {
+		logger(fmt.Sprintf("The range %s read back from the blob does not match the local VHD", r))
+	}
+	if !clearMismatched {
+		return fmt.Errorf("%d ranges of the blob, %d bytes, do not match the local VHD: %w", len(mismatched), common.TotalRangeLength(mismatched), BlobDataMismatch)
+	}
+	for _, r := range mismatched {
+		if _, err := client.ClearPages(ctx, blob.HTTPRange{Offset: r.Start, Count: r.Length()}, nil); err != nil {
+			return fmt.Errorf("failed to clear the mismatching range %s of the blob, rerun with --overwrite: %w", r, err)
+		}
+	}
+	return fmt.Errorf("%d ranges of the blob, %d bytes, do not match the local VHD and were cleared, rerun the command to upload them again: %w", len(mismatched), common.TotalRangeLength(mismatched), BlobDataMismatch)
+}
+
+// rangesToVerify returns the ranges of the blob to compare with the
+// local VHD once uploaded, in ranges of at most pageSetSize bytes:
+// the uploaded ranges and, when a whole upload is resumed, the ranges
+// written by the previous runs. The ranges kept from the blob by a
+// partial upload are not expected to match the local VHD.
+func rangesToVerify(uploadedRanges, previouslyUploaded []*common.IndexRange, pageSetSize int64) []*common.IndexRange {
+	all := make([]*common.IndexRange, 0, len(uploadedRanges)+len(previouslyUploaded))
+	all = append(all, uploadedRanges...)
+	all = append(all, previouslyUploaded...)
+	return common.ChunkRangesBySize(coalesceRanges(all), pageSetSize)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/flatcar/azure-vhd-utils/upload/progress"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// jsonProgressLine is a single line of the progress in JSON format.
+type jsonProgressLine struct {
+	Phase            string  `json:"phase"`
+	Percent          float64 `json:"percent"`
+	BytesProcessed   int64   `json:"bytesProcessed"`
+	RemainingSeconds float64 `json:"remainingSeconds"`
+	ThroughputMbps   float64 `json:"throughputMbps"`
+	BlocksCompleted  int64   `json:"blocksCompleted,omitempty"`
+	BlocksTotal      int64   `json:"blocksTotal,omitempty"`
+}
+
+// newProgressPrinter returns the progress consumer for the format
+// selected with the --progress-format flag, nil for the default text
+// format printed by the upload itself.
+func newProgressPrinter(format string) (func(progress.Record), error) {
+	switch format {
+	case "", "text":
+		return nil, nil
+	case "json":
+		var mutex sync.Mutex
+		return func(record progress.Record) {
+			b, err := json.Marshal(jsonProgressLine{
+				Phase:            string(record.Phase),
+				Percent:          record.PercentComplete,
+				BytesProcessed:   record.BytesProcessed,
+				RemainingSeconds: record.RemainingDuration.Seconds(),
+				ThroughputMbps:   record.AverageThroughputMbPerSecond,
+				BlocksCompleted:  record.BlocksCompleted,
+				BlocksTotal:      record.BlocksTotal,
+			})
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			os.Stdout.Write(append(b, '\n'))
+		}, nil
+	default:
+		return nil, fmt.Errorf("Invalid value for --progress-format %q, expected text or json", format)
+	}
+}
+
+// defaultProgressInterval is the default period of the progress lines
+// logged with the --no-progress flag.
+const defaultProgressInterval = 30 * time.Second
+
+// newPeriodicProgressPrinter returns the progress consumer selected
+// with the --no-progress flag, which logs a plain line every interval
+// instead of redrawing the progress line, so logs captured by CI do
+// not fill up with it. The first and the completed record of every
+// phase are always logged.
+func newPeriodicProgressPrinter(interval time.Duration) func(progress.Record) {
+	var mutex sync.Mutex
+	var phase progress.Phase
+	var last time.Time
+	completed := false
+	return func(record progress.Record) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		now := time.Now()
+		switch {
+		case record.Phase != phase || last.IsZero():
+			phase, completed = record.Phase, false
+		case completed:
+			return
+		case record.PercentComplete < 100 && now.Sub(last) < interval:
+			return
+		}
+		last = now
+		completed = record.PercentComplete >= 100
+
+		const oneMB = 1024 * 1024
+		blocks := ""
+		if record.BlocksTotal > 0 {
+			blocks = fmt.Sprintf(", block %d/%d", record.BlocksCompleted, record.BlocksTotal)
+		}
+		log.Printf("%s: %d%% (%.2f MB%s), %d Mb/sec\n",
+			record.Phase,
+			int(record.PercentComplete),
+			float64(record.BytesProcessed)/oneMB,
+			blocks,
+			int(record.AverageThroughputMbPerSecond))
+	}
+}
+
+// parseProgressPrinter returns the progress consumer selected with
+// the --no-progress, --progress-interval and --progress-format flags,
+// nil for the default progress line.
+func parseProgressPrinter(c *cli.Context) (func(progress.Record), error) {
+	if !c.Bool("no-progress") {
+		if c.IsSet("progress-interval") {
+			return nil, errors.New("The --progress-interval flag requires --no-progress")
+		}
+		return newProgressPrinter(c.String("progress-format"))
+	}
+	if c.IsSet("progress-format") {
+		return nil, errors.New("The --no-progress and --progress-format flags cannot be used together")
+	}
+	interval := defaultProgressInterval
+	if c.IsSet("progress-interval") {
+		d, err := time.ParseDuration(c.String("progress-interval"))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("Invalid value for --progress-interval %q, expected a positive duration like 10s or 1m", c.String("progress-interval"))
+		}
+		interval = d
+	}
+	return newPeriodicProgressPrinter(interval), nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/flatcar/azure-vhd-utils/upload/progress"
+)
+
+// progressWriteTimeout is the time limit of writing a progress
+// message to a client of the progress socket, a client not reading
+// its messages is disconnected.
+const progressWriteTimeout = time.Second
+
+// progressMessage is the JSON representation of a progress record
+// sent over the progress socket, one message per line.
+type progressMessage struct {
+	Phase            string          `json:"phase"`
+	PercentComplete  float64         `json:"percentComplete"`
+	ThroughputMbps   float64         `json:"throughputMbps"`
+	RemainingSeconds float64         `json:"remainingSeconds"`
+	BytesProcessed   int64           `json:"bytesProcessed"`
+	InFlightRanges   []progressRange `json:"inFlightRanges"`
+	BlocksCompleted  int64           `json:"blocksCompleted,omitempty"`
+	BlocksTotal      int64           `json:"blocksTotal,omitempty"`
+}
+
+// progressRange is the JSON representation of a range of the VHD,
+// with inclusive bounds in bytes.
+type progressRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// progressServer streams the progress records of an upload as JSON
+// lines to the clients connected to a Unix domain socket.
+type progressServer struct {
+	listener *net.UnixListener
+	mutex    sync.Mutex
+	conns    []net.Conn
+}
+
+// newProgressServer creates a new instance of progressServer
+// listening on a Unix domain socket at the given path. A stale socket
+// left at the path by a previous run is removed first, any other
+// file there is an error. The socket is removed when the server is
+// closed.
+func newProgressServer(path string) (*progressServer, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("Unable to create the progress socket, %s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("Unable to remove the stale progress socket: %v", err)
+		}
+	}
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create the progress socket: %v", err)
+	}
+
+	s := &progressServer{
+		listener: listener,
+	}
+	go s.accept()
+	return s, nil
+}
+
+// accept adds the connecting clients until the listener is closed.
+func (s *progressServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Failed to accept a progress socket client: %v\n", err)
+			}
+			return
+		}
+		s.mutex.Lock()
+		s.conns = append(s.conns, conn)
+		s.mutex.Unlock()
+	}
+}
+
+// send writes the record as a JSON line to all the connected
+// clients, the clients failing to read it are disconnected.
+func (s *progressServer) send(record progress.Record) {
+	msg := progressMessage{
+		Phase:            string(record.Phase),
+		PercentComplete:  record.PercentComplete,
+		ThroughputMbps:   record.AverageThroughputMbPerSecond,
+		RemainingSeconds: record.RemainingDuration.Seconds(),
+		BytesProcessed:   record.BytesProcessed,
+		InFlightRanges:   make([]progressRange, len(record.InFlightRanges)),
+		BlocksCompleted:  record.BlocksCompleted,
+		BlocksTotal:      record.BlocksTotal,
+	}
+	for i, r := range record.InFlightRanges {
+		msg.InFlightRanges[i] = progressRange{Start: r.Start, End: r.End}
+	}
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	conns := s.conns[:0]
+	for _, conn := range s.conns {
+		conn.SetWriteDeadline(time.Now().Add(progressWriteTimeout))
+		if _, err := conn.Write(line); err != nil {
+			conn.Close()
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	s.conns = conns
+}
+
+// Close disconnects the clients and removes the socket.
+func (s *progressServer) Close() {
+	s.listener.Close()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// sasURL is a container or blob SAS URL given with --sasuri.
+type sasURL struct {
+	serviceURL string // The URL of the blob service, with the SAS token
+	container  string // The container the SAS URL points at
+	blob       string // The blob the SAS URL points at, empty for a container SAS URL
+}
+
+// parseSASURL parses the container or blob SAS URL given with
+// --sasuri, it returns nil if the flag is not set. Like the blob
+// service endpoint, the URL must use HTTPS, unless --allow-http is
+// passed.
+func parseSASURL(c *cli.Context) (*sasURL, error) {
+	rawURL := c.String("sasuri")
+	if rawURL == "" {
+		return nil, nil
+	}
+
+	parts, err := parseSASURLParts(c, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	s := &sasURL{
+		container: parts.ContainerName,
+		blob:      parts.BlobName,
+	}
+	parts.ContainerName = ""
+	parts.BlobName = ""
+	s.serviceURL = parts.String()
+	return s, nil
+}
+
+// parseManagedDiskSASURL parses the upload SAS URL of a managed disk
+// given with --sasuri, as returned by az disk grant-access. It must
+// be a blob SAS URL allowing writes, granted directly with the write
+// permission or with the access policy of the disk, whose permissions
+// cannot be checked locally.
+func parseManagedDiskSASURL(c *cli.Context) (string, error) {
+	rawURL := c.String("sasuri")
+	if rawURL == "" {
+		return "", errors.New("Missing required argument --sasuri")
+	}
+
+	parts, err := parseSASURLParts(c, rawURL)
+	if err != nil {
+		return "", err
+	}
+	if parts.BlobName == "" {
+		return "", errors.New("The SAS URL does not point at the blob of a managed disk")
+	}
+	if r := parts.SAS.Resource(); r != "" && r != "b" {
+		return "", fmt.Errorf("The SAS URL grants access to the resource %q, expected a blob SAS URL", r)
+	}
+	if p := parts.SAS.Permissions(); p != "" && !strings.Contains(p, "w") {
+		return "", fmt.Errorf("The SAS URL only has the permissions %q, the upload needs the write permission, grant it with --access-level Write", p)
+	} else if p == "" && parts.SAS.Identifier() == "" {
+		return "", errors.New("The SAS URL has neither permissions nor an access policy, expected a write SAS URL")
+	}
+	return rawURL, nil
+}
+
+// parseSASURLParts parses and checks the SAS URL, which must use
+// HTTPS, unless --allow-http is passed, and have a SAS token.
+func parseSASURLParts(c *cli.Context, rawURL string) (blob.URLParts, error) {
+	parts, err := blob.ParseURL(rawURL)
+	if err != nil {
+		return blob.URLParts{}, fmt.Errorf("Invalid SAS URL: %w", err)
+	}
+	switch strings.ToLower(parts.Scheme) {
+	case "https":
+	case "http":
+		if !c.Bool("allow-http") {
+			return blob.URLParts{}, errors.New("Refusing to use plain HTTP SAS URL, use HTTPS or pass --allow-http (meant for storage emulators only)")
+		}
+	default:
+		return blob.URLParts{}, fmt.Errorf("Unsupported scheme %q in SAS URL, expected https", parts.Scheme)
+	}
+	if parts.Host == "" {
+		return blob.URLParts{}, errors.New("Missing host in SAS URL")
+	}
+	if parts.ContainerName == "" {
+		return blob.URLParts{}, errors.New("The SAS URL does not point at a container or a blob")
+	}
+	if parts.SAS.Signature() == "" {
+		return blob.URLParts{}, errors.New("The SAS URL has no SAS token")
+	}
+	return parts, nil
+}
@@ -0,0 +1,166 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+// adaptiveLimiter limits the number of page writes in flight to a level adapted to the observed throughput. The
+// level starts low and grows while the throughput improves, it falls back to the last good level once growing
+// stops helping and it is halved when the service throttles the writes, this way it converges on a level the link
+// and the storage account can sustain.
+type adaptiveLimiter struct {
+	mutex      sync.Mutex
+	cond       *sync.Cond
+	min        int
+	max        int
+	limit      int
+	active     int
+	bytes      int64
+	throttled  bool
+	growing    bool
+	previous   int
+	best       float64
+	lastAdjust time.Time
+	logger     logFunc
+}
+
+// newAdaptiveLimiter creates a new instance of adaptiveLimiter allowing initial writes in flight, the level is kept
+// between min and max. The changes of the level are logged with the given logger.
+func newAdaptiveLimiter(initial, min, max int, logger logFunc) *adaptiveLimiter {
+	if initial < min {
+		initial = min
+	}
+	if initial > max {
+		initial = max
+	}
+	l := &adaptiveLimiter{
+		min:        min,
+		max:        max,
+		limit:      initial,
+		previous:   initial,
+		growing:    true,
+		lastAdjust: time.Now(),
+		logger:     logger,
+	}
+	l.cond = sync.NewCond(&l.mutex)
+	return l
+}
+
+// acquire blocks until a write can be started at the current level.
+func (l *adaptiveLimiter) acquire() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+}
+
+// release records the end of a write started with acquire, which wrote count bytes or failed with err.
+func (l *adaptiveLimiter) release(count int64, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.active--
+	if err == nil {
+		l.bytes += count
+	} else if isThrottled(err) {
+		l.throttled = true
+	}
+	l.cond.Broadcast()
+}
+
+// level returns the current number of writes allowed in flight.
+func (l *adaptiveLimiter) level() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.limit
+}
+
+// adjust computes the throughput since the previous adjustment and updates the level accordingly.
+func (l *adaptiveLimiter) adjust(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	elapsed := now.Sub(l.lastAdjust).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	throughput := float64(l.bytes) / elapsed
+	l.bytes = 0
+	l.lastAdjust = now
+
+	limit := l.limit
+	switch {
+	case l.throttled:
+		limit = l.limit / 2
+		l.growing = false
+		l.best = throughput
+	case throughput > l.best*1.05:
+		l.best = throughput
+		if l.growing {
+			l.previous = l.limit
+			limit = l.limit + l.limit/4 + 1
+		}
+	case l.growing:
+		// Growing did not improve the throughput, settle on the previous level.
+		limit = l.previous
+		l.growing = false
+	case throughput < l.best*0.8:
+		// The link changed, probe for a better level again.
+		l.best = throughput
+		l.previous = l.limit
+		l.growing = true
+	}
+	l.throttled = false
+
+	if limit < l.min {
+		limit = l.min
+	}
+	if limit > l.max {
+		limit = l.max
+	}
+	if limit == l.limit {
+		return
+	}
+	l.limit = limit
+	l.cond.Broadcast()
+
+	msg := "Adjusted upload parallelism"
+	fields := map[string]string{
+		"parallelism":    strconv.Itoa(limit),
+		"throughputMbps": strconv.FormatFloat(8*throughput/oneMB, 'f', 2, 64),
+	}
+	if l.logger == nil {
+		fmt.Printf("\n%s to %d at %s Mb/sec\n", msg, limit, fields["throughputMbps"])
+	} else {
+		l.logger(msg, fields)
+	}
+}
+
+// run adjusts the level every interval until the done channel is closed.
+func (l *adaptiveLimiter) run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			l.adjust(now)
+		case <-done:
+			return
+		}
+	}
+}
+
+// isThrottled returns true if the error is a response of the service throttling the requests, either 429 Too
+// Many Requests or 503 Server Busy.
+func isThrottled(err error) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) &&
+		(respErr.StatusCode == http.StatusTooManyRequests || respErr.StatusCode == http.StatusServiceUnavailable)
+}
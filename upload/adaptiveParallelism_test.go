@@ -0,0 +1,76 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+
+	"github.com/flatcar/azure-vhd-utils/upload/uploadtest"
+)
+
+func TestAdaptiveLimiterBacksOffOnThrottling(t *testing.T) {
+	const minLevel, maxLevel = 2, 16
+	const pageCount = 64
+	client := uploadtest.NewPageBlobClient()
+	if _, err := client.Create(context.Background(), pageCount*uploadtest.PageSize, nil); err != nil {
+		t.Fatal(err)
+	}
+	var throttling int32
+	client.Fault = func(ctx context.Context, method string, r blob.HTTPRange) error {
+		if method == uploadtest.MethodUploadPages && atomic.LoadInt32(&throttling) != 0 {
+			return uploadtest.NewResponseError(http.StatusServiceUnavailable, "ServerBusy")
+		}
+		return nil
+	}
+	limiter := newAdaptiveLimiter(maxLevel, minLevel, maxLevel, func(string, map[string]string) {})
+	now := time.Now()
+	// round writes every page of the blob through the limiter and adjusts its level as if an interval passed.
+	round := func() int {
+		page := make([]byte, uploadtest.PageSize)
+		var wg sync.WaitGroup
+		for p := int64(0); p < pageCount; p++ {
+			limiter.acquire()
+			wg.Add(1)
+			go func(p int64) {
+				defer wg.Done()
+				r := blob.HTTPRange{Offset: p * uploadtest.PageSize, Count: uploadtest.PageSize}
+				_, err := client.UploadPages(context.Background(), streaming.NopCloser(bytes.NewReader(page)), r, nil)
+				limiter.release(uploadtest.PageSize, err)
+			}(p)
+		}
+		wg.Wait()
+		now = now.Add(adaptiveParallelismInterval)
+		limiter.adjust(now)
+		return limiter.level()
+	}
+
+	atomic.StoreInt32(&throttling, 1)
+	previous := limiter.level()
+	for i := 0; i < 6; i++ {
+		level := round()
+		if level < minLevel || level > maxLevel {
+			t.Fatalf("got %d writes in flight, expected between %d and %d", level, minLevel, maxLevel)
+		}
+		if level > previous || (level == previous && level != minLevel) {
+			t.Errorf("got %d writes in flight after %d while throttled, expected fewer", level, previous)
+		}
+		previous = level
+	}
+	if previous != minLevel {
+		t.Errorf("got %d writes in flight after the throttling, expected the minimum of %d", previous, minLevel)
+	}
+
+	atomic.StoreInt32(&throttling, 0)
+	for i := 0; i < 20; i++ {
+		if level := round(); level < minLevel || level > maxLevel {
+			t.Fatalf("got %d writes in flight, expected between %d and %d", level, minLevel, maxLevel)
+		}
+	}
+}
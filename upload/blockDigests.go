@@ -0,0 +1,47 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"sort"
+	"sync"
+
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+)
+
+// BlockDigest is the SHA256 digest of the data of a range written to the page blob.
+type BlockDigest struct {
+	Range  *common.IndexRange
+	SHA256 []byte
+}
+
+// BlockDigests collects the SHA256 digests of the ranges written by an upload. It is safe for concurrent use, the
+// workers compute and add the digests of their ranges in parallel.
+type BlockDigests struct {
+	mutex   sync.Mutex
+	digests []BlockDigest
+}
+
+// NewBlockDigests creates an empty BlockDigests.
+func NewBlockDigests() *BlockDigests {
+	return &BlockDigests{}
+}
+
+// Add computes the SHA256 digest of the data written to the range r and adds it.
+func (d *BlockDigests) Add(r *common.IndexRange, data []byte) {
+	sum := sha256.Sum256(data)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.digests = append(d.digests, BlockDigest{Range: r, SHA256: sum[:]})
+}
+
+// Digests returns the digests added so far, sorted by the start of their range.
+func (d *BlockDigests) Digests() []BlockDigest {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	digests := make([]BlockDigest, len(d.digests))
+	copy(digests, d.digests)
+	sort.Slice(digests, func(i, j int) bool {
+		return digests[i].Range.Start < digests[j].Range.Start
+	})
+	return digests
+}
@@ -0,0 +1,89 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+// circuitBreaker pauses all the page writes for a cool-down period once the service responded with 503 Server
+// Busy to a number of consecutive writes. Retrying every failed write at once only makes the throttling worse.
+type circuitBreaker struct {
+	mutex       sync.Mutex
+	threshold   int
+	coolDown    time.Duration
+	consecutive int
+	pausedUntil time.Time
+	logger      logFunc
+}
+
+// newCircuitBreaker creates a new instance of circuitBreaker that pauses the writes for coolDown after threshold
+// consecutive 503 responses, logging the pauses with the given logger.
+func newCircuitBreaker(threshold int, coolDown time.Duration, logger logFunc) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		coolDown:  coolDown,
+		logger:    logger,
+	}
+}
+
+// wait blocks until the writes are not paused or the context is done.
+func (b *circuitBreaker) wait(ctx context.Context) error {
+	b.mutex.Lock()
+	pause := time.Until(b.pausedUntil)
+	b.mutex.Unlock()
+	if pause <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(pause)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// report records the result of a write, pausing the writes if it was the threshold-th consecutive 503 response.
+func (b *circuitBreaker) report(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !isServerBusy(err) {
+		if err == nil {
+			b.consecutive = 0
+		}
+		return
+	}
+
+	b.consecutive++
+	if b.consecutive < b.threshold {
+		return
+	}
+	b.consecutive = 0
+	b.pausedUntil = time.Now().Add(b.coolDown)
+
+	msg := "Service is busy, pausing all uploads"
+	fields := map[string]string{
+		"consecutiveBusyResponses": strconv.Itoa(b.threshold),
+		"coolDown":                 b.coolDown.String(),
+	}
+	if b.logger == nil {
+		fmt.Printf("\n%s for %s after %d consecutive busy responses\n", msg, b.coolDown, b.threshold)
+	} else {
+		b.logger(msg, fields)
+	}
+}
+
+// isServerBusy returns true if the error is a 503 Server Busy response of the service.
+func isServerBusy(err error) bool {
+	var respErr *azcore.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusServiceUnavailable
+}
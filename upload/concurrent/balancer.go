@@ -2,18 +2,22 @@ package concurrent
 
 import (
 	"container/heap"
-	"time"
+	"context"
 )
 
 // Balancer is a type that can balance load among a set of workers
 type Balancer struct {
-	errorChan              chan error   // The channel used by all workers to report error
-	requestHandledChan     chan *Worker // The channel used by a worker to signal balancer that a work has been executed
-	tearDownChan           chan bool    // The channel that all workers listening for force quit signal
-	workerFinishedChan     chan *Worker // The channel that all worker used to signal balancer that it exiting
-	allWorkersFinishedChan chan bool    // The channel this balancer signals once all worker signals it's exit on workerFinishedChan
-	pool                   Pool         // Pool of workers that this load balancer balances
-	workerCount            int          // The number of workers
+	errorChan              chan error    // The channel used by all workers to report error
+	requestHandledChan     chan *Worker  // The channel used by a worker to signal balancer that a work has been executed
+	tearDownChan           chan bool     // The channel that all workers listening for force quit signal
+	workerFinishedChan     chan *Worker  // The channel that all worker used to signal balancer that it exiting
+	allWorkersFinishedChan chan bool     // The channel this balancer signals once all worker signals it's exit on workerFinishedChan
+	workerFreedChan        chan struct{} // The channel signalled when a worker completes a work, so a waiting dispatch can retry
+	pool                   Pool          // Pool of workers that this load balancer balances
+	workerCount            int           // The number of workers
+	queueDepth             int           // The number of requests buffered ahead of their dispatch to the workers
+	ctx                    context.Context
+	cancel                 context.CancelFunc
 }
 
 // The size of work channel associated with each worker this balancer manages.
@@ -21,15 +25,43 @@ const workerQueueSize int = 3
 
 // NewBalancer creates a new instance of Balancer that needs to balance load between 'workerCount' workers
 func NewBalancer(workerCount int) *Balancer {
+	return NewBalancerWithContext(context.Background(), workerCount)
+}
+
+// NewBalancerWithContext creates a new instance of Balancer like NewBalancer does, the context of the works it
+// runs is derived from the given context. A workerCount below 1 is raised to 1, a balancer without workers would
+// never finish.
+func NewBalancerWithContext(ctx context.Context, workerCount int) *Balancer {
+	return NewBalancerWithQueue(ctx, workerCount, 0)
+}
+
+// NewBalancerWithQueue creates a new instance of Balancer like NewBalancerWithContext does, buffering up to
+// queueDepth requests read from the request channel ahead of their dispatch to the workers. The buffer lets the
+// producer of the requests, like the reader of the disk, go on while all the workers are busy, smoothing the
+// throughput when the producer and the workers have bursts. Every buffered request holds the data of its work,
+// up to 4 MB for an upload, so the buffer costs up to queueDepth times that much memory. A queueDepth of zero or
+// less buffers nothing, the request channel is then read only when a request can be dispatched.
+func NewBalancerWithQueue(ctx context.Context, workerCount, queueDepth int) *Balancer {
+	if workerCount < 1 {
+		workerCount = 1
+	}
 	balancer := &Balancer{
 		workerCount: workerCount,
+		queueDepth:  queueDepth,
 		pool: Pool{
 			Workers: make([]*Worker, workerCount),
 		},
 	}
+	balancer.ctx, balancer.cancel = context.WithCancel(ctx)
 	return balancer
 }
 
+// Context returns the context the works run by the balancer should use, it is cancelled when the workers are torn
+// down, so the works in progress are aborted instead of delaying the teardown.
+func (b *Balancer) Context() context.Context {
+	return b.ctx
+}
+
 // Init initializes all channels and start the workers.
 func (b *Balancer) Init() {
 	b.errorChan = make(chan error, 0)
@@ -37,6 +69,7 @@ func (b *Balancer) Init() {
 	b.workerFinishedChan = make(chan *Worker, 0)
 	b.allWorkersFinishedChan = make(chan bool, 0)
 	b.tearDownChan = make(chan bool, 0)
+	b.workerFreedChan = make(chan struct{}, 1)
 	for i := 0; i < b.workerCount; i++ {
 		b.pool.Workers[i] = NewWorker(i, workerQueueSize, &(b.pool), b.errorChan, b.requestHandledChan, b.workerFinishedChan)
 		(b.pool.Workers[i]).Run(b.tearDownChan)
@@ -44,25 +77,37 @@ func (b *Balancer) Init() {
 }
 
 // TearDownWorkers sends a force quit signal to all workers, which case worker to quit as soon as possible,
-// workers won't drain it's request channel in this case.
+// workers won't drain it's request channel in this case. The context of the works is cancelled.
 func (b *Balancer) TearDownWorkers() {
+	b.cancel()
 	close(b.tearDownChan)
 }
 
 // Run read request from the request channel identified by the parameter requestChan and dispatch it the worker
 // with least load. This method returns two channels, a channel to communicate error from any worker back to
 // the consumer of balancer and second channel is used by the balancer to signal consumer that all workers has
-// been finished executing.
+// been finished executing. The error channel is closed once all workers has been finished, before the signal
+// on the second channel, so the consumer can drain it with a range loop.
 func (b *Balancer) Run(requestChan <-chan *Request) (<-chan error, <-chan bool) {
-	// Request dispatcher
+	if b.queueDepth > 0 {
+		requestChan = b.bufferRequests(requestChan)
+	}
+
+	// Request dispatcher, it stops once the workers are torn down or the context is cancelled, the workers then
+	// finish the works already dispatched to them unless torn down
 	go func() {
+		defer b.closeWorkersRequestChannel()
 		for {
-			requestToHandle, ok := <-requestChan
-			if !ok {
-				b.closeWorkersRequestChannel()
+			select {
+			case requestToHandle, ok := <-requestChan:
+				if !ok || !b.dispatch(requestToHandle) {
+					return
+				}
+			case <-b.tearDownChan:
+				return
+			case <-b.ctx.Done():
 				return
 			}
-			b.dispatch(requestToHandle)
 		}
 	}()
 
@@ -76,6 +121,10 @@ func (b *Balancer) Run(requestChan <-chan *Request) (<-chan error, <-chan bool)
 			case _ = <-b.workerFinishedChan:
 				remainingWorkers--
 				if remainingWorkers == 0 {
+					// No worker is left to report an error
+					close(b.errorChan)
+					// Nor any work left to use the context
+					b.cancel()
 					b.allWorkersFinishedChan <- true // All workers has been exited
 					return
 				}
@@ -86,10 +135,30 @@ func (b *Balancer) Run(requestChan <-chan *Request) (<-chan error, <-chan bool)
 	return b.errorChan, b.allWorkersFinishedChan
 }
 
+// bufferRequests returns a channel buffering up to queueDepth of the requests read from requestChan, which is
+// closed once requestChan is closed and the requests sent. The requests not sent yet are dropped when the workers
+// are torn down.
+func (b *Balancer) bufferRequests(requestChan <-chan *Request) <-chan *Request {
+	bufferedChan := make(chan *Request, b.queueDepth)
+	go func() {
+		defer close(bufferedChan)
+		for request := range requestChan {
+			select {
+			case bufferedChan <- request:
+			case <-b.tearDownChan:
+				return
+			}
+		}
+	}()
+	return bufferedChan
+}
+
 // closeWorkersRequestChannel closes the Request channel of all workers, this indicates that no
 // more work will not be send the channel so that the workers can gracefully exit after handling
 // any pending work in the channel.
 func (b *Balancer) closeWorkersRequestChannel() {
+	b.pool.RLock()
+	defer b.pool.RUnlock()
 	for i := 0; i < b.workerCount; i++ {
 		close((b.pool.Workers[i]).RequestsToHandleChan)
 	}
@@ -97,36 +166,50 @@ func (b *Balancer) closeWorkersRequestChannel() {
 
 // dispatch dispatches the request to the worker with least load. If all workers are completely
 // busy (i.e. there Pending request count is currently equal to the maximum load) then this
-// method will poll until one worker is available.
-func (b *Balancer) dispatch(request *Request) {
+// method will wait until one worker completes a work. It returns false without dispatching the
+// request if the workers are torn down or the context is cancelled meanwhile.
+func (b *Balancer) dispatch(request *Request) bool {
 	for {
-		if b.pool.Workers[0].Pending >= workerQueueSize {
-			// Wait for a worker to be available
-			time.Sleep(500 * time.Millisecond)
-		} else {
-			b.pool.Lock()
-			worker := b.pool.Workers[0]
+		b.pool.Lock()
+		worker := b.pool.Workers[0]
+		if worker.Pending < workerQueueSize {
 			worker.Pending++
 			heap.Fix(&b.pool, worker.Index)
 			worker.RequestsToHandleChan <- request
 			b.pool.Unlock()
-			return
+			return true
+		}
+		b.pool.Unlock()
+
+		// Wait for a worker to be available
+		select {
+		case <-b.workerFreedChan:
+		case <-b.tearDownChan:
+			return false
+		case <-b.ctx.Done():
+			return false
 		}
 	}
 }
 
 // completed is called when a worker finishes one work, it updates the load status of the given the
-// worker.
+// worker and wakes up the dispatch waiting for a worker, if any.
 func (b *Balancer) completed(worker *Worker) {
 	b.pool.Lock()
 	worker.Pending--
 	heap.Fix(&b.pool, worker.Index)
 	b.pool.Unlock()
+	select {
+	case b.workerFreedChan <- struct{}{}:
+	default:
+	}
 }
 
 // WorkersCurrentLoad returns the load of the workers this balancer manages as comma separated string
 // values where each value consists of worker id (Worker.Id property) and pending requests associated
 // with the worker.
 func (b *Balancer) WorkersCurrentLoad() string {
+	b.pool.RLock()
+	defer b.pool.RUnlock()
 	return b.pool.WorkersCurrentLoad()
 }
@@ -0,0 +1,119 @@
+package concurrent
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewBalancerWithQueueClampsWorkerCount(t *testing.T) {
+	for _, test := range []struct {
+		workerCount int
+		expected    int
+	}{
+		{-3, 1},
+		{0, 1},
+		{1, 1},
+		{7, 7},
+	} {
+		b := NewBalancerWithQueue(context.Background(), test.workerCount, 0)
+		if b.workerCount != test.expected || len(b.pool.Workers) != test.expected {
+			t.Errorf("got %d workers for a worker count of %d, expected %d", b.workerCount, test.workerCount, test.expected)
+		}
+	}
+}
+
+func TestBalancerWithoutWorkersRunsWorks(t *testing.T) {
+	b := NewBalancerWithQueue(context.Background(), 0, 0)
+	b.Init()
+	requests := make(chan *Request)
+	errorChan, finishedChan := b.Run(requests)
+	var done int32
+	go func() {
+		for i := 0; i < 5; i++ {
+			requests <- &Request{
+				ID:          "work",
+				Work:        func() error { atomic.AddInt32(&done, 1); return nil },
+				ShouldRetry: func(error) bool { return false },
+			}
+		}
+		close(requests)
+	}()
+	for err := range errorChan {
+		t.Errorf("got error %v, expected none", err)
+	}
+	select {
+	case <-finishedChan:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the balancer did not finish")
+	}
+	if got := atomic.LoadInt32(&done); got != 5 {
+		t.Errorf("got %d works done, expected 5", got)
+	}
+}
+
+func TestBalancerTearDownWithBlockingWorks(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	b := NewBalancerWithQueue(context.Background(), 1, 0)
+	b.Init()
+	requests := make(chan *Request)
+	_, finishedChan := b.Run(requests)
+	started := make(chan struct{}, 1)
+	produced := make(chan struct{})
+	go func() {
+		defer close(produced)
+		// More requests than the worker can queue, the dispatcher waits for the worker with the last ones
+		for i := 0; i < 6; i++ {
+			select {
+			case requests <- &Request{
+				ID: "blocking",
+				Work: func() error {
+					started <- struct{}{}
+					<-b.Context().Done()
+					return b.Context().Err()
+				},
+				ShouldRetry: func(error) bool { return false },
+			}:
+			case <-time.After(time.Second):
+				// The dispatcher is waiting for the worker
+				return
+			}
+		}
+	}()
+	<-started
+	<-produced
+
+	b.TearDownWorkers()
+	select {
+	case <-finishedChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the workers did not finish after the teardown")
+	}
+	// The dispatcher and the workers exit
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("got %d goroutines after the teardown, expected %d:\n%s", runtime.NumGoroutine(), goroutines, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBalancerCancelsContextWhenFinished(t *testing.T) {
+	b := NewBalancerWithQueue(context.Background(), 2, 0)
+	b.Init()
+	requests := make(chan *Request)
+	errorChan, finishedChan := b.Run(requests)
+	close(requests)
+	for range errorChan {
+	}
+	<-finishedChan
+	select {
+	case <-b.Context().Done():
+	case <-time.After(2 * time.Second):
+		t.Error("the context of the works is not cancelled once the workers finished")
+	}
+}
@@ -1,8 +1,58 @@
 package concurrent
 
+import (
+	"math/rand"
+	"time"
+)
+
 // Request represents a work that Worker needs to execute
 type Request struct {
-	ID          string               // The Id of the work (for debugging purposes)
-	Work        func() error         // The work to be executed by a worker
-	ShouldRetry func(err error) bool // The method used by worker to decide whether to retry if work execution fails
+	ID           string               // The Id of the work (for debugging purposes)
+	Work         func() error         // The work to be executed by a worker
+	ShouldRetry  func(err error) bool // The method used by worker to decide whether to retry if work execution fails
+	MaxRetries   int                  // The number of retries of a failing work, zero for the default of 5, negative for none
+	RetryBackoff time.Duration        // The longest delay before the first retry, doubled for each next one up to maxRetryBackoff
+	Bytes        int64                // The number of bytes the work transfers, counted in the worker statistics if it succeeds
+}
+
+// maxRetryBackoff is the longest delay between two executions of a failing work.
+const maxRetryBackoff = 30 * time.Second
+
+// retries returns the number of times the work is retried if it fails.
+func (r *Request) retries() int {
+	switch {
+	case r.MaxRetries < 0:
+		return 0
+	case r.MaxRetries == 0:
+		return maxRetryCount
+	default:
+		return r.MaxRetries
+	}
+}
+
+// backoff returns the longest delay before the given retry of the
+// work, counted from 1. The worker waits a random part of it.
+func (r *Request) backoff(retry int) time.Duration {
+	if r.RetryBackoff <= 0 {
+		return 0
+	}
+	delay := r.RetryBackoff
+	for i := 1; i < retry && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	return delay
+}
+
+// jitter returns a random delay in [0, backoff], drawn from rnd.
+// With this "full jitter", the works failing at once, like when the
+// service throttles all the workers, are retried spread over the
+// backoff instead of all at the same time, throttling it again.
+func jitter(rnd *rand.Rand, backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rnd.Int63n(int64(backoff) + 1))
 }
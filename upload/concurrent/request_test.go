@@ -0,0 +1,60 @@
+package concurrent
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestRequestBackoff(t *testing.T) {
+	for _, test := range []struct {
+		retryBackoff time.Duration
+		retry        int
+		expected     time.Duration
+	}{
+		{0, 1, 0},
+		{-time.Second, 3, 0},
+		{time.Second, 1, time.Second},
+		{time.Second, 2, 2 * time.Second},
+		{time.Second, 3, 4 * time.Second},
+		{time.Second, 5, 16 * time.Second},
+		{time.Second, 6, maxRetryBackoff},
+		{time.Second, 1000, maxRetryBackoff},
+		{20 * time.Second, 2, maxRetryBackoff},
+		{time.Minute, 1, maxRetryBackoff},
+	} {
+		r := &Request{RetryBackoff: test.retryBackoff}
+		if got := r.backoff(test.retry); got != test.expected {
+			t.Errorf("got backoff %v for retry %d of %v, expected %v", got, test.retry, test.retryBackoff, test.expected)
+		}
+	}
+}
+
+func TestJitterWithinBackoff(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	if got := jitter(rnd, 0); got != 0 {
+		t.Errorf("got jitter %v for no backoff, expected none", got)
+	}
+	if got := jitter(rnd, -time.Second); got != 0 {
+		t.Errorf("got jitter %v for a negative backoff, expected none", got)
+	}
+	for _, backoff := range []time.Duration{time.Nanosecond, time.Millisecond, 2 * time.Second, maxRetryBackoff} {
+		var lowest, highest time.Duration = backoff, 0
+		for i := 0; i < 1000; i++ {
+			d := jitter(rnd, backoff)
+			if d < 0 || d > backoff {
+				t.Fatalf("got jitter %v, expected it within [0, %v]", d, backoff)
+			}
+			if d < lowest {
+				lowest = d
+			}
+			if d > highest {
+				highest = d
+			}
+		}
+		// The delays are spread over the whole backoff
+		if backoff > time.Nanosecond && (lowest > backoff/10 || highest < backoff-backoff/10) {
+			t.Errorf("got jitters within [%v, %v], expected them spread over [0, %v]", lowest, highest, backoff)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package concurrent
+
+import (
+	"sort"
+	"time"
+)
+
+// WorkerStats are the counters of the works handled by a worker, they tell whether a worker is starved or failing
+// more than its peers.
+type WorkerStats struct {
+	ID       int           // The Id of the worker
+	Requests int           // The number of works handled, whether they succeeded or failed
+	Retries  int           // The number of times a failing work was executed again
+	Failures int           // The number of works which failed after all their retries
+	Bytes    int64         // The number of bytes transferred by the works which succeeded, see Request.Bytes
+	BusyTime time.Duration // The time spent executing the works, without the delays between the retries
+}
+
+// record counts a work handled after the given number of attempts, err is the error of the last one.
+func (s *WorkerStats) record(request *Request, attempts int, err error) {
+	s.Requests++
+	if attempts > 1 {
+		s.Retries += attempts - 1
+	}
+	if err != nil {
+		s.Failures++
+	} else {
+		s.Bytes += request.Bytes
+	}
+}
+
+// WorkerStats returns the counters of the workers this balancer manages, sorted by worker id. Each worker owns its
+// counters while it runs, so this method must only be called once the balancer signalled that all workers are
+// finished on the channel returned by Run.
+func (b *Balancer) WorkerStats() []WorkerStats {
+	stats := make([]WorkerStats, 0, b.workerCount)
+	for _, w := range b.pool.Workers {
+		stats = append(stats, w.stats)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+	return stats
+}
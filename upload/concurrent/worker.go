@@ -1,6 +1,10 @@
 package concurrent
 
-import "fmt"
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
 
 // Worker represents a type which can listen for work from a channel and run them
 type Worker struct {
@@ -12,9 +16,26 @@ type Worker struct {
 	ID                   int            // Unique Id for worker (Debugging purpose)
 	Index                int            // The index of the item in the heap.
 	pool                 *Pool          // The parent pool holding all workers (used for work stealing)
+	stats                WorkerStats    // The counters of the works handled, owned by the worker go-routine
+	rnd                  *rand.Rand     // The source of the retry jitter, owned by the worker go-routine
 }
 
-// The maximum number of times a work needs to be retried before reporting failure on errorChan.
+// WorkError is the error reported on the error channel when a work failed.
+type WorkError struct {
+	ID       string // The Id of the failed work
+	Attempts int    // The number of times the work was executed
+	Err      error  // The error returned by the last execution of the work
+}
+
+func (e *WorkError) Error() string {
+	return fmt.Sprintf("%s: %v", e.ID, e.Err)
+}
+
+func (e *WorkError) Unwrap() error {
+	return e.Err
+}
+
+// The default number of times a work needs to be retried before reporting failure on errorChan.
 const maxRetryCount int = 5
 
 // NewWorker creates a new instance of the worker with the given work channel size.
@@ -23,6 +44,8 @@ const maxRetryCount int = 5
 func NewWorker(id int, workChannelSize int, pool *Pool, errorChan chan<- error, requestHandledChan chan<- *Worker, workerFinishedChan chan<- *Worker) *Worker {
 	return &Worker{
 		ID:                   id,
+		stats:                WorkerStats{ID: id},
+		rnd:                  rand.New(rand.NewSource(time.Now().UnixNano() + int64(id))),
 		RequestsToHandleChan: make(chan *Request, workChannelSize),
 		errorChan:            errorChan,
 		requestHandledChan:   requestHandledChan,
@@ -37,7 +60,8 @@ func NewWorker(id int, workChannelSize int, pool *Pool, errorChan chan<- error,
 //  2. A signal is received in the tearDownChan channel parameter
 //
 // After executing each work, this method sends report to Worker::requestHandledChan channel
-// If a work fails after maximum retry, this method sends report to Worker::errorChan channel
+// If a work fails after maximum retry, this method sends report to Worker::errorChan channel, the retries are
+// delayed by a random duration up to the backoff of the request
 func (w *Worker) Run(tearDownChan <-chan bool) {
 	go func() {
 		defer func() {
@@ -68,23 +92,41 @@ func (w *Worker) Run(tearDownChan <-chan bool) {
 			}
 
 			var err error
+			attempts := 0
 			// Do work, retry on failure.
 		Loop:
-			for count := 0; count < maxRetryCount+1; count++ {
+			for attempts < requestToHandle.retries()+1 {
+				var backoff <-chan time.Time
+				if attempts > 0 {
+					if delay := jitter(w.rnd, requestToHandle.backoff(attempts)); delay > 0 {
+						backoff = time.After(delay)
+					}
+				}
+				if backoff != nil {
+					select {
+					case <-tearDownChan:
+						return
+					case <-backoff:
+					}
+				}
 				select {
 				case <-tearDownChan:
 					return
 				default:
+					attempts++
+					started := time.Now()
 					err = requestToHandle.Work() // Run work
+					w.stats.BusyTime += time.Since(started)
 					if err == nil || !requestToHandle.ShouldRetry(err) {
 						break Loop
 					}
 				}
 			}
 
+			w.stats.record(requestToHandle, attempts, err)
 			if err != nil {
 				select {
-				case w.errorChan <- fmt.Errorf("%s: %v", requestToHandle.ID, err):
+				case w.errorChan <- &WorkError{ID: requestToHandle.ID, Attempts: attempts, Err: err}:
 				case <-tearDownChan:
 					return
 				}
@@ -102,7 +144,11 @@ func (w *Worker) Run(tearDownChan <-chan bool) {
 // tryStealWork will try to steal a work from peer worker if available. If all peer channels are
 // empty then return nil
 func (w *Worker) tryStealWork() *Request {
-	for _, w1 := range w.pool.Workers {
+	// The balancer reorders the workers as they complete their works
+	w.pool.RLock()
+	workers := append([]*Worker(nil), w.pool.Workers...)
+	w.pool.RUnlock()
+	for _, w1 := range workers {
 		request, ok := <-w1.RequestsToHandleChan
 		if ok {
 			return request
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"sync"
 
 	"github.com/flatcar/azure-vhd-utils/vhdcore/block/bitmap"
 	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
@@ -22,17 +23,38 @@ type DataWithRange struct {
 // The empty range detection required only for Fixed disk, if the stream is a expandable disk stream this method simply
 // returns the parameter uploadableRanges as it is.
 func DetectEmptyRanges(diskStream *diskstream.DiskStream, uploadableRanges []*common.IndexRange) ([]*common.IndexRange, error) {
+	return DetectEmptyRangesWithParallelism(diskStream, uploadableRanges, 1, false)
+}
+
+// DetectEmptyRangesWithParallelism is like DetectEmptyRanges, but the ranges are scanned by parallelism goroutines,
+// the result does not depend on it. If quiet is true, nothing is printed as the scan goes.
+//
+// The ranges of an expandable disk are not scanned at all, the block allocation table read with the disk tells
+// the blocks with data, without reading them.
+func DetectEmptyRangesWithParallelism(diskStream *diskstream.DiskStream, uploadableRanges []*common.IndexRange, parallelism int, quiet bool) ([]*common.IndexRange, error) {
 	if diskStream.GetDiskType() != footer.DiskTypeFixed {
 		return uploadableRanges, nil
 	}
 
+	if quiet {
+		return removeEmptyRanges(diskStream, uploadableRanges, parallelism, nil)
+	}
 	fmt.Println("\nDetecting empty ranges..")
+	return removeEmptyRanges(diskStream, uploadableRanges, parallelism, func(empty, total int) {
+		fmt.Printf("\r Empty ranges : %d/%d", empty, total)
+	})
+}
+
+// removeEmptyRanges removes the ranges of a fixed disk holding only zeros from the parameter uploadableRanges, scanned
+// by parallelism goroutines, and returns the updated ranges. The function report, if not nil, is called with the
+// number of empty ranges found so far each time a range with data is found.
+func removeEmptyRanges(diskStream *diskstream.DiskStream, uploadableRanges []*common.IndexRange, parallelism int, report func(empty, total int)) ([]*common.IndexRange, error) {
 	totalRangesCount := len(uploadableRanges)
 	lastIndex := int32(-1)
 	emptyRangesCount := int32(0)
 	bits := make([]byte, int32(math.Ceil(float64(totalRangesCount)/float64(8))))
 	bmap := bitmap.NewBitMapFromByteSliceCopy(bits)
-	indexChan, errChan := LocateNonEmptyRangeIndices(diskStream, uploadableRanges)
+	indexChan, errChan := LocateNonEmptyRangeIndicesWithParallelism(diskStream, uploadableRanges, parallelism)
 L:
 	for {
 		select {
@@ -43,7 +65,9 @@ L:
 			bmap.Set(index, true)
 			emptyRangesCount += index - lastIndex - 1
 			lastIndex = index
-			fmt.Printf("\r Empty ranges : %d/%d", emptyRangesCount, totalRangesCount)
+			if report != nil {
+				report(int(emptyRangesCount), totalRangesCount)
+			}
 		case err := <-errChan:
 			return nil, err
 		}
@@ -67,36 +91,125 @@ L:
 // int channel will be closed on a successful completion, the caller must not expect any more value in the
 // int channel if the error channel is signaled.
 func LocateNonEmptyRangeIndices(stream *diskstream.DiskStream, ranges []*common.IndexRange) (<-chan int32, <-chan error) {
+	return LocateNonEmptyRangeIndicesWithParallelism(stream, ranges, 1)
+}
+
+// LocateNonEmptyRangeIndicesWithParallelism is like LocateNonEmptyRangeIndices, but the ranges are scanned by
+// 'parallelism' goroutines, each reading from its own duplicate of the stream, the indices are still reported
+// in ascending order.
+func LocateNonEmptyRangeIndicesWithParallelism(stream *diskstream.DiskStream, ranges []*common.IndexRange, parallelism int) (<-chan int32, <-chan error) {
 	indexChan := make(chan int32, 0)
 	errorChan := make(chan error, 0)
 	go func() {
-		count := int64(-1)
-		var buf []byte
-		for index, r := range ranges {
-			if count != r.Length() {
-				count = r.Length()
-				buf = make([]byte, count)
-			}
-
-			_, err := stream.Seek(r.Start, 0)
-			if err != nil {
-				errorChan <- err
-				return
-			}
-			_, err = io.ReadFull(stream, buf)
-			if err != nil {
-				errorChan <- err
-				return
-			}
-			if !isAllZero(buf) {
-				indexChan <- int32(index)
-			}
+		if err := locateNonEmptyRangeIndices(stream, ranges, parallelism, indexChan); err != nil {
+			errorChan <- err
+			return
 		}
 		close(indexChan)
 	}()
 	return indexChan, errorChan
 }
 
+// locateNonEmptyRangeIndices implements LocateNonEmptyRangeIndicesWithParallelism, it sends the indices of the non-empty ranges
+// to indexChan and returns the first error. It returns once the goroutines scanning the ranges are gone and the
+// duplicates of the stream closed, so the caller may close the stream as soon as it gets the error.
+func locateNonEmptyRangeIndices(stream *diskstream.DiskStream, ranges []*common.IndexRange, parallelism int, indexChan chan<- int32) error {
+	if parallelism > len(ranges) {
+		parallelism = len(ranges)
+	}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	streams := make([]*diskstream.DiskStream, parallelism)
+	streams[0] = stream
+	for i := 1; i < parallelism; i++ {
+		s, err := stream.Duplicate()
+		if err != nil {
+			closeStreams(streams[1:i])
+			return err
+		}
+		streams[i] = s
+	}
+	defer closeStreams(streams[1:])
+
+	// Worker k scans the ranges with index k, k + parallelism, k + 2*parallelism, ... and reports
+	// the result of each range in its own channel, reading the channels in round-robin fashion
+	// gives the results in the order of the ranges. The streams are closed only once the workers
+	// are gone.
+	doneChan := make(chan struct{})
+	var scanners sync.WaitGroup
+	defer func() {
+		close(doneChan)
+		scanners.Wait()
+	}()
+	resultChans := make([]chan scanResult, parallelism)
+	for k := 0; k < parallelism; k++ {
+		resultChans[k] = make(chan scanResult, 1)
+		scanners.Add(1)
+		go func(k int) {
+			defer scanners.Done()
+			scanRanges(streams[k], ranges, k, parallelism, resultChans[k], doneChan)
+		}(k)
+	}
+
+	for index := range ranges {
+		result := <-resultChans[index%parallelism]
+		if result.err != nil {
+			return result.err
+		}
+		if !result.empty {
+			indexChan <- int32(index)
+		}
+	}
+	return nil
+}
+
+// scanResult describes the result of checking whether a range is empty.
+type scanResult struct {
+	empty bool
+	err   error
+}
+
+// scanRanges reads every step-th range starting from the range at index first and reports whether it
+// is empty to the resultChan channel. It stops after the first error or once doneChan is closed.
+func scanRanges(stream *diskstream.DiskStream, ranges []*common.IndexRange, first, step int, resultChan chan<- scanResult, doneChan <-chan struct{}) {
+	count := int64(-1)
+	var buf []byte
+	for index := first; index < len(ranges); index += step {
+		r := ranges[index]
+		if count != r.Length() {
+			count = r.Length()
+			buf = make([]byte, count)
+		}
+
+		var result scanResult
+		if _, err := stream.Seek(r.Start, 0); err != nil {
+			result.err = err
+		} else if _, err := io.ReadFull(stream, buf); err != nil {
+			result.err = err
+		} else {
+			result.empty = isAllZero(buf)
+		}
+
+		select {
+		case resultChan <- result:
+		case <-doneChan:
+			return
+		}
+		if result.err != nil {
+			return
+		}
+	}
+}
+
+// closeStreams closes the given disk streams.
+func closeStreams(streams []*diskstream.DiskStream) {
+	for _, s := range streams {
+		s.Close()
+	}
+}
+
 // isAllZero returns true if the given byte slice contain all zeros
 func isAllZero(buf []byte) bool {
 	l := len(buf)
@@ -0,0 +1,103 @@
+package upload
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/flatcar/azure-vhd-utils/upload/uploadtest"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+)
+
+// testDiskRanges returns the ranges of testPageSetSize bytes of the fixed VHD at path.
+func testDiskRanges(tb testing.TB, path string) []*common.IndexRange {
+	tb.Helper()
+	stream := uploadtest.OpenVHD(tb, path)
+	ranges, err := LocateUploadableRanges(stream, nil, uploadtest.PageSize, testPageSetSize)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return ranges
+}
+
+func TestDetectEmptyRangesDoesNotDependOnParallelism(t *testing.T) {
+	var dataPages []int64
+	for p := int64(0); p < 8192; p += 300 {
+		dataPages = append(dataPages, p)
+	}
+	data := uploadtest.NewData(8192*uploadtest.PageSize, 4, dataPages...)
+	path := uploadtest.NewFixedVHD(t, data)
+
+	// The ranges with a non-zero byte, and the footer
+	var expected []*common.IndexRange
+	for _, r := range testDiskRanges(t, path) {
+		if r.Start >= int64(len(data)) || !isAllZero(data[r.Start:r.End+1]) {
+			expected = append(expected, r)
+		}
+	}
+	if len(expected) < 2 || len(expected) == len(testDiskRanges(t, path)) {
+		t.Fatalf("the disk has %d ranges with data, expected some empty ones", len(expected))
+	}
+
+	for _, parallelism := range []int{1, 2, 3, 8, 64, 1000} {
+		stream := uploadtest.OpenVHD(t, path)
+		ranges, err := DetectEmptyRangesWithParallelism(stream, testDiskRanges(t, path), parallelism, true)
+		if err != nil {
+			t.Fatalf("parallelism %d: %v", parallelism, err)
+		}
+		if len(ranges) != len(expected) {
+			t.Fatalf("parallelism %d: got %d ranges with data, expected %d", parallelism, len(ranges), len(expected))
+		}
+		for i, r := range ranges {
+			if r.Start != expected[i].Start || r.End != expected[i].End {
+				t.Fatalf("parallelism %d: got the range %s at index %d, expected %s", parallelism, r, i, expected[i])
+			}
+		}
+	}
+}
+
+func TestDetectEmptyRangesKeepsDynamicDiskRanges(t *testing.T) {
+	// A block of 512 KB allocated for its first page only, the other ranges of the block hold zeros
+	const blockSize = 512 * 1024
+	data := uploadtest.NewData(4*blockSize, 7, blockSize/uploadtest.PageSize)
+	stream := uploadtest.OpenVHD(t, uploadtest.NewDynamicVHD(t, data, blockSize))
+	expected, err := LocateUploadableRanges(stream, nil, uploadtest.PageSize, testPageSetSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(expected)) < blockSize/testPageSetSize {
+		t.Fatalf("got %d ranges, expected the block to span several ranges", len(expected))
+	}
+
+	for _, parallelism := range []int{1, 4} {
+		ranges, err := DetectEmptyRangesWithParallelism(stream, append([]*common.IndexRange(nil), expected...), parallelism, true)
+		if err != nil {
+			t.Fatalf("parallelism %d: %v", parallelism, err)
+		}
+		if len(ranges) != len(expected) {
+			t.Fatalf("parallelism %d: got %d ranges, expected the %d ranges of the allocated block", parallelism, len(ranges), len(expected))
+		}
+	}
+}
+
+func BenchmarkDetectEmptyRanges(b *testing.B) {
+	// One page with data in every fourth range of 64 KB
+	const size = 64 * 1024 * 1024
+	var dataPages []int64
+	for p := int64(0); p < size/uploadtest.PageSize; p += 4 * testPageSetSize / uploadtest.PageSize {
+		dataPages = append(dataPages, p)
+	}
+	path := uploadtest.NewFixedVHD(b, uploadtest.NewData(size, 5, dataPages...))
+	ranges := testDiskRanges(b, path)
+
+	for _, parallelism := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("parallelism=%d", parallelism), func(b *testing.B) {
+			stream := uploadtest.OpenVHD(b, path)
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				if _, err := removeEmptyRanges(stream, append([]*common.IndexRange(nil), ranges...), parallelism, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package upload
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Logger is the interface of the loggers with levels, the upload logs the retried writes and the pauses on
+// throttling as warnings and the failed writes as errors. The structured details of the messages, like the range of
+// a failed write, are appended to them as key=value pairs, unless the logger is a FieldLogger.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// FieldLogger is the optional interface of the loggers getting the structured details of a message, like the range
+// and the attempts of a failed write, as separate fields instead of having them appended to the message. The fields
+// may be nil.
+type FieldLogger interface {
+	Logger
+	LogFields(level Level, msg string, fields map[string]string)
+}
+
+// Level is the level of a logged message.
+type Level int
+
+const (
+	LevelInfo Level = iota
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// funcLogger is a Logger writing the messages to a function, the warnings and the errors are prefixed with their
+// level.
+type funcLogger func(string)
+
+// NewFuncLogger creates a Logger writing the messages of all levels to the given function, for the callers logging
+// with a func(string).
+func NewFuncLogger(logger func(string)) Logger {
+	return funcLogger(logger)
+}
+
+func (l funcLogger) Infof(format string, args ...interface{}) {
+	l(fmt.Sprintf(format, args...))
+}
+
+func (l funcLogger) Warnf(format string, args ...interface{}) {
+	l("Warning: " + fmt.Sprintf(format, args...))
+}
+
+func (l funcLogger) Errorf(format string, args ...interface{}) {
+	l("Error: " + fmt.Sprintf(format, args...))
+}
+
+// logFunc is the type of functions logging a message along with fields carrying structured details of the message.
+// The fields may be nil.
+type logFunc func(msg string, fields map[string]string)
+
+// newLogFunc returns the function logging the messages to the given logger at the given level, nil if the logger
+// is nil. The fields are passed to a FieldLogger as they are, for the other loggers they are appended to the
+// message as key=value pairs sorted by their key.
+func newLogFunc(logger Logger, level Level) logFunc {
+	if logger == nil {
+		return nil
+	}
+	if fieldLogger, ok := logger.(FieldLogger); ok {
+		return func(msg string, fields map[string]string) {
+			fieldLogger.LogFields(level, msg, fields)
+		}
+	}
+	logf := logger.Infof
+	switch level {
+	case LevelWarn:
+		logf = logger.Warnf
+	case LevelError:
+		logf = logger.Errorf
+	}
+	return func(msg string, fields map[string]string) {
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var b strings.Builder
+		b.WriteString(msg)
+		for _, k := range keys {
+			fmt.Fprintf(&b, " %s=%q", k, fields[k])
+		}
+		logf("%s", b.String())
+	}
+}
@@ -8,10 +8,14 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/flatcar/azure-vhd-utils/upload/progress"
+	"github.com/flatcar/azure-vhd-utils/vhdcore"
 	"github.com/flatcar/azure-vhd-utils/vhdcore/diskstream"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/footer"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/reader"
 )
 
 // The key of the page blob metadata collection entry holding VHD metadata as json.
@@ -30,6 +34,14 @@ type FileMetaData struct {
 	VHDSize          int64     `json:"vhdSize"`
 	LastModifiedTime time.Time `json:"lastModifiedTime"`
 	MD5Hash          []byte    `json:"md5Hash"` // Marshal will encodes []byte as a base64-encoded string
+	// DataComplete is set once all the data of the VHD is in the page blob, before the upload is
+	// finalized by setting the MD5 hash in the blob properties.
+	DataComplete bool `json:"dataComplete,omitempty"`
+	// FooterUniqueID and FooterCheckSum are the unique id and the checksum of the footer of the VHD
+	// uploaded, they tell a resumed upload whether the local VHD is still the one whose pages were
+	// written when the MD5 hash is not known yet. The blobs of older uploads lack them.
+	FooterUniqueID string `json:"footerUniqueId,omitempty"`
+	FooterCheckSum uint32 `json:"footerCheckSum,omitempty"`
 }
 
 // ToJSON returns MetaData as a json string.
@@ -64,6 +76,33 @@ func (m *MetaData) ToPtrMap() (map[string]*string, error) {
 // NewMetaDataFromLocalVHD creates a MetaData instance that should be associated with the page blob
 // holding the VHD. The parameter vhdPath is the path to the local VHD.
 func NewMetaDataFromLocalVHD(vhdPath string) (*MetaData, error) {
+	return newMetaDataFromLocalVHD(vhdPath, true)
+}
+
+// NewMetaDataFromLocalVHDWithoutHash creates a MetaData instance like NewMetaDataFromLocalVHD does, but does
+// not compute the MD5 hash of the VHD, sparing a full read of the disk. The caller is expected to fill in
+// FileMetaData.MD5Hash once the hash is known, e.g. after computing it while uploading the disk.
+func NewMetaDataFromLocalVHDWithoutHash(vhdPath string) (*MetaData, error) {
+	return newMetaDataFromLocalVHD(vhdPath, false)
+}
+
+// newMetaDataFromLocalVHD creates a MetaData instance for the local VHD identified by the parameter vhdPath,
+// including the MD5 hash of the VHD only if the parameter computeHash is true.
+func newMetaDataFromLocalVHD(vhdPath string, computeHash bool) (*MetaData, error) {
+	diskStream, err := diskstream.CreateNewDiskStream(vhdPath)
+	if err != nil {
+		return nil, err
+	}
+	defer diskStream.Close()
+	return NewMetaDataFromDiskStream(vhdPath, diskStream, computeHash, nil, false)
+}
+
+// NewMetaDataFromDiskStream creates a MetaData instance for the local VHD identified by the parameter vhdPath,
+// the size and the MD5 hash of the VHD are those of the given disk stream over it, so they account for the
+// options of the stream. The MD5 hash is computed only if the parameter computeHash is true, using a duplicate
+// of the stream, so the given stream is left untouched. The progress of the computation is printed, unless the
+// parameter quiet is true, and passed to the parameter callback if it is not nil.
+func NewMetaDataFromDiskStream(vhdPath string, diskStream *diskstream.DiskStream, computeHash bool, callback func(record progress.Record), quiet bool) (*MetaData, error) {
 	fileStat, err := getFileStat(vhdPath)
 	if err != nil {
 		return nil, err
@@ -73,17 +112,26 @@ func NewMetaDataFromLocalVHD(vhdPath string) (*MetaData, error) {
 		FileName:         fileStat.Name(),
 		FileSize:         fileStat.Size(),
 		LastModifiedTime: fileStat.ModTime(),
+		VHDSize:          diskStream.GetSize(),
 	}
 
-	diskStream, err := diskstream.CreateNewDiskStream(vhdPath)
+	vhdFooter, err := readFooter(diskStream)
 	if err != nil {
 		return nil, err
 	}
-	defer diskStream.Close()
-	fileMetaData.VHDSize = diskStream.GetSize()
-	fileMetaData.MD5Hash, err = calculateMD5Hash(diskStream)
-	if err != nil {
-		return nil, err
+	fileMetaData.FooterUniqueID = vhdFooter.UniqueID.String()
+	fileMetaData.FooterCheckSum = vhdFooter.CheckSum
+
+	if computeHash {
+		hashStream, err := diskStream.Duplicate()
+		if err != nil {
+			return nil, err
+		}
+		defer hashStream.Close()
+		fileMetaData.MD5Hash, err = calculateMD5Hash(hashStream, callback, quiet)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &MetaData{
@@ -94,8 +142,16 @@ func NewMetaDataFromLocalVHD(vhdPath string) (*MetaData, error) {
 // NewMetadataFromBlobMetadata returns MetaData instance associated with a Azure page blob, if there is no MetaData
 // associated with the blob it returns nil value for MetaData
 func NewMetadataFromBlobMetadata(blobmd map[string]*string) (*MetaData, error) {
-	m, ok := blobmd[metaDataKey]
-	if !ok || m == nil {
+	// Metadata names are case-insensitive, the client returns
+	// them with the case of the HTTP header they came in.
+	var m *string
+	for k, v := range blobmd {
+		if strings.EqualFold(k, metaDataKey) {
+			m = v
+			break
+		}
+	}
+	if m == nil {
 		return nil, nil
 	}
 	metadata := new(MetaData)
@@ -105,18 +161,54 @@ func NewMetadataFromBlobMetadata(blobmd map[string]*string) (*MetaData, error) {
 	return metadata, nil
 }
 
+// HasMetaData returns true if the blob metadata collection has the VHD metadata entry, the marker left on the
+// page blob by an upload.
+func HasMetaData(blobmd map[string]*string) bool {
+	for k := range blobmd {
+		if IsMetaDataKey(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsMetaDataKey returns true if name is the name of the VHD metadata entry in a blob metadata collection.
+func IsMetaDataKey(name string) bool {
+	return strings.EqualFold(name, metaDataKey)
+}
+
+// WithoutMetaData returns a copy of the blob metadata collection without the VHD metadata entry.
+func WithoutMetaData(blobmd map[string]*string) map[string]*string {
+	m := make(map[string]*string, len(blobmd))
+	for k, v := range blobmd {
+		if !strings.EqualFold(k, metaDataKey) {
+			m[k] = v
+		}
+	}
+	return m
+}
+
 // CompareMetaData compares the MetaData associated with the remote page blob and local VHD file. If both metadata
 // are same this method returns an empty error slice else a non-empty error slice with each error describing
-// the metadata entry that mismatched.
+// the metadata entry that mismatched. The MD5 hashes are compared only if the remote metadata has one, it is
+// missing if the upload was interrupted before the hash, computed while uploading, was known.
 func CompareMetaData(remote, local *MetaData) []error {
 	var metadataErrors = make([]error, 0)
-	if !bytes.Equal(remote.FileMetaData.MD5Hash, local.FileMetaData.MD5Hash) {
+	if len(remote.FileMetaData.MD5Hash) > 0 && !bytes.Equal(remote.FileMetaData.MD5Hash, local.FileMetaData.MD5Hash) {
 		metadataErrors = append(metadataErrors,
 			fmt.Errorf("MD5 hash of VHD file in Azure blob storage (%v) and local VHD file (%v) does not match",
 				base64.StdEncoding.EncodeToString(remote.FileMetaData.MD5Hash),
 				base64.StdEncoding.EncodeToString(local.FileMetaData.MD5Hash)))
 	}
 
+	if remote.FileMetaData.FooterUniqueID != "" &&
+		(remote.FileMetaData.FooterUniqueID != local.FileMetaData.FooterUniqueID || remote.FileMetaData.FooterCheckSum != local.FileMetaData.FooterCheckSum) {
+		metadataErrors = append(metadataErrors,
+			fmt.Errorf("Footer of the VHD file in Azure blob storage (unique id %s, checksum %08x) and local VHD file (unique id %s, checksum %08x) does not match",
+				remote.FileMetaData.FooterUniqueID, remote.FileMetaData.FooterCheckSum,
+				local.FileMetaData.FooterUniqueID, local.FileMetaData.FooterCheckSum))
+	}
+
 	if remote.FileMetaData.VHDSize != local.FileMetaData.VHDSize {
 		metadataErrors = append(metadataErrors,
 			fmt.Errorf("Logical size of the VHD file in Azure blob storage (%d) and local VHD file (%d) does not match",
@@ -129,7 +221,7 @@ func CompareMetaData(remote, local *MetaData) []error {
 				remote.FileMetaData.FileSize, local.FileMetaData.FileSize))
 	}
 
-	if remote.FileMetaData.LastModifiedTime != local.FileMetaData.LastModifiedTime {
+	if !remote.FileMetaData.LastModifiedTime.Equal(local.FileMetaData.LastModifiedTime) {
 		metadataErrors = append(metadataErrors,
 			fmt.Errorf("Last modified time of the VHD file in Azure blob storage (%v) and local VHD file (%v) does not match",
 				remote.FileMetaData.LastModifiedTime, local.FileMetaData.LastModifiedTime))
@@ -154,22 +246,49 @@ func getFileStat(filePath string) (os.FileInfo, error) {
 	return fd.Stat()
 }
 
-// calculateMD5Hash compute the MD5 checksum of a disk stream, it writes the compute progress in stdout
+// readFooter reads the footer at the end of the disk stream, the one uploaded, using a duplicate of the stream so
+// the given stream is left untouched.
+func readFooter(diskStream *diskstream.DiskStream) (*footer.Footer, error) {
+	footerStream, err := diskStream.Duplicate()
+	if err != nil {
+		return nil, err
+	}
+	defer footerStream.Close()
+	b := make([]byte, vhdcore.VhdFooterSize)
+	if _, err := footerStream.Seek(diskStream.GetSize()-vhdcore.VhdFooterSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(footerStream, b); err != nil {
+		return nil, fmt.Errorf("failed to read the footer of the VHD: %v", err)
+	}
+	return footer.NewFactory(reader.NewVhdReaderFromByteSlice(b)).Create()
+}
+
+// calculateMD5Hash compute the MD5 checksum of a disk stream, it writes the compute progress in stdout unless quiet
+// is true and passes it to the callback if it is not nil.
 // If there is an error in reading file, then the MD5 compute will stop and it return error.
-func calculateMD5Hash(diskStream *diskstream.DiskStream) ([]byte, error) {
-	progressStream := progress.NewReaderWithProgress(diskStream, diskStream.GetSize(), 1*time.Second)
+func calculateMD5Hash(diskStream *diskstream.DiskStream, callback func(record progress.Record), quiet bool) ([]byte, error) {
+	progressStream := progress.NewReaderWithProgressInPhase(diskStream, diskStream.GetSize(), 1*time.Second, progress.PhaseHashing)
 	defer progressStream.Close()
 
 	go func() {
 		s := time.Time{}
-		fmt.Println("Computing MD5 Checksum..")
+		if !quiet {
+			fmt.Println("Computing MD5 Checksum..")
+		}
 		for progressRecord := range progressStream.ProgressChan {
-			t := s.Add(progressRecord.RemainingDuration)
-			fmt.Printf("\r Completed: %3d%% RemainingTime: %02dh:%02dm:%02ds Throughput: %d MB/sec",
-				int(progressRecord.PercentComplete),
-				t.Hour(), t.Minute(), t.Second(),
-				int(progressRecord.AverageThroughputMbPerSecond),
-			)
+			if !quiet {
+				t := s.Add(progressRecord.RemainingDuration)
+				fmt.Printf("\r %s: %3d%% RemainingTime: %02dh:%02dm:%02ds Throughput: %d MB/sec",
+					progressRecord.Phase,
+					int(progressRecord.PercentComplete),
+					t.Hour(), t.Minute(), t.Second(),
+					int(progressRecord.AverageThroughputMbPerSecond),
+				)
+			}
+			if callback != nil {
+				callback(*progressRecord)
+			}
 		}
 	}()
 
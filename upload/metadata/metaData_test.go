@@ -0,0 +1,37 @@
+package metadata
+
+import (
+	"testing"
+	"time"
+)
+
+func testMetaData(uniqueID string, checkSum uint32) *MetaData {
+	return &MetaData{
+		FileMetaData: &FileMetaData{
+			FileName:         "disk.vhd",
+			FileSize:         1024,
+			VHDSize:          1024,
+			LastModifiedTime: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+			FooterUniqueID:   uniqueID,
+			FooterCheckSum:   checkSum,
+		},
+	}
+}
+
+func TestCompareMetaDataFooter(t *testing.T) {
+	local := testMetaData("8f0c5e4b-8d1c-4bb5-9c5e-0f1d2a3b4c5d", 0xfffff0ab)
+	for _, test := range []struct {
+		name   string
+		remote *MetaData
+		errors int
+	}{
+		{"same footer", testMetaData("8f0c5e4b-8d1c-4bb5-9c5e-0f1d2a3b4c5d", 0xfffff0ab), 0},
+		{"other unique id", testMetaData("00000000-8d1c-4bb5-9c5e-0f1d2a3b4c5d", 0xfffff0ab), 1},
+		{"other checksum", testMetaData("8f0c5e4b-8d1c-4bb5-9c5e-0f1d2a3b4c5d", 0xfffff0ac), 1},
+		{"older upload without footer", testMetaData("", 0), 0},
+	} {
+		if errs := CompareMetaData(test.remote, local); len(errs) != test.errors {
+			t.Errorf("%s: got the errors %v, expected %d", test.name, errs, test.errors)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package upload
+
+import (
+	"context"
+	"io"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/pageblob"
+)
+
+// PageBlobClient is the subset of the operations of a page blob client used by an upload, it is implemented by
+// *pageblob.Client. Another implementation, e.g. an in-memory one, can be used to run an upload without Azure.
+type PageBlobClient interface {
+	// Create creates the page blob with the given size, replacing an existing one.
+	Create(ctx context.Context, size int64, o *pageblob.CreateOptions) (pageblob.CreateResponse, error)
+	// UploadPages writes the body to the given range of the page blob.
+	UploadPages(ctx context.Context, body io.ReadSeekCloser, contentRange blob.HTTPRange, options *pageblob.UploadPagesOptions) (pageblob.UploadPagesResponse, error)
+	// ClearPages frees the pages of the given range of the page blob.
+	ClearPages(ctx context.Context, rnge blob.HTTPRange, options *pageblob.ClearPagesOptions) (pageblob.ClearPagesResponse, error)
+	// NewGetPageRangesPager returns a pager over the allocated page ranges of the page blob.
+	NewGetPageRangesPager(o *pageblob.GetPageRangesOptions) *runtime.Pager[pageblob.GetPageRangesResponse]
+	// DownloadStream reads the given range of the page blob.
+	DownloadStream(ctx context.Context, o *blob.DownloadStreamOptions) (blob.DownloadStreamResponse, error)
+	// GetProperties returns the properties and the metadata of the page blob.
+	GetProperties(ctx context.Context, o *blob.GetPropertiesOptions) (blob.GetPropertiesResponse, error)
+	// SetMetadata replaces the metadata of the page blob.
+	SetMetadata(ctx context.Context, metadata map[string]*string, o *blob.SetMetadataOptions) (blob.SetMetadataResponse, error)
+	// SetHTTPHeaders replaces the HTTP headers of the page blob, like its MD5 hash.
+	SetHTTPHeaders(ctx context.Context, HTTPHeaders blob.HTTPHeaders, o *blob.SetHTTPHeadersOptions) (blob.SetHTTPHeadersResponse, error)
+	// UpdateSequenceNumber changes the sequence number of the page blob, the writes can be conditioned on it.
+	UpdateSequenceNumber(ctx context.Context, options *pageblob.UpdateSequenceNumberOptions) (pageblob.UpdateSequenceNumberResponse, error)
+	// SetTags replaces the tags of the page blob.
+	SetTags(ctx context.Context, tags map[string]string, o *blob.SetTagsOptions) (blob.SetTagsResponse, error)
+	// GetAccountInfo returns the SKU and the kind of the storage account of the page blob.
+	GetAccountInfo(ctx context.Context, o *blob.GetAccountInfoOptions) (blob.GetAccountInfoResponse, error)
+}
+
+var _ PageBlobClient = (*pageblob.Client)(nil)
@@ -0,0 +1,16 @@
+package progress
+
+// Phase is the label of the work whose progress a Record reports, the upload of a VHD runs
+// through several phases reading the whole disk.
+type Phase string
+
+const (
+	// PhaseHashing is the computation of the MD5 hash of the VHD
+	PhaseHashing Phase = "Hashing"
+	// PhaseUploading is the upload of the ranges of the VHD
+	PhaseUploading Phase = "Uploading"
+	// PhaseVerifying is the verification of the VHD against its expected MD5 hash
+	PhaseVerifying Phase = "Verifying"
+	// PhaseDownloading is the download of the ranges of a page blob
+	PhaseDownloading Phase = "Downloading"
+)
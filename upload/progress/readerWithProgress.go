@@ -17,9 +17,16 @@ type ReaderWithProgress struct {
 // progressIntervalInSeconds is the interval at which the read progress needs to be send to ProgressChan channel.
 // After using the this reader, it must be closed by calling Close method to avoid goroutine leak.
 func NewReaderWithProgress(inner io.ReadCloser, sizeInBytes int64, progressIntervalInSeconds time.Duration) *ReaderWithProgress {
+	return NewReaderWithProgressInPhase(inner, sizeInBytes, progressIntervalInSeconds, "")
+}
+
+// NewReaderWithProgressInPhase creates a new instance of ReaderWithProgress like NewReaderWithProgress does, the
+// progress records sent to ProgressChan report the given phase.
+func NewReaderWithProgressInPhase(inner io.ReadCloser, sizeInBytes int64, progressIntervalInSeconds time.Duration, phase Phase) *ReaderWithProgress {
 	r := &ReaderWithProgress{}
 	r.innerReadCloser = inner
-	r.progressStatus = NewStatus(0, 0, sizeInBytes, NewComputestateDefaultSize())
+	r.progressStatus = NewStatus(0, 0, sizeInBytes, NewComputestateDefaultSize(), DefaultThroughputWindow, DefaultThroughputSmoothing)
+	r.progressStatus.SetPhase(phase)
 	r.ProgressChan = r.progressStatus.Run()
 	return r
 }
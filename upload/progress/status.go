@@ -1,7 +1,12 @@
 package progress
 
 import (
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
 )
 
 // Status can be used by a collection of workers (reporters) to report the amount of work done when they need,
@@ -9,19 +14,49 @@ import (
 type Status struct {
 	bytesProcessedCountChan chan int64
 	doneChan                chan bool
-	bytesProcessed          int64
+	exitedChan              chan struct{} // Closed once the last progress record has been sent
+	closeMutex              sync.RWMutex  // Guards closed and the sends on bytesProcessedCountChan
+	closed                  bool
+	endTime                 time.Time // The time of the Close, guarded by closeMutex
+	bytesProcessed          int64     // Updated atomically, read by the progress record sender
 	totalBytes              int64
+	blocksCompleted         int64 // Updated atomically, read by the progress record sender
+	blocksTotal             int64
 	alreadyProcessedBytes   int64
 	startTime               time.Time
 	throughputStats         *ComputeStats
+	throughputWindow        time.Duration
+	smoothing               float64 // The weight of the newest throughput in smoothedThroughput
+	smoothedThroughput      float64 // The exponential moving average of the running average throughput in MB, -1 before the first record
+	samples                 []throughputSample
+	rangesMutex             sync.Mutex
+	inFlightRanges          map[*common.IndexRange]struct{}
+	lastStartedRange        *common.IndexRange
+	phase                   Phase
 }
 
 // Record type is used by the ProgressStatus to report the progress at regular interval.
 type Record struct {
+	Phase                        Phase // The phase of the work reported, empty if not set on the Status
 	PercentComplete              float64
-	AverageThroughputMbPerSecond float64
-	RemainingDuration            time.Duration
+	AverageThroughputMbPerSecond float64       // The running average of the throughput since the start, smoothed across the records
+	RawThroughputMbPerSecond     float64       // The running average of the throughput since the start, as of this record
+	WindowThroughputMbPerSecond  float64       // The throughput over the throughput window, the average one without it
+	RemainingDuration            time.Duration // Estimated from the throughput over the window, if any
 	BytesProcessed               int64
+	LastStartedRange             *common.IndexRange   // The range whose processing started most recently, if any
+	InFlightRanges               []*common.IndexRange // The ranges being processed, sorted by their start
+	BlocksTotal                  int64                // The number of blocks to process, zero if not set on the Status
+	BlocksCompleted              int64                // The number of blocks processed so far
+}
+
+// Summary describes the whole processing tracked by a Status, from its creation until it is closed.
+type Summary struct {
+	Phase                        Phase         // The phase of the work, empty if not set on the Status
+	BytesProcessed               int64         // The bytes processed, without the ones already processed before
+	TotalBytes                   int64         // The bytes the processing was to process
+	Duration                     time.Duration // The time elapsed since the Status was created until it was closed, or until now
+	AverageThroughputMbPerSecond float64       // The throughput over the Duration
 }
 
 // oneMB is one MegaByte
@@ -30,26 +65,92 @@ const oneMB = float64(1048576)
 // nanosecondsInOneSecond is 1 second expressed as nano-second unit
 const nanosecondsInOneSecond = 1000 * 1000 * 1000
 
+// DefaultThroughputWindow is the period over which the recent throughput the remaining time is estimated from is
+// computed by default.
+const DefaultThroughputWindow = 10 * time.Second
+
+// DefaultThroughputSmoothing is the smoothing factor of the reported average throughput used by default.
+const DefaultThroughputSmoothing = 0.2
+
 // NewStatus creates a new instance of Status. reporterCount is the number of concurrent goroutines that want to
 // report processed bytes count, alreadyProcessedBytes is the bytes already processed if any, the parameter
 // totalBytes is the total number of bytes that the reports will be process eventually, the parameter computeStats
-// is used to calculate the running average.
-func NewStatus(reportersCount int, alreadyProcessedBytes, totalBytes int64, computeStats *ComputeStats) *Status {
+// is used to calculate the running average. The remaining time is estimated from the throughput over the last
+// throughputWindow, which reacts faster to a change of bandwidth than the running average, a zero window uses the
+// running average instead. The average throughput reported is an exponential moving average of the running
+// average of the records, smoothing is the weight of the newest one, between 0 and 1, so the printed number does
+// not flicker, a smoothing of 1 or out of that range reports the running average as it is.
+func NewStatus(reportersCount int, alreadyProcessedBytes, totalBytes int64, computeStats *ComputeStats, throughputWindow time.Duration, smoothing float64) *Status {
+	if smoothing <= 0 || smoothing > 1 {
+		smoothing = 1
+	}
+	startTime := time.Now()
 	return &Status{
 		bytesProcessedCountChan: make(chan int64, reportersCount),
 		doneChan:                make(chan bool, 0),
+		exitedChan:              make(chan struct{}),
 		totalBytes:              totalBytes,
 		alreadyProcessedBytes:   alreadyProcessedBytes,
-		startTime:               time.Now(),
+		startTime:               startTime,
 		throughputStats:         computeStats,
+		throughputWindow:        throughputWindow,
+		smoothing:               smoothing,
+		smoothedThroughput:      -1,
+		samples:                 []throughputSample{{time: startTime}},
+		inFlightRanges:          make(map[*common.IndexRange]struct{}),
 	}
 }
 
-// ReportBytesProcessedCount method is used to report the number of bytes processed.
+// SetPhase sets the phase reported in the progress records, it must be called before Run.
+func (s *Status) SetPhase(phase Phase) {
+	s.phase = phase
+}
+
+// SetBlocksTotal sets the number of blocks the processed bytes are made of, the progress records then report it
+// with the number of blocks reported by ReportBlockComplete, it must be called before Run. The percentage stays
+// based on the bytes, since the blocks may differ in size.
+func (s *Status) SetBlocksTotal(total int64) {
+	s.blocksTotal = total
+}
+
+// ReportBytesProcessedCount method is used to report the number of bytes processed. The count reported once the
+// Status is closed is ignored.
 func (s *Status) ReportBytesProcessedCount(count int64) {
+	s.closeMutex.RLock()
+	defer s.closeMutex.RUnlock()
+	if s.closed {
+		return
+	}
 	s.bytesProcessedCountChan <- count
 }
 
+// ReportBlockComplete method is used to report that one more block was processed, in addition to reporting its
+// bytes with ReportBytesProcessedCount. The block reported once the Status is closed is ignored.
+func (s *Status) ReportBlockComplete() {
+	s.closeMutex.RLock()
+	defer s.closeMutex.RUnlock()
+	if s.closed {
+		return
+	}
+	atomic.AddInt64(&s.blocksCompleted, 1)
+}
+
+// ReportRangeStarted method is used to report that the processing of the range r started, the range is reported
+// as in-flight in the progress records until ReportRangeFinished is called for it.
+func (s *Status) ReportRangeStarted(r *common.IndexRange) {
+	s.rangesMutex.Lock()
+	defer s.rangesMutex.Unlock()
+	s.inFlightRanges[r] = struct{}{}
+	s.lastStartedRange = r
+}
+
+// ReportRangeFinished method is used to report that the processing of the range r, successful or not, is over.
+func (s *Status) ReportRangeFinished(r *common.IndexRange) {
+	s.rangesMutex.Lock()
+	defer s.rangesMutex.Unlock()
+	delete(s.inFlightRanges, r)
+}
+
 // Run starts counting the reported processed bytes count and compute the progress, this method returns a channel,
 // the computed progress will be send to this channel in regular interval. Once done with using ProgressStatus
 // instance, you must call Dispose method otherwise there will be go routine leak.
@@ -60,65 +161,168 @@ func (s *Status) Run() <-chan *Record {
 	return outChan
 }
 
-// Close disposes this ProgressStatus instance, an attempt to invoke ReportBytesProcessedCount method on a closed
-// instance will be panic. Close also stops sending progress to the channel returned by Run method. Not calling
-// Close will cause goroutine leak.
+// Close disposes this ProgressStatus instance, the bytes count reported by ReportBytesProcessedCount afterwards is
+// ignored and calling Close again does nothing. Once the counts reported before are added up, a last progress
+// record with the final count is sent to the channel returned by Run method and the channel is closed, Done can
+// be used to wait for it. Not calling Close will cause goroutine leak.
 func (s *Status) Close() {
-	close(s.bytesProcessedCountChan)
+	s.closeMutex.Lock()
+	defer s.closeMutex.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.endTime = time.Now()
+		close(s.bytesProcessedCountChan)
+	}
+}
+
+// Summary returns the summary of the processing, the elapsed time ends when Close is called. The bytes reported
+// just before Close may not be in the summary until the channel returned by Done is closed.
+func (s *Status) Summary() Summary {
+	s.closeMutex.RLock()
+	end := s.endTime
+	closed := s.closed
+	s.closeMutex.RUnlock()
+	if !closed {
+		end = time.Now()
+	}
+	summary := Summary{
+		Phase:          s.phase,
+		BytesProcessed: s.processedBytes(),
+		TotalBytes:     s.totalBytes,
+		Duration:       end.Sub(s.startTime),
+	}
+	if seconds := summary.Duration.Seconds(); seconds > 0 {
+		summary.AverageThroughputMbPerSecond = 8.0 * float64(summary.BytesProcessed) / oneMB / seconds
+	}
+	return summary
+}
+
+// Done returns a channel which is closed once the last progress record has been sent after Close and the channel
+// returned by Run method is closed.
+func (s *Status) Done() <-chan struct{} {
+	return s.exitedChan
 }
 
 // bytesProcessedCountReceiver read the channel containing the collection of reported bytes count and update the total
 // bytes processed. This method signal doneChan when there is no more data to read.
 func (s *Status) bytesProcessedCountReceiver() {
 	for c := range s.bytesProcessedCountChan {
-		s.bytesProcessed += c
+		atomic.AddInt64(&s.bytesProcessed, c)
 	}
 	s.doneChan <- true
 }
 
 // progressRecordSender compute the progress information at regular interval and send it to channel outChan which is
-// returned by the Run method
+// returned by the Run method. Once all the reported bytes count are read, it sends a last record and closes both
+// outChan and exitedChan.
 func (s *Status) progressRecordSender(outChan chan<- *Record) {
-	progressRecord := &Record{}
+	defer close(s.exitedChan)
 	tickerChan := time.NewTicker(500 * time.Millisecond)
 Loop:
 	for {
 		select {
 		case <-tickerChan.C:
-			computeAvg := s.throughputStats.ComputeAvg(s.throughputMBs())
-			avtThroughputMbps := 8.0 * computeAvg
-			remainingSeconds := (s.remainingMB() / computeAvg)
-
-			progressRecord.PercentComplete = s.percentComplete()
-			progressRecord.RemainingDuration = time.Duration(nanosecondsInOneSecond * remainingSeconds)
-			progressRecord.AverageThroughputMbPerSecond = avtThroughputMbps
-			progressRecord.BytesProcessed = s.bytesProcessed
-
-			outChan <- progressRecord
+			outChan <- s.record(time.Now())
 		case <-s.doneChan:
 			tickerChan.Stop()
 			break Loop
 		}
 	}
+	outChan <- s.record(time.Now())
 	close(outChan)
 }
 
+// record computes the progress information from the bytes processed so far, as of the time now.
+func (s *Status) record(now time.Time) *Record {
+	computeAvg := s.throughputStats.ComputeAvg(s.throughputMBs(now))
+	avtThroughputMbps := 8.0 * computeAvg
+	windowThroughput := computeAvg
+	if s.throughputWindow > 0 {
+		if w := s.windowThroughputMBs(now); w > 0 {
+			windowThroughput = w
+		}
+	}
+	remainingSeconds := (s.remainingMB() / windowThroughput)
+
+	progressRecord := &Record{Phase: s.phase}
+	progressRecord.PercentComplete = s.percentComplete()
+	progressRecord.RemainingDuration = time.Duration(nanosecondsInOneSecond * remainingSeconds)
+	progressRecord.AverageThroughputMbPerSecond = 8.0 * s.smoothThroughput(computeAvg)
+	progressRecord.RawThroughputMbPerSecond = avtThroughputMbps
+	progressRecord.WindowThroughputMbPerSecond = 8.0 * windowThroughput
+	progressRecord.BytesProcessed = s.processedBytes()
+	progressRecord.LastStartedRange, progressRecord.InFlightRanges = s.ranges()
+	progressRecord.BlocksTotal = s.blocksTotal
+	progressRecord.BlocksCompleted = atomic.LoadInt64(&s.blocksCompleted)
+	return progressRecord
+}
+
+// smoothThroughput adds the given running average throughput in MB to the exponential moving average of the
+// previous ones and returns it. The first throughput starts the average.
+func (s *Status) smoothThroughput(throughput float64) float64 {
+	if s.smoothedThroughput < 0 {
+		s.smoothedThroughput = throughput
+	} else {
+		s.smoothedThroughput = s.smoothing*throughput + (1-s.smoothing)*s.smoothedThroughput
+	}
+	return s.smoothedThroughput
+}
+
+// processedBytes returns the bytes processed so far.
+func (s *Status) processedBytes() int64 {
+	return atomic.LoadInt64(&s.bytesProcessed)
+}
+
+// ranges returns the range whose processing started most recently and a sorted copy of the in-flight ranges.
+func (s *Status) ranges() (*common.IndexRange, []*common.IndexRange) {
+	s.rangesMutex.Lock()
+	defer s.rangesMutex.Unlock()
+	inFlightRanges := make([]*common.IndexRange, 0, len(s.inFlightRanges))
+	for r := range s.inFlightRanges {
+		inFlightRanges = append(inFlightRanges, r)
+	}
+	sort.Slice(inFlightRanges, func(i, j int) bool {
+		return inFlightRanges[i].Start < inFlightRanges[j].Start
+	})
+	return s.lastStartedRange, inFlightRanges
+}
+
 // remainingMB returns remaining bytes to be processed as MB.
 func (s *Status) remainingMB() float64 {
-	return float64(s.totalBytes-s.bytesProcessed) / oneMB
+	return float64(s.totalBytes-s.processedBytes()) / oneMB
 }
 
 // percentComplete returns the percentage of bytes processed out of total bytes.
 func (s *Status) percentComplete() float64 {
-	return float64(100.0) * (float64(s.bytesProcessed) / float64(s.totalBytes))
+	return float64(100.0) * (float64(s.processedBytes()) / float64(s.totalBytes))
 }
 
-// processTime returns the Duration representing the time taken to process the bytes so far.
-func (s *Status) processTime() time.Duration {
-	return time.Since(s.startTime)
+// processTime returns the Duration representing the time taken to process the bytes so far, as of the time now.
+func (s *Status) processTime(now time.Time) time.Duration {
+	return now.Sub(s.startTime)
 }
 
-// throughputMBs returns the throughput in MB
-func (s *Status) throughputMBs() float64 {
-	return float64(s.bytesProcessed) / oneMB / s.processTime().Seconds()
+// throughputMBs returns the throughput in MB as of the time now
+func (s *Status) throughputMBs(now time.Time) float64 {
+	return float64(s.processedBytes()) / oneMB / s.processTime(now).Seconds()
+}
+
+// windowThroughputMBs records the bytes processed so far at the time now and returns the throughput in MB over the
+// throughput window ending then. The oldest sample kept is the last one taken before the window, so the
+// throughput covers the whole window once the processing ran for that long.
+func (s *Status) windowThroughputMBs(now time.Time) float64 {
+	s.samples = append(s.samples, throughputSample{time: now, bytesProcessed: s.processedBytes()})
+	windowStart := now.Add(-s.throughputWindow)
+	drop := 0
+	for drop+1 < len(s.samples) && !s.samples[drop+1].time.After(windowStart) {
+		drop++
+	}
+	s.samples = s.samples[drop:]
+
+	first, last := s.samples[0], s.samples[len(s.samples)-1]
+	elapsed := last.time.Sub(first.time).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.bytesProcessed-first.bytesProcessed) / oneMB / elapsed
 }
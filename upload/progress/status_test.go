@@ -0,0 +1,141 @@
+package progress
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+)
+
+func TestStatusReportsRacingClose(t *testing.T) {
+	const reporters = 8
+	for i := 0; i < 20; i++ {
+		s := NewStatus(reporters, 0, 1<<30, NewComputestateDefaultSize(), DefaultThroughputWindow, DefaultThroughputSmoothing)
+		records := s.Run()
+		drained := make(chan struct{})
+		go func() {
+			defer close(drained)
+			for range records {
+			}
+		}()
+
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for j := 0; j < reporters; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				<-start
+				for k := 0; k < 1000; k++ {
+					r := common.NewIndexRange(int64(k)*512, int64(k)*512+511)
+					s.ReportRangeStarted(r)
+					s.ReportBytesProcessedCount(512)
+					s.ReportBlockComplete()
+					s.ReportRangeFinished(r)
+				}
+			}(j)
+		}
+		close(start)
+		s.Close()
+		// The reports after the Close are ignored
+		wg.Wait()
+		s.Close()
+
+		select {
+		case <-s.Done():
+		case <-time.After(10 * time.Second):
+			t.Fatal("the status did not send its last record")
+		}
+		<-drained
+		if got := s.Summary().BytesProcessed; got > reporters*1000*512 {
+			t.Errorf("got %d bytes processed, expected at most the %d reported", got, reporters*1000*512)
+		}
+	}
+}
+
+// simulateStatus feeds the bytes of the steps to s, one step every interval of time since the start of s, and
+// returns the records computed after each step.
+func simulateStatus(s *Status, interval time.Duration, steps []int64) []*Record {
+	records := make([]*Record, 0, len(steps))
+	for i, bytes := range steps {
+		atomic.AddInt64(&s.bytesProcessed, bytes)
+		records = append(records, s.record(s.startTime.Add(time.Duration(i+1)*interval)))
+	}
+	return records
+}
+
+func TestStatusWindowedEstimateFollowsThroughputChange(t *testing.T) {
+	const interval = 500 * time.Millisecond
+	const total = 1 << 30
+	// 8 MB/s for 20 seconds, then 1 MB/s
+	var steps []int64
+	for i := 0; i < 40; i++ {
+		steps = append(steps, 4*1024*1024)
+	}
+	change := len(steps)
+	for i := 0; i < 120; i++ {
+		steps = append(steps, 512*1024)
+	}
+
+	// converged returns the number of steps after the change until the estimate of the remaining time stays
+	// within 10% of the one at 1 MB/s.
+	converged := func(records []*Record) int {
+		at := len(records)
+		for i := len(records) - 1; i >= change; i-- {
+			expected := float64(total-records[i].BytesProcessed) / (1024 * 1024)
+			if math.Abs(records[i].RemainingDuration.Seconds()-expected) > 0.1*expected {
+				break
+			}
+			at = i
+		}
+		return at - change
+	}
+	windowed := converged(simulateStatus(NewStatus(1, 0, total, NewComputestateDefaultSize(), 5*time.Second, 1), interval, steps))
+	cumulative := converged(simulateStatus(NewStatus(1, 0, total, NewComputestateDefaultSize(), 0, 1), interval, steps))
+	if windowed > 5*int(time.Second/interval)+1 {
+		t.Errorf("the windowed estimate converged after %d steps, expected it within the window", windowed)
+	}
+	if windowed >= cumulative {
+		t.Errorf("the windowed estimate converged after %d steps, the cumulative one after %d, expected it faster", windowed, cumulative)
+	}
+}
+
+// variance returns the variance of the values.
+func variance(values []float64) float64 {
+	var sum, squares float64
+	for _, v := range values {
+		sum += v
+		squares += v * v
+	}
+	mean := sum / float64(len(values))
+	return squares/float64(len(values)) - mean*mean
+}
+
+func TestStatusSmoothsNoisyThroughput(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	// Bursts of up to 8 MB every half second, like the writes of ranges completing in batches
+	steps := make([]int64, 120)
+	for i := range steps {
+		steps[i] = rnd.Int63n(8 * 1024 * 1024)
+	}
+	records := simulateStatus(NewStatus(1, 0, 1<<30, NewComputeStats(1), 0, DefaultThroughputSmoothing), 500*time.Millisecond, steps)
+
+	// The records of the first 10 seconds, with few bytes reported, are left out
+	var smoothed, raw []float64
+	for _, r := range records[20:] {
+		smoothed = append(smoothed, r.AverageThroughputMbPerSecond)
+		raw = append(raw, r.RawThroughputMbPerSecond)
+	}
+	if vs, vr := variance(smoothed), variance(raw); vs >= vr {
+		t.Errorf("got a variance of %.3f of the smoothed throughput, expected it below the %.3f of the raw one", vs, vr)
+	}
+	// The smoothing keeps the average throughput the records agree on
+	last := records[len(records)-1]
+	if math.Abs(last.AverageThroughputMbPerSecond-last.RawThroughputMbPerSecond) > 0.1*last.RawThroughputMbPerSecond {
+		t.Errorf("got the smoothed throughput %.2f, expected it close to the raw one %.2f", last.AverageThroughputMbPerSecond, last.RawThroughputMbPerSecond)
+	}
+}
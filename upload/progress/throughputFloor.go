@@ -0,0 +1,53 @@
+package progress
+
+import (
+	"time"
+)
+
+// ThroughputFloor detects a throughput staying below a minimum for a period of time.
+type ThroughputFloor struct {
+	minMbps float64
+	window  time.Duration
+	samples []throughputSample
+}
+
+// throughputSample is the number of bytes processed at a point in time.
+type throughputSample struct {
+	time           time.Time
+	bytesProcessed int64
+}
+
+// NewThroughputFloor creates a new instance of ThroughputFloor, the parameter minMbps is the minimum throughput in
+// megabits per second and the parameter window is the period of time the throughput needs to stay below it.
+func NewThroughputFloor(minMbps float64, window time.Duration) *ThroughputFloor {
+	return &ThroughputFloor{
+		minMbps: minMbps,
+		window:  window,
+	}
+}
+
+// IsBelow records the number of bytes processed so far at the given time and returns true if the throughput over
+// the last window was below the minimum. It returns false until the samples span a whole window.
+func (f *ThroughputFloor) IsBelow(bytesProcessed int64, now time.Time) bool {
+	f.samples = append(f.samples, throughputSample{time: now, bytesProcessed: bytesProcessed})
+
+	// Drop the samples not needed to cover the last window, the oldest kept sample is the newest one which is at
+	// least window old.
+	windowStart := now.Add(-f.window)
+	i := 0
+	for i+1 < len(f.samples) && !f.samples[i+1].time.After(windowStart) {
+		i++
+	}
+	f.samples = f.samples[i:]
+
+	oldest := f.samples[0]
+	if oldest.time.After(windowStart) {
+		return false
+	}
+	seconds := now.Sub(oldest.time).Seconds()
+	if seconds <= 0 {
+		return false
+	}
+	mbps := 8.0 * float64(bytesProcessed-oldest.bytesProcessed) / oneMB / seconds
+	return mbps < f.minMbps
+}
@@ -0,0 +1,57 @@
+package upload
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the bandwidth of the page writes with a token bucket: the bucket fills with one token per
+// byte at the allowed rate, up to one second worth of tokens, and a write takes as many tokens as it has bytes
+// before it is sent. A write larger than the tokens available takes them in advance, the next writes wait until
+// the debt is paid back, so the writes in flight together keep to the rate.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64 // The bytes per second allowed
+	tokens float64 // The bytes which can be sent right away, negative when in debt
+	last   time.Time
+}
+
+// newRateLimiter creates a new instance of rateLimiter allowing bytesPerSecond bytes per second, the bucket starts
+// full.
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until count bytes can be sent or the context is done.
+func (l *rateLimiter) wait(ctx context.Context, count int64) error {
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(count)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mutex.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,23 @@
+package upload
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+// isRetriable returns true if a write failing with the error is worth retrying. The responses of the service for
+// a throttling, a timeout or a server error are, the other client errors like 403 Forbidden or 404 Not Found
+// would fail again and only hide the reason. Errors without a response, like the network ones, are retried.
+func isRetriable(err error) bool {
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		return true
+	}
+	switch respErr.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return respErr.StatusCode >= http.StatusInternalServerError
+}
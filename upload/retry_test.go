@@ -0,0 +1,46 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+
+	"github.com/flatcar/azure-vhd-utils/upload/uploadtest"
+)
+
+func TestIsRetriable(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		err       error
+		retriable bool
+	}{
+		{"request timeout", uploadtest.NewResponseError(http.StatusRequestTimeout, "OperationTimedOut"), true},
+		{"too many requests", uploadtest.NewResponseError(http.StatusTooManyRequests, "TooManyRequests"), true},
+		{"bad request", uploadtest.NewResponseError(http.StatusBadRequest, "InvalidHeaderValue"), false},
+		{"forbidden", uploadtest.NewResponseError(http.StatusForbidden, "AuthorizationFailure"), false},
+		{"not found", uploadtest.NewResponseError(http.StatusNotFound, "BlobNotFound"), false},
+		{"conflict", uploadtest.NewResponseError(http.StatusConflict, "LeaseIdMissing"), false},
+		{"precondition failed", uploadtest.NewResponseError(http.StatusPreconditionFailed, "SequenceNumberConditionNotMet"), false},
+		{"range not satisfiable", uploadtest.NewResponseError(http.StatusRequestedRangeNotSatisfiable, "InvalidPageRange"), false},
+		{"internal server error", uploadtest.NewResponseError(http.StatusInternalServerError, "InternalError"), true},
+		{"bad gateway", uploadtest.NewResponseError(http.StatusBadGateway, ""), true},
+		{"service unavailable", uploadtest.NewResponseError(http.StatusServiceUnavailable, "ServerBusy"), true},
+		{"gateway timeout", uploadtest.NewResponseError(http.StatusGatewayTimeout, ""), true},
+		{"wrapped server error", fmt.Errorf("write failed: %w", uploadtest.NewResponseError(http.StatusServiceUnavailable, "ServerBusy")), true},
+		{"wrapped client error", fmt.Errorf("write failed: %w", uploadtest.NewResponseError(http.StatusForbidden, "AuthorizationFailure")), false},
+		{"connection reset", &net.OpError{Op: "write", Net: "tcp", Err: syscall.ECONNRESET}, true},
+		{"dns", &net.DNSError{Err: "no such host", Name: "account.blob.core.windows.net", IsTemporary: true}, true},
+		// The cancellation is told by the context of the upload, not by the error of a write
+		{"cancelled", context.Canceled, true},
+		{"deadline exceeded", context.DeadlineExceeded, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isRetriable(test.err); got != test.retriable {
+				t.Errorf("got %v for error %v, expected %v", got, test.err, test.retriable)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package upload
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/diskstream"
+)
+
+// MinimizeSparseRanges reads the ranges identified by the parameter uploadableRanges from the disk stream and
+// replaces each range whose fraction of all-zero pages is at least threshold with the runs of its non-zero pages.
+// It returns the updated ranges. The parameter pageSize is the size of a page blob page in bytes, every range
+// is expected to be a multiple of it.
+//
+// Unlike DetectEmptyRanges, which only drops ranges made entirely of zeros, this catches mostly-empty ranges
+// too, at the cost of more and smaller page writes. Nothing is lost since the skipped pages contain zeros only,
+// but it relies on the destination page blob being freshly created, the pages never written read back as zeros
+// only in that case. If quiet is true, nothing is printed as the ranges are read.
+func MinimizeSparseRanges(diskStream *diskstream.DiskStream, uploadableRanges []*common.IndexRange, pageSize int64, threshold float64, quiet bool) ([]*common.IndexRange, error) {
+	if !quiet {
+		fmt.Println("\nDetecting mostly empty ranges..")
+	}
+	totalRangesCount := len(uploadableRanges)
+	minimizedRangesCount := 0
+	result := make([]*common.IndexRange, 0, totalRangesCount)
+	var buf []byte
+	for i, r := range uploadableRanges {
+		var err error
+		if buf, err = readRange(diskStream, r, buf); err != nil {
+			return nil, err
+		}
+
+		nonZeroRanges, zeroPagesCount, pagesCount := locateNonZeroPages(buf, r.Start, pageSize)
+		if float64(zeroPagesCount) >= threshold*float64(pagesCount) {
+			result = append(result, nonZeroRanges...)
+			minimizedRangesCount++
+		} else {
+			result = append(result, r)
+		}
+		if !quiet {
+			fmt.Printf("\r Mostly empty ranges : %d/%d", minimizedRangesCount, i+1)
+		}
+	}
+	if !quiet {
+		fmt.Println()
+	}
+	return result, nil
+}
+
+// NonZeroPageRanges reads the ranges identified by the parameter ranges from the disk stream and returns the
+// ranges covering the runs of consecutive pages of pageSize bytes that are not all zeros. Each range is read
+// at once, so the ranges should be chunked to a reasonable size.
+func NonZeroPageRanges(diskStream *diskstream.DiskStream, ranges []*common.IndexRange, pageSize int64) ([]*common.IndexRange, error) {
+	var result []*common.IndexRange
+	var buf []byte
+	for _, r := range ranges {
+		var err error
+		if buf, err = readRange(diskStream, r, buf); err != nil {
+			return nil, err
+		}
+		nonZeroRanges, _, _ := locateNonZeroPages(buf, r.Start, pageSize)
+		result = append(result, nonZeroRanges...)
+	}
+	return result, nil
+}
+
+// readRange reads the range r from the disk stream into buf, which is reallocated if its size does not match the
+// length of the range. It returns the buffer holding the data.
+func readRange(diskStream *diskstream.DiskStream, r *common.IndexRange, buf []byte) ([]byte, error) {
+	if int64(len(buf)) != r.Length() {
+		buf = make([]byte, r.Length())
+	}
+	if _, err := diskStream.Seek(r.Start, 0); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(diskStream, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// locateNonZeroPages splits the data buf, starting at the stream offset start, into pages of pageSize bytes and
+// returns the ranges covering the runs of consecutive non-zero pages, along with the number of all-zero pages
+// and the total number of pages.
+func locateNonZeroPages(buf []byte, start, pageSize int64) (ranges []*common.IndexRange, zeroPagesCount, pagesCount int64) {
+	runStart := int64(-1)
+	length := int64(len(buf))
+	for offset := int64(0); offset < length; offset += pageSize {
+		end := offset + pageSize
+		if end > length {
+			end = length
+		}
+		pagesCount++
+		if isAllZero(buf[offset:end]) {
+			zeroPagesCount++
+			if runStart != -1 {
+				ranges = append(ranges, common.NewIndexRange(start+runStart, start+offset-1))
+				runStart = -1
+			}
+		} else if runStart == -1 {
+			runStart = offset
+		}
+	}
+	if runStart != -1 {
+		ranges = append(ranges, common.NewIndexRange(start+runStart, start+length-1))
+	}
+	return ranges, zeroPagesCount, pagesCount
+}
@@ -0,0 +1,64 @@
+package upload
+
+import (
+	"testing"
+
+	"github.com/flatcar/azure-vhd-utils/upload/uploadtest"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+)
+
+// pageRange returns the range from the page first to the page last, both included.
+func pageRange(first, last int64) *common.IndexRange {
+	return common.NewIndexRange(first*uploadtest.PageSize, (last+1)*uploadtest.PageSize-1)
+}
+
+func TestMinimizeSparseRanges(t *testing.T) {
+	// Ranges of 8 pages: 2 pages with data apart, 3 consecutive pages with data, none and all of them
+	dataPages := []int64{1, 3, 8, 9, 10, 24, 25, 26, 27, 28, 29, 30, 31}
+	data := uploadtest.NewData(32*uploadtest.PageSize, 6, dataPages...)
+	path := uploadtest.NewFixedVHD(t, data)
+	ranges := []*common.IndexRange{pageRange(0, 7), pageRange(8, 15), pageRange(16, 23), pageRange(24, 31)}
+
+	for _, test := range []struct {
+		name      string
+		threshold float64
+		expected  []*common.IndexRange
+	}{
+		{
+			name:      "zero splits all",
+			threshold: 0,
+			expected:  []*common.IndexRange{pageRange(1, 1), pageRange(3, 3), pageRange(8, 10), pageRange(24, 31)},
+		},
+		{
+			name:      "six zero pages of eight at three quarters",
+			threshold: 0.75,
+			expected:  []*common.IndexRange{pageRange(1, 1), pageRange(3, 3), pageRange(8, 15), pageRange(24, 31)},
+		},
+		{
+			name:      "five zero pages of eight at five eighths",
+			threshold: 0.625,
+			expected:  []*common.IndexRange{pageRange(1, 1), pageRange(3, 3), pageRange(8, 10), pageRange(24, 31)},
+		},
+		{
+			name:      "one drops the empty ranges only",
+			threshold: 1,
+			expected:  []*common.IndexRange{pageRange(0, 7), pageRange(8, 15), pageRange(24, 31)},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			stream := uploadtest.OpenVHD(t, path)
+			result, err := MinimizeSparseRanges(stream, append([]*common.IndexRange(nil), ranges...), uploadtest.PageSize, test.threshold, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result) != len(test.expected) {
+				t.Fatalf("got the ranges %v, expected %v", result, test.expected)
+			}
+			for i, r := range result {
+				if r.Start != test.expected[i].Start || r.End != test.expected[i].End {
+					t.Fatalf("got the ranges %v, expected %v", result, test.expected)
+				}
+			}
+		})
+	}
+}
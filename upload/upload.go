@@ -5,7 +5,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/flatcar/azure-vhd-utils/upload/concurrent"
@@ -14,7 +18,6 @@ import (
 	"github.com/flatcar/azure-vhd-utils/vhdcore/diskstream"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
-	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/pageblob"
 )
 
 // DiskUploadContext type describes VHD upload context, this includes the disk stream to read from, the ranges of the
@@ -24,11 +27,75 @@ type DiskUploadContext struct {
 	VhdStream             *diskstream.DiskStream // The stream whose ranges needs to be uploaded
 	AlreadyProcessedBytes int64                  // The size in bytes already uploaded
 	UploadableRanges      []*common.IndexRange   // The subset of stream ranges to be uploaded
-	PageblobClient        *pageblob.Client       // The client to make Azure blob service API calls
+	PageblobClient        PageBlobClient         // The client to make Azure blob service API calls
 	Parallelism           int                    // The number of concurrent goroutines to be used for upload
 	Resume                bool                   // Indicate whether this is a new or resuming upload
+	Hash                  hash.Hash              // If not nil, fed with the content of the whole disk while reading the ranges
+	MinThroughputMbps     float64                // If greater than zero, abort if the throughput in Mb/sec stays below it
+	MinThroughputWindow   time.Duration          // The period of time the throughput needs to stay below MinThroughputMbps
+	Logger                Logger                 // If not nil, used to log the upload size, the failed writes, the retries and the throttling instead of printing them
+	BusyThreshold         int                    // The number of consecutive 503 responses pausing all writes, zero disables it
+	BusyCoolDown          time.Duration          // The period of time the writes are paused for after BusyThreshold 503 responses
+	Progress              ProgressCallback       // If not nil, called with every progress record
+	QuietProgress         bool                   // Do not print anything, e.g. when Progress renders the progress, the messages still go to Logger
+	NoFinalStatus         bool                   // Skip printing the final 100% status line on success
+	AdaptiveParallelism   bool                   // Adapt the writes in flight to the throughput, up to Parallelism
+	MinParallelism        int                    // The least writes in flight with AdaptiveParallelism, 1 if not greater than zero
+	MaxRetriesPerBlock    int                    // The number of retries of a failed write, zero for the default of 5, negative for none
+	RetryBackoff          time.Duration          // The delay before the first retry of a failed write, doubled for each next one
+	OperationTimeout      time.Duration          // If greater than zero, the time a write may take before it is abandoned and retried
+	MaxBytesPerSecond     int64                  // If greater than zero, the bandwidth the writes are limited to
+	ReadParallelism       int                    // The number of goroutines reading the ranges from the disk, 1 if not greater than zero
+	QueueDepth            int                    // The number of ranges read ahead of the writes buffered for the workers, none if not greater than zero
+	BlockDigests          *BlockDigests          // If not nil, fed with the SHA256 digest of every range written
+	LogBlocks             bool                   // Log every write of a range started, done or failed instead of printing the progress
 }
 
+// logger returns the function logging the events of the given level, nil if the events are printed instead.
+func (uctx *DiskUploadContext) logger(level Level) logFunc {
+	return newLogFunc(uctx.Logger, level)
+}
+
+// statusLogger returns the function logging the status events of the given level, like the throttling or the
+// failed writes, nil if they are printed instead. Without a logger they are dropped with QuietProgress, so the
+// upload prints nothing.
+func (uctx *DiskUploadContext) statusLogger(level Level) logFunc {
+	if logger := uctx.logger(level); logger != nil || !uctx.QuietProgress {
+		return logger
+	}
+	return func(string, map[string]string) {}
+}
+
+// logEffectiveSize logs the size of the ranges to upload, or prints it unless QuietProgress is set.
+func (uctx *DiskUploadContext) logEffectiveSize(uploadSizeInBytes int64, suffix string) {
+	msg := fmt.Sprintf("Effective upload size: %.2f MB (from %.2f MB originally)%s", float64(uploadSizeInBytes)/oneMB, float64(uctx.VhdStream.GetSize())/oneMB, suffix)
+	if uctx.Logger != nil {
+		uctx.Logger.Infof("%s", msg)
+	} else if !uctx.QuietProgress {
+		fmt.Printf("\n%s", msg)
+	}
+}
+
+// Result describes a completed upload.
+type Result struct {
+	Parallelism    int                      // The number of concurrent writes used, the level converged on with AdaptiveParallelism
+	BytesUploaded  int64                    // The number of bytes written to the page blob
+	BlocksUploaded int                      // The number of ranges written to the page blob
+	BlocksRetried  int                      // The number of ranges whose write was retried at least once
+	Duration       time.Duration            // The time spent reading and writing the ranges
+	WorkerStats    []concurrent.WorkerStats // The counters of the writes handled by each worker, for diagnosing skew
+}
+
+// adaptiveParallelismStart is the number of concurrent writes an upload with adaptive parallelism starts with.
+const adaptiveParallelismStart = 4
+
+// adaptiveParallelismInterval is the period of time between the adjustments of the adaptive parallelism.
+const adaptiveParallelismInterval = 10 * time.Second
+
+// ProgressCallback is the type of functions receiving a copy of every progress record of an upload, along with the
+// ranges being uploaded.
+type ProgressCallback func(record progress.Record)
+
 // oneMB is one MegaByte
 const oneMB = float64(1048576)
 
@@ -48,42 +115,117 @@ var _ io.ReadSeekCloser = byteReadSeekCloser{}
 
 // Upload uploads the disk ranges described by the parameter uctx, this parameter describes the disk stream to
 // read from, the ranges of the stream to read, the destination blob and it's container, the client to communicate
-// with Azure storage and the number of parallel go-routines to use for upload.
-func Upload(ctx context.Context, uctx *DiskUploadContext) error {
+// with Azure storage and the number of parallel go-routines to use for upload. Once the context is cancelled no
+// more writes are started, the writes in flight are abandoned and the error returned wraps the error of the
+// context. The pages written until then stay in the blob, so the upload can be resumed.
+func Upload(ctx context.Context, uctx *DiskUploadContext) (*Result, error) {
+	started := time.Now()
+
+	// Nothing to write, like for a resumed upload with all the data in the blob already
+	if len(uctx.UploadableRanges) == 0 {
+		return uploadNoRanges(uctx, started), nil
+	}
+
+	// Stop reading the disk once the upload is over, whatever the reason
+	readDone := make(chan struct{})
+	defer close(readDone)
+
 	// Get the channel that contains stream of disk data to upload
-	dataWithRangeChan, streamReadErrChan := GetDataWithRanges(uctx.VhdStream, uctx.UploadableRanges)
+	dataWithRangeChan, streamReadErrChan := getDataWithRangesAndHash(uctx.VhdStream, uctx.UploadableRanges, uctx.Hash, uctx.ReadParallelism, readDone)
 
 	// The channel to send upload request to load-balancer
 	requtestChan := make(chan *concurrent.Request, 0)
 
 	// Prepare and start the load-balancer that load request across 'uctx.Parallelism' workers
-	loadBalancer := concurrent.NewBalancer(uctx.Parallelism)
+	loadBalancer := concurrent.NewBalancerWithQueue(ctx, uctx.Parallelism, uctx.QueueDepth)
 	loadBalancer.Init()
 	workerErrorChan, allWorkersFinishedChan := loadBalancer.Run(requtestChan)
+	// The writes in flight are aborted when the workers are torn down
+	workCtx := loadBalancer.Context()
 
 	// Calculate the actual size of the data to upload
 	uploadSizeInBytes := int64(0)
 	for _, r := range uctx.UploadableRanges {
 		uploadSizeInBytes += r.Length()
 	}
-	fmt.Printf("\nEffective upload size: %.2f MB (from %.2f MB originally)", float64(uploadSizeInBytes)/oneMB, float64(uctx.VhdStream.GetSize())/oneMB)
+	uctx.logEffectiveSize(uploadSizeInBytes, "")
 
 	// Prepare and start the upload progress tracker
-	uploadProgress := progress.NewStatus(uctx.Parallelism, uctx.AlreadyProcessedBytes, uploadSizeInBytes, progress.NewComputestateDefaultSize())
+	uploadProgress := progress.NewStatus(uctx.Parallelism, uctx.AlreadyProcessedBytes, uploadSizeInBytes, progress.NewComputestateDefaultSize(), progress.DefaultThroughputWindow, progress.DefaultThroughputSmoothing)
+	uploadProgress.SetPhase(progress.PhaseUploading)
+	uploadProgress.SetBlocksTotal(int64(len(uctx.UploadableRanges)))
 	progressChan := uploadProgress.Run()
 
+	// watch the throughput if asked to abort the upload on a degraded link
+	var slowChan <-chan struct{}
+	if uctx.MinThroughputMbps > 0 {
+		floor := progress.NewThroughputFloor(uctx.MinThroughputMbps, uctx.MinThroughputWindow)
+		progressChan, slowChan = watchThroughput(progressChan, floor)
+	}
+
 	// read progress status from progress tracker and print it
-	go readAndPrintProgress(progressChan, uctx.Resume)
+	printDone := make(chan struct{})
+	go func() {
+		defer close(printDone)
+		if uctx.LogBlocks && !uctx.QuietProgress {
+			// The logged writes start on a line of their own
+			fmt.Println()
+		}
+		readAndPrintProgress(progressChan, uctx.Resume, uctx.QuietProgress || uctx.LogBlocks, uctx.Progress)
+	}()
 
-	// listen for errors reported by workers and print it
-	var allWorkSucceeded = true
+	// listen for errors reported by workers and print it, the channel is closed once all workers exited
+	var workErrors []error
+	workErrorsDone := make(chan struct{})
+	errorLogger := uctx.statusLogger(LevelError)
 	go func() {
-		for {
-			fmt.Println(<-workerErrorChan)
-			allWorkSucceeded = false
+		defer close(workErrorsDone)
+		for err := range workerErrorChan {
+			workErrors = append(workErrors, err)
+			if workCtx.Err() != nil {
+				// The writes abandoned on cancellation or teardown
+				continue
+			}
+			if errorLogger == nil {
+				fmt.Println(err)
+			} else {
+				logWorkError(errorLogger, err)
+			}
 		}
 	}()
+	retryLogger := uctx.logger(LevelWarn)
+	var blockLogger, blockFailureLogger logFunc
+	if uctx.LogBlocks {
+		blockLogger = uctx.logger(LevelInfo)
+		blockFailureLogger = retryLogger
+	}
+
+	// pause all writes for a while when the service is throttling
+	var breaker *circuitBreaker
+	if uctx.BusyThreshold > 0 {
+		breaker = newCircuitBreaker(uctx.BusyThreshold, uctx.BusyCoolDown, uctx.statusLogger(LevelWarn))
+	}
+
+	// adapt the number of concurrent writes to the throughput
+	var limiter *adaptiveLimiter
+	if uctx.AdaptiveParallelism {
+		minParallelism := 1
+		if uctx.MinParallelism > 0 {
+			minParallelism = uctx.MinParallelism
+		}
+		limiter = newAdaptiveLimiter(adaptiveParallelismStart, minParallelism, uctx.Parallelism, uctx.statusLogger(LevelInfo))
+		limiterDone := make(chan struct{})
+		defer close(limiterDone)
+		go limiter.run(adaptiveParallelismInterval, limiterDone)
+	}
+
+	// limit the bandwidth of the writes
+	var rate *rateLimiter
+	if uctx.MaxBytesPerSecond > 0 {
+		rate = newRateLimiter(uctx.MaxBytesPerSecond)
+	}
 
+	var uploadedBytes, uploadedBlocks, retriedBlocks int64
 	var err error
 L:
 	for {
@@ -96,53 +238,208 @@ L:
 
 			// Create work request
 			//
+			attempts := int32(0)
+			// The attempts of a request are run one after another by the same worker
+			var lastErr error
 			req := &concurrent.Request{
 				Work: func() error {
+					attempt := atomic.AddInt32(&attempts, 1)
+					if attempt == 2 {
+						atomic.AddInt64(&retriedBlocks, 1)
+					}
+					if attempt > 1 && retryLogger != nil {
+						retryLogger("Retrying the upload of range", map[string]string{
+							"rangeID": dataWithRange.Range.String(),
+							"attempt": strconv.Itoa(int(attempt)),
+							"error":   lastErr.Error(),
+						})
+					}
+					if breaker != nil {
+						if err := breaker.wait(workCtx); err != nil {
+							return err
+						}
+					}
+					if rate != nil {
+						// Waiting before the range is reported as started keeps it out of the
+						// in-flight ranges, the throughput is computed from the written bytes.
+						if err := rate.wait(workCtx, dataWithRange.Range.Length()); err != nil {
+							return err
+						}
+					}
+					if limiter != nil {
+						limiter.acquire()
+					}
+					uploadProgress.ReportRangeStarted(dataWithRange.Range)
+					defer uploadProgress.ReportRangeFinished(dataWithRange.Range)
+					if blockLogger != nil {
+						blockLogger("Uploading range", map[string]string{
+							"rangeID": dataWithRange.Range.String(),
+							"offset":  strconv.FormatInt(dataWithRange.Range.Start, 10),
+							"length":  strconv.FormatInt(dataWithRange.Range.Length(), 10),
+							"attempt": strconv.Itoa(int(attempt)),
+						})
+					}
+					writeStarted := time.Now()
+					writeCtx := workCtx
+					if uctx.OperationTimeout > 0 {
+						var cancel context.CancelFunc
+						writeCtx, cancel = context.WithTimeout(workCtx, uctx.OperationTimeout)
+						defer cancel()
+					}
 					_, err := uctx.PageblobClient.UploadPages(
-						ctx,
+						writeCtx,
 						newByteReadSeekCloser(dataWithRange.Data),
 						blob.HTTPRange{
 							Offset: dataWithRange.Range.Start,
 							Count:  dataWithRange.Range.Length(),
 						},
 						nil)
+					if err != nil && workCtx.Err() == nil && errors.Is(writeCtx.Err(), context.DeadlineExceeded) {
+						// Only this attempt is abandoned, it is retried like a failed write
+						err = fmt.Errorf("the write did not complete within %s: %w", uctx.OperationTimeout, err)
+					}
+					if breaker != nil {
+						breaker.report(err)
+					}
+					if limiter != nil {
+						limiter.release(dataWithRange.Range.Length(), err)
+					}
+					if blockLogger != nil {
+						fields := map[string]string{
+							"rangeID":  dataWithRange.Range.String(),
+							"attempt":  strconv.Itoa(int(attempt)),
+							"duration": time.Since(writeStarted).Round(time.Millisecond).String(),
+						}
+						if err == nil {
+							blockLogger("Uploaded range", fields)
+						} else if workCtx.Err() == nil {
+							fields["error"] = err.Error()
+							blockFailureLogger("Write of range failed", fields)
+						}
+					}
 					if err == nil {
+						atomic.AddInt64(&uploadedBytes, dataWithRange.Range.Length())
+						atomic.AddInt64(&uploadedBlocks, 1)
 						uploadProgress.ReportBytesProcessedCount(dataWithRange.Range.Length())
+						uploadProgress.ReportBlockComplete()
+						if uctx.BlockDigests != nil {
+							uctx.BlockDigests.Add(dataWithRange.Range, dataWithRange.Data)
+						}
 					}
 					return err
 				},
 				ShouldRetry: func(e error) bool {
-					return true
+					lastErr = e
+					// A write failing because of the cancellation or of a client error would fail again
+					return workCtx.Err() == nil && isRetriable(e)
 				},
-				ID: dataWithRange.Range.String(),
+				ID:           dataWithRange.Range.String(),
+				MaxRetries:   uctx.MaxRetriesPerBlock,
+				RetryBackoff: uctx.RetryBackoff,
+				Bytes:        dataWithRange.Range.Length(),
 			}
 
 			// Send work request to load balancer for processing
 			//
-			requtestChan <- req
+			select {
+			case requtestChan <- req:
+			case <-ctx.Done():
+				close(requtestChan)
+				loadBalancer.TearDownWorkers()
+				break L
+			}
 		case err = <-streamReadErrChan:
 			close(requtestChan)
 			loadBalancer.TearDownWorkers()
 			break L
+		case <-slowChan:
+			err = fmt.Errorf("\nUpload aborted: the throughput stayed below %.2f Mb/sec for %s, the link seems to be degraded, retry later", uctx.MinThroughputMbps, uctx.MinThroughputWindow)
+			close(requtestChan)
+			loadBalancer.TearDownWorkers()
+			break L
+		case <-ctx.Done():
+			close(requtestChan)
+			loadBalancer.TearDownWorkers()
+			break L
 		}
 	}
 
 	<-allWorkersFinishedChan
+	<-workErrorsDone
 	uploadProgress.Close()
+	<-printDone
 
-	if !allWorkSucceeded {
-		err = errors.New("\nUpload Incomplete: Some blocks of the VHD failed to upload, rerun the command to upload those blocks")
+	allWorkSucceeded := len(workErrors) == 0
+	if ctx.Err() != nil && (err != nil || !allWorkSucceeded || uploadedBytes < uploadSizeInBytes) {
+		// The writes failing once cancelled are not worth reporting as incomplete
+		err = fmt.Errorf("\nUpload cancelled with %.2f MB uploaded, rerun the command to resume the upload: %w", float64(atomic.LoadInt64(&uploadedBytes))/oneMB, ctx.Err())
+	} else if !allWorkSucceeded && err == nil {
+		// The writes abandoned on teardown fail too, keep the reason of the teardown
+		err = fmt.Errorf("\nUpload Incomplete: %d blocks of the VHD failed to upload, rerun the command to upload those blocks: %w", len(workErrors), errors.Join(workErrors...))
 	}
 
-	if err == nil {
-		fmt.Printf("\r Completed: %3d%% [%10.2f MB] RemainingTime: %02dh:%02dm:%02ds Throughput: %d Mb/sec  %2c ",
+	summary := uploadProgress.Summary()
+	if err == nil && uctx.Progress != nil {
+		// The last record of the progress tracker may predate the end of the upload
+		uctx.Progress(progress.Record{
+			Phase:                        progress.PhaseUploading,
+			PercentComplete:              100,
+			AverageThroughputMbPerSecond: summary.AverageThroughputMbPerSecond,
+			WindowThroughputMbPerSecond:  summary.AverageThroughputMbPerSecond,
+			BytesProcessed:               uctx.AlreadyProcessedBytes + uploadSizeInBytes,
+			BlocksTotal:                  int64(len(uctx.UploadableRanges)),
+			BlocksCompleted:              int64(len(uctx.UploadableRanges)),
+		})
+	}
+	if err == nil && !uctx.NoFinalStatus && !uctx.QuietProgress {
+		// The elapsed time and the average throughput of the whole upload replace the estimates
+		t := time.Time{}.Add(summary.Duration)
+		fmt.Printf("\r Completed: %3d%% [%10.2f MB] ElapsedTime  : %02dh:%02dm:%02ds Throughput: %d Mb/sec  %2c \n",
 			100,
 			float64(uploadSizeInBytes)/oneMB,
-			0, 0, 0,
-			0, ' ')
+			t.Hour(), t.Minute(), t.Second(),
+			int(summary.AverageThroughputMbPerSecond), ' ')
+	}
+	if err != nil {
+		return nil, err
+	}
 
+	result := &Result{
+		Parallelism:    uctx.Parallelism,
+		BytesUploaded:  atomic.LoadInt64(&uploadedBytes),
+		BlocksUploaded: int(atomic.LoadInt64(&uploadedBlocks)),
+		BlocksRetried:  int(atomic.LoadInt64(&retriedBlocks)),
+		Duration:       time.Since(started),
+		WorkerStats:    loadBalancer.WorkerStats(),
+	}
+	if limiter != nil {
+		result.Parallelism = limiter.level()
+	}
+	return result, nil
+}
+
+// uploadNoRanges completes an upload with no range to write, without starting the readers, the workers and the
+// progress tracker. The hash, if any, is the one of a disk of zeros, as all of it is skipped as empty.
+func uploadNoRanges(uctx *DiskUploadContext, started time.Time) *Result {
+	if uctx.Hash != nil {
+		writeZeros(uctx.Hash, uctx.VhdStream.GetSize())
+	}
+	uctx.logEffectiveSize(0, ", no page to write")
+	if uctx.Logger == nil && !uctx.QuietProgress {
+		fmt.Println()
+	}
+	record := progress.Record{
+		Phase:           progress.PhaseUploading,
+		PercentComplete: 100,
+		BytesProcessed:  uctx.AlreadyProcessedBytes,
+	}
+	if uctx.Progress != nil {
+		uctx.Progress(record)
+	}
+	return &Result{
+		Parallelism: uctx.Parallelism,
+		Duration:    time.Since(started),
 	}
-	return err
 }
 
 // GetDataWithRanges with start reading and streaming the ranges from the disk identified by the parameter ranges.
@@ -150,34 +447,201 @@ L:
 // the disk. On successful completion the data channel will be closed. the caller must not expect any more value in
 // the data channel if the error channel is signaled.
 func GetDataWithRanges(stream *diskstream.DiskStream, ranges []*common.IndexRange) (<-chan *DataWithRange, <-chan error) {
+	return GetDataWithRangesAndHash(stream, ranges, nil)
+}
+
+// GetDataWithRangesAndHash works like GetDataWithRanges, additionally it writes the content of the whole disk to
+// the hash h, if it is not nil, as the ranges are read. The gaps between the ranges are skipped sparse ranges, so
+// zeros are written for them, this way the hash covers the full logical disk without a separate read pass. The
+// ranges must be sorted and must not overlap. The hash is complete once the data channel is closed.
+func GetDataWithRangesAndHash(stream *diskstream.DiskStream, ranges []*common.IndexRange, h hash.Hash) (<-chan *DataWithRange, <-chan error) {
+	return getDataWithRangesAndHash(stream, ranges, h, 1, nil)
+}
+
+// getDataWithRangesAndHash implements GetDataWithRangesAndHash, the ranges are read by parallelism goroutines and
+// the reading stops once the done channel, if not nil, is closed.
+//
+// Each goroutine reads from its own duplicate of the stream, goroutine k reads the ranges with index k,
+// k + parallelism, k + 2*parallelism, ... ahead of the upload, so the reads of a slow disk overlap. The ranges are
+// still streamed and hashed in their order.
+func getDataWithRangesAndHash(stream *diskstream.DiskStream, ranges []*common.IndexRange, h hash.Hash, parallelism int, done <-chan struct{}) (<-chan *DataWithRange, <-chan error) {
 	dataWithRangeChan := make(chan *DataWithRange, 0)
 	errorChan := make(chan error, 0)
+	sendErr := func(err error) {
+		select {
+		case errorChan <- err:
+		case <-done:
+		}
+	}
 	go func() {
-		for _, r := range ranges {
-			dataWithRange := &DataWithRange{
-				Range: r,
-				Data:  make([]byte, r.Length()),
-			}
-			_, err := stream.Seek(r.Start, 0)
+		if parallelism > len(ranges) {
+			parallelism = len(ranges)
+		}
+		if parallelism < 1 {
+			parallelism = 1
+		}
+
+		streams := make([]*diskstream.DiskStream, parallelism)
+		streams[0] = stream
+		for i := 1; i < parallelism; i++ {
+			s, err := stream.Duplicate()
 			if err != nil {
-				errorChan <- err
+				closeStreams(streams[1:i])
+				sendErr(err)
 				return
 			}
-			_, err = io.ReadFull(stream, dataWithRange.Data)
-			if err != nil {
-				errorChan <- err
+			streams[i] = s
+		}
+		defer closeStreams(streams[1:])
+
+		// The streams are closed only once the readers are gone
+		stopChan := make(chan struct{})
+		var readers sync.WaitGroup
+		defer func() {
+			close(stopChan)
+			readers.Wait()
+		}()
+		resultChans := make([]chan readResult, parallelism)
+		for k := 0; k < parallelism; k++ {
+			resultChans[k] = make(chan readResult, 1)
+			readers.Add(1)
+			go func(k int) {
+				defer readers.Done()
+				readRanges(streams[k], ranges, k, parallelism, resultChans[k], stopChan)
+			}(k)
+		}
+
+		hashedSize := int64(0)
+		for index, r := range ranges {
+			var result readResult
+			select {
+			case result = <-resultChans[index%parallelism]:
+			case <-done:
 				return
 			}
-			dataWithRangeChan <- dataWithRange
+			if result.err != nil {
+				sendErr(result.err)
+				return
+			}
+			if h != nil {
+				if r.Start < hashedSize {
+					sendErr(fmt.Errorf("range %s overlaps or precedes already hashed data, ranges must be sorted", r))
+					return
+				}
+				writeZeros(h, r.Start-hashedSize)
+				hashedSize = r.End + 1
+				h.Write(result.data.Data)
+			}
+			select {
+			case dataWithRangeChan <- result.data:
+			case <-done:
+				return
+			}
+		}
+		if h != nil {
+			writeZeros(h, stream.GetSize()-hashedSize)
 		}
 		close(dataWithRangeChan)
 	}()
 	return dataWithRangeChan, errorChan
 }
 
-// readAndPrintProgress reads the progress records from the given progress channel and output it. It reads the
-// progress record until the channel is closed.
-func readAndPrintProgress(progressChan <-chan *progress.Record, resume bool) {
+// readResult describes the result of reading a range.
+type readResult struct {
+	data *DataWithRange
+	err  error
+}
+
+// readRanges reads every step-th range starting from the range at index first and reports its data to the
+// resultChan channel. It stops after the first error or once stopChan is closed.
+func readRanges(stream *diskstream.DiskStream, ranges []*common.IndexRange, first, step int, resultChan chan<- readResult, stopChan <-chan struct{}) {
+	for index := first; index < len(ranges); index += step {
+		r := ranges[index]
+		result := readResult{
+			data: &DataWithRange{
+				Range: r,
+				Data:  make([]byte, r.Length()),
+			},
+		}
+		if _, err := stream.Seek(r.Start, 0); err != nil {
+			result.err = err
+		} else if _, err := io.ReadFull(stream, result.data.Data); err != nil {
+			result.err = err
+		}
+
+		select {
+		case resultChan <- result:
+		case <-stopChan:
+			return
+		}
+		if result.err != nil {
+			return
+		}
+	}
+}
+
+// zeroBuf is a buffer of zeros used by writeZeros.
+var zeroBuf = make([]byte, 64*1024)
+
+// writeZeros writes count zero bytes to the hash h.
+func writeZeros(h hash.Hash, count int64) {
+	for count > 0 {
+		n := int64(len(zeroBuf))
+		if n > count {
+			n = count
+		}
+		h.Write(zeroBuf[:n])
+		count -= n
+	}
+}
+
+// logWorkError logs the error reported by a worker, using the details of the failed work as fields.
+func logWorkError(logger logFunc, err error) {
+	var workErr *concurrent.WorkError
+	if !errors.As(err, &workErr) {
+		logger(err.Error(), nil)
+		return
+	}
+	logger("Failed to upload range", map[string]string{
+		"rangeID":  workErr.ID,
+		"attempts": strconv.Itoa(workErr.Attempts),
+		"error":    workErr.Err.Error(),
+	})
+}
+
+// watchThroughput forwards the progress records from the given progress channel to the returned progress channel
+// and checks the throughput using the given floor. The returned struct{} channel is closed once the throughput stayed
+// below the floor.
+func watchThroughput(progressChan <-chan *progress.Record, floor *progress.ThroughputFloor) (<-chan *progress.Record, <-chan struct{}) {
+	outChan := make(chan *progress.Record, 0)
+	slowChan := make(chan struct{})
+	go func() {
+		slow := false
+		for progressRecord := range progressChan {
+			if !slow && floor.IsBelow(progressRecord.BytesProcessed, time.Now()) {
+				slow = true
+				close(slowChan)
+			}
+			outChan <- progressRecord
+		}
+		close(outChan)
+	}()
+	return outChan, slowChan
+}
+
+// readAndPrintProgress reads the progress records from the given progress channel and output it, passing them to the
+// callback too if it is not nil. If quiet is true, they are not printed, so they do not interleave with the logged
+// writes or with the rendering of the callback. It reads the progress record until the channel is closed.
+func readAndPrintProgress(progressChan <-chan *progress.Record, resume, quiet bool, callback ProgressCallback) {
+	if quiet {
+		for progressRecord := range progressChan {
+			if callback != nil {
+				callback(*progressRecord)
+			}
+		}
+		return
+	}
+
 	var spinChars = [4]rune{'\\', '|', '/', '-'}
 	s := time.Time{}
 	if resume {
@@ -192,13 +656,27 @@ func readAndPrintProgress(progressChan <-chan *progress.Record, resume bool) {
 			i = 0
 		}
 		t := s.Add(progressRecord.RemainingDuration)
-		fmt.Printf("\r Completed: %3d%% [%10.2f MB] RemainingTime: %02dh:%02dm:%02ds Throughput: %d Mb/sec  %2c ",
+		fmt.Printf("\r %s: %3d%% [%10.2f MB]%s RemainingTime: %02dh:%02dm:%02ds Throughput: %d Mb/sec  %2c ",
+			progressRecord.Phase,
 			int(progressRecord.PercentComplete),
 			float64(progressRecord.BytesProcessed)/oneMB,
+			formatBlocks(progressRecord),
 			t.Hour(), t.Minute(), t.Second(),
 			int(progressRecord.AverageThroughputMbPerSecond),
 			spinChars[i],
 		)
+		if callback != nil {
+			callback(*progressRecord)
+		}
 		i++
 	}
 }
+
+// formatBlocks returns the blocks processed out of the total ones of the given progress record, to be printed after
+// its percentage, or an empty string when the record does not count the blocks.
+func formatBlocks(record *progress.Record) string {
+	if record.BlocksTotal <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" Block: %d/%d", record.BlocksCompleted, record.BlocksTotal)
+}
@@ -0,0 +1,308 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+
+	"github.com/flatcar/azure-vhd-utils/upload/concurrent"
+	"github.com/flatcar/azure-vhd-utils/upload/uploadtest"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+)
+
+var _ PageBlobClient = (*uploadtest.PageBlobClient)(nil)
+
+// testPageSetSize is the size of the ranges of the test uploads, small so the disks have several of them.
+const testPageSetSize int64 = 64 * 1024
+
+// testUpload is an upload of the ranges with data of a fixed VHD to a new in-memory page blob.
+type testUpload struct {
+	uctx   *DiskUploadContext
+	client *uploadtest.PageBlobClient
+	vhd    []byte // The content of the VHD file, the expected content of the blob
+}
+
+// newTestUpload prepares the upload of a fixed VHD with the given disk data, in ranges of testPageSetSize bytes
+// without the ranges holding only zeros, to a page blob created by the client.
+func newTestUpload(t *testing.T, data []byte, client *uploadtest.PageBlobClient) *testUpload {
+	t.Helper()
+	path := uploadtest.NewFixedVHD(t, data)
+	vhd, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := uploadtest.OpenVHD(t, path)
+	ranges, err := LocateUploadableRanges(stream, nil, uploadtest.PageSize, testPageSetSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges, err = removeEmptyRanges(stream, ranges, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Create(context.Background(), stream.GetSize(), nil); err != nil {
+		t.Fatal(err)
+	}
+	return &testUpload{
+		uctx: &DiskUploadContext{
+			VhdStream:             stream,
+			AlreadyProcessedBytes: stream.GetSize() - common.TotalRangeLength(ranges),
+			UploadableRanges:      ranges,
+			PageblobClient:        client,
+			Parallelism:           4,
+			RetryBackoff:          time.Millisecond,
+			QuietProgress:         true,
+			NoFinalStatus:         true,
+		},
+		client: client,
+		vhd:    vhd,
+	}
+}
+
+// failOnce returns a fault hook failing the first write of every range with the given status code.
+func failOnce(statusCode int, errorCode string) uploadtest.FaultFunc {
+	var mutex sync.Mutex
+	failed := make(map[int64]bool)
+	return func(ctx context.Context, method string, r blob.HTTPRange) error {
+		if method != uploadtest.MethodUploadPages {
+			return nil
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failed[r.Offset] {
+			return nil
+		}
+		failed[r.Offset] = true
+		return uploadtest.NewResponseError(statusCode, errorCode)
+	}
+}
+
+func TestUploadRetriesServerBusy(t *testing.T) {
+	client := uploadtest.NewPageBlobClient()
+	client.Fault = failOnce(http.StatusServiceUnavailable, "ServerBusy")
+	u := newTestUpload(t, uploadtest.NewData(1024*1024, 1, 0, 300, 1500), client)
+
+	result, err := Upload(context.Background(), u.uctx)
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	ranges := len(u.uctx.UploadableRanges)
+	if got := client.Calls(uploadtest.MethodUploadPages); got != 2*ranges {
+		t.Errorf("got %d writes, expected %d, two for each of the %d ranges", got, 2*ranges, ranges)
+	}
+	if result.BlocksRetried != ranges || result.BlocksUploaded != ranges {
+		t.Errorf("got %d ranges uploaded and %d retried, expected %d of both", result.BlocksUploaded, result.BlocksRetried, ranges)
+	}
+	if !bytes.Equal(client.Data(), u.vhd) {
+		t.Error("the content of the blob differs from the VHD")
+	}
+}
+
+func TestUploadDoesNotRetryClientError(t *testing.T) {
+	client := uploadtest.NewPageBlobClient()
+	client.Fault = failOnce(http.StatusForbidden, "AuthorizationFailure")
+	u := newTestUpload(t, uploadtest.NewData(1024*1024, 1, 0, 300, 1500), client)
+
+	_, err := Upload(context.Background(), u.uctx)
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) || respErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("got error %v, expected the 403 response of the writes", err)
+	}
+	ranges := len(u.uctx.UploadableRanges)
+	if got := client.Calls(uploadtest.MethodUploadPages); got != ranges {
+		t.Errorf("got %d writes, expected a single one for each of the %d ranges", got, ranges)
+	}
+	if written := client.WrittenRanges(); len(written) > 0 {
+		t.Errorf("got pages written at %v, expected none", written)
+	}
+}
+
+func TestUploadCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := uploadtest.NewPageBlobClient()
+	// The writes after the first one hang until the context is done, like on a dead link
+	var mutex sync.Mutex
+	writes := 0
+	client.Fault = func(writeCtx context.Context, method string, r blob.HTTPRange) error {
+		if method != uploadtest.MethodUploadPages {
+			return nil
+		}
+		mutex.Lock()
+		writes++
+		first := writes == 1
+		mutex.Unlock()
+		if first {
+			return nil
+		}
+		cancel()
+		<-writeCtx.Done()
+		return writeCtx.Err()
+	}
+	u := newTestUpload(t, uploadtest.NewData(1024*1024, 1, 0, 300, 1500), client)
+	u.uctx.Parallelism = 1
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := Upload(ctx, u.uctx)
+		done <- err
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the cancelled upload did not return")
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, expected the cancellation", err)
+	}
+	first := u.uctx.UploadableRanges[0]
+	written := client.WrittenRanges()
+	if len(written) != 1 || written[0].Start != first.Start || written[0].End != first.End {
+		t.Errorf("got pages written at %v, expected only the first range %s", written, first)
+	}
+}
+
+func TestUploadLeavesEmptyRangesUnwritten(t *testing.T) {
+	client := uploadtest.NewPageBlobClient()
+	u := newTestUpload(t, uploadtest.NewData(1024*1024, 2, 1, 2, 1000, 2047), client)
+
+	if _, err := Upload(context.Background(), u.uctx); err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if !bytes.Equal(client.Data(), u.vhd) {
+		t.Error("the content of the blob differs from the VHD")
+	}
+	// The ranges with data and the footer, the zeros in between are never written
+	expected := []*common.IndexRange{
+		common.NewIndexRange(0, testPageSetSize-1),
+		common.NewIndexRange(7*testPageSetSize, 8*testPageSetSize-1),
+		common.NewIndexRange(15*testPageSetSize, 16*testPageSetSize+uploadtest.PageSize-1),
+	}
+	written := client.WrittenRanges()
+	if len(written) != len(expected) {
+		t.Fatalf("got pages written at %v, expected %v", written, expected)
+	}
+	for i, r := range written {
+		if r.Start != expected[i].Start || r.End != expected[i].End {
+			t.Errorf("got pages written at %v, expected %v", written, expected)
+			break
+		}
+	}
+}
+
+func TestUploadReportsAllFailedRanges(t *testing.T) {
+	client := uploadtest.NewPageBlobClient()
+	// Each write of the ranges starting in the first half of the disk fails with its own error
+	client.Fault = func(ctx context.Context, method string, r blob.HTTPRange) error {
+		if method != uploadtest.MethodUploadPages || r.Offset >= 512*1024 {
+			return nil
+		}
+		return uploadtest.NewResponseError(http.StatusForbidden, fmt.Sprintf("Failure%d", r.Offset))
+	}
+	u := newTestUpload(t, uploadtest.NewData(1024*1024, 3, 0, 200, 400, 600, 800, 1200, 1600), client)
+
+	_, err := Upload(context.Background(), u.uctx)
+	if err == nil {
+		t.Fatal("upload succeeded, expected the failed writes reported")
+	}
+	// The start of the failing ranges by their ID
+	failed := make(map[string]int64)
+	for _, r := range u.uctx.UploadableRanges {
+		if r.Start < 512*1024 {
+			failed[r.String()] = r.Start
+		}
+	}
+	if len(failed) < 2 {
+		t.Fatalf("got %d ranges failing, expected several", len(failed))
+	}
+	joined, ok := errors.Unwrap(err).(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatalf("got error %v, expected the joined errors of the writes", err)
+	}
+	for _, e := range joined.Unwrap() {
+		var workErr *concurrent.WorkError
+		if !errors.As(e, &workErr) {
+			t.Errorf("got error %v, expected the error of a write", e)
+			continue
+		}
+		start, ok := failed[workErr.ID]
+		if !ok {
+			t.Errorf("got error %v of a range not failing or reported twice", e)
+			continue
+		}
+		delete(failed, workErr.ID)
+		var respErr *azcore.ResponseError
+		if !errors.As(e, &respErr) || respErr.ErrorCode != fmt.Sprintf("Failure%d", start) {
+			t.Errorf("got error %v, expected the error of the write of range %s", e, workErr.ID)
+		}
+	}
+	for id := range failed {
+		t.Errorf("the error of the range %s is missing from %v", id, err)
+	}
+}
+
+func BenchmarkReadParallelism(b *testing.B) {
+	const size = 32 * 1024 * 1024
+	pages := make([]int64, size/uploadtest.PageSize)
+	for i := range pages {
+		pages[i] = int64(i)
+	}
+	stream := uploadtest.OpenVHD(b, uploadtest.NewFixedVHD(b, uploadtest.NewData(size, 16, pages...)))
+	ranges, err := LocateUploadableRanges(stream, nil, uploadtest.PageSize, 4*1024*1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, parallelism := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("readers=%d", parallelism), func(b *testing.B) {
+			b.SetBytes(stream.GetSize())
+			for i := 0; i < b.N; i++ {
+				dataChan, errChan := getDataWithRangesAndHash(stream, ranges, nil, parallelism, nil)
+				for range dataChan {
+				}
+				select {
+				case err := <-errChan:
+					b.Fatal(err)
+				default:
+				}
+			}
+		})
+	}
+}
+
+func TestUploadQuietPrintsNothing(t *testing.T) {
+	client := uploadtest.NewPageBlobClient()
+	client.Fault = failOnce(http.StatusForbidden, "AuthorizationFailure")
+	u := newTestUpload(t, uploadtest.NewData(1024*1024, 1, 0, 300, 1500), client)
+	u.uctx.BusyThreshold = 1
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	_, uploadErr := Upload(context.Background(), u.uctx)
+	os.Stdout = stdout
+	w.Close()
+	printed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploadErr == nil {
+		t.Error("upload succeeded, expected the failed writes reported")
+	}
+	if len(printed) > 0 {
+		t.Errorf("got %q printed by a quiet upload, expected nothing", printed)
+	}
+}
@@ -1,8 +1,12 @@
 package upload
 
 import (
+	"fmt"
+	"runtime"
+
 	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
 	"github.com/flatcar/azure-vhd-utils/vhdcore/diskstream"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/footer"
 )
 
 // LocateUploadableRanges detects the uploadable ranges in a VHD stream, size of each range is at most
@@ -36,3 +40,48 @@ func LocateUploadableRanges(stream *diskstream.DiskStream, rangesToSkip []*commo
 	diskRanges = common.ChunkRangesBySizeWithQuant(diskRanges, pageSetSizeInBytes, pageSizeInBytes)
 	return diskRanges, nil
 }
+
+// EnsureRangesWithinBlob checks that every range in the parameter ranges fits in a page blob of blobSize bytes,
+// the service rejects writes past the end of the blob with an error that does not tell which range was at fault.
+// It returns an error describing the first offending range.
+func EnsureRangesWithinBlob(ranges []*common.IndexRange, blobSize int64) error {
+	for _, r := range ranges {
+		if r.Start < 0 || r.End >= blobSize {
+			return fmt.Errorf("range %s (%d bytes) does not fit in the page blob of size %d bytes", r, r.Length(), blobSize)
+		}
+	}
+	return nil
+}
+
+// UploadPlan describes the ranges of a VHD stream an upload to a new page blob writes.
+type UploadPlan struct {
+	Ranges        []*common.IndexRange // The ranges to write, of at most 4 MB each, without the ranges holding only zeros
+	TotalSize     int64                // The size of the stream, which is the size of the page blob
+	EffectiveSize int64                // The number of bytes of the ranges to write
+}
+
+// DetectUploadableRanges computes the ranges of the VHD stream an upload to a new page blob writes, without
+// contacting Azure: the ranges with data, chunked in sets of pages of at most 4 MB, without the ranges holding only
+// zeros. The ranges of a fixed disk are scanned for zeros by one goroutine per CPU, each reading from its own
+// duplicate of the stream, those of an expandable disk are told by its block allocation table. Unlike
+// DetectEmptyRanges, it prints nothing.
+func DetectUploadableRanges(stream *diskstream.DiskStream) (*UploadPlan, error) {
+	const PageBlobPageSize int64 = 512
+	const PageBlobPageSetSize int64 = 4 * 1024 * 1024
+
+	ranges, err := LocateUploadableRanges(stream, nil, PageBlobPageSize, PageBlobPageSetSize)
+	if err != nil {
+		return nil, err
+	}
+	if stream.GetDiskType() == footer.DiskTypeFixed {
+		ranges, err = removeEmptyRanges(stream, ranges, runtime.NumCPU(), nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &UploadPlan{
+		Ranges:        ranges,
+		TotalSize:     stream.GetSize(),
+		EffectiveSize: common.TotalRangeLength(ranges),
+	}, nil
+}
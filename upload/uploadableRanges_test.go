@@ -0,0 +1,115 @@
+package upload
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/flatcar/azure-vhd-utils/upload/uploadtest"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+)
+
+func TestEnsureRangesWithinBlob(t *testing.T) {
+	const pageSetSize int64 = 4 * 1024 * 1024
+	for _, test := range []struct {
+		name     string
+		diskSize int64
+		blobSize int64 // The size of the blob, relative to the size of the VHD
+		tooSmall bool  // The last range, the one with the footer, does not fit in the blob
+	}{
+		{name: "one page", diskSize: 512, blobSize: 0},
+		{name: "below a page set", diskSize: 1024 * 1024, blobSize: 0},
+		{name: "page set and a page", diskSize: pageSetSize + 512, blobSize: 0},
+		{name: "odd pages", diskSize: 3*pageSetSize - 7*512, blobSize: 0},
+		{name: "blob larger", diskSize: pageSetSize + 512, blobSize: 4096},
+		{name: "footer out", diskSize: pageSetSize + 512, blobSize: -512, tooSmall: true},
+		{name: "footer partly out", diskSize: 3*pageSetSize - 7*512, blobSize: -1, tooSmall: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := uploadtest.NewFixedVHD(t, make([]byte, test.diskSize))
+			stream := uploadtest.OpenVHD(t, path)
+			ranges, err := LocateUploadableRanges(stream, nil, uploadtest.PageSize, pageSetSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			last := ranges[len(ranges)-1]
+			if last.End != stream.GetSize()-1 {
+				t.Fatalf("got the last range %s, expected it to end with the VHD of %d bytes", last, stream.GetSize())
+			}
+			err = EnsureRangesWithinBlob(ranges, stream.GetSize()+test.blobSize)
+			if !test.tooSmall {
+				if err != nil {
+					t.Errorf("got error %v, expected the ranges %v to fit", err, ranges)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), last.String()) {
+				t.Errorf("got error %v, expected it to name the range %s", err, last)
+			}
+		})
+	}
+}
+
+func TestEnsureRangesWithinBlobNamesFirstOffendingRange(t *testing.T) {
+	ranges := []*common.IndexRange{
+		common.NewIndexRange(0, 511),
+		common.NewIndexRange(-512, -1),
+		common.NewIndexRange(4096, 8191),
+	}
+	err := EnsureRangesWithinBlob(ranges, 4096)
+	if err == nil || !strings.Contains(err.Error(), ranges[1].String()) {
+		t.Errorf("got error %v, expected it to name the range %s", err, ranges[1])
+	}
+}
+
+func TestDetectUploadableRanges(t *testing.T) {
+	const mb = 1024 * 1024
+	// Data in the first page and in the page at 10,240,000 bytes of a 16 MB disk
+	data := uploadtest.NewData(16*mb, 13, 0, 20000)
+	for _, test := range []struct {
+		name     string
+		path     string
+		expected []*common.IndexRange
+	}{
+		{
+			name: "fixed",
+			path: uploadtest.NewFixedVHD(t, data),
+			// The sets of pages holding data, and the footer
+			expected: []*common.IndexRange{
+				common.NewIndexRange(0, 4*mb-1),
+				common.NewIndexRange(8*mb, 12*mb-1),
+				common.NewIndexRange(16*mb, 16*mb+511),
+			},
+		},
+		{
+			name: "dynamic",
+			path: uploadtest.NewDynamicVHD(t, data, 2*mb),
+			// The allocated blocks, and the footer
+			expected: []*common.IndexRange{
+				common.NewIndexRange(0, 2*mb-1),
+				common.NewIndexRange(8*mb, 10*mb-1),
+				common.NewIndexRange(16*mb, 16*mb+511),
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			plan, err := DetectUploadableRanges(uploadtest.OpenVHD(t, test.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plan.Ranges) != len(test.expected) {
+				t.Fatalf("got the ranges %v, expected %v", plan.Ranges, test.expected)
+			}
+			for i, r := range plan.Ranges {
+				if r.Start != test.expected[i].Start || r.End != test.expected[i].End {
+					t.Fatalf("got the ranges %v, expected %v", plan.Ranges, test.expected)
+				}
+			}
+			if plan.TotalSize != 16*mb+512 {
+				t.Errorf("got a total size of %d bytes, expected %d", plan.TotalSize, 16*mb+512)
+			}
+			if expected := common.TotalRangeLength(test.expected); plan.EffectiveSize != expected {
+				t.Errorf("got an effective size of %d bytes, expected %d", plan.EffectiveSize, expected)
+			}
+		})
+	}
+}
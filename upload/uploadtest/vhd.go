@@ -0,0 +1,71 @@
+package uploadtest
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/converter"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/diskstream"
+)
+
+// NewData returns size bytes of disk data, the pages of PageSize bytes whose index is in dataPages hold random
+// bytes drawn from the given seed, the other ones hold zeros.
+func NewData(size int64, seed int64, dataPages ...int64) []byte {
+	data := make([]byte, size)
+	rnd := rand.New(rand.NewSource(seed))
+	for _, p := range dataPages {
+		rnd.Read(data[p*PageSize : (p+1)*PageSize])
+	}
+	return data
+}
+
+// NewFixedVHD writes a fixed VHD with the given disk data, whose size must be a multiple of the sector length, to
+// a temporary file removed with the test. It returns the path of the VHD.
+func NewFixedVHD(t testing.TB, data []byte) string {
+	t.Helper()
+	uniqueID, err := common.NewRandomUUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "fixed.vhd")
+	vhd := append(append([]byte(nil), data...), converter.NewFixedFooter(int64(len(data)), uniqueID)...)
+	if err := os.WriteFile(path, vhd, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// NewDynamicVHD writes a dynamic VHD with blocks of blockSize bytes and the given disk data, whose size must be
+// a multiple of the sector length, to a temporary file removed with the test. The blocks holding only zeros are
+// left unallocated. It returns the path of the VHD.
+func NewDynamicVHD(t testing.TB, data []byte, blockSize uint32) string {
+	t.Helper()
+	stream := OpenVHD(t, NewFixedVHD(t, data))
+	path := filepath.Join(t.TempDir(), "dynamic.vhd")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := converter.ToDynamic(stream, f, blockSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// OpenVHD opens the disk stream of the VHD at the given path, it is closed with the test.
+func OpenVHD(t testing.TB, path string) *diskstream.DiskStream {
+	t.Helper()
+	stream, err := diskstream.CreateNewDiskStream(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stream.Close() })
+	return stream
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"gopkg.in/urfave/cli.v1"
-	"log"
 	"os"
 )
 
@@ -17,14 +16,33 @@ func main() {
 			Name:  "verbose",
 			Usage: "Show more output",
 		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Usage: "Format of the log output, text or json (Default: text)",
+		},
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "Configuration file with the default values of the flags (Default: ~/" + defaultConfigName + " if it exists)",
+		},
 	}
+	app.Before = setupLogFormat
 
 	app.Commands = []cli.Command{
 		vhdInspectCmdHandler(),
 		vhdUploadCmdHandler(),
+		vhdUploadManagedDiskCmdHandler(),
+		vhdConvertCmdHandler(),
+		vhdChecksumCmdHandler(),
+		vhdDownloadCmdHandler(),
+		vhdCopyCmdHandler(),
+		vhdVerifyCmdHandler(),
+		vhdCleanupCmdHandler(),
+	}
+	for i := range app.Commands {
+		app.Commands[i].Before = applyConfigFile
 	}
 
 	if err := app.Run(os.Args); err != nil {
-		log.Fatalln(err)
+		logFatal(err)
 	}
 }
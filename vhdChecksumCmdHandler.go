@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"gopkg.in/urfave/cli.v1"
+
+	"github.com/flatcar/azure-vhd-utils/op"
+)
+
+func vhdChecksumCmdHandler() cli.Command {
+	return cli.Command{
+		Name:  "checksum",
+		Usage: "Compute the MD5 hash of a local VHD as stored on its page blob",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "localvhdpath",
+				Usage: "Path to the VHD in the local machine.",
+			},
+			cli.StringFlag{
+				Name:  "parent",
+				Usage: "Path to the parent VHD of a differencing disk, if the path recorded in the disk is wrong (optional).",
+			},
+			cli.BoolFlag{
+				Name:  "sha256",
+				Usage: "Compute the SHA256 hash too.",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			localVHDPath := c.String("localvhdpath")
+			if localVHDPath == "" {
+				return errors.New("Missing required argument --localvhdpath")
+			}
+
+			checksum, err := op.Checksum(localVHDPath, &op.ChecksumOptions{
+				ParentPath: c.String("parent"),
+				SHA256:     c.IsSet("sha256"),
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Println()
+			fmt.Printf("Size:          %d bytes\n", checksum.Size)
+			fmt.Printf("MD5 (hex):     %x\n", checksum.MD5)
+			fmt.Printf("MD5 (base64):  %s\n", base64.StdEncoding.EncodeToString(checksum.MD5))
+			if checksum.SHA256 != nil {
+				fmt.Printf("SHA256 (hex):  %x\n", checksum.SHA256)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gopkg.in/urfave/cli.v1"
+
+	"github.com/flatcar/azure-vhd-utils/op"
+)
+
+func vhdCleanupCmdHandler() cli.Command {
+	return cli.Command{
+		Name:  "cleanup",
+		Usage: "List and clear the upload markers of the page blobs in a container",
+		Flags: append(storageAccountFlags(),
+			cli.StringFlag{
+				Name:  "containername",
+				Usage: "Name of the container holding the page blobs. (Default: vhds)",
+			},
+			cli.DurationFlag{
+				Name:  "older-than",
+				Usage: "Age of the last change of a blob with an unfinished upload after which its marker is stale. (Default: 24h)",
+			},
+			cli.BoolFlag{
+				Name:  "clear",
+				Usage: "Remove the markers of the finished uploads and the stale markers, instead of only listing them.",
+			},
+		),
+		Action: func(c *cli.Context) error {
+			stgAccountName := c.String("stgaccountname")
+			if stgAccountName == "" {
+				return errors.New("Missing required argument --stgaccountname, or the " + accountNameEnv + " environment variable")
+			}
+
+			stgAccountKey := storageAccountKey(c)
+
+			containerName := c.String("containername")
+			if containerName == "" {
+				containerName = "vhds"
+				log.Println("Using default container 'vhds'")
+			}
+
+			olderThan := c.Duration("older-than")
+			if c.IsSet("older-than") && olderThan <= 0 {
+				return errors.New("The --older-than argument must be a positive duration")
+			}
+
+			serviceClient, err := createServiceClient(c, stgAccountName, stgAccountKey)
+			if err != nil {
+				return err
+			}
+
+			copts := op.CleanupOptions{
+				OlderThan: olderThan,
+				Clear:     c.IsSet("clear"),
+				Logger: func(s string) {
+					log.Println(s)
+				},
+			}
+			markers, err := op.Cleanup(context.TODO(), serviceClient, containerName, &copts)
+			for _, m := range markers {
+				state := "in progress"
+				if m.Complete {
+					state = "complete"
+				} else if m.Stale {
+					state = "stale"
+				}
+				if m.Cleared {
+					state += ", cleared"
+				}
+				fmt.Printf("%s\t%s\t%s\n", m.BlobName, m.LastModified.UTC().Format(time.RFC3339), state)
+			}
+			return err
+		},
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"gopkg.in/urfave/cli.v1"
+
+	"github.com/flatcar/azure-vhd-utils/op"
+)
+
+func vhdConvertCmdHandler() cli.Command {
+	return cli.Command{
+		Name:  "convert",
+		Usage: "Convert a local VHD or VHDX to a dynamic or fixed VHD",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "localvhdpath",
+				Usage: "Path to the source VHD or VHDX in the local machine.",
+			},
+			cli.StringFlag{
+				Name:  "output",
+				Usage: "Path to the VHD to create.",
+			},
+			cli.StringFlag{
+				Name:  "type",
+				Usage: "Type of the VHD to create, dynamic or fixed, a VHDX can only be converted to a fixed VHD (Default: dynamic)",
+			},
+			cli.StringFlag{
+				Name:  "blocksize",
+				Usage: "Size of the blocks of the dynamic VHD, in bytes with an optional K or M suffix (Default: 2M)",
+			},
+			cli.BoolFlag{
+				Name:  "overwrite",
+				Usage: "Overwrite the output VHD if already exists.",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			localVHDPath := c.String("localvhdpath")
+			if localVHDPath == "" {
+				return errors.New("Missing required argument --localvhdpath")
+			}
+
+			output := c.String("output")
+			if output == "" {
+				return errors.New("Missing required argument --output")
+			}
+
+			fixed := false
+			switch c.String("type") {
+			case "", "dynamic":
+			case "fixed":
+				fixed = true
+			default:
+				return fmt.Errorf("Invalid value for --type %q, expected dynamic or fixed", c.String("type"))
+			}
+			if fixed && c.IsSet("blocksize") {
+				return errors.New("The --blocksize flag only applies to dynamic VHDs")
+			}
+
+			blockSize := uint32(0)
+			if c.IsSet("blocksize") {
+				value := c.String("blocksize")
+				multiplier := uint64(1)
+				switch {
+				case strings.HasSuffix(value, "K"):
+					value, multiplier = strings.TrimSuffix(value, "K"), 1024
+				case strings.HasSuffix(value, "M"):
+					value, multiplier = strings.TrimSuffix(value, "M"), 1024*1024
+				}
+				b, err := strconv.ParseUint(value, 10, 32)
+				if err != nil || b == 0 || b*multiplier > 1<<31 {
+					return fmt.Errorf("Invalid value for --blocksize %q, expected a size in bytes with an optional K or M suffix", c.String("blocksize"))
+				}
+				blockSize = uint32(b * multiplier)
+			}
+
+			copts := op.ConvertOptions{
+				Overwrite: c.IsSet("overwrite"),
+				BlockSize: blockSize,
+				Logger: func(s string) {
+					log.Println(s)
+				},
+			}
+			if fixed {
+				return op.ConvertToFixed(localVHDPath, output, &copts)
+			}
+			return op.ConvertToDynamic(localVHDPath, output, &copts)
+		},
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"gopkg.in/urfave/cli.v1"
+
+	"github.com/flatcar/azure-vhd-utils/op"
+)
+
+func vhdCopyCmdHandler() cli.Command {
+	return cli.Command{
+		Name:  "copy",
+		Usage: "Copy a VHD page blob to another name or container in the same storage account",
+		Flags: append(storageAccountFlags(),
+			cli.StringFlag{
+				Name:  "containername",
+				Usage: "Name of the container holding source page blob. (Default: vhds)",
+			},
+			cli.StringFlag{
+				Name:  "blobname",
+				Usage: "Name of the source page blob.",
+			},
+			cli.StringFlag{
+				Name:  "destcontainername",
+				Usage: "Name of the container holding destination page blob. (Default: the source container)",
+			},
+			cli.StringFlag{
+				Name:  "destblobname",
+				Usage: "Name of the destination page blob.",
+			},
+			cli.BoolFlag{
+				Name:  "overwrite",
+				Usage: "Overwrite the destination blob if already exists.",
+			},
+			cli.BoolFlag{
+				Name:  "deletesource",
+				Usage: "Delete the source blob once it was copied, renaming the blob.",
+			},
+			cli.BoolFlag{
+				Name:  "create-container",
+				Usage: "Create the destination container if it does not exist.",
+			},
+		),
+		Action: func(c *cli.Context) error {
+			stgAccountName := c.String("stgaccountname")
+			if stgAccountName == "" {
+				return errors.New("Missing required argument --stgaccountname, or the " + accountNameEnv + " environment variable")
+			}
+
+			stgAccountKey := storageAccountKey(c)
+
+			containerName := c.String("containername")
+			if containerName == "" {
+				containerName = "vhds"
+				log.Println("Using default container 'vhds'")
+			}
+
+			blobName := c.String("blobname")
+			if blobName == "" {
+				return errors.New("Missing required argument --blobname")
+			}
+
+			destContainerName := c.String("destcontainername")
+			if destContainerName == "" {
+				destContainerName = containerName
+			}
+
+			destBlobName := c.String("destblobname")
+			if destBlobName == "" {
+				return errors.New("Missing required argument --destblobname")
+			}
+
+			if !strings.HasSuffix(strings.ToLower(destBlobName), ".vhd") {
+				destBlobName = destBlobName + ".vhd"
+			}
+
+			serviceClient, err := createServiceClient(c, stgAccountName, stgAccountKey)
+			if err != nil {
+				return err
+			}
+
+			copts := op.CopyOptions{
+				Overwrite:       c.IsSet("overwrite"),
+				DeleteSource:    c.IsSet("deletesource"),
+				CreateContainer: c.IsSet("create-container"),
+				Logger: func(s string) {
+					log.Println(s)
+				},
+			}
+			err = op.Copy(context.TODO(), serviceClient, containerName, blobName, destContainerName, destBlobName, &copts)
+			if errors.Is(err, op.ContainerNotFound) {
+				return fmt.Errorf("The container '%s' does not exist, create it or pass --create-container", destContainerName)
+			}
+			return err
+		},
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"gopkg.in/urfave/cli.v1"
+
+	"github.com/flatcar/azure-vhd-utils/op"
+)
+
+func vhdDownloadCmdHandler() cli.Command {
+	return cli.Command{
+		Name:  "download",
+		Usage: "Download a VHD page blob to the local machine",
+		Flags: append(append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "localvhdpath",
+				Usage: "Path to the destination VHD in the local machine.",
+			},
+		}, storageAccountFlags()...),
+			cli.StringFlag{
+				Name:  "containername",
+				Usage: "Name of the container holding the page blob. (Default: vhds)",
+			},
+			cli.StringFlag{
+				Name:  "blobname",
+				Usage: "Name of the page blob.",
+			},
+			cli.StringFlag{
+				Name:  "parallelism",
+				Usage: "Number of concurrent goroutines to be used for download",
+			},
+			cli.BoolFlag{
+				Name:  "overwrite",
+				Usage: "Overwrite the local VHD if already exists.",
+			},
+		),
+		Action: func(c *cli.Context) error {
+			localVHDPath := c.String("localvhdpath")
+			if localVHDPath == "" {
+				return errors.New("Missing required argument --localvhdpath")
+			}
+
+			stgAccountName := c.String("stgaccountname")
+			if stgAccountName == "" {
+				return errors.New("Missing required argument --stgaccountname, or the " + accountNameEnv + " environment variable")
+			}
+
+			stgAccountKey := storageAccountKey(c)
+
+			containerName := c.String("containername")
+			if containerName == "" {
+				containerName = "vhds"
+				log.Println("Using default container 'vhds'")
+			}
+
+			blobName := c.String("blobname")
+			if blobName == "" {
+				return errors.New("Missing required argument --blobname")
+			}
+
+			if !strings.HasSuffix(strings.ToLower(blobName), ".vhd") {
+				blobName = blobName + ".vhd"
+			}
+
+			parallelism, err := parseParallelism(c)
+			if err != nil {
+				return err
+			}
+
+			serviceClient, err := createServiceClient(c, stgAccountName, stgAccountKey)
+			if err != nil {
+				return err
+			}
+
+			dopts := op.DownloadOptions{
+				Overwrite:   c.IsSet("overwrite"),
+				Parallelism: parallelism,
+				Logger: func(s string) {
+					log.Println(s)
+				},
+			}
+			// An interrupt cancels the download, a second one
+			// exits at once.
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			go func() {
+				<-ctx.Done()
+				stop()
+			}()
+			return op.Download(ctx, serviceClient, containerName, blobName, localVHDPath, &dopts)
+		},
+	}
+}
@@ -3,16 +3,19 @@ package main
 import (
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"text/template"
+	"time"
 
 	"github.com/flatcar/azure-vhd-utils/vhdcore"
 	"github.com/flatcar/azure-vhd-utils/vhdcore/block/bitmap"
 	"github.com/flatcar/azure-vhd-utils/vhdcore/footer"
 	"github.com/flatcar/azure-vhd-utils/vhdcore/vhdfile"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/vhdx"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -32,10 +35,76 @@ type ExpandableDiskBlocksInfo struct {
 	EmptyBlockCount       int64
 }
 
+// VhdSummary type describes the main fields of the footer and, for an expandable disk, of the header of a VHD
+type VhdSummary struct {
+	DiskType           string             `json:"diskType"`
+	CurrentSize        int64              `json:"currentSize"`
+	OriginalSize       int64              `json:"originalSize"`
+	CreatorApplication string             `json:"creatorApplication"`
+	TimeStamp          time.Time          `json:"timeStamp"`
+	Cookie             string             `json:"cookie"`
+	CookieValid        bool               `json:"cookieValid"`
+	CheckSum           uint32             `json:"checkSum"`
+	CheckSumValid      bool               `json:"checkSumValid"`
+	UniqueID           string             `json:"uniqueId"`
+	DiskGeometry       DiskGeometryInfo   `json:"diskGeometry"`
+	Dynamic            *DynamicHeaderInfo `json:"dynamic,omitempty"`
+}
+
+// DiskGeometryInfo type describes the cylinders, heads and sectors per track in the footer of a VHD
+type DiskGeometryInfo struct {
+	Cylinders uint16 `json:"cylinders"`
+	Heads     byte   `json:"heads"`
+	Sectors   byte   `json:"sectors"`
+}
+
+// VhdxSummary type describes the main fields of the headers, the region table and the metadata of a VHDX
+type VhdxSummary struct {
+	Format             string           `json:"format"`
+	Creator            string           `json:"creator"`
+	DiskType           string           `json:"diskType"`
+	VirtualSize        int64            `json:"virtualSize"`
+	BlockSize          uint32           `json:"blockSize"`
+	LogicalSectorSize  uint32           `json:"logicalSectorSize"`
+	PhysicalSectorSize uint32           `json:"physicalSectorSize"`
+	VirtualDiskID      string           `json:"virtualDiskId"`
+	SequenceNumber     uint64           `json:"sequenceNumber"`
+	HasLog             bool             `json:"hasLog"`
+	Regions            []VhdxRegionInfo `json:"regions"`
+	BlockCount         int64            `json:"blockCount"`
+	BlockStates        map[string]int64 `json:"blockStates"`
+}
+
+// VhdxRegionInfo type describes an entry of the region table of a VHDX
+type VhdxRegionInfo struct {
+	Name       string `json:"name"`
+	FileOffset uint64 `json:"fileOffset"`
+	Length     uint32 `json:"length"`
+	Required   bool   `json:"required"`
+}
+
+// DynamicHeaderInfo type describes the main fields of the header of an expandable disk
+type DynamicHeaderInfo struct {
+	TableOffset     int64  `json:"tableOffset"`
+	BlockSize       uint32 `json:"blockSize"`
+	MaxTableEntries uint32 `json:"maxTableEntries"`
+}
+
 func vhdInspectCmdHandler() cli.Command {
 	return cli.Command{
 		Name:  "inspect",
-		Usage: "Commands to inspect local VHD",
+		Usage: "Show the summary of a local VHD or VHDX, or inspect the segments of a VHD with the subcommands",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "localvhdpath",
+				Usage: "Path to VHD or VHDX.",
+			},
+			cli.BoolFlag{
+				Name:  "json",
+				Usage: "Show the summary as JSON.",
+			},
+		},
+		Action: showVhdSummary,
 		Subcommands: []cli.Command{
 			{
 				Name:  "header",
@@ -118,6 +187,157 @@ func vhdInspectCmdHandler() cli.Command {
 	}
 }
 
+const summaryTempl = `Footer:
+  DiskType          : {{.DiskType}}
+  CurrentSize       : {{.CurrentSize}} bytes
+  OriginalSize      : {{.OriginalSize}} bytes
+  CreatorApplication: {{.CreatorApplication}}
+  TimeStamp         : {{.TimeStamp | printf "%v"}}
+  Cookie            : {{.Cookie}}{{if not .CookieValid}} (invalid){{end}}
+  CheckSum          : {{.CheckSum | printf "0x%08X"}} ({{if .CheckSumValid}}valid{{else}}invalid{{end}})
+  UniqueID          : {{.UniqueID}}
+  DiskGeometry      : {{with .DiskGeometry}}{{.Cylinders}} cylinders, {{.Heads}} heads, {{.Sectors}} sectors per track{{end}}
+{{with .Dynamic}}Dynamic header:
+  TableOffset       : {{.TableOffset}}
+  BlockSize         : {{.BlockSize}} bytes
+  MaxTableEntries   : {{.MaxTableEntries}}
+{{end}}`
+
+const vhdxSummaryTempl = `VHDX:
+  Creator           : {{.Creator}}
+  DiskType          : {{.DiskType}}
+  VirtualSize       : {{.VirtualSize}} bytes
+  BlockSize         : {{.BlockSize}} bytes
+  LogicalSectorSize : {{.LogicalSectorSize}} bytes
+  PhysicalSectorSize: {{.PhysicalSectorSize}} bytes
+  VirtualDiskID     : {{.VirtualDiskID}}
+  SequenceNumber    : {{.SequenceNumber}}
+  Log               : {{if .HasLog}}not applied{{else}}empty{{end}}
+Regions:
+{{range .Regions}}  {{.Name | printf "%-18s"}}: offset {{.FileOffset}}, {{.Length}} bytes{{if .Required}}, required{{end}}
+{{end}}Blocks:
+  Total             : {{.BlockCount}}
+{{range $state, $count := .BlockStates}}  {{$state | printf "%-18s"}}: {{$count}}
+{{end}}`
+
+func showVhdSummary(c *cli.Context) error {
+	vhdPath := c.String("localvhdpath")
+	if vhdPath == "" {
+		return errors.New("Missing required argument --localvhdpath")
+	}
+
+	isVhdx, err := vhdx.IsVhdxFile(vhdPath)
+	if err != nil {
+		return err
+	}
+	if isVhdx {
+		return showVhdxSummary(c, vhdPath)
+	}
+
+	vhdFooter, vhdHeader, err := vhdfile.ReadFooterAndHeader(vhdPath)
+	if err != nil {
+		return err
+	}
+
+	summary := &VhdSummary{
+		DiskType:           vhdFooter.DiskType.String(),
+		CurrentSize:        vhdFooter.VirtualSize,
+		OriginalSize:       vhdFooter.PhysicalSize,
+		CreatorApplication: vhdFooter.CreatorApplication,
+		Cookie:             vhdFooter.Cookie.String(),
+		CookieValid:        vhdFooter.Cookie.IsValid(),
+		CheckSum:           vhdFooter.CheckSum,
+		CheckSumValid:      footer.ComputeCheckSum(vhdFooter.RawData) == vhdFooter.CheckSum,
+		UniqueID:           vhdFooter.UniqueID.String(),
+		DiskGeometry: DiskGeometryInfo{
+			Cylinders: vhdFooter.DiskGeometry.Cylinder,
+			Heads:     vhdFooter.DiskGeometry.Heads,
+			Sectors:   vhdFooter.DiskGeometry.Sectors,
+		},
+	}
+	if vhdFooter.TimeStamp != nil {
+		summary.TimeStamp = *vhdFooter.TimeStamp
+	}
+	if vhdHeader != nil {
+		summary.Dynamic = &DynamicHeaderInfo{
+			TableOffset:     vhdHeader.TableOffset,
+			BlockSize:       vhdHeader.BlockSize,
+			MaxTableEntries: vhdHeader.MaxTableEntries,
+		}
+	}
+
+	if c.IsSet("json") {
+		b, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	t, err := template.New("root").Parse(summaryTempl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(os.Stdout, summary)
+}
+
+func showVhdxSummary(c *cli.Context, vhdPath string) error {
+	v, err := vhdx.Open(vhdPath)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	diskType := "Dynamic"
+	switch {
+	case v.Metadata.HasParent:
+		diskType = "Differencing"
+	case v.Metadata.LeaveBlocksAllocated:
+		diskType = "Fixed"
+	}
+	summary := &VhdxSummary{
+		Format:             "VHDX",
+		Creator:            v.Creator,
+		DiskType:           diskType,
+		VirtualSize:        v.VirtualSize(),
+		BlockSize:          v.Metadata.BlockSize,
+		LogicalSectorSize:  v.Metadata.LogicalSectorSize,
+		PhysicalSectorSize: v.Metadata.PhysicalSectorSize,
+		VirtualDiskID:      v.Metadata.VirtualDiskID.String(),
+		SequenceNumber:     v.Header.SequenceNumber,
+		HasLog:             v.Header.HasLog(),
+		BlockCount:         v.DataBlockCount(),
+		BlockStates:        make(map[string]int64),
+	}
+	for _, r := range v.Regions {
+		summary.Regions = append(summary.Regions, VhdxRegionInfo{
+			Name:       r.Name(),
+			FileOffset: r.FileOffset,
+			Length:     r.Length,
+			Required:   r.Required,
+		})
+	}
+	for i := int64(0); i < summary.BlockCount; i++ {
+		summary.BlockStates[v.PayloadEntry(i).State().String()]++
+	}
+
+	if c.IsSet("json") {
+		b, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	t, err := template.New("root").Parse(vhdxSummaryTempl)
+	if err != nil {
+		return err
+	}
+	return t.Execute(os.Stdout, summary)
+}
+
 const headerTempl = `Cookie            : {{.Cookie }}
 DataOffset        : {{.DataOffset}}
 TableOffset       : {{.TableOffset}}
@@ -148,21 +368,19 @@ func showVhdHeader(c *cli.Context) error {
 		return errors.New("Missing required argument --path")
 	}
 
-	vFileFactory := &vhdfile.FileFactory{}
-	vFile, err := vFileFactory.Create(vhdPath)
+	_, vhdHeader, err := vhdfile.ReadFooterAndHeader(vhdPath)
 	if err != nil {
 		return err
 	}
 
-	defer vFileFactory.Dispose(nil)
-	if vFile.GetDiskType() == footer.DiskTypeFixed {
+	if vhdHeader == nil {
 		return errors.New("Warn: Only expandable VHDs has header structure, this is a fixed VHD")
 	}
 
 	t, err := template.New("root").
 		Funcs(template.FuncMap{"dump": hex.Dump}).
 		Parse(headerTempl)
-	t.Execute(os.Stdout, vFile.Header)
+	t.Execute(os.Stdout, vhdHeader)
 
 	return nil
 }
@@ -193,17 +411,15 @@ func showVhdFooter(c *cli.Context) error {
 		return errors.New("Missing required argument --path")
 	}
 
-	vFileFactory := &vhdfile.FileFactory{}
-	vFile, err := vFileFactory.Create(vhdPath)
+	vhdFooter, _, err := vhdfile.ReadFooterAndHeader(vhdPath)
 	if err != nil {
 		return err
 	}
 
-	defer vFileFactory.Dispose(nil)
 	t, err := template.New("root").
 		Funcs(template.FuncMap{"dump": hex.Dump}).
 		Parse(footerTempl)
-	t.Execute(os.Stdout, vFile.Footer)
+	t.Execute(os.Stdout, vhdFooter)
 
 	return nil
 }
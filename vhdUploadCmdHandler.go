@@ -1,20 +1,39 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"net/url"
+	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
 	"gopkg.in/urfave/cli.v1"
 
 	"github.com/flatcar/azure-vhd-utils/op"
+	"github.com/flatcar/azure-vhd-utils/upload/progress"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/diskstream"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/footer"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/validator"
 )
 
 func createServiceClient(c *cli.Context, account, key string) (*service.Client, error) {
@@ -22,7 +41,46 @@ func createServiceClient(c *cli.Context, account, key string) (*service.Client,
 		client *service.Client
 		err    error
 	)
-	accountURL := fmt.Sprintf("https://%s.blob.core.windows.net", url.PathEscape(account))
+	sas, err := parseSASURL(c)
+	if err != nil {
+		return nil, err
+	}
+	if sas != nil {
+		if key != "" {
+			return nil, errors.New("The --sasuri and --stgaccountkey flags cannot be used together")
+		}
+		if c.String("blobendpoint") != "" {
+			return nil, errors.New("The --sasuri and --blobendpoint flags cannot be used together")
+		}
+		if c.String("endpoint-suffix") != "" {
+			return nil, errors.New("The --sasuri and --endpoint-suffix flags cannot be used together")
+		}
+		client, err = service.NewClientWithNoCredential(sas.serviceURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create storage service client: %w", err)
+		}
+		return client, nil
+	}
+
+	// a blob URL names the account and its blob service
+	// endpoint, but authenticates like the account name
+	bu, err := parseBlobURL(c)
+	if err != nil {
+		return nil, err
+	}
+	var accountURL, suffix string
+	if bu != nil {
+		accountURL, suffix = bu.serviceURL, bu.endpointSuffix
+		if account == "" {
+			account = bu.account
+		}
+	} else {
+		if accountURL, err = getAccountURL(c, account); err != nil {
+			return nil, err
+		}
+		// the suffix was already checked by getAccountURL
+		suffix, _ = getEndpointSuffix(c)
+	}
 
 	if key != "" {
 		skc, err := service.NewSharedKeyCredential(account, key)
@@ -35,6 +93,12 @@ func createServiceClient(c *cli.Context, account, key string) (*service.Client,
 			DisableInstanceDiscovery: c.Bool("disableinstancediscovery"),
 			TenantID:                 c.String("tenantid"),
 		}
+		// the sovereign clouds authenticate with their own
+		// authority, the one of other clouds like Azure Stack
+		// is taken from AZURE_AUTHORITY_HOST as usual
+		if cloudConfig, ok := knownClouds[strings.ToLower(suffix)]; ok {
+			opts.ClientOptions.Cloud = cloudConfig
+		}
 		creds, err := azidentity.NewDefaultAzureCredential(&opts)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to create default Azure credential: %w", err)
@@ -49,30 +113,141 @@ func createServiceClient(c *cli.Context, account, key string) (*service.Client,
 	return client, nil
 }
 
+// storageAccountFlags returns the flags selecting the storage account
+// and the way to authenticate to it, shared by the commands talking to
+// the blob service.
+func storageAccountFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:   "stgaccountname",
+			Usage:  "Azure storage account name.",
+			EnvVar: accountNameEnv,
+		},
+		cli.StringFlag{
+			Name:   "stgaccountkey",
+			Usage:  "Azure storage account key (optional).",
+			EnvVar: accountKeyEnv,
+		},
+		cli.StringFlag{
+			Name:   "tenantid",
+			Usage:  "Azure Tenant ID.",
+			EnvVar: "AZURE_TENANT_ID",
+		},
+		cli.BoolFlag{
+			Name:  "disableinstancediscovery",
+			Usage: "Skip the request to Microsoft Entra before authenticating.",
+		},
+		cli.StringFlag{
+			Name:  "blobendpoint",
+			Usage: "Blob service endpoint of the storage account (optional, default: https://<stgaccountname>.blob.<endpoint-suffix>).",
+		},
+		cli.StringFlag{
+			Name:  "endpoint-suffix",
+			Usage: "Storage endpoint suffix of the Azure cloud, like core.usgovcloudapi.net (optional, default: " + defaultEndpointSuffix + ").",
+		},
+		cli.BoolFlag{
+			Name:  "allow-http",
+			Usage: "Allow plain HTTP blob service endpoint, meant for storage emulators only.",
+		},
+	}
+}
+
+// The environment variables standing in for the --stgaccountname and
+// --stgaccountkey flags, the ones of the Azure CLI.
+const (
+	accountNameEnv = "AZURE_STORAGE_ACCOUNT"
+	accountKeyEnv  = "AZURE_STORAGE_KEY"
+)
+
+// storageAccountKey returns the storage account key given with the
+// --stgaccountkey flag or, without it, in the environment. The key
+// of the environment is ignored when a SAS URL is given, it is only
+// a fallback for a missing flag. The key must never be logged.
+func storageAccountKey(c *cli.Context) string {
+	key := c.String("stgaccountkey")
+	if c.String("sasuri") != "" && key == os.Getenv(accountKeyEnv) {
+		return ""
+	}
+	return key
+}
+
+// defaultEndpointSuffix is the storage endpoint suffix of the public
+// Azure cloud.
+const defaultEndpointSuffix = "core.windows.net"
+
+// knownClouds maps the storage endpoint suffixes of the Azure clouds
+// known to the SDK to their authentication configuration.
+var knownClouds = map[string]cloud.Configuration{
+	defaultEndpointSuffix:    cloud.AzurePublic,
+	"core.usgovcloudapi.net": cloud.AzureGovernment,
+	"core.chinacloudapi.cn":  cloud.AzureChina,
+}
+
+// getEndpointSuffix returns the storage endpoint suffix given with
+// --endpoint-suffix, or the one of the public cloud.
+func getEndpointSuffix(c *cli.Context) (string, error) {
+	suffix := c.String("endpoint-suffix")
+	if suffix == "" {
+		return defaultEndpointSuffix, nil
+	}
+	suffix = strings.TrimPrefix(suffix, ".")
+	if strings.ContainsAny(suffix, "/:@?# ") || !strings.Contains(suffix, ".") {
+		return "", fmt.Errorf("Invalid value for --endpoint-suffix %q, expected a domain like core.usgovcloudapi.net", c.String("endpoint-suffix"))
+	}
+	return suffix, nil
+}
+
+// getAccountURL returns the blob service endpoint of the storage
+// account. The endpoint is either given explicitly with --blobendpoint
+// or derived from the account name and the endpoint suffix. Only HTTPS
+// endpoints are accepted, unless --allow-http is passed.
+func getAccountURL(c *cli.Context, account string) (string, error) {
+	suffix, err := getEndpointSuffix(c)
+	if err != nil {
+		return "", err
+	}
+	accountURL := c.String("blobendpoint")
+	if accountURL == "" {
+		accountURL = fmt.Sprintf("https://%s.blob.%s", url.PathEscape(account), suffix)
+	}
+
+	u, err := url.Parse(accountURL)
+	if err != nil {
+		return "", fmt.Errorf("Invalid blob service endpoint %q: %w", accountURL, err)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "https":
+	case "http":
+		if !c.Bool("allow-http") {
+			return "", fmt.Errorf("Refusing to use plain HTTP blob service endpoint %q, use HTTPS or pass --allow-http (meant for storage emulators only)", accountURL)
+		}
+	default:
+		return "", fmt.Errorf("Unsupported scheme %q in blob service endpoint %q, expected https", u.Scheme, accountURL)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("Missing host in blob service endpoint %q", accountURL)
+	}
+
+	return accountURL, nil
+}
+
 func vhdUploadCmdHandler() cli.Command {
 	return cli.Command{
 		Name:  "upload",
 		Usage: "Upload a local VHD to Azure storage as page blob",
-		Flags: []cli.Flag{
+		Flags: append(append([]cli.Flag{
 			cli.StringFlag{
 				Name:  "localvhdpath",
-				Usage: "Path to source VHD in the local machine.",
-			},
-			cli.StringFlag{
-				Name:  "stgaccountname",
-				Usage: "Azure storage account name.",
+				Usage: "Path to source VHD in the local machine, - for the standard input.",
 			},
+		}, storageAccountFlags()...),
 			cli.StringFlag{
-				Name:  "stgaccountkey",
-				Usage: "Azure storage account key (optional).",
+				Name:  "sasuri",
+				Usage: "SAS URL of the destination container or page blob, instead of the storage account name and key (optional).",
 			},
 			cli.StringFlag{
-				Name:  "tenantid",
-				Usage: "Azure Tenant ID.",
-			},
-			cli.BoolFlag{
-				Name:  "disableinstancediscovery",
-				Usage: "Skip the request to Microsoft Entra before authenticating.",
+				Name:  "bloburl",
+				Usage: "URL of the destination page blob, like https://<account>.blob.core.windows.net/<container>/<blob>.vhd, instead of the storage account, container and blob names (optional).",
 			},
 			cli.StringFlag{
 				Name:  "containername",
@@ -82,6 +257,10 @@ func vhdUploadCmdHandler() cli.Command {
 				Name:  "blobname",
 				Usage: "Name of the destination page blob.",
 			},
+			cli.StringFlag{
+				Name:  "name-template",
+				Usage: "Template of the destination page blob name, with the {basename}, {date}, {time} and {sha8} placeholders, instead of --blobname.",
+			},
 			cli.StringFlag{
 				Name:  "parallelism",
 				Usage: "Number of concurrent goroutines to be used for upload",
@@ -90,7 +269,227 @@ func vhdUploadCmdHandler() cli.Command {
 				Name:  "overwrite",
 				Usage: "Overwrite the blob if already exists.",
 			},
-		},
+			cli.BoolFlag{
+				Name:  "yes",
+				Usage: "Do not ask for confirmation before overwriting an existing blob.",
+			},
+			cli.BoolFlag{
+				Name:  "force",
+				Usage: "Same as --yes.",
+			},
+			cli.BoolFlag{
+				Name:  "no-overwrite-check",
+				Usage: "Skip checking whether the blob already exists (unsafe, use only for blobs known to be new).",
+			},
+			cli.StringFlag{
+				Name:  "min-throughput",
+				Usage: "Abort the upload if the throughput stays below this many Mb/sec for the --min-throughput-window period (optional).",
+			},
+			cli.StringFlag{
+				Name:  "min-throughput-window",
+				Usage: "The period of time the throughput needs to stay below --min-throughput to abort the upload (Default: 5m).",
+			},
+			cli.BoolFlag{
+				Name:  "verify-blob-size",
+				Usage: "Check the size of the created page blob before uploading.",
+			},
+			cli.BoolFlag{
+				Name:  "verify-empty-blob",
+				Usage: "Check that the created page blob has no allocated pages before uploading.",
+			},
+			cli.BoolFlag{
+				Name:  "verify-md5",
+				Usage: "Check the MD5 hash stored in the page blob properties once uploaded.",
+			},
+			cli.BoolFlag{
+				Name:  "per-block-checksum",
+				Usage: "Read every uploaded range back and compare its SHA256 digest with the digest of the uploaded data before finalizing the upload.",
+			},
+			cli.StringFlag{
+				Name:  "block-checksum-file",
+				Usage: "Path of a file to write the SHA256 digests of the uploaded ranges to, implies --per-block-checksum (optional).",
+			},
+			cli.BoolFlag{
+				Name:  "verify-after-upload",
+				Usage: "Read the data of the VHD back from the blob and compare it with the local VHD before finalizing the upload.",
+			},
+			cli.BoolFlag{
+				Name:  "acquire-lease",
+				Usage: "Hold a lease on the page blob during the upload, so no other writer can modify it.",
+			},
+			cli.BoolFlag{
+				Name:  "conditional-writes",
+				Usage: "Condition the page writes on a sequence number set on the page blob, so the upload aborts if another upload takes the blob over.",
+			},
+			cli.StringFlag{
+				Name:  "sparse-threshold",
+				Usage: "Skip the zero pages of ranges whose fraction of zero pages is at least this value, between 0 and 1 (optional).",
+			},
+			cli.BoolFlag{
+				Name:  "low-mem",
+				Usage: "Upload with a small memory footprint, at the cost of throughput, for huge disks on small machines.",
+			},
+			cli.StringFlag{
+				Name:  "block-size",
+				Usage: "Size of the chunks the ranges are written in, in bytes with an optional K or M suffix, a multiple of 512 of at most 4M (Default: 4M, 1M with --low-mem)",
+			},
+			cli.BoolFlag{
+				Name:  "strict",
+				Usage: "Reject the local VHD if its footer has any oddity, instead of warning about the minor ones.",
+			},
+			cli.BoolFlag{
+				Name:  "lenient",
+				Usage: "Only warn about the nonstandard cookie, checksum mismatch or oddities of the local VHD footer.",
+			},
+			cli.StringSliceFlag{
+				Name:  "metadata",
+				Usage: "Custom metadata to store on the page blob as key=value, can be repeated (optional).",
+			},
+			cli.StringSliceFlag{
+				Name:  "tag",
+				Usage: "Tag to set on the page blob once uploaded as key=value, can be repeated (optional).",
+			},
+			cli.BoolFlag{
+				Name:  "create-container",
+				Usage: "Create the destination container if it does not exist.",
+			},
+			cli.StringFlag{
+				Name:  "container-access",
+				Usage: "Public access level of the container created with --create-container: private, blob or container (Default: private).",
+			},
+			cli.StringFlag{
+				Name:  "tier",
+				Usage: "Premium page blob access tier to create the page blob with, P4 to P80, needs a premium storage account (optional).",
+			},
+			cli.StringFlag{
+				Name:  "encryption-scope",
+				Usage: "Encryption scope to create and write the page blob with (optional).",
+			},
+			cli.StringFlag{
+				Name:  "cpk-key",
+				Usage: "Base64 encoded AES-256 customer-provided key to encrypt the page blob with, needs HTTPS (optional).",
+			},
+			cli.BoolFlag{
+				Name:  "resume",
+				Usage: "Resume the upload into an existing blob without upload metadata, trusting the pages it has.",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "Check the local VHD and report the size which would be uploaded, without contacting Azure.",
+			},
+			cli.BoolFlag{
+				Name:  "skip-validation",
+				Usage: "Do not validate the footer and header of the local VHD before the upload, for advanced users.",
+			},
+			cli.BoolFlag{
+				Name:  "direct-io",
+				Usage: "Read the local VHD bypassing the page cache of the operating system, where supported.",
+			},
+			cli.BoolFlag{
+				Name:  "detect-source-changes",
+				Usage: "Abort the upload if the local VHD changes while it is read, for a VHD that may be in use.",
+			},
+			cli.StringFlag{
+				Name:  "notify-url",
+				Usage: "URL to POST a JSON summary of the upload to once it completed or failed (optional).",
+			},
+			cli.StringFlag{
+				Name:  "progress-socket",
+				Usage: "Path of a Unix domain socket streaming the upload progress as JSON lines to the connected clients (optional).",
+			},
+			cli.StringFlag{
+				Name:  "progress-format",
+				Usage: "Format of the upload progress written to the standard output, text or json for one JSON object per line (Default: text)",
+			},
+			cli.BoolFlag{
+				Name:  "no-progress",
+				Usage: "Log a plain progress line every --progress-interval instead of redrawing the progress line, for CI logs.",
+			},
+			cli.StringFlag{
+				Name:  "progress-interval",
+				Usage: "Period of the progress lines logged with --no-progress (Default: 30s).",
+			},
+			cli.StringFlag{
+				Name:  "start-offset",
+				Usage: "Upload the ranges of the VHD from this 512 byte aligned offset on into the existing blob (optional).",
+			},
+			cli.StringFlag{
+				Name:  "length",
+				Usage: "Upload only this many bytes, a multiple of 512, from --start-offset on into the existing blob (optional).",
+			},
+			cli.BoolFlag{
+				Name:  "concurrency-auto",
+				Usage: "Adapt the number of concurrent writes to the observed throughput, up to --parallelism.",
+			},
+			cli.StringFlag{
+				Name:  "min-parallelism",
+				Usage: "Least number of concurrent writes of --concurrency-auto (Default: 1).",
+			},
+			cli.StringFlag{
+				Name:  "max-parallelism",
+				Usage: "Most number of concurrent writes of --concurrency-auto, instead of --parallelism.",
+			},
+			cli.StringFlag{
+				Name:  "read-parallelism",
+				Usage: "Number of concurrent goroutines reading the local VHD ahead of the writes (Default: 1)",
+			},
+			cli.StringFlag{
+				Name:  "queue-depth",
+				Usage: "Number of ranges read ahead of the writes to buffer while all the writes are busy, each costing up to --block-size of memory (Default: 0)",
+			},
+			cli.StringFlag{
+				Name:  "maxbandwidth",
+				Usage: "Limit the bandwidth of the upload, in bytes per second with an optional K, M or G suffix, or in megabits per second with the Mbps suffix (optional).",
+			},
+			cli.StringFlag{
+				Name:  "max-retries",
+				Usage: "Number of times a failed write is retried before giving up on the range (Default: 5).",
+			},
+			cli.StringFlag{
+				Name:  "retry-backoff",
+				Usage: "Longest delay before the first retry of a failed write, doubled for each next one up to 30s (Default: 2s).",
+			},
+			cli.StringFlag{
+				Name:  "operation-timeout",
+				Usage: "Time a single write may take before it is abandoned and retried, zero for no limit (Default: 2m).",
+			},
+			cli.BoolFlag{
+				Name:  "no-final-status",
+				Usage: "Do not print the final status line once the upload completed.",
+			},
+			cli.StringFlag{
+				Name:  "parent",
+				Usage: "Path to the parent VHD of a differencing disk, if the path recorded in the disk is wrong (optional).",
+			},
+			cli.StringFlag{
+				Name:  "expected-size",
+				Usage: "Fail if the virtual size of the local VHD in bytes is not this value (optional).",
+			},
+			cli.StringFlag{
+				Name:  "expected-md5",
+				Usage: "Fail if the hex encoded MD5 hash of the local VHD file is not this value (optional).",
+			},
+			cli.StringFlag{
+				Name:  "footer-cookie",
+				Usage: "Cookie to write in the VHD footer of the page blob, exactly 8 characters (optional).",
+			},
+			cli.StringFlag{
+				Name:  "footer-creator-app",
+				Usage: "Creator application to write in the VHD footer of the page blob, at most 4 characters (optional).",
+			},
+			cli.StringFlag{
+				Name:  "footer-creator-version",
+				Usage: "Creator version to write in the VHD footer of the page blob, as major.minor (optional).",
+			},
+			cli.StringFlag{
+				Name:  "footer-creator-host-os",
+				Usage: "Creator host OS to write in the VHD footer of the page blob, as 4 characters like Wi2k (optional).",
+			},
+			cli.BoolFlag{
+				Name:  "new-uuid",
+				Usage: "Write a freshly generated unique ID to the VHD footer of the page blob, for the clones of a base image.",
+			},
+		),
 		Action: func(c *cli.Context) error {
 			const PageBlobPageSize int64 = 512
 			const PageBlobPageSetSize int64 = 4 * 1024 * 1024
@@ -99,64 +498,704 @@ func vhdUploadCmdHandler() cli.Command {
 			if localVHDPath == "" {
 				return errors.New("Missing required argument --localvhdpath")
 			}
+			dryRun := c.IsSet("dry-run")
+			if dryRun && localVHDPath == "-" {
+				return errors.New("The --dry-run flag cannot be used with a VHD read from the standard input")
+			}
+
+			// a SAS URL authenticates on its own and names
+			// the container, and maybe the blob
+			sas, err := parseSASURL(c)
+			if err != nil {
+				return err
+			}
+			// a blob URL names the account, the container and
+			// the blob
+			bu, err := parseBlobURL(c)
+			if err != nil {
+				return err
+			}
 
 			stgAccountName := c.String("stgaccountname")
-			if stgAccountName == "" {
-				return errors.New("Missing required argument --stgaccountname")
+			if bu != nil {
+				stgAccountName = bu.account
+			}
+			if stgAccountName == "" && sas == nil && !dryRun {
+				return errors.New("Missing required argument --stgaccountname, or the " + accountNameEnv + " environment variable")
 			}
 
 			// account key is optional, if not passed,
 			// then we expect that the required storage
 			// blob roles for storage account are already
 			// assigned to azure account
-			stgAccountKey := c.String("stgaccountkey")
+			stgAccountKey := storageAccountKey(c)
+			if sas != nil && stgAccountKey != "" {
+				return errors.New("The --sasuri and --stgaccountkey flags cannot be used together")
+			}
 
 			containerName := c.String("containername")
+			if sas != nil {
+				if containerName != "" && containerName != sas.container {
+					return fmt.Errorf("The --containername %q differs from the container %q of the SAS URL", containerName, sas.container)
+				}
+				containerName = sas.container
+			}
+			if bu != nil {
+				if containerName != "" && containerName != bu.container {
+					return fmt.Errorf("The --containername %q differs from the container %q of the blob URL", containerName, bu.container)
+				}
+				containerName = bu.container
+			}
 			if containerName == "" {
 				containerName = "vhds"
 				log.Println("Using default container 'vhds'")
 			}
 
 			blobName := c.String("blobname")
-			if blobName == "" {
+			blobFromSAS := sas != nil && sas.blob != ""
+			if blobFromSAS {
+				if (blobName != "" && blobName != sas.blob) || c.IsSet("name-template") {
+					return fmt.Errorf("The SAS URL points at the blob %q, the --blobname and --name-template flags cannot name another one", sas.blob)
+				}
+				blobName = sas.blob
+			}
+			if bu != nil {
+				if (blobName != "" && blobName != bu.blob) || c.IsSet("name-template") {
+					return fmt.Errorf("The blob URL points at the blob %q, the --blobname and --name-template flags cannot name another one", bu.blob)
+				}
+				blobName = bu.blob
+			}
+			if c.IsSet("name-template") {
+				if blobName != "" {
+					return errors.New("The --blobname and --name-template flags cannot be used together")
+				}
+				var err error
+				if blobName, err = expandNameTemplate(c.String("name-template"), localVHDPath, time.Now()); err != nil {
+					return err
+				}
+			}
+			if blobName == "" && !dryRun {
 				return errors.New("Missing required argument --blobname")
 			}
 
-			if !strings.HasSuffix(strings.ToLower(blobName), ".vhd") {
-				blobName = blobName + ".vhd"
+			// the SAS token of a blob is only valid for its exact
+			// name, and a blob URL names the blob exactly too
+			if blobName != "" {
+				if strings.TrimSpace(blobName) != blobName {
+					return fmt.Errorf("Invalid blob name %q, it must not start or end with spaces", blobName)
+				}
+				if !blobFromSAS && bu == nil && !strings.HasSuffix(strings.ToLower(blobName), ".vhd") {
+					blobName = blobName + ".vhd"
+				}
+				if err := validateBlobName(blobName); err != nil {
+					return err
+				}
 			}
 
-			parallelism := int(0)
-			if c.IsSet("parallelism") {
-				p, err := strconv.ParseUint(c.String("parallelism"), 10, 32)
-				if err != nil {
-					return fmt.Errorf("invalid index value --parallelism: %s", err)
-				}
-				parallelism = int(p)
-			} else {
+			parallelism, err := parseParallelism(c)
+			if err != nil {
+				return err
+			}
+			if parallelism == 0 && !c.IsSet("low-mem") {
 				parallelism = 8 * runtime.NumCPU()
 				log.Printf("Using default parallelism [8*NumCPU] : %d\n", parallelism)
 			}
 
+			if (c.IsSet("min-parallelism") || c.IsSet("max-parallelism")) && !c.IsSet("concurrency-auto") {
+				return errors.New("The --min-parallelism and --max-parallelism flags need --concurrency-auto")
+			}
+			minParallelism := 0
+			if c.IsSet("min-parallelism") {
+				p, err := strconv.ParseUint(c.String("min-parallelism"), 10, 32)
+				if err != nil || p == 0 {
+					return fmt.Errorf("Invalid value for --min-parallelism %q, expected a positive number", c.String("min-parallelism"))
+				}
+				minParallelism = int(p)
+			}
+			maxParallelism := 0
+			if c.IsSet("max-parallelism") {
+				p, err := strconv.ParseUint(c.String("max-parallelism"), 10, 32)
+				if err != nil || p == 0 {
+					return fmt.Errorf("Invalid value for --max-parallelism %q, expected a positive number", c.String("max-parallelism"))
+				}
+				maxParallelism = int(p)
+			}
+			if maxParallelism > 0 && parallelism > 0 {
+				return errors.New("The --parallelism and --max-parallelism flags cannot be used together")
+			}
+			if minParallelism > 0 && maxParallelism > 0 && minParallelism > maxParallelism {
+				return fmt.Errorf("The --min-parallelism %d is above the --max-parallelism %d", minParallelism, maxParallelism)
+			}
+
+			blobMetadata, err := parseKeyValues(c, "metadata")
+			if err != nil {
+				return err
+			}
+			blobTags, err := parseKeyValues(c, "tag")
+			if err != nil {
+				return err
+			}
+
+			var accessTier *blob.AccessTier
+			if c.IsSet("tier") {
+				tier := blob.AccessTier(strings.ToUpper(c.String("tier")))
+				if !strings.HasPrefix(string(tier), "P") {
+					return fmt.Errorf("Invalid value for --tier %q, page blobs only support the premium tiers P4 to P80", c.String("tier"))
+				}
+				accessTier = &tier
+			}
+
+			var containerAccess *container.PublicAccessType
+			if c.IsSet("container-access") {
+				if !c.IsSet("create-container") {
+					return errors.New("The --container-access flag requires --create-container")
+				}
+				switch access := c.String("container-access"); access {
+				case "private":
+				case string(container.PublicAccessTypeBlob), string(container.PublicAccessTypeContainer):
+					publicAccess := container.PublicAccessType(access)
+					containerAccess = &publicAccess
+				default:
+					return fmt.Errorf("Invalid value for --container-access %q, expected private, blob or container", access)
+				}
+			}
+
+			customerProvidedKey, err := parseCustomerProvidedKey(c)
+			if err != nil {
+				return err
+			}
+			if customerProvidedKey != nil && c.String("encryption-scope") != "" {
+				return errors.New("The --cpk-key and --encryption-scope flags cannot be used together")
+			}
+
 			overwrite := c.IsSet("overwrite")
 
-			serviceClient, err := createServiceClient(c, stgAccountName, stgAccountKey)
+			sparseThreshold := float64(0)
+			if c.IsSet("sparse-threshold") {
+				t, err := strconv.ParseFloat(c.String("sparse-threshold"), 64)
+				if err != nil || t <= 0 || t > 1 {
+					return fmt.Errorf("Invalid value for --sparse-threshold %q, expected a number greater than 0 and at most 1", c.String("sparse-threshold"))
+				}
+				sparseThreshold = t
+			}
+
+			expectedSize := int64(0)
+			if c.IsSet("expected-size") {
+				s, err := strconv.ParseInt(c.String("expected-size"), 10, 64)
+				if err != nil || s <= 0 {
+					return fmt.Errorf("Invalid value for --expected-size %q, expected a positive number of bytes", c.String("expected-size"))
+				}
+				expectedSize = s
+			}
+
+			var expectedMD5 []byte
+			if c.IsSet("expected-md5") {
+				h, err := hex.DecodeString(c.String("expected-md5"))
+				if err != nil || len(h) != md5.Size {
+					return fmt.Errorf("Invalid value for --expected-md5 %q, expected a hex encoded MD5 hash", c.String("expected-md5"))
+				}
+				expectedMD5 = h
+			}
+
+			startOffset := int64(0)
+			if c.IsSet("start-offset") {
+				o, err := strconv.ParseInt(c.String("start-offset"), 10, 64)
+				if err != nil || o < 0 || o%PageBlobPageSize != 0 {
+					return fmt.Errorf("Invalid value for --start-offset %q, expected a multiple of %d", c.String("start-offset"), PageBlobPageSize)
+				}
+				if overwrite {
+					return errors.New("The --start-offset and --overwrite flags cannot be used together")
+				}
+				startOffset = o
+			}
+			length := int64(0)
+			if c.IsSet("length") {
+				l, err := strconv.ParseInt(c.String("length"), 10, 64)
+				if err != nil || l <= 0 || l%PageBlobPageSize != 0 {
+					return fmt.Errorf("Invalid value for --length %q, expected a positive multiple of %d", c.String("length"), PageBlobPageSize)
+				}
+				if overwrite {
+					return errors.New("The --length and --overwrite flags cannot be used together")
+				}
+				length = l
+			}
+
+			validationLevel := validator.LevelDefault
+			if c.IsSet("strict") {
+				if c.IsSet("lenient") {
+					return errors.New("The --strict and --lenient flags cannot be used together")
+				}
+				validationLevel = validator.LevelStrict
+			} else if c.IsSet("lenient") {
+				validationLevel = validator.LevelLenient
+			}
+			if c.IsSet("skip-validation") && c.IsSet("strict") {
+				return errors.New("The --skip-validation and --strict flags cannot be used together")
+			}
+
+			footerOverrides, err := parseFooterOverrides(c)
 			if err != nil {
 				return err
 			}
 
+			minThroughput := float64(0)
+			if c.IsSet("min-throughput") {
+				t, err := strconv.ParseFloat(c.String("min-throughput"), 64)
+				if err != nil || t <= 0 {
+					return fmt.Errorf("Invalid value for --min-throughput %q, expected a positive number", c.String("min-throughput"))
+				}
+				minThroughput = t
+			}
+
+			minThroughputWindow := 5 * time.Minute
+			if c.IsSet("min-throughput-window") {
+				w, err := time.ParseDuration(c.String("min-throughput-window"))
+				if err != nil || w <= 0 {
+					return fmt.Errorf("Invalid value for --min-throughput-window %q, expected a positive duration like 90s or 5m", c.String("min-throughput-window"))
+				}
+				minThroughputWindow = w
+			}
+
+			readParallelism := 0
+			if c.IsSet("read-parallelism") {
+				p, err := strconv.ParseUint(c.String("read-parallelism"), 10, 32)
+				if err != nil || p == 0 {
+					return fmt.Errorf("Invalid value for --read-parallelism %q, expected a positive number", c.String("read-parallelism"))
+				}
+				readParallelism = int(p)
+			}
+
+			queueDepth := 0
+			if c.IsSet("queue-depth") {
+				d, err := strconv.ParseUint(c.String("queue-depth"), 10, 32)
+				if err != nil {
+					return fmt.Errorf("Invalid value for --queue-depth %q, expected a non-negative number", c.String("queue-depth"))
+				}
+				queueDepth = int(d)
+			}
+
+			uploadBlockSize, err := parseUploadBlockSize(c)
+			if err != nil {
+				return err
+			}
+
+			maxBytesPerSecond := int64(0)
+			if c.IsSet("maxbandwidth") {
+				b, err := parseBandwidth(c.String("maxbandwidth"))
+				if err != nil {
+					return err
+				}
+				maxBytesPerSecond = b
+			}
+
+			maxRetries := 0
+			if c.IsSet("max-retries") {
+				r, err := strconv.ParseUint(c.String("max-retries"), 10, 16)
+				if err != nil {
+					return fmt.Errorf("Invalid value for --max-retries %q, expected a number of retries", c.String("max-retries"))
+				}
+				// Zero retries is negative for the upload
+				maxRetries = int(r)
+				if maxRetries == 0 {
+					maxRetries = -1
+				}
+			}
+
+			retryBackoff := time.Duration(0)
+			if c.IsSet("retry-backoff") {
+				b, err := time.ParseDuration(c.String("retry-backoff"))
+				if err != nil || b < 0 {
+					return fmt.Errorf("Invalid value for --retry-backoff %q, expected a duration like 500ms or 2s", c.String("retry-backoff"))
+				}
+				retryBackoff = b
+				if retryBackoff == 0 {
+					retryBackoff = -1
+				}
+			}
+
+			operationTimeout := time.Duration(0)
+			if c.IsSet("operation-timeout") {
+				t, err := time.ParseDuration(c.String("operation-timeout"))
+				if err != nil || t < 0 {
+					return fmt.Errorf("Invalid value for --operation-timeout %q, expected a duration like 30s or 2m", c.String("operation-timeout"))
+				}
+				operationTimeout = t
+				if operationTimeout == 0 {
+					operationTimeout = -1
+				}
+			}
+
 			uopts := op.UploadOptions{
-				Overwrite:   overwrite,
-				Parallelism: parallelism,
-				Logger: func(s string) {
-					log.Println(s)
-				},
+				Overwrite:           overwrite,
+				Parallelism:         parallelism,
+				SkipExistenceCheck:  c.IsSet("no-overwrite-check"),
+				SparseThreshold:     sparseThreshold,
+				MinThroughputMbps:   minThroughput,
+				MinThroughputWindow: minThroughputWindow,
+				VerifyBlobSize:      c.IsSet("verify-blob-size"),
+				VerifyEmptyBlob:     c.IsSet("verify-empty-blob"),
+				VerifyMD5:           c.IsSet("verify-md5"),
+				PerBlockChecksum:    c.IsSet("per-block-checksum") || c.String("block-checksum-file") != "",
+				VerifyAfterUpload:   c.IsSet("verify-after-upload"),
+				AcquireLease:        c.IsSet("acquire-lease"),
+				ConditionalWrites:   c.IsSet("conditional-writes"),
+				Logger:              uploadLogger(),
+				FooterOverrides:     footerOverrides,
+				ExpectedSize:        expectedSize,
+				ExpectedMD5:         expectedMD5,
+				NoFinalStatus:       c.IsSet("no-final-status"),
+				LogBlocks:           c.GlobalBool("verbose"),
+				ParentPath:          c.String("parent"),
+				AdaptiveParallelism: c.IsSet("concurrency-auto"),
+				MinParallelism:      minParallelism,
+				MaxParallelism:      maxParallelism,
+				StartOffset:         startOffset,
+				Length:              length,
+				DirectIO:            c.IsSet("direct-io"),
+				DetectSourceChanges: c.IsSet("detect-source-changes"),
+				ValidationLevel:     validationLevel,
+				SkipValidation:      c.IsSet("skip-validation"),
+				TrustExistingPages:  c.IsSet("resume"),
+				Metadata:            blobMetadata,
+				Tags:                blobTags,
+				AccessTier:          accessTier,
+				EncryptionScope:     c.String("encryption-scope"),
+				CustomerProvidedKey: customerProvidedKey,
+				SkipContainerCreate: !c.IsSet("create-container"),
+				ContainerAccess:     containerAccess,
+				LowMemory:           c.IsSet("low-mem"),
+				UploadBlockSize:     uploadBlockSize,
+				MaxRetriesPerBlock:  maxRetries,
+				RetryBackoff:        retryBackoff,
+				OperationTimeout:    operationTimeout,
+				MaxBytesPerSecond:   maxBytesPerSecond,
+				ReadParallelism:     readParallelism,
+				QueueDepth:          queueDepth,
+			}
+			if dryRun {
+				const oneMB = 1024 * 1024
+				estimate, err := op.EstimateUpload(localVHDPath, &uopts)
+				if err != nil {
+					return withExitCode(err, uploadExitCode(err))
+				}
+				// the range detection leaves its status line open
+				fmt.Println()
+				log.Printf("Dry run: %.2f MB of %.2f MB would be uploaded in %d ranges\n",
+					float64(estimate.UploadSize)/oneMB, float64(estimate.VHDSize)/oneMB, len(estimate.Ranges))
+				return nil
+			}
+
+			serviceClient, err := createServiceClient(c, stgAccountName, stgAccountKey)
+			if err != nil {
+				return err
+			}
+			if overwrite && !c.IsSet("yes") && !c.IsSet("force") && isInteractive() {
+				uopts.ConfirmOverwrite = func(size int64, lastModified time.Time) bool {
+					return confirmOverwrite(containerName, blobName, size, lastModified)
+				}
+			}
+			progressPrinter, err := parseProgressPrinter(c)
+			if err != nil {
+				return err
+			}
+			uopts.Progress = progressPrinter
+			uopts.QuietProgress = progressPrinter != nil
+			if socketPath := c.String("progress-socket"); socketPath != "" {
+				progressServer, err := newProgressServer(socketPath)
+				if err != nil {
+					return err
+				}
+				defer progressServer.Close()
+				uopts.Progress = progressServer.send
+				if progressPrinter != nil {
+					uopts.Progress = func(record progress.Record) {
+						progressPrinter(record)
+						progressServer.send(record)
+					}
+				}
+			}
+			// An interrupt cancels the upload, keeping what was
+			// uploaded for a resume, a second one exits at once.
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			go func() {
+				<-ctx.Done()
+				stop()
+			}()
+			started := time.Now()
+			var result *op.UploadResult
+			if localVHDPath == "-" {
+				result, err = op.UploadStream(ctx, serviceClient, containerName, blobName, os.Stdin, 0, &uopts)
+			} else {
+				result, err = op.Upload(ctx, serviceClient, containerName, blobName, localVHDPath, &uopts)
+			}
+			if notifyURL := c.String("notify-url"); notifyURL != "" {
+				n := newUploadNotification(localVHDPath, containerName, blobName, started, result, err)
+				if nerr := notify(notifyURL, n); nerr != nil {
+					log.Printf("Failed to send the completion notification to %s: %v\n", notifyURL, nerr)
+				}
 			}
-			err = op.Upload(context.TODO(), serviceClient, containerName, blobName, localVHDPath, &uopts)
 			if err != nil {
-				log.Fatal(err)
+				return withExitCode(describeUploadError(err, containerName, blobName), uploadExitCode(err))
+			}
+			if uopts.AdaptiveParallelism {
+				log.Printf("Adaptive parallelism settled on %d concurrent writes\n", result.Parallelism)
 			}
-			return nil
+			logUploadSummary(result)
+			if c.GlobalBool("verbose") {
+				logWorkerStats(result)
+			}
+			return writeBlockChecksums(c.String("block-checksum-file"), result.BlockChecksums)
 		},
 	}
 }
+
+// logUploadSummary logs the amount of data written by the upload
+// and how fast.
+func logUploadSummary(result *op.UploadResult) {
+	const oneMB = 1024 * 1024
+	log.Printf("Uploaded %.2f MB of %.2f MB in %d blocks (%d retried) in %s, %.2f Mb/sec\n",
+		float64(result.BytesUploaded)/oneMB, float64(result.TotalLogicalBytes)/oneMB,
+		result.BlocksUploaded, result.BlocksRetried,
+		result.Duration.Round(time.Millisecond), result.AverageThroughputMbps)
+}
+
+// logWorkerStats logs a table of the writes handled by each worker
+// of the upload, to spot a worker starved or failing more than the
+// others.
+func logWorkerStats(result *op.UploadResult) {
+	const oneMB = 1024 * 1024
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Worker\tRanges\tRetries\tFailures\tMB\tBusy\tBusy %\t")
+	for _, s := range result.WorkerStats {
+		busy := 0.0
+		if result.Duration > 0 {
+			busy = 100 * s.BusyTime.Seconds() / result.Duration.Seconds()
+		}
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%.2f\t%s\t%.0f%%\t\n",
+			s.ID, s.Requests, s.Retries, s.Failures,
+			float64(s.BytesUploaded)/oneMB, s.BusyTime.Round(time.Millisecond), busy)
+	}
+	w.Flush()
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+		log.Println(line)
+	}
+}
+
+// writeBlockChecksums writes the SHA256 digests of the uploaded
+// ranges to the file at path, if not empty, one "offset length
+// digest" line per range.
+func writeBlockChecksums(path string, checksums []op.BlockChecksum) error {
+	if path == "" {
+		return nil
+	}
+	var b strings.Builder
+	for _, checksum := range checksums {
+		fmt.Fprintf(&b, "%d %d %s\n", checksum.Offset, checksum.Length, checksum.SHA256)
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("Failed to write the block checksums: %w", err)
+	}
+	log.Printf("Wrote the SHA256 digests of %d ranges to %s\n", len(checksums), path)
+	return nil
+}
+
+// parallelismCap is the largest number of concurrent requests
+// accepted from --parallelism, a larger value only exhausts the
+// connections and the memory of the buffered ranges.
+const parallelismCap = 512
+
+// parseParallelism returns the value of the --parallelism flag, or 0
+// if it is not set or set to 0, both meaning the default of the
+// command. A value above parallelismCap is lowered to it with a
+// warning.
+func parseParallelism(c *cli.Context) (int, error) {
+	if !c.IsSet("parallelism") {
+		return 0, nil
+	}
+	p, err := strconv.ParseUint(c.String("parallelism"), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid value for --parallelism %q, expected a number, 0 for the default", c.String("parallelism"))
+	}
+	if p > parallelismCap {
+		log.Printf("Warning: --parallelism %d is too large, using %d\n", p, parallelismCap)
+		return parallelismCap, nil
+	}
+	return int(p), nil
+}
+
+// parseBandwidth returns the bytes per second of a bandwidth given
+// in bytes per second, with an optional K, M or G binary suffix, or
+// in megabits per second with the Mbps suffix.
+func parseBandwidth(value string) (int64, error) {
+	number := value
+	multiplier := float64(1)
+	switch {
+	case strings.HasSuffix(value, "Mbps"):
+		number, multiplier = strings.TrimSuffix(value, "Mbps"), 1000*1000/8
+	case strings.HasSuffix(value, "K"):
+		number, multiplier = strings.TrimSuffix(value, "K"), 1024
+	case strings.HasSuffix(value, "M"):
+		number, multiplier = strings.TrimSuffix(value, "M"), 1024*1024
+	case strings.HasSuffix(value, "G"):
+		number, multiplier = strings.TrimSuffix(value, "G"), 1024*1024*1024
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	bytesPerSecond := int64(n * multiplier)
+	if err != nil || bytesPerSecond <= 0 {
+		return 0, fmt.Errorf("Invalid value for --maxbandwidth %q, expected a bandwidth like 5242880, 5M or 40Mbps", value)
+	}
+	return bytesPerSecond, nil
+}
+
+// parseUploadBlockSize returns the size of the chunks the ranges are
+// written in given with the --block-size flag, in bytes with an
+// optional K or M binary suffix, or zero if it is not set.
+func parseUploadBlockSize(c *cli.Context) (int64, error) {
+	if !c.IsSet("block-size") {
+		return 0, nil
+	}
+	value := c.String("block-size")
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		value, multiplier = strings.TrimSuffix(value, "K"), 1024
+	case strings.HasSuffix(value, "M"):
+		value, multiplier = strings.TrimSuffix(value, "M"), 1024*1024
+	}
+	b, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || b <= 0 || b*multiplier > 4*1024*1024 || b*multiplier%512 != 0 {
+		return 0, fmt.Errorf("Invalid value for --block-size %q, expected a multiple of 512 bytes of at most 4M, with an optional K or M suffix", c.String("block-size"))
+	}
+	return b * multiplier, nil
+}
+
+// parseCustomerProvidedKey returns the customer-provided key given
+// with the --cpk-key flag, base64 encoded, with its SHA256 hash, or
+// nil if it is not set.
+func parseCustomerProvidedKey(c *cli.Context) (*blob.CPKInfo, error) {
+	encodedKey := c.String("cpk-key")
+	if encodedKey == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, errors.New("Invalid value for --cpk-key, expected a base64 encoded AES-256 key")
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Invalid value for --cpk-key, expected an AES-256 key of 32 bytes, got %d bytes", len(key))
+	}
+	sum := sha256.Sum256(key)
+	hash := base64.StdEncoding.EncodeToString(sum[:])
+	algorithm := blob.EncryptionAlgorithmTypeAES256
+	return &blob.CPKInfo{
+		EncryptionKey:       &encodedKey,
+		EncryptionKeySHA256: &hash,
+		EncryptionAlgorithm: &algorithm,
+	}, nil
+}
+
+// isInteractive returns true if the standard input and output are
+// terminals, so someone is there to answer a question.
+func isInteractive() bool {
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		fi, err := f.Stat()
+		if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// describeUploadError returns the error of an upload with a hint
+// about what to do for the errors about the existing blob or its
+// container.
+func describeUploadError(err error, containerName, blobName string) error {
+	switch {
+	case errors.Is(err, op.BlobAlreadyExists):
+		return fmt.Errorf("The blob '%s/%s' already exists and its upload is complete, pass --overwrite to replace it", containerName, blobName)
+	case errors.Is(err, op.MissingUploadMetadata):
+		return fmt.Errorf("The blob '%s/%s' already exists without upload metadata, pass --overwrite to replace it or --resume to trust its pages", containerName, blobName)
+	case errors.Is(err, op.OverwriteNotConfirmed):
+		return fmt.Errorf("The blob '%s/%s' was not overwritten", containerName, blobName)
+	case errors.Is(err, op.BlobModifiedConcurrently):
+		return fmt.Errorf("The blob '%s/%s' was modified by another writer during the upload, which was aborted, make sure a single upload writes to it", containerName, blobName)
+	case errors.Is(err, op.ContainerNotFound):
+		return fmt.Errorf("The container '%s' does not exist, create it or pass --create-container", containerName)
+	}
+	return err
+}
+
+// confirmOverwrite asks the user whether the existing blob should be
+// overwritten, showing its current size and last modification time.
+func confirmOverwrite(containerName, blobName string, size int64, lastModified time.Time) bool {
+	fmt.Fprintf(os.Stderr, "Blob '%s/%s' already exists (size: %d bytes, last modified: %s).\nOverwrite it? [y/N] ", containerName, blobName, size, lastModified.Local().Format(time.RFC1123))
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// parseFooterOverrides returns the overrides of the VHD footer fields
+// set with the footer flags, or nil if none of them is set.
+func parseFooterOverrides(c *cli.Context) (*diskstream.FooterOverrides, error) {
+	if !c.IsSet("footer-cookie") && !c.IsSet("footer-creator-app") && !c.IsSet("footer-creator-version") && !c.IsSet("footer-creator-host-os") && !c.IsSet("new-uuid") {
+		return nil, nil
+	}
+
+	overrides := &diskstream.FooterOverrides{
+		Cookie:             c.String("footer-cookie"),
+		CreatorApplication: c.String("footer-creator-app"),
+	}
+	if c.IsSet("footer-creator-version") {
+		var major, minor uint16
+		v := c.String("footer-creator-version")
+		if n, err := fmt.Sscanf(v, "%d.%d", &major, &minor); err != nil || n != 2 || fmt.Sprintf("%d.%d", major, minor) != v {
+			return nil, fmt.Errorf("Invalid value for --footer-creator-version %q, expected major.minor", v)
+		}
+		overrides.CreatorVersion = footer.VhdCreatorVersion(uint32(major)<<16 | uint32(minor))
+	}
+	if c.IsSet("footer-creator-host-os") {
+		h := c.String("footer-creator-host-os")
+		if len(h) != 4 {
+			return nil, fmt.Errorf("Invalid value for --footer-creator-host-os %q, expected 4 characters", h)
+		}
+		overrides.CreatorHostOsType = footer.HostOsType(binary.BigEndian.Uint32([]byte(h)))
+	}
+	if c.IsSet("new-uuid") {
+		id, err := common.NewRandomUUID()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to generate the new unique ID: %v", err)
+		}
+		log.Printf("Writing the new unique ID %s to the VHD footer of the page blob", id)
+		overrides.UniqueID = id
+	}
+	if err := overrides.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid footer override: %v", err)
+	}
+	return overrides, nil
+}
+
+// parseKeyValues parses the key=value pairs given with the repeatable
+// flag of the given name, it returns nil if the flag is not set.
+func parseKeyValues(c *cli.Context, name string) (map[string]string, error) {
+	values := c.StringSlice(name)
+	if len(values) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string, len(values))
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("Invalid value for --%s %q, expected key=value", name, v)
+		}
+		if _, ok := m[key]; ok {
+			return nil, fmt.Errorf("Duplicate key %q in --%s", key, name)
+		}
+		m[key] = value
+	}
+	return m, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+func TestParseParallelism(t *testing.T) {
+	for _, test := range []struct {
+		args     []string
+		expected int
+		invalid  bool
+	}{
+		{args: nil, expected: 0},
+		{args: []string{"--parallelism", "0"}, expected: 0},
+		{args: []string{"--parallelism", "1"}, expected: 1},
+		{args: []string{"--parallelism", "64"}, expected: 64},
+		{args: []string{"--parallelism", "512"}, expected: parallelismCap},
+		{args: []string{"--parallelism", "513"}, expected: parallelismCap},
+		{args: []string{"--parallelism", "100000"}, expected: parallelismCap},
+		{args: []string{"--parallelism", "-1"}, invalid: true},
+		{args: []string{"--parallelism", "many"}, invalid: true},
+	} {
+		set := flag.NewFlagSet("upload", flag.ContinueOnError)
+		set.String("parallelism", "", "")
+		if err := set.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		p, err := parseParallelism(cli.NewContext(nil, set, nil))
+		if test.invalid {
+			if err == nil {
+				t.Errorf("got parallelism %d for %v, expected an error", p, test.args)
+			}
+			continue
+		}
+		if err != nil || p != test.expected {
+			t.Errorf("got parallelism %d and error %v for %v, expected %d", p, err, test.args, test.expected)
+		}
+	}
+}
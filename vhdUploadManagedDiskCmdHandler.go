@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/pageblob"
+	"gopkg.in/urfave/cli.v1"
+
+	"github.com/flatcar/azure-vhd-utils/op"
+)
+
+func vhdUploadManagedDiskCmdHandler() cli.Command {
+	return cli.Command{
+		Name:  "upload-managed-disk",
+		Usage: "Upload a local VHD to a managed disk through its upload SAS URL",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "localvhdpath",
+				Usage: "Path to source VHD in the local machine.",
+			},
+			cli.StringFlag{
+				Name:  "sasuri",
+				Usage: "Upload SAS URL of the managed disk, as returned by az disk grant-access --access-level Write.",
+			},
+			cli.BoolFlag{
+				Name:  "allow-http",
+				Usage: "Allow plain HTTP SAS URL, meant for storage emulators only.",
+			},
+			cli.StringFlag{
+				Name:  "parallelism",
+				Usage: "Number of concurrent goroutines to be used for upload",
+			},
+			cli.StringFlag{
+				Name:  "read-parallelism",
+				Usage: "Number of concurrent goroutines reading the local VHD ahead of the writes (Default: 1)",
+			},
+			cli.StringFlag{
+				Name:  "maxbandwidth",
+				Usage: "Limit the bandwidth of the upload, in bytes per second with an optional K, M or G suffix, or in megabits per second with the Mbps suffix (optional).",
+			},
+			cli.StringFlag{
+				Name:  "parent",
+				Usage: "Path to the parent VHD of a differencing disk, if the path recorded in the disk is wrong (optional).",
+			},
+			cli.BoolFlag{
+				Name:  "low-mem",
+				Usage: "Upload with a small memory footprint, at the cost of throughput, for huge disks on small machines.",
+			},
+			cli.StringFlag{
+				Name:  "block-size",
+				Usage: "Size of the chunks the ranges are written in, in bytes with an optional K or M suffix, a multiple of 512 of at most 4M (Default: 4M, 1M with --low-mem)",
+			},
+			cli.BoolFlag{
+				Name:  "per-block-checksum",
+				Usage: "Read every uploaded range back and compare its SHA256 digest with the digest of the uploaded data before finalizing the upload.",
+			},
+			cli.StringFlag{
+				Name:  "block-checksum-file",
+				Usage: "Path of a file to write the SHA256 digests of the uploaded ranges to, implies --per-block-checksum (optional).",
+			},
+			cli.BoolFlag{
+				Name:  "verify-after-upload",
+				Usage: "Read the data of the VHD back from the blob and compare it with the local VHD before finalizing the upload.",
+			},
+		},
+		Action: func(c *cli.Context) error {
+			localVHDPath := c.String("localvhdpath")
+			if localVHDPath == "" {
+				return errors.New("Missing required argument --localvhdpath")
+			}
+
+			sasURL, err := parseManagedDiskSASURL(c)
+			if err != nil {
+				return err
+			}
+
+			parallelism, err := parseParallelism(c)
+			if err != nil {
+				return err
+			}
+
+			readParallelism := 0
+			if c.IsSet("read-parallelism") {
+				p, err := strconv.ParseUint(c.String("read-parallelism"), 10, 32)
+				if err != nil || p == 0 {
+					return fmt.Errorf("Invalid value for --read-parallelism %q, expected a positive number", c.String("read-parallelism"))
+				}
+				readParallelism = int(p)
+			}
+
+			uploadBlockSize, err := parseUploadBlockSize(c)
+			if err != nil {
+				return err
+			}
+
+			maxBytesPerSecond := int64(0)
+			if c.IsSet("maxbandwidth") {
+				b, err := parseBandwidth(c.String("maxbandwidth"))
+				if err != nil {
+					return err
+				}
+				maxBytesPerSecond = b
+			}
+
+			client, err := pageblob.NewClientWithNoCredential(sasURL, nil)
+			if err != nil {
+				return fmt.Errorf("Failed to create page blob client: %w", err)
+			}
+
+			uopts := op.UploadOptions{
+				Parallelism:       parallelism,
+				ReadParallelism:   readParallelism,
+				MaxBytesPerSecond: maxBytesPerSecond,
+				ParentPath:        c.String("parent"),
+				LowMemory:         c.IsSet("low-mem"),
+				UploadBlockSize:   uploadBlockSize,
+				PerBlockChecksum:  c.IsSet("per-block-checksum") || c.String("block-checksum-file") != "",
+				VerifyAfterUpload: c.IsSet("verify-after-upload"),
+				LogBlocks:         c.GlobalBool("verbose"),
+				Logger:            uploadLogger(),
+			}
+			// An interrupt cancels the upload, a second one
+			// exits at once.
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			go func() {
+				<-ctx.Done()
+				stop()
+			}()
+			result, err := op.UploadToManagedDisk(ctx, client, localVHDPath, &uopts)
+			if err != nil {
+				return withExitCode(err, uploadExitCode(err))
+			}
+			logUploadSummary(result)
+			if c.GlobalBool("verbose") {
+				logWorkerStats(result)
+			}
+			return writeBlockChecksums(c.String("block-checksum-file"), result.BlockChecksums)
+		},
+	}
+}
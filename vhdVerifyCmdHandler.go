@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"gopkg.in/urfave/cli.v1"
+
+	"github.com/flatcar/azure-vhd-utils/op"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+)
+
+func vhdVerifyCmdHandler() cli.Command {
+	return cli.Command{
+		Name:  "verify",
+		Usage: "Commands to verify a VHD page blob against the local VHD",
+		Subcommands: []cli.Command{
+			{
+				Name:  "ranges",
+				Usage: "Compare the allocated page ranges of the blob with the ranges of the local VHD holding data",
+				Flags: append(append([]cli.Flag{
+					cli.StringFlag{
+						Name:  "localvhdpath",
+						Usage: "Path to source VHD in the local machine.",
+					},
+				}, storageAccountFlags()...),
+					cli.StringFlag{
+						Name:  "containername",
+						Usage: "Name of the container holding the page blob. (Default: vhds)",
+					},
+					cli.StringFlag{
+						Name:  "blobname",
+						Usage: "Name of the page blob.",
+					},
+				),
+				Action: verifyPageRanges,
+			},
+		},
+	}
+}
+
+func verifyPageRanges(c *cli.Context) error {
+	localVHDPath := c.String("localvhdpath")
+	if localVHDPath == "" {
+		return errors.New("Missing required argument --localvhdpath")
+	}
+
+	stgAccountName := c.String("stgaccountname")
+	if stgAccountName == "" {
+		return errors.New("Missing required argument --stgaccountname, or the " + accountNameEnv + " environment variable")
+	}
+
+	stgAccountKey := storageAccountKey(c)
+
+	containerName := c.String("containername")
+	if containerName == "" {
+		containerName = "vhds"
+		log.Println("Using default container 'vhds'")
+	}
+
+	blobName := c.String("blobname")
+	if blobName == "" {
+		return errors.New("Missing required argument --blobname")
+	}
+
+	if !strings.HasSuffix(strings.ToLower(blobName), ".vhd") {
+		blobName = blobName + ".vhd"
+	}
+
+	serviceClient, err := createServiceClient(c, stgAccountName, stgAccountKey)
+	if err != nil {
+		return err
+	}
+
+	report, err := op.VerifyPageRanges(context.TODO(), serviceClient, containerName, blobName, localVHDPath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\nLocal ranges holding data: %d (%d bytes)\n", len(report.LocalRanges), common.TotalRangeLength(report.LocalRanges))
+	fmt.Printf("Allocated blob page ranges: %d (%d bytes)\n", len(report.BlobRanges), common.TotalRangeLength(report.BlobRanges))
+	printRanges("Missing in the blob", report.Missing)
+	printRanges("Extra in the blob", report.Extra)
+
+	if !report.Matches() {
+		return errors.New("Page ranges of the blob do not match the local VHD")
+	}
+	fmt.Println("Page ranges of the blob match the local VHD")
+	return nil
+}
+
+func printRanges(title string, ranges []*common.IndexRange) {
+	if len(ranges) == 0 {
+		return
+	}
+	fmt.Printf("%s: %d ranges (%d bytes)\n", title, len(ranges), common.TotalRangeLength(ranges))
+	for _, r := range ranges {
+		fmt.Printf("  %s\n", r)
+	}
+}
@@ -24,19 +24,24 @@ func NewBlockAllocationFactory(vhdReader *reader.VhdReader, vhdHeader *header.He
 }
 
 // Create creates a BlockAllocationTable instance by reading the BAT section of the disk.
+// The section is read at once and then decoded, so creating the
+// BAT of a huge disk does not cost one read per entry.
 // This function return error if any error occurs while reading or parsing the BAT entries.
 func (f *BlockAllocationTableFactory) Create() (*BlockAllocationTable, error) {
-	var err error
 	batEntriesCount := f.vhdHeader.MaxTableEntries
-	batEntryOffset := f.vhdHeader.TableOffset
+	buf := make([]byte, int64(batEntriesCount)*4)
+	if n, err := f.vhdReader.ReadBytes(f.vhdHeader.TableOffset, buf); err != nil && n < len(buf) {
+		return nil, NewBlockAllocationTableParseError(uint32(n/4), err)
+	}
+
+	batReader := reader.NewVhdReaderFromByteSlice(buf)
 	bat := make([]uint32, batEntriesCount)
 	for i := uint32(0); i < batEntriesCount; i++ {
-		bat[i], err = f.vhdReader.ReadUInt32(batEntryOffset)
+		entry, err := batReader.ReadUInt32(int64(i) * 4)
 		if err != nil {
 			return nil, NewBlockAllocationTableParseError(i, err)
 		}
-
-		batEntryOffset += 4
+		bat[i] = entry
 	}
 	return NewBlockAllocationTable(f.vhdHeader.BlockSize, bat), nil
 }
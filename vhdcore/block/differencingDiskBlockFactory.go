@@ -81,6 +81,7 @@ func (f *DifferencingDiskBlockFactory) Create(blockIndex uint32) (*Block, error)
 			VhdUniqueID:     f.params.VhdFooter.UniqueID,
 			IsEmpty:         false,
 			BlockDataReader: f.blockDataReader,
+			blockFactory:    f,
 		}
 
 		var err error
@@ -296,17 +296,22 @@ func (ir *IndexRange) Subtract(other *IndexRange, result []*IndexRange) []*Index
 // the differences to result slice. The result slice will be sorted and de-duped if sortandDedup
 // is true.
 func (ir *IndexRange) SubtractRanges(ranges []*IndexRange, sortandDedup bool, result []*IndexRange) []*IndexRange {
-	intersectAny := false
+	// Each range is subtracted from what is left after subtracting
+	// the previous ones, so that the ranges intersecting this
+	// range at different places are all taken out.
+	remaining := []*IndexRange{NewIndexRange(ir.Start, ir.End)}
 	for _, o := range ranges {
-		if ir.Intersects(o) {
-			result = ir.Subtract(o, result)
-			intersectAny = true
+		var next []*IndexRange
+		for _, r := range remaining {
+			if r.Intersects(o) {
+				next = r.Subtract(o, next)
+			} else {
+				next = append(next, r)
+			}
 		}
+		remaining = next
 	}
-
-	if !intersectAny {
-		result = append(result, NewIndexRange(ir.Start, ir.End))
-	}
+	result = append(result, remaining...)
 
 	if !sortandDedup {
 		return result
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"crypto/rand"
 	"errors"
 	"fmt"
 )
@@ -21,24 +22,26 @@ func NewUUID(b []byte) (*UUID, error) {
 	return u, nil
 }
 
-// String returns the string representation of the UUID which is 16 hex digits separated by hyphens
-// int form xxxx-xx-xx-xx-xxxxxx
+// NewRandomUUID creates a new random UUID, a version 4 UUID as its String method formats it.
+func NewRandomUUID() (*UUID, error) {
+	u := &UUID{}
+	if _, err := rand.Read(u.uuid[:]); err != nil {
+		return nil, err
+	}
+	// The version is in the high nibble of the third group, stored in little-endian byte order
+	u.uuid[7] = u.uuid[7]&0x0f | 0x40
+	u.uuid[8] = u.uuid[8]&0x3f | 0x80
+	return u, nil
+}
+
+// String returns the string representation of the UUID in the standard GUID form, 32 lowercase hex digits in
+// groups of 8-4-4-4-12 separated by hyphens, like 5c1f3a8e-2b7d-4e4f-9a61-0c2d3e4f5a6b. As Hyper-V does, the
+// first three groups are read in little-endian byte order and the last two in the stored order.
 func (u *UUID) String() string {
 	a := uint32(u.uuid[3])<<24 | uint32(u.uuid[2])<<16 | uint32(u.uuid[1])<<8 | uint32(u.uuid[0])
-	// a := b.order.Uint32(b.buffer[:4])
-	b1 := int16(int32(u.uuid[5])<<8 | int32(u.uuid[4]))
-	// b1 := b.order.Uint16(b.buffer[4:6])
-	c := int16(int32(u.uuid[7])<<8 | int32(u.uuid[6]))
-	// c := b.order.Uint16(b.buffer[6:8])
-	d := u.uuid[8]
-	e := u.uuid[9]
-	f := u.uuid[10]
-	g := u.uuid[11]
-	h := u.uuid[12]
-	i := u.uuid[13]
-	j := u.uuid[14]
-	k := u.uuid[15]
-	return fmt.Sprintf("%x-%x-%x-%x%x-%x%x%x%x%x%x", a, b1, c, d, e, f, g, h, i, j, k)
+	b := uint16(u.uuid[5])<<8 | uint16(u.uuid[4])
+	c := uint16(u.uuid[7])<<8 | uint16(u.uuid[6])
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x", a, b, c, u.uuid[8:10], u.uuid[10:])
 }
 
 // ToByteSlice returns the UUID as byte slice.
@@ -20,3 +20,9 @@ const VhdSectorLength int64 = 512
 
 // VhdFooterChecksumOffset is the bye offset of checksum field in the VHD footer.
 const VhdFooterChecksumOffset int = 64
+
+// VhdHeaderSize is the size of the VHD header of an expandable disk in bytes.
+const VhdHeaderSize int64 = 1024
+
+// VhdHeaderChecksumOffset is the byte offset of checksum field in the VHD header.
+const VhdHeaderChecksumOffset int = 36
@@ -0,0 +1,138 @@
+package converter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/flatcar/azure-vhd-utils/vhdcore"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/diskstream"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/footer"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/header"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/reader"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/writer"
+)
+
+// DefaultBlockSize is the default size of the blocks of a dynamic disk, the one used by Hyper-V.
+const DefaultBlockSize uint32 = 2 * 1024 * 1024
+
+// headerOffset is the offset of the header of the dynamic disk, right after the copy of the footer.
+const headerOffset = vhdcore.VhdFooterSize
+
+// tableOffset is the offset of the Block Allocation Table of the dynamic disk, right after the header.
+const tableOffset = headerOffset + vhdcore.VhdHeaderSize
+
+// ToDynamic writes the disk read by the given stream to target as a dynamic disk with blocks of blockSize
+// bytes, a power of two of at least 4 KB. The blocks of the stream holding only zeros are left unallocated.
+// The layout is the one of the disks created by Hyper-V: the copy of the footer, the header, the Block
+// Allocation Table, the allocated blocks in order and the footer. It returns the size of the dynamic disk
+// in bytes.
+func ToDynamic(stream *diskstream.DiskStream, target io.WriterAt, blockSize uint32) (int64, error) {
+	if blockSize < 4096 || blockSize&(blockSize-1) != 0 {
+		return 0, fmt.Errorf("invalid block size %d, expected a power of two of at least 4096 bytes", blockSize)
+	}
+
+	virtualSize := stream.GetSize() - vhdcore.VhdFooterSize
+	footerData := make([]byte, vhdcore.VhdFooterSize)
+	if _, err := stream.Seek(virtualSize, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(stream, footerData); err != nil {
+		return 0, fmt.Errorf("failed to read the footer of the disk: %v", err)
+	}
+	vhdFooter, err := footer.NewFactory(reader.NewVhdReaderFromByteSlice(footerData)).Create()
+	if err != nil {
+		return 0, err
+	}
+
+	size := int64(blockSize)
+	blockCount := (virtualSize + size - 1) / size
+	batSize := roundUpToSector(blockCount * 4)
+	// One bit per sector of the block, set for all of them
+	bitmap := make([]byte, roundUpToSector(size/vhdcore.VhdSectorLength/8))
+	for i := int64(0); i < size/vhdcore.VhdSectorLength/8; i++ {
+		bitmap[i] = 0xFF
+	}
+
+	bat := make([]byte, batSize)
+	for i := range bat {
+		bat[i] = 0xFF
+	}
+	batWriter := writer.NewVhdWriterFromByteSlice(bat)
+
+	if _, err := stream.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	data := make([]byte, size)
+	zeros := make([]byte, size)
+	next := tableOffset + batSize
+	for i := int64(0); i < blockCount; i++ {
+		n := size
+		if remaining := virtualSize - i*size; remaining < n {
+			n = remaining
+			copy(data[n:], zeros[n:])
+		}
+		if _, err := io.ReadFull(stream, data[:n]); err != nil {
+			return 0, fmt.Errorf("failed to read block %d of the disk: %v", i, err)
+		}
+		if bytes.Equal(data, zeros) {
+			continue
+		}
+		sector := next / vhdcore.VhdSectorLength
+		if sector >= int64(vhdcore.VhdNoDataInt) {
+			return 0, fmt.Errorf("the dynamic disk is too large, block %d is beyond the sectors addressable by the BAT", i)
+		}
+		batWriter.WriteUInt32(i*4, uint32(sector))
+		if err := writeAt(target, bitmap, next); err != nil {
+			return 0, err
+		}
+		if err := writeAt(target, data, next+int64(len(bitmap))); err != nil {
+			return 0, err
+		}
+		next += int64(len(bitmap)) + size
+	}
+
+	vhdHeader := &header.Header{
+		Cookie:          vhdcore.CreateHeaderCookie(),
+		DataOffset:      vhdcore.VhdNoDataLong,
+		TableOffset:     tableOffset,
+		HeaderVersion:   header.VhdHeaderSupportedVersion,
+		MaxTableEntries: uint32(blockCount),
+		BlockSize:       blockSize,
+	}
+	if err := writeAt(target, header.SerializeHeader(vhdHeader), headerOffset); err != nil {
+		return 0, err
+	}
+	if err := writeAt(target, bat, tableOffset); err != nil {
+		return 0, err
+	}
+
+	// The dynamic disk is a new disk created now
+	dynamicFooter := vhdFooter.CreateCopy()
+	dynamicFooter.DiskType = footer.DiskTypeDynamic
+	dynamicFooter.HeaderOffset = headerOffset
+	now := time.Now()
+	dynamicFooter.TimeStamp = &now
+	footerData = footer.SerializeFooter(dynamicFooter)
+	if err := writeAt(target, footerData, 0); err != nil {
+		return 0, err
+	}
+	if err := writeAt(target, footerData, next); err != nil {
+		return 0, err
+	}
+	return next + vhdcore.VhdFooterSize, nil
+}
+
+// roundUpToSector returns n rounded up to a multiple of the sector length.
+func roundUpToSector(n int64) int64 {
+	return (n + vhdcore.VhdSectorLength - 1) / vhdcore.VhdSectorLength * vhdcore.VhdSectorLength
+}
+
+// writeAt writes b to target at offset off.
+func writeAt(target io.WriterAt, b []byte, off int64) error {
+	if _, err := target.WriteAt(b, off); err != nil {
+		return fmt.Errorf("failed to write the dynamic disk: %v", err)
+	}
+	return nil
+}
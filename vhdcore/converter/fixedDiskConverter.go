@@ -0,0 +1,62 @@
+package converter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/flatcar/azure-vhd-utils/vhdcore"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/footer"
+)
+
+// copyChunkSize is the size of the chunks ToFixed copies, the chunks holding only zeros are not written.
+const copyChunkSize = 1024 * 1024
+
+// ToFixed copies the size bytes read from source to target, which must be empty or read as zeros, like a file
+// truncated to size. The chunks holding only zeros are not written, so they stay holes of a sparse file. The
+// source is meant to be a disk stream, reading any VHD as a fixed one, or the data of a disk followed by a footer
+// created with NewFixedFooter. It returns the number of bytes copied.
+func ToFixed(source io.Reader, size int64, target io.WriterAt) (int64, error) {
+	data := make([]byte, copyChunkSize)
+	zeros := make([]byte, copyChunkSize)
+	for offset := int64(0); offset < size; {
+		n := int64(copyChunkSize)
+		if remaining := size - offset; remaining < n {
+			n = remaining
+		}
+		if _, err := io.ReadFull(source, data[:n]); err != nil {
+			return offset, fmt.Errorf("failed to read the disk at offset %d: %v", offset, err)
+		}
+		if !bytes.Equal(data[:n], zeros[:n]) {
+			if _, err := target.WriteAt(data[:n], offset); err != nil {
+				return offset, fmt.Errorf("failed to write the fixed disk: %v", err)
+			}
+		}
+		offset += n
+	}
+	return size, nil
+}
+
+// NewFixedFooter returns the serialized footer of a new fixed disk of virtualSize bytes identified by uniqueID,
+// virtualSize must be a multiple of the sector length.
+func NewFixedFooter(virtualSize int64, uniqueID *common.UUID) []byte {
+	now := time.Now()
+	return footer.SerializeFooter(&footer.Footer{
+		Cookie:             vhdcore.CreateFooterCookie(),
+		Features:           footer.VhdFeatureReserved,
+		FileFormatVersion:  footer.VhdFileFormatVersionDefault,
+		HeaderOffset:       vhdcore.VhdNoDataLong,
+		TimeStamp:          &now,
+		CreatorApplication: "wa",
+		CreatorVersion:     footer.VhdCreatorVersionCSUP2011,
+		CreatorHostOsType:  footer.HostOsTypeWindows,
+		PhysicalSize:       virtualSize,
+		VirtualSize:        virtualSize,
+		DiskGeometry:       footer.CreateNewDiskGeometry(virtualSize),
+		DiskType:           footer.DiskTypeFixed,
+		UniqueID:           uniqueID,
+		Reserved:           make([]byte, 427),
+	})
+}
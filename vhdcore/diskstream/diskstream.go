@@ -2,7 +2,10 @@ package diskstream
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"os"
+	"time"
 
 	"github.com/flatcar/azure-vhd-utils/vhdcore"
 	"github.com/flatcar/azure-vhd-utils/vhdcore/block"
@@ -15,6 +18,7 @@ import (
 // The type exposes the VHD as a fixed VHD, regardless of actual underlying VHD type (dynamic, differencing
 // or fixed type)
 type DiskStream struct {
+	vhdPath         string
 	offset          int64
 	size            int64
 	isClosed        bool
@@ -23,6 +27,71 @@ type DiskStream struct {
 	vhdBlockFactory block.Factory
 	vhdFooterRange  *common.IndexRange
 	vhdDataRange    *common.IndexRange
+	options         Options
+	sourceSize      int64     // The size of the VHD file at the open, if DetectChanges is set
+	sourceModTime   time.Time // The modification time of the VHD file at the open, if DetectChanges is set
+}
+
+// ErrSourceChanged is the error a read of a DiskStream wraps when the VHD file changed since the stream was
+// opened, with the DetectChanges option.
+var ErrSourceChanged = errors.New("source file changed during upload")
+
+// Options describes the optional behaviour of a DiskStream.
+type Options struct {
+	// FooterOverrides, if not nil, replaces fields of the footer exposed by the stream.
+	FooterOverrides *FooterOverrides
+	// ParentPath, if not empty, is the path to the parent of a differencing disk, overriding the path recorded
+	// in the disk.
+	ParentPath string
+	// DirectIO reads the VHD bypassing the page cache of the operating system where supported.
+	DirectIO bool
+	// AllowCookieVariants accepts VHD footers with a cookie other than the standard one.
+	AllowCookieVariants bool
+	// DetectChanges fails the reads with ErrSourceChanged once the size or the modification time of the VHD
+	// file differs from the one at the open of the stream, so a VHD written to while it is read is not read
+	// inconsistently. The parent of a differencing disk is not checked.
+	DetectChanges bool
+}
+
+// FooterOverrides describes the fields of the footer exposed by a DiskStream to replace, a field with zero
+// value keeps the value from the footer of the VHD. This allows setting the values expected by the consumers
+// of the VHD, like Microsoft-compatible creator fields.
+type FooterOverrides struct {
+	Cookie             string                   // The footer cookie, exactly 8 characters
+	CreatorApplication string                   // The creator application, at most 4 characters
+	CreatorVersion     footer.VhdCreatorVersion // The creator version
+	CreatorHostOsType  footer.HostOsType        // The creator host OS type
+	UniqueID           *common.UUID             // The unique id of the disk, nil to keep it
+}
+
+// Validate returns an error if the overrides can't be stored in a footer.
+func (o *FooterOverrides) Validate() error {
+	if o.Cookie != "" && len(o.Cookie) != 8 {
+		return fmt.Errorf("footer cookie %q must be exactly 8 characters long", o.Cookie)
+	}
+	if len(o.CreatorApplication) > 4 {
+		return fmt.Errorf("footer creator application %q must be at most 4 characters long", o.CreatorApplication)
+	}
+	return nil
+}
+
+// apply replaces the fields of the footer f with the overrides.
+func (o *FooterOverrides) apply(f *footer.Footer) {
+	if o.Cookie != "" {
+		f.Cookie = vhdcore.CreateNewVhdCookie(false, []byte(o.Cookie))
+	}
+	if o.CreatorApplication != "" {
+		f.CreatorApplication = o.CreatorApplication
+	}
+	if o.CreatorVersion != footer.VhdCreatorVersionNone {
+		f.CreatorVersion = o.CreatorVersion
+	}
+	if o.CreatorHostOsType != footer.HostOsTypeNone {
+		f.CreatorHostOsType = o.CreatorHostOsType
+	}
+	if o.UniqueID != nil {
+		f.UniqueID = o.UniqueID
+	}
 }
 
 // StreamExtent describes a block range of a disk which contains data.
@@ -34,9 +103,28 @@ type StreamExtent struct {
 // CreateNewDiskStream creates a new DiskStream.
 // Parameter vhdPath is the path to VHD
 func CreateNewDiskStream(vhdPath string) (*DiskStream, error) {
+	return CreateNewDiskStreamWithOptions(vhdPath, nil)
+}
+
+// CreateNewDiskStreamWithOptions creates a new DiskStream with the given options, nil options are the same as
+// the zero Options.
+// Parameter vhdPath is the path to VHD
+func CreateNewDiskStreamWithOptions(vhdPath string, opts *Options) (*DiskStream, error) {
 	var err error
-	stream := &DiskStream{offset: 0, isClosed: false}
-	stream.vhdFactory = &vhdfile.FileFactory{}
+	stream := &DiskStream{vhdPath: vhdPath, offset: 0, isClosed: false}
+	if opts != nil {
+		if opts.FooterOverrides != nil {
+			if err := opts.FooterOverrides.Validate(); err != nil {
+				return nil, err
+			}
+		}
+		stream.options = *opts
+	}
+	stream.vhdFactory = &vhdfile.FileFactory{
+		ParentPath:          stream.options.ParentPath,
+		DirectIO:            stream.options.DirectIO,
+		AllowCookieVariants: stream.options.AllowCookieVariants,
+	}
 	if stream.vhdFile, err = stream.vhdFactory.Create(vhdPath); err != nil {
 		return nil, err
 	}
@@ -48,6 +136,27 @@ func CreateNewDiskStream(vhdPath string) (*DiskStream, error) {
 	stream.vhdFooterRange = stream.vhdBlockFactory.GetFooterRange()
 	stream.size = stream.vhdFooterRange.End + 1
 	stream.vhdDataRange = common.NewIndexRangeFromLength(0, stream.size-stream.vhdFooterRange.Length())
+	if stream.options.DetectChanges {
+		fi, err := os.Stat(vhdPath)
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
+		stream.sourceSize, stream.sourceModTime = fi.Size(), fi.ModTime()
+	}
+	return stream, nil
+}
+
+// Duplicate creates a new DiskStream over the same VHD as this stream. The new stream opens its own
+// handles to the VHD and has its own read offset, so it can be used concurrently with this stream.
+// The caller must close the returned stream. The changes of the VHD file are detected against the
+// same state of the file as for this stream.
+func (s *DiskStream) Duplicate() (*DiskStream, error) {
+	stream, err := CreateNewDiskStreamWithOptions(s.vhdPath, &s.options)
+	if err != nil {
+		return nil, err
+	}
+	stream.sourceSize, stream.sourceModTime = s.sourceSize, s.sourceModTime
 	return stream, nil
 }
 
@@ -86,6 +195,12 @@ func (s *DiskStream) Read(p []byte) (n int, err error) {
 	rangeToRead := common.NewIndexRangeFromLength(s.offset, int64(count))
 	if s.vhdDataRange.Intersects(rangeToRead) {
 		writtenCount, err := s.readFromBlocks(rangeToRead, p)
+		if err == nil {
+			// The data read may mix the old and the new content of a changed file
+			if cerr := s.checkSourceUnchanged(); cerr != nil {
+				return 0, cerr
+			}
+		}
 		s.offset += int64(writtenCount)
 		return writtenCount, err
 	}
@@ -99,6 +214,25 @@ func (s *DiskStream) Read(p []byte) (n int, err error) {
 	return 0, nil
 }
 
+// checkSourceUnchanged returns an error wrapping ErrSourceChanged if the DetectChanges option is set and the
+// size or the modification time of the VHD file differs from the one at the open of the stream.
+func (s *DiskStream) checkSourceUnchanged() error {
+	if !s.options.DetectChanges {
+		return nil
+	}
+	fi, err := os.Stat(s.vhdPath)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != s.sourceSize {
+		return fmt.Errorf("%w: the size of %s changed from %d to %d bytes while it was read, upload a copy or a snapshot of a VHD in use", ErrSourceChanged, s.vhdPath, s.sourceSize, fi.Size())
+	}
+	if !fi.ModTime().Equal(s.sourceModTime) {
+		return fmt.Errorf("%w: %s was modified at %s while it was read, upload a copy or a snapshot of a VHD in use", ErrSourceChanged, s.vhdPath, fi.ModTime().Format(time.RFC3339Nano))
+	}
+	return nil
+}
+
 // Seek sets the offset for the next Read on the stream to offset, interpreted according to whence:
 // 0 means relative to the origin of the stream, 1 means relative to the current offset, and 2
 // means relative to the end. It returns the new offset and an error, if any.
@@ -143,25 +277,19 @@ func (s *DiskStream) Close() error {
 // For fixed disk - this method returns extents describing ranges of all blocks, to rule out fixed disk block
 // ranges containing zero bytes use DetectEmptyRanges function in upload package.
 func (s *DiskStream) GetExtents() ([]*StreamExtent, error) {
-	extents := make([]*StreamExtent, 1)
-	blocksCount := s.vhdBlockFactory.GetBlockCount()
-	for i := int64(0); i < blocksCount; i++ {
-		currentBlock, err := s.vhdBlockFactory.Create(uint32(i))
-		if err != nil {
-			return nil, err
-		}
-		if !currentBlock.IsEmpty {
-			extents = append(extents, &StreamExtent{
-				Range:            currentBlock.LogicalRange,
-				OwnerVhdUniqueID: currentBlock.VhdUniqueID,
-			})
+	var err error
+	extents := make([]*StreamExtent, 0)
+	s.EnumerateExtents(func(ext *StreamExtent, extErr error) bool {
+		if extErr != nil {
+			err = extErr
+			return false
 		}
-	}
-	extents = append(extents, &StreamExtent{
-		Range:            s.vhdFooterRange,
-		OwnerVhdUniqueID: s.vhdFile.Footer.UniqueID,
+		extents = append(extents, ext)
+		return true
 	})
-
+	if err != nil {
+		return nil, err
+	}
 	return extents, nil
 }
 
@@ -169,7 +297,8 @@ func (s *DiskStream) GetExtents() ([]*StreamExtent, error) {
 // identified by the parameter f for each extent. Each extent describes a block's data section range which
 // contains data.
 // For dynamic or differencing disk - a block is empty if the BAT corresponding to the block contains 0xFFFFFFFF
-// so returned extents slice will not contain such range.
+// so returned extents slice will not contain such range. The extents come from the BAT alone, no block data is
+// read, so they are cheap to get even for a huge sparse disk.
 // For fixed disk - this method returns extents describing ranges of all blocks, to rule out fixed disk block
 // ranges containing zero bytes use DetectEmptyRanges function in upload package.
 func (s *DiskStream) EnumerateExtents(f func(*StreamExtent, error) bool) {
@@ -249,6 +378,9 @@ func (s *DiskStream) readFromFooter(rangeToRead *common.IndexRange, p []byte) (n
 		vhdFooter.HeaderOffset = vhdcore.VhdNoDataLong
 		vhdFooter.CreatorApplication = "wa"
 	}
+	if s.options.FooterOverrides != nil {
+		s.options.FooterOverrides.apply(vhdFooter)
+	}
 	// As per VHD spec, the size reported by the footer should same as 'header.MaxTableEntries * header.BlockSize'
 	// But the VHD created by some tool (e.g. qemu) are not honoring this. Azure will reject the VHD if the size
 	// specified in the footer of VHD not match 'VHD blob size - VHD Footer Size'
@@ -118,8 +118,9 @@ func (f *Factory) Create() (*Footer, error) {
 }
 
 // readVhdCookie reads the vhd cookie string and returns it as an instance of VhdCookie.
-// This function returns error if the cookie is invalid, if no or fewer bytes could be
-// read. Cookie is stored as eight-character ASCII string starting at offset 0 relative
+// This function returns error if no or fewer bytes could be read, a cookie other than
+// the standard one is returned as is, CheckCookie tells whether it is valid.
+// Cookie is stored as eight-character ASCII string starting at offset 0 relative
 // to the beginning of footer.
 func (f *Factory) readVhdCookie() (*vhdcore.Cookie, error) {
 	cookieData := make([]byte, 8)
@@ -127,11 +128,16 @@ func (f *Factory) readVhdCookie() (*vhdcore.Cookie, error) {
 		return nil, NewParseError("Cookie", err)
 	}
 
-	cookie := vhdcore.CreateNewVhdCookie(false, cookieData)
-	if !cookie.IsValid() {
-		return nil, NewParseError("Cookie", fmt.Errorf("Invalid footer cookie data %v", cookieData))
+	return vhdcore.CreateNewVhdCookie(false, cookieData), nil
+}
+
+// CheckCookie returns error if the cookie of the given footer is not the standard
+// "conectix" cookie.
+func CheckCookie(footer *Footer) error {
+	if !footer.Cookie.IsValid() {
+		return NewParseError("Cookie", fmt.Errorf("Invalid footer cookie data %v", footer.Cookie.Data))
 	}
-	return cookie, nil
+	return nil
 }
 
 // readFeatures reads and return the feature field. This function return error if no or
@@ -31,19 +31,20 @@ func SerializeFooter(footer *Footer) []byte {
 	writer.WriteBytes(68, footer.UniqueID.ToByteSlice())
 	writer.WriteBoolean(84, footer.SavedState)
 	writer.WriteBytes(85, footer.Reserved)
-	// + Checksum
-	//
-	// Checksum is one’s complement of the sum of all the bytes in the footer without the
-	// checksum field.
+	writer.WriteUInt32(64, ComputeCheckSum(buffer))
+
+	return buffer
+}
+
+// ComputeCheckSum returns the checksum of the given 512 bytes of a serialized footer.
+// Checksum is one’s complement of the sum of all the bytes in the footer without the
+// checksum field.
+func ComputeCheckSum(buffer []byte) uint32 {
 	checkSum := uint32(0)
 	for i := int(0); i < int(vhdcore.VhdFooterSize); i++ {
 		if i < vhdcore.VhdFooterChecksumOffset || i >= vhdcore.VhdFooterChecksumOffset+4 {
 			checkSum += uint32(buffer[i])
 		}
 	}
-
-	writer.WriteUInt32(64, ^checkSum)
-	// - Checksum
-
-	return buffer
+	return ^checkSum
 }
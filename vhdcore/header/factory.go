@@ -265,7 +265,7 @@ func (f *Factory) readParentLocators() (parentlocator.ParentLocators, error) {
 // readWholeHeader reads the entire header as a raw bytes. This function return error if the byte
 // could be read.
 func (f *Factory) readWholeHeader() ([]byte, error) {
-	rawData := make([]byte, 1024)
+	rawData := make([]byte, vhdcore.VhdHeaderSize)
 	_, err := f.vhdReader.ReadBytes(f.headerOffset+0, rawData)
 	if err != nil {
 		return nil, err
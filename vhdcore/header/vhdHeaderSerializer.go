@@ -0,0 +1,64 @@
+package header
+
+import (
+	"unicode/utf16"
+
+	"github.com/flatcar/azure-vhd-utils/vhdcore"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/writer"
+)
+
+// SerializeHeader returns the given Header instance as byte slice of length 1024 bytes.
+// The parent fields are written only if set, they are zero for dynamic disks.
+func SerializeHeader(header *Header) []byte {
+	buffer := make([]byte, vhdcore.VhdHeaderSize)
+	writer := writer.NewVhdWriterFromByteSlice(buffer)
+
+	writer.WriteBytes(0, header.Cookie.Data)
+	writer.WriteInt64(8, header.DataOffset)
+	writer.WriteInt64(16, header.TableOffset)
+	writer.WriteUInt32(24, uint32(header.HeaderVersion))
+	writer.WriteUInt32(28, header.MaxTableEntries)
+	writer.WriteUInt32(32, header.BlockSize)
+	if header.ParentUniqueID != nil {
+		writer.WriteBytes(40, header.ParentUniqueID.ToByteSlice())
+	}
+	if header.ParentTimeStamp != nil {
+		writer.WriteTimeStamp(56, header.ParentTimeStamp)
+	}
+	writer.WriteUInt32(60, header.Reserved)
+	// + ParentPath, UTF-16 big-endian
+	for i, c := range utf16.Encode([]rune(header.ParentPath)) {
+		if i >= 256 {
+			break
+		}
+		writer.WriteUInt16(int64(64+2*i), c)
+	}
+	// - ParentPath
+	for i, locator := range header.ParentLocators {
+		if i >= 8 {
+			break
+		}
+		off := int64(576 + 24*i)
+		writer.WriteInt32(off, int32(locator.PlatformCode))
+		writer.WriteInt32(off+4, locator.PlatformDataSpace)
+		writer.WriteInt32(off+8, locator.PlatformDataLength)
+		writer.WriteInt32(off+12, locator.Reserved)
+		writer.WriteInt64(off+16, locator.PlatformDataOffset)
+	}
+	writer.WriteUInt32(int64(vhdcore.VhdHeaderChecksumOffset), ComputeCheckSum(buffer))
+
+	return buffer
+}
+
+// ComputeCheckSum returns the checksum of the given 1024 bytes of a serialized header.
+// Checksum is one’s complement of the sum of all the bytes in the header without the
+// checksum field.
+func ComputeCheckSum(buffer []byte) uint32 {
+	checkSum := uint32(0)
+	for i := int(0); i < int(vhdcore.VhdHeaderSize); i++ {
+		if i < vhdcore.VhdHeaderChecksumOffset || i >= vhdcore.VhdHeaderChecksumOffset+4 {
+			checkSum += uint32(buffer[i])
+		}
+	}
+	return ^checkSum
+}
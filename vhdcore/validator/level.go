@@ -0,0 +1,57 @@
+package validator
+
+import "fmt"
+
+// Level is the strictness of the validation of a VHD footer. It decides which of the
+// nonstandard footers are rejected and which are only warned about.
+type Level int
+
+const (
+	// LevelDefault rejects footers with a nonstandard cookie or a checksum mismatch and
+	// warns about disk type oddities.
+	LevelDefault Level = iota
+	// LevelStrict rejects footers with a nonstandard cookie, a checksum mismatch or a
+	// disk type oddity.
+	LevelStrict
+	// LevelLenient warns about footers with a nonstandard cookie, a checksum mismatch
+	// or a disk type oddity, it rejects only the footers which cannot be read at all.
+	LevelLenient
+)
+
+// String returns the string representation of the Level.
+func (l Level) String() string {
+	switch l {
+	case LevelDefault:
+		return "default"
+	case LevelStrict:
+		return "strict"
+	case LevelLenient:
+		return "lenient"
+	}
+	return "unknown"
+}
+
+// check reports the problem found in a footer, as an error if it is rejected at this
+// level or through warn otherwise. The parameter rejectedAt is the least strict level
+// rejecting the problem.
+func (l Level) check(rejectedAt Level, warn func(string), format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if l.strictness() >= rejectedAt.strictness() {
+		return fmt.Errorf("%s (validation level: %s)", msg, l)
+	}
+	if warn != nil {
+		warn(fmt.Sprintf("Warning: %s, accepted at the %s validation level", msg, l))
+	}
+	return nil
+}
+
+// strictness orders the levels from the most lenient to the strictest.
+func (l Level) strictness() int {
+	switch l {
+	case LevelLenient:
+		return 0
+	case LevelStrict:
+		return 2
+	}
+	return 1
+}
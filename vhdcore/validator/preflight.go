@@ -0,0 +1,83 @@
+package validator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/flatcar/azure-vhd-utils/vhdcore"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/footer"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/vhdx"
+)
+
+// ErrNotVHD is the error CheckVhdFile wraps when the file is not a VHD file at all.
+var ErrNotVHD = errors.New("not a VHD file")
+
+// qcow2Magic is the magic number at the start of a QCOW2 image, commonly mistaken for a VHD.
+var qcow2Magic = []byte("QFI\xfb")
+
+// CheckVhdFile returns error if the file at vhdPath is obviously not a VHD, like a raw
+// disk image, a QCOW2 or a VHDX one, before it is parsed: the footer at the end of the file must
+// have the "conectix" cookie, or another cookie and a valid checksum if cookie variants
+// are allowed. The data of a fixed disk must be at least as large as the current size in
+// its footer and an expandable disk must start with a copy of its footer.
+func CheckVhdFile(vhdPath string, allowCookieVariants bool) error {
+	f, err := os.Open(vhdPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if size < vhdcore.VhdFooterSize {
+		return fmt.Errorf("%s is %w: the file of %d bytes is too small to hold a VHD footer", vhdPath, ErrNotVHD, size)
+	}
+
+	rawFooter := make([]byte, vhdcore.VhdFooterSize)
+	if _, err := f.ReadAt(rawFooter, size-vhdcore.VhdFooterSize); err != nil {
+		return err
+	}
+	head := make([]byte, vhdcore.VhdFooterSize)
+	if _, err := f.ReadAt(head, 0); err != nil {
+		return err
+	}
+
+	if vhdx.HasSignature(head) {
+		return fmt.Errorf("%s is %w: VHDX is not yet supported for the upload to a page blob, convert it to a fixed VHD first with azure-vhd-utils convert --type fixed", vhdPath, ErrNotVHD)
+	}
+
+	cookie := vhdcore.CreateNewVhdCookie(false, rawFooter[0:8])
+	checkSum := binary.BigEndian.Uint32(rawFooter[vhdcore.VhdFooterChecksumOffset:])
+	if !cookie.IsValid() && (!allowCookieVariants || checkSum != footer.ComputeCheckSum(rawFooter)) {
+		return fmt.Errorf("%s is %w: missing footer cookie, %s", vhdPath, ErrNotVHD, guessDiskImageFormat(head))
+	}
+
+	switch footer.DiskType(binary.BigEndian.Uint32(rawFooter[60:])) {
+	case footer.DiskTypeFixed:
+		currentSize := int64(binary.BigEndian.Uint64(rawFooter[48:]))
+		if dataSize := size - vhdcore.VhdFooterSize; dataSize < currentSize {
+			return fmt.Errorf("%s is truncated: the fixed disk holds %d bytes of data, while its footer has the current size %d", vhdPath, dataSize, currentSize)
+		}
+	case footer.DiskTypeDynamic, footer.DiskTypeDifferencing:
+		if !bytes.Equal(head[0:8], rawFooter[0:8]) {
+			return fmt.Errorf("%s is not a valid VHD: the expandable disk does not start with a copy of its footer", vhdPath)
+		}
+	}
+	return nil
+}
+
+// guessDiskImageFormat returns a hint about the format of the disk image starting with
+// the given bytes, which is not a VHD.
+func guessDiskImageFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, qcow2Magic):
+		return "the file looks like a QCOW2 image, convert it with qemu-img convert -O vpc -o subformat=fixed,force_size"
+	default:
+		return "the file may be a raw disk image, convert it with qemu-img convert -f raw -O vpc -o subformat=fixed,force_size"
+	}
+}
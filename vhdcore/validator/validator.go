@@ -2,30 +2,166 @@ package validator
 
 import (
 	"fmt"
+	"os"
 
+	"github.com/flatcar/azure-vhd-utils/vhdcore"
 	"github.com/flatcar/azure-vhd-utils/vhdcore/diskstream"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/footer"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/header"
 	"github.com/flatcar/azure-vhd-utils/vhdcore/vhdfile"
 )
 
-// oneTB is one TeraByte
-const oneTB int64 = 1024 * 1024 * 1024 * 1024
+// maxPageBlobSize is the largest size of an Azure page blob, 8 TiB.
+const maxPageBlobSize int64 = 8 * 1024 * 1024 * 1024 * 1024
+
+// pageBlobPageSize is the size of the pages of an Azure page blob, the size of a page blob is a multiple of it.
+const pageBlobPageSize int64 = 512
+
+// Options are the options of the validation of a VHD.
+type Options struct {
+	// ParentPath, if not empty, is the path to the parent of a differencing disk.
+	ParentPath string
+	// Level is the strictness of the validation of the VHD footers and headers.
+	Level Level
+	// Warn, if not nil, is called with the problems of the VHD footers and headers accepted at
+	// the validation level.
+	Warn func(string)
+}
 
 // ValidateVhd returns error if the vhdPath refer to invalid vhd.
 func ValidateVhd(vhdPath string) error {
-	vFactory := &vhdfile.FileFactory{}
-	_, err := vFactory.Create(vhdPath)
+	return ValidateVhdWithParent(vhdPath, "")
+}
+
+// ValidateVhdWithParent returns error if the vhdPath refer to invalid vhd, the parameter
+// parentPath, if not empty, is the path to the parent of a differencing disk.
+func ValidateVhdWithParent(vhdPath, parentPath string) error {
+	return ValidateVhdWithOptions(vhdPath, &Options{ParentPath: parentPath})
+}
+
+// ValidateVhdWithOptions returns error if the vhdPath refer to invalid vhd, the footers
+// and the headers of the VHD and of its parents, if any, are validated at the level of
+// the options.
+func ValidateVhdWithOptions(vhdPath string, opts *Options) error {
+	vFactory := &vhdfile.FileFactory{ParentPath: opts.ParentPath, AllowCookieVariants: true}
+	vFile, err := vFactory.Create(vhdPath)
 	if err != nil {
 		return fmt.Errorf("%s is not a valid VHD: %v", vhdPath, err)
 	}
+	defer vFactory.Dispose(nil)
+
+	for f := vFile; f != nil; f = f.Parent {
+		if err := validateFooter(f, opts.Level, opts.Warn); err != nil {
+			return fmt.Errorf("%s is not a valid VHD: %v", vhdPath, err)
+		}
+		if err := validateHeader(f, opts.Level, opts.Warn); err != nil {
+			return fmt.Errorf("%s is not a valid VHD: %v", vhdPath, err)
+		}
+	}
+	return nil
+}
+
+// validateFooter returns error if the footer of the VHD has a problem rejected at the
+// given level, the other problems are reported through warn.
+func validateFooter(vFile *vhdfile.VhdFile, level Level, warn func(string)) error {
+	vhdFooter := vFile.Footer
+	if err := footer.CheckCookie(vhdFooter); err != nil {
+		if err := level.check(LevelDefault, warn, "the footer has the nonstandard cookie %q", vhdFooter.Cookie); err != nil {
+			return err
+		}
+	}
+
+	if checkSum := footer.ComputeCheckSum(vhdFooter.RawData); checkSum != vhdFooter.CheckSum {
+		if err := level.check(LevelDefault, warn, "the footer checksum is 0x%08X, while 0x%08X is expected", vhdFooter.CheckSum, checkSum); err != nil {
+			return err
+		}
+	}
+
+	if vhdFooter.DiskType == footer.DiskTypeFixed {
+		if vhdFooter.HeaderOffset != -1 {
+			if err := level.check(LevelStrict, warn, "the footer of the fixed disk has the header offset %d, while fixed disks have no header", vhdFooter.HeaderOffset); err != nil {
+				return err
+			}
+		}
+		if dataSize := vFile.VhdReader.Size - vhdcore.VhdFooterSize; dataSize != vhdFooter.VirtualSize {
+			if err := level.check(LevelStrict, warn, "the fixed disk holds %d bytes of data, while its footer has the virtual size %d", dataSize, vhdFooter.VirtualSize); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateHeader returns error if the header of the expandable VHD has a problem rejected
+// at the given level, the other problems are reported through warn. Fixed disks have no
+// header.
+func validateHeader(vFile *vhdfile.VhdFile, level Level, warn func(string)) error {
+	vhdHeader := vFile.Header
+	if vhdHeader == nil {
+		return nil
+	}
+
+	if checkSum := header.ComputeCheckSum(vhdHeader.RawData); checkSum != vhdHeader.CheckSum {
+		if err := level.check(LevelDefault, warn, "the dynamic header checksum is 0x%08X, while 0x%08X is expected", vhdHeader.CheckSum, checkSum); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// ValidateVhdSize returns error if size of the vhd referenced by vhdPath is more than
-// the maximum allowed size (1TB)
+// ValidateVhdSize returns error if size of the vhd referenced by vhdPath does not fit in
+// a page blob: it must be a multiple of 512 bytes and, with the footer, at most 8 TiB.
 func ValidateVhdSize(vhdPath string) error {
-	stream, _ := diskstream.CreateNewDiskStream(vhdPath)
-	if stream.GetSize() > oneTB {
-		return fmt.Errorf("VHD size is too large ('%d'), maximum allowed size is '%d'", stream.GetSize(), oneTB)
+	return ValidateVhdSizeWithParent(vhdPath, "")
+}
+
+// ValidateVhdSizeWithParent returns error if size of the vhd referenced by vhdPath does
+// not fit in a page blob, the parameter parentPath, if not empty, is
+// the path to the parent of a differencing disk.
+func ValidateVhdSizeWithParent(vhdPath, parentPath string) error {
+	return ValidateVhdSizeWithOptions(vhdPath, &Options{ParentPath: parentPath})
+}
+
+// ValidateVhdSizeWithOptions returns error if size of the vhd referenced by vhdPath does
+// not fit in a page blob. The virtual size in the footer of the VHD must be a multiple of
+// 512 bytes, and so must be the data of a fixed VHD, which is uploaded as it is in the file.
+// The page blob has the size of the data with the footer appended, it must be at most 8 TiB.
+// The errors tell the virtual size from the size of the file, which differs from it for a
+// dynamic or differencing disk. The VHD footers with a nonstandard cookie are accepted at
+// the lenient level of the options only.
+func ValidateVhdSizeWithOptions(vhdPath string, opts *Options) error {
+	vFactory := &vhdfile.FileFactory{ParentPath: opts.ParentPath, AllowCookieVariants: opts.Level == LevelLenient}
+	vFile, err := vFactory.Create(vhdPath)
+	if err != nil {
+		return err
+	}
+	defer vFactory.Dispose(nil)
+	stream, err := diskstream.CreateNewDiskStreamWithOptions(vhdPath, &diskstream.Options{
+		ParentPath:          opts.ParentPath,
+		AllowCookieVariants: opts.Level == LevelLenient,
+	})
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	fi, err := os.Stat(vhdPath)
+	if err != nil {
+		return err
+	}
+
+	virtualSize := vFile.Footer.VirtualSize
+	if virtualSize%pageBlobPageSize != 0 {
+		return fmt.Errorf("the virtual size of %s in its footer, %d bytes, is not a multiple of %d bytes as the size of a page blob must be (the file is %d bytes on disk)",
+			vhdPath, virtualSize, pageBlobPageSize, fi.Size())
+	}
+	blobSize := stream.GetSize()
+	if dataSize := blobSize - vhdcore.VhdFooterSize; dataSize%pageBlobPageSize != 0 {
+		return fmt.Errorf("the data of the fixed VHD %s, the %d bytes of the file on disk before its footer, is not a multiple of %d bytes as the size of a page blob must be (the virtual size in its footer is %d bytes)",
+			vhdPath, dataSize, pageBlobPageSize, virtualSize)
+	}
+	if blobSize > maxPageBlobSize {
+		return fmt.Errorf("the VHD %s makes a page blob of %d bytes, its data with the footer, over the page blob maximum of %d bytes (8 TiB) by %d bytes (the virtual size in its footer is %d bytes, the file is %d bytes on disk)",
+			vhdPath, blobSize, maxPageBlobSize, blobSize-maxPageBlobSize, virtualSize, fi.Size())
 	}
 	return nil
 }
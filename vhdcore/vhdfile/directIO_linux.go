@@ -0,0 +1,23 @@
+//go:build linux
+
+package vhdfile
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// openDirect opens the file at path for direct I/O, bypassing the page cache. If the file system does not support
+// direct I/O, the file is opened for regular reads instead, the returned bool is true only if direct I/O is used.
+func openDirect(path string) (*os.File, bool, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECT, 0)
+	if err == nil {
+		return f, true, nil
+	}
+	if !errors.Is(err, syscall.EINVAL) {
+		return nil, false, err
+	}
+	f, err = os.Open(path)
+	return f, false, err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package vhdfile
+
+import (
+	"os"
+)
+
+// openDirect opens the file at path for regular reads, direct I/O is supported on Linux only. The returned bool
+// is always false.
+func openDirect(path string) (*os.File, bool, error) {
+	f, err := os.Open(path)
+	return f, false, err
+}
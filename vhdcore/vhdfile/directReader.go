@@ -0,0 +1,80 @@
+package vhdfile
+
+import (
+	"io"
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// directIOAlignment is the alignment of the offsets, the sizes and the buffers of the reads from a file opened
+// for direct I/O. It is the logical block size of the common Linux block devices and file systems.
+const directIOAlignment = 4096
+
+// directIOBufferSize is the size of the reads from a file opened for direct I/O.
+const directIOBufferSize = 1024 * 1024
+
+// directReader is a reader.ReadAtReader reading a file opened for direct I/O, which bypasses the page cache of
+// the operating system. Such a file can be read at aligned offsets into aligned buffers only, so directReader
+// reads whole aligned chunks into its own buffer and copies the requested bytes out of it.
+type directReader struct {
+	mutex  sync.Mutex
+	file   *os.File
+	buf    []byte
+	offset int64
+}
+
+// newDirectReader creates a new instance of directReader reading the file, which is expected to be opened for
+// direct I/O.
+func newDirectReader(file *os.File) *directReader {
+	return &directReader{
+		file: file,
+		buf:  alignedBuffer(directIOBufferSize),
+	}
+}
+
+// ReadAt reads len(p) bytes into p starting at offset off of the file.
+func (r *directReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		alignedPos := pos &^ (directIOAlignment - 1)
+		count, err := r.file.ReadAt(r.buf, alignedPos)
+		skip := int(pos - alignedPos)
+		if count > skip {
+			n += copy(p[n:], r.buf[skip:count])
+		}
+		if n == len(p) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if count <= skip {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// Read reads up to len(p) bytes into p from the current offset of the reader.
+func (r *directReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// alignedBuffer returns a buffer of the given size whose address is aligned to directIOAlignment.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directIOAlignment)
+	shift := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlignment - 1)); rem != 0 {
+		shift = directIOAlignment - rem
+	}
+	return buf[shift : shift+size]
+}
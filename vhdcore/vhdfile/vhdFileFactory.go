@@ -1,10 +1,14 @@
 package vhdfile
 
 import (
+	"bytes"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/flatcar/azure-vhd-utils/vhdcore/bat"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/common"
 	"github.com/flatcar/azure-vhd-utils/vhdcore/footer"
 	"github.com/flatcar/azure-vhd-utils/vhdcore/header"
 	"github.com/flatcar/azure-vhd-utils/vhdcore/reader"
@@ -12,6 +16,17 @@ import (
 
 // FileFactory is a type to create VhdFile representing VHD in the local machine
 type FileFactory struct {
+	// ParentPath, if not empty, is the path to the parent VHD of a differencing disk, it is used instead of the
+	// paths recorded in the differencing disk. It applies to the immediate parent only, the ancestors of the
+	// parent are located using the paths recorded in the parent.
+	ParentPath string
+	// DirectIO reads the VHD files bypassing the page cache of the operating system where supported, so reading
+	// a huge VHD does not evict useful data from the cache. The regular reads are used where it is unsupported.
+	DirectIO bool
+	// AllowCookieVariants accepts the VHD files whose footer has a cookie other than the standard "conectix"
+	// one, the cookie is left to check to the caller. Such files are rejected by default.
+	AllowCookieVariants bool
+
 	vhdDir               string       // Path to the directory holding VHD file
 	fd                   *os.File     // File descriptor of the VHD file
 	parentVhdFileFactory *FileFactory // Reference to the parent VhdFileFactory if this VHD file is parent of a dynamic VHD
@@ -21,14 +36,28 @@ type FileFactory struct {
 // Create creates a new VhdFile representing a VHD in the local machine located at vhdPath
 func (f *FileFactory) Create(vhdPath string) (*VhdFile, error) {
 	var err error
-	if f.fd, err = os.Open(vhdPath); err != nil {
-		f.Dispose(err)
-		return nil, err
+	var r reader.ReadAtReader
+	if f.DirectIO {
+		var direct bool
+		if f.fd, direct, err = openDirect(vhdPath); err != nil {
+			f.Dispose(err)
+			return nil, err
+		}
+		r = f.fd
+		if direct {
+			r = newDirectReader(f.fd)
+		}
+	} else {
+		if f.fd, err = os.Open(vhdPath); err != nil {
+			f.Dispose(err)
+			return nil, err
+		}
+		r = f.fd
 	}
 
 	f.vhdDir = filepath.Dir(vhdPath)
 	fStat, _ := f.fd.Stat()
-	file, err := f.CreateFromReaderAtReader(f.fd, fStat.Size())
+	file, err := f.CreateFromReaderAtReader(r, fStat.Size())
 	if err != nil {
 		f.Dispose(err)
 		return nil, err
@@ -45,6 +74,16 @@ func (f *FileFactory) CreateFromReaderAtReader(r reader.ReadAtReader, size int64
 	if err != nil {
 		return nil, err
 	}
+	if !f.AllowCookieVariants {
+		if err := footer.CheckCookie(vhdFooter); err != nil {
+			return nil, err
+		}
+	}
+	switch vhdFooter.DiskType {
+	case footer.DiskTypeFixed, footer.DiskTypeDynamic, footer.DiskTypeDifferencing:
+	default:
+		return nil, fmt.Errorf("Unsupported disk type %d in the footer", uint32(vhdFooter.DiskType))
+	}
 
 	vhdFile := VhdFile{
 		Footer:    vhdFooter,
@@ -72,24 +111,144 @@ func (f *FileFactory) CreateFromReaderAtReader(r reader.ReadAtReader, size int64
 		return &vhdFile, nil
 	}
 
-	var parentPath string
-	if f.vhdDir == "." || f.vhdDir == string(os.PathSeparator) {
-		parentPath = vhdHeader.ParentPath
-	} else {
-		parentPath = filepath.Join(parentPath, vhdHeader.ParentLocators.GetRelativeParentPath())
+	parentPath, err := f.locateParent(vhdHeader)
+	if err != nil {
+		return nil, err
 	}
 
 	// Insert a node in the doubly linked list of VhdFileFactory chain.
-	f.parentVhdFileFactory = &FileFactory{childVhdFileFactory: f}
+	f.parentVhdFileFactory = &FileFactory{
+		childVhdFileFactory: f,
+		DirectIO:            f.DirectIO,
+		AllowCookieVariants: f.AllowCookieVariants,
+	}
 	// Set differencing disk parent VhdFile
 	vhdFile.Parent, err = f.parentVhdFileFactory.Create(parentPath)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Unable to open the parent VHD %s: %v", parentPath, err)
+	}
+
+	parentID := vhdFile.Parent.Footer.UniqueID.ToByteSlice()
+	if !bytes.Equal(parentID, vhdHeader.ParentUniqueID.ToByteSlice()) {
+		return nil, fmt.Errorf("The VHD %s is not the parent of the differencing disk, its unique ID is %x while %x is expected",
+			parentPath, parentID, vhdHeader.ParentUniqueID.ToByteSlice())
 	}
 
 	return &vhdFile, nil
 }
 
+// ReadUniqueID reads the unique id from the footer of the VHD located at vhdPath, the GUID Hyper-V identifies
+// the disk with, which its String method formats. Like ReadFooterAndHeader, only the footer is read.
+func ReadUniqueID(vhdPath string) (*common.UUID, error) {
+	vhdFooter, err := readFooter(vhdPath)
+	if err != nil {
+		return nil, err
+	}
+	return vhdFooter.UniqueID, nil
+}
+
+// ReadDiskGeometry reads the cylinders, heads and sectors per track from the footer of the VHD located at
+// vhdPath. Like ReadFooterAndHeader, only the footer is read.
+func ReadDiskGeometry(vhdPath string) (*footer.DiskGeometry, error) {
+	vhdFooter, err := readFooter(vhdPath)
+	if err != nil {
+		return nil, err
+	}
+	return vhdFooter.DiskGeometry, nil
+}
+
+// readFooter reads the footer of the VHD located at vhdPath, without checking its cookie.
+func readFooter(vhdPath string) (*footer.Footer, error) {
+	fd, err := os.Open(vhdPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	fStat, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return (footer.NewFactory(reader.NewVhdReader(fd, fStat.Size()))).Create()
+}
+
+// ReadFooterAndHeader reads the footer of the VHD located at vhdPath and, for an expandable disk, its header. The
+// header is nil for a fixed disk. Unlike Create, the BAT is not read and the parent of a differencing disk is not
+// opened, so only the few bytes of these two structures are read whatever the size of the disk. The cookie of
+// the footer is not checked, so the VHD files with non-standard cookies can be inspected.
+func ReadFooterAndHeader(vhdPath string) (*footer.Footer, *header.Header, error) {
+	fd, err := os.Open(vhdPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fd.Close()
+
+	fStat, err := fd.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	return ReadFooterAndHeaderFromReaderAtReader(fd, fStat.Size())
+}
+
+// ReadFooterAndHeaderFromReaderAtReader works like ReadFooterAndHeader, reading the VHD of size bytes from the
+// reader.ReadAtReader r.
+func ReadFooterAndHeaderFromReaderAtReader(r reader.ReadAtReader, size int64) (*footer.Footer, *header.Header, error) {
+	vhdReader := reader.NewVhdReader(r, size)
+	vhdFooter, err := (footer.NewFactory(vhdReader)).Create()
+	if err != nil {
+		return nil, nil, err
+	}
+	if vhdFooter.DiskType == footer.DiskTypeFixed {
+		return vhdFooter, nil, nil
+	}
+
+	vhdHeader, err := (header.NewFactory(vhdReader, vhdFooter.HeaderOffset)).Create()
+	if err != nil {
+		return nil, nil, err
+	}
+	return vhdFooter, vhdHeader, nil
+}
+
+// locateParent returns the path to the parent VHD of the differencing disk with the given header. It is the
+// ParentPath of the factory if set, otherwise the first existing file among the relative and the absolute
+// paths in the parent locators and the parent file name in the header, relative paths are resolved against
+// the directory of the differencing disk.
+func (f *FileFactory) locateParent(vhdHeader *header.Header) (string, error) {
+	if f.ParentPath != "" {
+		if _, err := os.Stat(f.ParentPath); err != nil {
+			return "", fmt.Errorf("Unable to find the parent VHD: %v", err)
+		}
+		return f.ParentPath, nil
+	}
+
+	var candidates []string
+	for _, c := range []struct {
+		path     string
+		relative bool
+	}{
+		{vhdHeader.ParentLocators.GetRelativeParentPath(), true},
+		{vhdHeader.ParentLocators.GetAbsoluteParentPath(), false},
+		{vhdHeader.ParentPath, true},
+	} {
+		p := strings.TrimRight(c.path, "\x00 ")
+		if p == "" {
+			continue
+		}
+		// The paths are recorded by Windows tools, with backslash separators.
+		p = filepath.FromSlash(strings.ReplaceAll(p, "\\", "/"))
+		if c.relative {
+			p = filepath.Join(f.vhdDir, p)
+		}
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+		candidates = append(candidates, p)
+	}
+
+	return "", fmt.Errorf("Unable to find the parent VHD of the differencing disk, tried %s, the path to the parent can be given explicitly",
+		strings.Join(candidates, ", "))
+}
+
 // Dispose disposes this instance of VhdFileFactory and VhdFileFactory instances of parent and child
 // VHDs
 func (f *FileFactory) Dispose(err error) {
@@ -0,0 +1,66 @@
+package vhdfile_test
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/flatcar/azure-vhd-utils/upload/uploadtest"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/footer"
+	"github.com/flatcar/azure-vhd-utils/vhdcore/vhdfile"
+)
+
+// countingReader counts the bytes read from the file it reads.
+type countingReader struct {
+	*os.File
+	read int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.File.Read(p)
+	atomic.AddInt64(&r.read, int64(n))
+	return n, err
+}
+
+func (r *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.File.ReadAt(p, off)
+	atomic.AddInt64(&r.read, int64(n))
+	return n, err
+}
+
+func TestReadFooterAndHeaderReadsBoundedBytes(t *testing.T) {
+	const mb = 1024 * 1024
+	for _, size := range []int64{4 * mb, 64 * mb} {
+		data := uploadtest.NewData(size, 15, 0, size/uploadtest.PageSize-1)
+		for _, test := range []struct {
+			name     string
+			path     string
+			diskType footer.DiskType
+			limit    int64 // Twice the footer and the header of an expandable disk, read by field and then whole
+		}{
+			{"fixed", uploadtest.NewFixedVHD(t, data), footer.DiskTypeFixed, 2 * 512},
+			{"dynamic", uploadtest.NewDynamicVHD(t, data, 2*mb), footer.DiskTypeDynamic, 2 * (512 + 1024)},
+		} {
+			f, err := os.Open(test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			fi, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := &countingReader{File: f}
+			vhdFooter, _, err := vhdfile.ReadFooterAndHeaderFromReaderAtReader(r, fi.Size())
+			if err != nil {
+				t.Fatalf("%s VHD of %d bytes: %v", test.name, size, err)
+			}
+			if vhdFooter.DiskType != test.diskType || vhdFooter.VirtualSize != size {
+				t.Errorf("got a %v disk of %d bytes, expected a %s one of %d bytes", vhdFooter.DiskType, vhdFooter.VirtualSize, test.name, size)
+			}
+			if r.read > test.limit {
+				t.Errorf("got %d bytes read from the %s VHD of %d bytes, expected at most %d", r.read, test.name, fi.Size(), test.limit)
+			}
+		}
+	}
+}
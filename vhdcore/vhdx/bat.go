@@ -0,0 +1,92 @@
+package vhdx
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// BlockState is the state of a block in its entry of the Block Allocation Table.
+type BlockState uint8
+
+// The states of the payload blocks, and of the sector bitmap blocks for BlockNotPresent and BlockFullyPresent.
+const (
+	BlockNotPresent       BlockState = 0
+	BlockUndefined        BlockState = 1
+	BlockZero             BlockState = 2
+	BlockUnmapped         BlockState = 3
+	BlockFullyPresent     BlockState = 6
+	BlockPartiallyPresent BlockState = 7
+)
+
+// String returns the name of the block state.
+func (s BlockState) String() string {
+	switch s {
+	case BlockNotPresent:
+		return "NotPresent"
+	case BlockUndefined:
+		return "Undefined"
+	case BlockZero:
+		return "Zero"
+	case BlockUnmapped:
+		return "Unmapped"
+	case BlockFullyPresent:
+		return "FullyPresent"
+	case BlockPartiallyPresent:
+		return "PartiallyPresent"
+	default:
+		return fmt.Sprintf("Unknown(%d)", uint8(s))
+	}
+}
+
+// BATEntry is an entry of the Block Allocation Table, the state of a block and its offset in the file.
+type BATEntry uint64
+
+// State returns the state of the block.
+func (e BATEntry) State() BlockState {
+	return BlockState(e & 7)
+}
+
+// FileOffset returns the offset of the block in the file, in bytes.
+func (e BATEntry) FileOffset() int64 {
+	return int64(e>>20) * 1024 * 1024
+}
+
+// ChunkRatio returns the number of payload blocks described by a sector bitmap block, the BAT entry of a sector
+// bitmap block follows the entries of its payload blocks.
+func (v *File) ChunkRatio() int64 {
+	return (1 << 23) * int64(v.Metadata.LogicalSectorSize) / int64(v.Metadata.BlockSize)
+}
+
+// DataBlockCount returns the number of payload blocks of the disk.
+func (v *File) DataBlockCount() int64 {
+	blockSize := uint64(v.Metadata.BlockSize)
+	return int64((v.Metadata.VirtualDiskSize + blockSize - 1) / blockSize)
+}
+
+// PayloadEntry returns the BAT entry of the payload block with the given index.
+func (v *File) PayloadEntry(index int64) BATEntry {
+	return v.BAT[index+index/v.ChunkRatio()]
+}
+
+// readBAT reads the Block Allocation Table from the given region, the number of entries is given by the size of
+// the disk and of its blocks.
+func (v *File) readBAT(region *RegionEntry) ([]BATEntry, error) {
+	dataBlocks := v.DataBlockCount()
+	chunkRatio := v.ChunkRatio()
+	count := dataBlocks + (dataBlocks-1)/chunkRatio
+	if v.Metadata.HasParent {
+		count = (dataBlocks + chunkRatio - 1) / chunkRatio * (chunkRatio + 1)
+	}
+	if count*8 > int64(region.Length) {
+		return nil, fmt.Errorf("the BAT of %d entries does not fit in its region of %d bytes", count, region.Length)
+	}
+	b, err := v.read(int64(region.FileOffset), int(count*8))
+	if err != nil {
+		return nil, err
+	}
+	bat := make([]BATEntry, count)
+	for i := range bat {
+		bat[i] = BATEntry(binary.LittleEndian.Uint64(b[i*8:]))
+	}
+	return bat, nil
+}
@@ -0,0 +1,41 @@
+package vhdx
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// GUID is a GUID as stored in a VHDX file, with its first three fields in little-endian byte order.
+type GUID [16]byte
+
+// mustParseGUID returns the GUID of the given string form, like 2DC27766-F623-4200-9D64-115E9BFD4A08, it panics
+// if the string is not a GUID. It is meant for the GUIDs defined by the VHDX specification.
+func mustParseGUID(s string) GUID {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		panic(fmt.Sprintf("invalid GUID %q", s))
+	}
+	var g GUID
+	binary.LittleEndian.PutUint32(g[0:], binary.BigEndian.Uint32(b[0:]))
+	binary.LittleEndian.PutUint16(g[4:], binary.BigEndian.Uint16(b[4:]))
+	binary.LittleEndian.PutUint16(g[6:], binary.BigEndian.Uint16(b[6:]))
+	copy(g[8:], b[8:])
+	return g
+}
+
+// IsZero returns true if all the bytes of the GUID are zero.
+func (g GUID) IsZero() bool {
+	return g == GUID{}
+}
+
+// String returns the string form of the GUID, the hex digits of its five fields separated by hyphens.
+func (g GUID) String() string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:]),
+		binary.LittleEndian.Uint16(g[4:]),
+		binary.LittleEndian.Uint16(g[6:]),
+		g[8:10],
+		g[10:])
+}
@@ -0,0 +1,71 @@
+package vhdx
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// headerSignature is the signature of the headers.
+const headerSignature = "head"
+
+// Header is one of the two headers of a VHDX file, the one with the greatest sequence number is the current one.
+type Header struct {
+	// SequenceNumber tells the current header, it is incremented on every update.
+	SequenceNumber uint64
+	// FileWriteGUID changes on the first write to the file after it is opened.
+	FileWriteGUID GUID
+	// DataWriteGUID changes on the first write to the user visible data of the disk after it is opened.
+	DataWriteGUID GUID
+	// LogGUID is zero when the log is empty, otherwise the log holds updates to replay before reading the file.
+	LogGUID GUID
+	// LogVersion is the version of the format of the log, it must be 0.
+	LogVersion uint16
+	// Version is the version of the format of the file, it must be 1.
+	Version uint16
+	// LogLength and LogOffset locate the log in the file.
+	LogLength uint32
+	LogOffset uint64
+}
+
+// parseHeader parses the header of 4 KB in b, it returns nil if the header has no signature or an invalid
+// checksum.
+func parseHeader(b []byte) *Header {
+	if string(b[0:4]) != headerSignature || !validChecksum(b) {
+		return nil
+	}
+	h := &Header{
+		SequenceNumber: binary.LittleEndian.Uint64(b[8:]),
+		LogVersion:     binary.LittleEndian.Uint16(b[64:]),
+		Version:        binary.LittleEndian.Uint16(b[66:]),
+		LogLength:      binary.LittleEndian.Uint32(b[68:]),
+		LogOffset:      binary.LittleEndian.Uint64(b[72:]),
+	}
+	copy(h.FileWriteGUID[:], b[16:32])
+	copy(h.DataWriteGUID[:], b[32:48])
+	copy(h.LogGUID[:], b[48:64])
+	return h
+}
+
+// readCurrentHeader reads the two headers of the file and returns the valid one with the greatest sequence number.
+func (v *File) readCurrentHeader() (*Header, error) {
+	var current *Header
+	for _, offset := range []int64{header1Offset, header2Offset} {
+		b, err := v.read(offset, headerSize)
+		if err != nil {
+			return nil, err
+		}
+		if h := parseHeader(b); h != nil && (current == nil || h.SequenceNumber > current.SequenceNumber) {
+			current = h
+		}
+	}
+	if current == nil {
+		return nil, errors.New("both headers of the VHDX file are corrupted")
+	}
+	return current, nil
+}
+
+// HasLog returns true if the log of the file holds updates which were not applied yet, the file must then be
+// opened by Hyper-V, or another implementation replaying the log, before its data can be read.
+func (h *Header) HasLog() bool {
+	return !h.LogGUID.IsZero()
+}
@@ -0,0 +1,121 @@
+package vhdx
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// metadataTableSignature is the signature of the metadata table at the start of the metadata region.
+const metadataTableSignature = "metadata"
+
+// metadataTableSize is the size of the metadata table, its entries follow a header of 32 bytes.
+const metadataTableSize = 64 * 1024
+
+// maxMetadataEntries is the largest number of entries of the metadata table.
+const maxMetadataEntries = 2047
+
+// Metadata are the known items of the metadata region of a VHDX file.
+type Metadata struct {
+	// BlockSize is the size of the payload blocks of the disk, a power of two between 1 MB and 256 MB.
+	BlockSize uint32
+	// LeaveBlocksAllocated is true for a fixed disk, whose blocks are all allocated.
+	LeaveBlocksAllocated bool
+	// HasParent is true for a differencing disk.
+	HasParent bool
+	// VirtualDiskSize is the size of the disk seen by the virtual machine, in bytes.
+	VirtualDiskSize uint64
+	// VirtualDiskID identifies the disk, the SCSI page 83 data of the disk.
+	VirtualDiskID GUID
+	// LogicalSectorSize and PhysicalSectorSize are the sector sizes of the disk, 512 or 4096 bytes.
+	LogicalSectorSize  uint32
+	PhysicalSectorSize uint32
+}
+
+// readMetadata reads the metadata table at the start of the given region and the known items it points to. The
+// required items unknown to this package are rejected.
+func (v *File) readMetadata(region *RegionEntry) (*Metadata, error) {
+	table, err := v.read(int64(region.FileOffset), metadataTableSize)
+	if err != nil {
+		return nil, err
+	}
+	if string(table[0:8]) != metadataTableSignature {
+		return nil, fmt.Errorf("the metadata region has no metadata table")
+	}
+	count := binary.LittleEndian.Uint16(table[10:])
+	if count > maxMetadataEntries {
+		return nil, fmt.Errorf("the metadata table has %d entries, at most %d are allowed", count, maxMetadataEntries)
+	}
+
+	m := &Metadata{}
+	found := make(map[GUID]bool)
+	for i := 0; i < int(count); i++ {
+		e := table[32+i*32 : 32+(i+1)*32]
+		var id GUID
+		copy(id[:], e[0:16])
+		offset := binary.LittleEndian.Uint32(e[16:])
+		length := binary.LittleEndian.Uint32(e[20:])
+		required := binary.LittleEndian.Uint32(e[24:])&4 != 0
+		if uint64(offset)+uint64(length) > uint64(region.Length) {
+			return nil, fmt.Errorf("the metadata item %s is beyond the end of the metadata region", id)
+		}
+
+		var want uint32
+		switch id {
+		case fileParametersGUID:
+			want = 8
+		case virtualDiskSizeGUID:
+			want = 8
+		case virtualDiskIDGUID:
+			want = 16
+		case logicalSectorSizeGUID, physicalSectorSizeGUID:
+			want = 4
+		case parentLocatorGUID:
+			// Only told by HasParent, the parent is not read
+			continue
+		default:
+			if required {
+				return nil, fmt.Errorf("the VHDX file has the unknown required metadata item %s", id)
+			}
+			continue
+		}
+		if length < want {
+			return nil, fmt.Errorf("the metadata item %s has %d bytes, expected %d", id, length, want)
+		}
+		item, err := v.read(int64(region.FileOffset)+int64(offset), int(want))
+		if err != nil {
+			return nil, err
+		}
+		switch id {
+		case fileParametersGUID:
+			m.BlockSize = binary.LittleEndian.Uint32(item[0:])
+			flags := binary.LittleEndian.Uint32(item[4:])
+			m.LeaveBlocksAllocated = flags&1 != 0
+			m.HasParent = flags&2 != 0
+		case virtualDiskSizeGUID:
+			m.VirtualDiskSize = binary.LittleEndian.Uint64(item)
+		case virtualDiskIDGUID:
+			copy(m.VirtualDiskID[:], item)
+		case logicalSectorSizeGUID:
+			m.LogicalSectorSize = binary.LittleEndian.Uint32(item)
+		case physicalSectorSizeGUID:
+			m.PhysicalSectorSize = binary.LittleEndian.Uint32(item)
+		}
+		found[id] = true
+	}
+
+	for _, id := range []GUID{fileParametersGUID, virtualDiskSizeGUID, virtualDiskIDGUID, logicalSectorSizeGUID, physicalSectorSizeGUID} {
+		if !found[id] {
+			return nil, fmt.Errorf("the metadata region lacks the required item %s", id)
+		}
+	}
+	if m.BlockSize < 1024*1024 || m.BlockSize > 256*1024*1024 || m.BlockSize&(m.BlockSize-1) != 0 {
+		return nil, fmt.Errorf("invalid block size %d, expected a power of two between 1 MB and 256 MB", m.BlockSize)
+	}
+	if m.LogicalSectorSize != 512 && m.LogicalSectorSize != 4096 {
+		return nil, fmt.Errorf("invalid logical sector size %d, expected 512 or 4096", m.LogicalSectorSize)
+	}
+	if m.VirtualDiskSize == 0 || m.VirtualDiskSize%uint64(m.LogicalSectorSize) != 0 {
+		return nil, fmt.Errorf("invalid virtual disk size %d, expected a multiple of the logical sector size %d", m.VirtualDiskSize, m.LogicalSectorSize)
+	}
+	return m, nil
+}
@@ -0,0 +1,75 @@
+package vhdx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// VirtualSize returns the size of the disk seen by the virtual machine, in bytes.
+func (v *File) VirtualSize() int64 {
+	return int64(v.Metadata.VirtualDiskSize)
+}
+
+// CheckReadable returns an error if the data of the disk cannot be read by ReadAt: the disk is a differencing
+// disk or its log holds updates which were not applied yet.
+func (v *File) CheckReadable() error {
+	if v.Metadata.HasParent {
+		return errors.New("reading a differencing VHDX disk is not supported, merge it into its parent first")
+	}
+	if v.Header.HasLog() {
+		return errors.New("the log of the VHDX file holds updates which were not applied, open the disk in Hyper-V once to apply them")
+	}
+	return nil
+}
+
+// ReadAt reads len(p) bytes of the disk, as seen by the virtual machine, at the given offset. The blocks which are
+// not present read as zeros. It implements io.ReaderAt, the disk must pass CheckReadable.
+func (v *File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	size := v.VirtualSize()
+	if off >= size {
+		return 0, io.EOF
+	}
+	blockSize := int64(v.Metadata.BlockSize)
+	n := 0
+	for n < len(p) && off < size {
+		index := off / blockSize
+		inBlock := off % blockSize
+		count := blockSize - inBlock
+		if rest := int64(len(p) - n); count > rest {
+			count = rest
+		}
+		if rest := size - off; count > rest {
+			count = rest
+		}
+		chunk := p[n : n+int(count)]
+		entry := v.PayloadEntry(index)
+		switch entry.State() {
+		case BlockFullyPresent:
+			fileOffset := entry.FileOffset() + inBlock
+			if fileOffset+count > v.size {
+				return n, fmt.Errorf("the block %d is beyond the end of the VHDX file", index)
+			}
+			if _, err := v.file.ReadAt(chunk, fileOffset); err != nil {
+				return n, err
+			}
+		case BlockNotPresent, BlockUndefined, BlockZero, BlockUnmapped:
+			for i := range chunk {
+				chunk[i] = 0
+			}
+		default:
+			return n, fmt.Errorf("the block %d has the unsupported state %s", index, entry.State())
+		}
+		n += int(count)
+		off += count
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+var _ io.ReaderAt = (*File)(nil)
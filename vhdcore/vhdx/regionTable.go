@@ -0,0 +1,70 @@
+package vhdx
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// regionTableSignature is the signature of the region tables.
+const regionTableSignature = "regi"
+
+// maxRegionTableEntries is the largest number of entries of a region table.
+const maxRegionTableEntries = 2047
+
+// RegionEntry is an entry of the region table, locating a region of the file like the BAT or the metadata.
+type RegionEntry struct {
+	// GUID identifies the region.
+	GUID GUID
+	// FileOffset and Length locate the region in the file, they are multiples of 1 MB.
+	FileOffset uint64
+	Length     uint32
+	// Required is true if the region must be understood to open the file.
+	Required bool
+}
+
+// Name returns the name of the region, the GUID of a region unknown to this package.
+func (r *RegionEntry) Name() string {
+	switch r.GUID {
+	case batRegionGUID:
+		return "BAT"
+	case metadataRegionGUID:
+		return "Metadata"
+	default:
+		return r.GUID.String()
+	}
+}
+
+// readRegionTable returns the entries of the first of the two region tables of the file with a valid checksum. The
+// required regions unknown to this package are rejected.
+func (v *File) readRegionTable() ([]*RegionEntry, error) {
+	for _, offset := range []int64{regionTable1Offset, regionTable2Offset} {
+		b, err := v.read(offset, regionTableSize)
+		if err != nil {
+			return nil, err
+		}
+		if string(b[0:4]) != regionTableSignature || !validChecksum(b) {
+			continue
+		}
+		count := binary.LittleEndian.Uint32(b[8:])
+		if count > maxRegionTableEntries {
+			return nil, fmt.Errorf("the region table has %d entries, at most %d are allowed", count, maxRegionTableEntries)
+		}
+		entries := make([]*RegionEntry, 0, count)
+		for i := uint32(0); i < count; i++ {
+			e := b[16+i*32 : 16+(i+1)*32]
+			r := &RegionEntry{
+				FileOffset: binary.LittleEndian.Uint64(e[16:]),
+				Length:     binary.LittleEndian.Uint32(e[24:]),
+				Required:   binary.LittleEndian.Uint32(e[28:])&1 != 0,
+			}
+			copy(r.GUID[:], e[0:16])
+			if r.Required && r.GUID != batRegionGUID && r.GUID != metadataRegionGUID {
+				return nil, fmt.Errorf("the VHDX file has the unknown required region %s", r.GUID)
+			}
+			entries = append(entries, r)
+		}
+		return entries, nil
+	}
+	return nil, errors.New("both region tables of the VHDX file are corrupted")
+}
@@ -0,0 +1,205 @@
+// Package vhdx reads the VHDX files, the successor of the VHD format, as described by the MS-VHDX specification:
+// the file type identifier, the headers, the region table, the metadata region and the Block Allocation Table.
+package vhdx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"unicode/utf16"
+)
+
+// Signature is the signature at the start of every VHDX file.
+const Signature = "vhdxfile"
+
+// The offsets and sizes of the structures at the start of a VHDX file.
+const (
+	fileIdentifierSize = 64 * 1024
+	header1Offset      = 64 * 1024
+	header2Offset      = 128 * 1024
+	headerSize         = 4 * 1024
+	regionTable1Offset = 192 * 1024
+	regionTable2Offset = 256 * 1024
+	regionTableSize    = 64 * 1024
+)
+
+// The GUIDs of the regions and of the metadata items known to this package.
+var (
+	batRegionGUID      = mustParseGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	metadataRegionGUID = mustParseGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+
+	fileParametersGUID     = mustParseGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	virtualDiskSizeGUID    = mustParseGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	virtualDiskIDGUID      = mustParseGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	logicalSectorSizeGUID  = mustParseGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	physicalSectorSizeGUID = mustParseGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+	parentLocatorGUID      = mustParseGUID("A8D35F2D-B30B-454D-ABF7-D3D84834AB0C")
+)
+
+// crc32cTable is the table of the CRC-32C checksums of the headers and the region tables.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrNotVHDX is the error Open wraps when the file does not start with the VHDX signature.
+var ErrNotVHDX = errors.New("not a VHDX file")
+
+// File is a VHDX file opened by Open.
+type File struct {
+	// Creator is the name of the application which created the file, from the file type identifier.
+	Creator string
+	// Header is the current header, the valid one of the two headers with the greatest sequence number.
+	Header *Header
+	// Regions are the entries of the region table.
+	Regions []*RegionEntry
+	// Metadata are the known items of the metadata region.
+	Metadata *Metadata
+	// BAT is the Block Allocation Table, the payload and sector bitmap block entries interleaved.
+	BAT []BATEntry
+
+	file *os.File
+	size int64
+}
+
+// HasSignature returns true if the given bytes, read from the start of a file, start with the VHDX signature.
+func HasSignature(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(Signature))
+}
+
+// IsVhdxFile returns true if the file at the given path starts with the VHDX signature.
+func IsVhdxFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	head := make([]byte, len(Signature))
+	if _, err := io.ReadFull(f, head); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return HasSignature(head), nil
+}
+
+// Open opens the VHDX file at the given path and parses its structures, the file must be closed with Close. The
+// checksums of the headers and the region tables are checked, the first valid region table is used.
+func Open(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	v := &File{file: f}
+	if err := v.parse(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return v, nil
+}
+
+// Close closes the file.
+func (v *File) Close() error {
+	return v.file.Close()
+}
+
+// parse reads the structures of the file.
+func (v *File) parse() error {
+	fi, err := v.file.Stat()
+	if err != nil {
+		return err
+	}
+	v.size = fi.Size()
+	if v.size < regionTable2Offset+regionTableSize {
+		if v.size >= int64(len(Signature)) {
+			head := make([]byte, len(Signature))
+			if _, err := v.file.ReadAt(head, 0); err == nil && HasSignature(head) {
+				return fmt.Errorf("the file of %d bytes is too small to be a VHDX file", v.size)
+			}
+		}
+		return ErrNotVHDX
+	}
+
+	identifier, err := v.read(0, fileIdentifierSize)
+	if err != nil {
+		return err
+	}
+	if !HasSignature(identifier) {
+		return ErrNotVHDX
+	}
+	v.Creator = decodeUTF16(identifier[8 : 8+512])
+
+	if v.Header, err = v.readCurrentHeader(); err != nil {
+		return err
+	}
+	if v.Header.Version != 1 {
+		return fmt.Errorf("unsupported VHDX version %d", v.Header.Version)
+	}
+	if v.Regions, err = v.readRegionTable(); err != nil {
+		return err
+	}
+
+	metadataRegion := v.findRegion(metadataRegionGUID)
+	if metadataRegion == nil {
+		return errors.New("the region table has no metadata region")
+	}
+	if v.Metadata, err = v.readMetadata(metadataRegion); err != nil {
+		return err
+	}
+
+	batRegion := v.findRegion(batRegionGUID)
+	if batRegion == nil {
+		return errors.New("the region table has no BAT region")
+	}
+	if v.BAT, err = v.readBAT(batRegion); err != nil {
+		return err
+	}
+	return nil
+}
+
+// read reads length bytes of the file at the given offset.
+func (v *File) read(offset int64, length int) ([]byte, error) {
+	if offset < 0 || offset+int64(length) > v.size {
+		return nil, fmt.Errorf("the structure at offset %d of %d bytes is beyond the end of the file of %d bytes", offset, length, v.size)
+	}
+	b := make([]byte, length)
+	if _, err := v.file.ReadAt(b, offset); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// findRegion returns the entry of the region with the given GUID, nil if there is none.
+func (v *File) findRegion(guid GUID) *RegionEntry {
+	for _, r := range v.Regions {
+		if r.GUID == guid {
+			return r
+		}
+	}
+	return nil
+}
+
+// validChecksum returns true if the CRC-32C checksum stored at offset 4 of the given structure is the checksum of
+// the structure with the checksum field zeroed.
+func validChecksum(b []byte) bool {
+	stored := uint32(b[4]) | uint32(b[5])<<8 | uint32(b[6])<<16 | uint32(b[7])<<24
+	h := crc32.New(crc32cTable)
+	h.Write(b[:4])
+	h.Write(make([]byte, 4))
+	h.Write(b[8:])
+	return h.Sum32() == stored
+}
+
+// decodeUTF16 decodes the given NUL terminated UTF-16LE string.
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := uint16(b[i]) | uint16(b[i+1])<<8
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}